@@ -0,0 +1,193 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// listAPIKeys returns the caller's API keys. Administrators see every key
+// of their organization, or those of the user given in the username query
+// parameter.
+func (s *Server) listAPIKeys(c *gin.Context) {
+	username, _ := auth.GetUserIDFromContext(c)
+	orgID := ""
+	if role, _ := auth.GetRoleFromContext(c); auth.IsAdmin(role) {
+		username, orgID = c.Query("username"), auth.OrgScope(c)
+	}
+
+	keys, err := s.registry.ListAPIKeys(username, orgID)
+	if err != nil {
+		s.log(c).Error("Failed to list API keys", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+	if keys == nil {
+		keys = []*database.APIKey{}
+	}
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+// createAPIKey issues an API key for the caller, or for another user or
+// service account of the organization when the caller is an administrator
+func (s *Server) createAPIKey(c *gin.Context) {
+	var req struct {
+		Name       string   `json:"name" binding:"required"`
+		Scopes     []string `json:"scopes" binding:"required"`
+		AllowedIPs []string `json:"allowed_ips"`
+		// ExpiresIn is a duration such as "720h"; empty for no expiry
+		ExpiresIn string `json:"expires_in"`
+		Username  string `json:"username"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	var ttl time.Duration
+	if req.ExpiresIn != "" {
+		var err error
+		ttl, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "expires_in must be a positive duration such as 720h"})
+			return
+		}
+	}
+
+	caller, _ := auth.GetUserIDFromContext(c)
+	if req.Username == "" {
+		req.Username = caller
+	}
+	if role, _ := auth.GetRoleFromContext(c); req.Username != caller && !auth.IsAdmin(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can create API keys for other accounts"})
+		return
+	}
+	var (
+		owner *database.User
+		err   error
+	)
+	if req.Username == caller {
+		owner, err = s.registry.GetUser(caller)
+	} else {
+		owner, err = s.managedUser(c, req.Username)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to get user", "username", req.Username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	key, record, err := s.registry.CreateAPIKey(owner, registry.APIKeyRequest{
+		Name:       req.Name,
+		Scopes:     req.Scopes,
+		AllowedIPs: req.AllowedIPs,
+		TTL:        ttl,
+		CreatedBy:  caller,
+	})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAPIKeyCreate, TargetType: "api_key", TargetID: strconv.FormatInt(record.ID, 10),
+		After: record,
+	})
+
+	c.JSON(http.StatusCreated, gin.H{
+		"key":     key,
+		"api_key": record,
+		"message": "Store the key now; it is not shown again",
+	})
+}
+
+// revokeAPIKey revokes one of the caller's API keys, or any key of the
+// organization when the caller is an administrator
+func (s *Server) revokeAPIKey(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid API key ID"})
+		return
+	}
+
+	key, err := s.registry.GetAPIKey(id)
+	caller, _ := auth.GetUserIDFromContext(c)
+	role, _ := auth.GetRoleFromContext(c)
+	// Other users' keys are reported as missing to non-administrators, and
+	// keys of other organizations to everyone but super admins
+	if err == nil && key.Username != caller {
+		if !auth.IsAdmin(role) {
+			err = sql.ErrNoRows
+		} else if _, err = s.managedUser(c, key.Username); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			s.log(c).Error("Failed to get user", "username", key.Username, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+			return
+		}
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err == nil {
+		err = s.registry.RevokeAPIKey(id)
+	}
+	s.audit(c, registry.AuditRecord{Action: registry.AuditAPIKeyRevoke, TargetType: "api_key", TargetID: c.Param("id"), Err: err})
+	if err != nil {
+		s.log(c).Error("Failed to revoke API key", "api_key_id", id, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "revoked"})
+}
+
+// createServiceAccount adds an account without a password for automation
+// to the caller's organization. Super admins may choose the organization.
+func (s *Server) createServiceAccount(c *gin.Context) {
+	var req struct {
+		Username string `json:"username" binding:"required"`
+		Role     string `json:"role" binding:"required"`
+		OrgID    string `json:"org_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+	orgID, ok := targetOrg(c, req.OrgID)
+	if !ok {
+		return
+	}
+	if role, _ := auth.GetRoleFromContext(c); req.Role == auth.RoleSuperAdmin && role != auth.RoleSuperAdmin {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only super admins can create super admin accounts"})
+		return
+	}
+
+	user, err := s.registry.CreateServiceAccount(req.Username, req.Role, orgID)
+	s.audit(c, registry.AuditRecord{
+		OrgID: orgID, Action: registry.AuditServiceAccount, TargetType: "user", TargetID: req.Username,
+		After: gin.H{"role": req.Role}, Err: err,
+	})
+	switch {
+	case errors.Is(err, database.ErrUserExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	case errors.Is(err, auth.ErrInvalidRole), errors.Is(err, registry.ErrUnknownOrganization):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to create service account", "username", req.Username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+	c.JSON(http.StatusCreated, user)
+}
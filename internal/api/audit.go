@@ -0,0 +1,160 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// audit records an action of the authenticated user, or of rec.Actor when
+// set, from the request's client address. Unless rec.OrgID is set, it is
+// recorded under the organization of the agent acted on, or else the
+// caller's.
+func (s *Server) audit(c *gin.Context, rec registry.AuditRecord) {
+	if rec.Actor == "" {
+		rec.Actor, _ = auth.GetUserIDFromContext(c)
+	}
+	if rec.OrgID == "" {
+		rec.OrgID = c.GetString(agentOrgKey)
+	}
+	if rec.OrgID == "" {
+		rec.OrgID, _ = auth.GetOrgIDFromContext(c)
+	}
+	rec.SourceIP = c.ClientIP()
+	s.registry.Audit(rec)
+}
+
+// auditFilterFromQuery parses the audit event filters shared by listing and
+// export
+func auditFilterFromQuery(c *gin.Context) (database.AuditFilter, error) {
+	filter := database.AuditFilter{
+		Actor:      c.Query("actor"),
+		Action:     c.Query("action"),
+		TargetType: c.Query("target_type"),
+		TargetID:   c.Query("target_id"),
+		Outcome:    c.Query("outcome"),
+		OrgID:      auth.OrgScope(c),
+	}
+	if filter.Outcome != "" && filter.Outcome != database.AuditSuccess && filter.Outcome != database.AuditFailure {
+		return filter, fmt.Errorf("outcome must be %q or %q", database.AuditSuccess, database.AuditFailure)
+	}
+	for name, dst := range map[string]**time.Time{"from": &filter.From, "to": &filter.To} {
+		value := c.Query(name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be an RFC 3339 time", name)
+		}
+		*dst = &t
+	}
+	return filter, nil
+}
+
+func (s *Server) listAuditEvents(c *gin.Context) {
+	filter, err := auditFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	filter.Limit = defaultAuditLimit
+	if value := c.Query("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxAuditLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAuditLimit)})
+			return
+		}
+	}
+	if value := c.Query("before_id"); value != "" {
+		filter.BeforeID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || filter.BeforeID < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "before_id must be a positive integer"})
+			return
+		}
+	}
+
+	events, err := s.registry.ListAuditEvents(filter)
+	if err != nil {
+		s.log(c).Error("Failed to list audit events", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list audit events"})
+		return
+	}
+	if events == nil {
+		events = []*database.AuditEvent{}
+	}
+
+	response := gin.H{"events": events}
+	if len(events) == filter.Limit {
+		response["next_before_id"] = events[len(events)-1].ID
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// exportAuditEvents streams every matching event, oldest first, as JSON
+// lines or CSV
+func (s *Server) exportAuditEvents(c *gin.Context) {
+	filter, err := auditFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	format := c.DefaultQuery("format", "jsonl")
+	var write func(*database.AuditEvent) error
+	switch format {
+	case "jsonl":
+		c.Header("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(c.Writer)
+		write = func(e *database.AuditEvent) error { return enc.Encode(e) }
+	case "csv":
+		c.Header("Content-Type", "text/csv")
+		w := csv.NewWriter(c.Writer)
+		defer w.Flush()
+		w.Write([]string{"id", "time", "org_id", "actor", "source_ip", "action", "target_type", "target_id", "outcome", "before", "after", "prev_hash", "hash"})
+		write = func(e *database.AuditEvent) error {
+			return w.Write([]string{
+				strconv.FormatInt(e.ID, 10), e.Time.Format(time.RFC3339Nano), e.OrgID, e.Actor, e.SourceIP, e.Action,
+				e.TargetType, e.TargetID, e.Outcome, string(e.Before), string(e.After), e.PrevHash, e.Hash,
+			})
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=silentrig-audit-%s.%s", time.Now().UTC().Format("20060102-150405"), format))
+	c.Status(http.StatusOK)
+
+	if err := s.registry.EachAuditEvent(filter, write); err != nil {
+		// Headers are sent; the truncated export is all we can signal
+		s.log(c).Error("Failed to export audit events", "error", err)
+	}
+}
+
+func (s *Server) verifyAuditChain(c *gin.Context) {
+	result, err := s.registry.VerifyAuditChain()
+	if err != nil {
+		s.log(c).Error("Failed to verify audit log", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit log"})
+		return
+	}
+	if !result.Valid {
+		s.log(c).Error("Audit log hash chain is broken", "event_id", result.BrokenAt, "reason", result.Reason)
+	}
+	c.JSON(http.StatusOK, result)
+}
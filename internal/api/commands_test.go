@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+func TestSelectorCommandSkipsRemovedAgents(t *testing.T) {
+	ts := newTestServer(t, nil)
+	operator := ts.login("operator", auth.RoleOperator, database.DefaultOrg)
+	live := ts.registerAgent("machine-1", database.DefaultOrg)
+	revoked := ts.registerAgent("machine-2", database.DefaultOrg)
+	decommissioned := ts.registerAgent("machine-3", database.DefaultOrg)
+	for _, agent := range []*database.Agent{live, revoked, decommissioned} {
+		if _, err := ts.registry.UpdateAgent(agent.ID, nil, nil, []string{"rigs"}); err != nil {
+			t.Fatalf("update agent: %v", err)
+		}
+	}
+	if _, err := ts.registry.RevokeAgent(revoked.ID); err != nil {
+		t.Fatalf("revoke agent: %v", err)
+	}
+	if _, err := ts.registry.DecommissionAgent(decommissioned.ID); err != nil {
+		t.Fatalf("decommission agent: %v", err)
+	}
+
+	// Asking for the removed statuses explicitly does not select them either
+	rec := ts.do(http.MethodPost, "/api/v1/commands", operator, map[string]interface{}{
+		"command": "restart",
+		"selector": map[string]interface{}{
+			"groups":   []string{"rigs"},
+			"statuses": []string{database.StatusInactive, database.StatusActive, database.StatusRevoked, database.StatusDecommissioned},
+		},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST /api/v1/commands: got %d %s", rec.Code, rec.Body)
+	}
+	var resp struct {
+		CommandIDs map[string]int64 `json:"command_ids"`
+		Count      int              `json:"count"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if _, ok := resp.CommandIDs[live.ID]; !ok || resp.Count != 1 || len(resp.CommandIDs) != 1 {
+		t.Errorf("commands queued for %v, want only %s", resp.CommandIDs, live.ID)
+	}
+
+	for _, agent := range []*database.Agent{revoked, decommissioned} {
+		if commands, err := ts.registry.GetPendingCommands(agent.ID); err != nil || len(commands) != 0 {
+			t.Errorf("commands queued for removed agent %s: %v %v", agent.ID, commands, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// listConflicts returns the open identity conflicts of the caller's
+// organization, or every conflict with ?all=true
+func (s *Server) listConflicts(c *gin.Context) {
+	conflicts, err := s.registry.ListConflicts(auth.OrgScope(c), c.Query("all") == "true")
+	if err != nil {
+		s.log(c).Error("Failed to list agent conflicts", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list conflicts"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"conflicts": conflicts})
+}
+
+// resolveConflict applies an operator's decision on an identity conflict
+func (s *Server) resolveConflict(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conflict ID"})
+		return
+	}
+	var req struct {
+		Resolution string `json:"resolution" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	conflict, err := s.registry.GetConflictInOrg(auth.OrgScope(c), id)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Conflict not found"})
+		return
+	}
+
+	username, _ := auth.GetUserIDFromContext(c)
+	err = s.registry.ResolveConflict(conflict, req.Resolution, username)
+	switch {
+	case errors.Is(err, registry.ErrInvalidResolution):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Resolution must be accept, dismiss or revoke; clones cannot be accepted"})
+		return
+	case errors.Is(err, database.ErrConflictResolved), errors.Is(err, database.ErrAgentExists), errors.Is(err, registry.ErrAgentRevoked):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		OrgID: conflict.OrgID, Action: registry.AuditConflictResolve, TargetType: "agent", TargetID: conflict.AgentID,
+		Before: gin.H{"conflict_id": conflict.ID, "kind": conflict.Kind, "machine_id": conflict.MachineID, "source_ip": conflict.SourceIP},
+		After:  gin.H{"resolution": req.Resolution}, Err: err,
+	})
+	if err != nil {
+		s.log(c).Error("Failed to resolve agent conflict", "conflict_id", id, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve conflict"})
+		return
+	}
+
+	resolved, err := s.registry.GetConflictInOrg(auth.OrgScope(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve conflict"})
+		return
+	}
+	c.JSON(http.StatusOK, resolved)
+}
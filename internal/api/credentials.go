@@ -0,0 +1,120 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// rotateCredentialsCommand asks an agent to fetch a new token from
+// POST /api/v1/agents/{id}/credentials
+const rotateCredentialsCommand = "rotate_credentials"
+
+// agentToken returns the token an agent sent as a bearer token
+func agentToken(c *gin.Context) string {
+	token, _ := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return token
+}
+
+// requireAgentToken only lets an agent act on its own ID, as proven by its
+// token. Tokens of revoked agents are rejected. The address of every request
+// feeds clone detection.
+func (s *Server) requireAgentToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		agent, err := s.registry.AuthenticateAgent(c.Param("id"), agentToken(c))
+		if errors.Is(err, registry.ErrAgentCredentials) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid agent credentials"})
+			return
+		}
+		if err != nil {
+			s.log(c).Error("Failed to authenticate agent", "agent_id", c.Param("id"), "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate agent"})
+			return
+		}
+		c.Set(agentIDKey, agent.ID)
+		s.registry.ObserveAgentAddress(agent, c.ClientIP())
+		c.Next()
+	}
+}
+
+// agentRotateCredentials issues a new token to the calling agent. The token
+// it authenticated with stays valid until previous_token_expires_at in case
+// the response is lost.
+func (s *Server) agentRotateCredentials(c *gin.Context) {
+	agentID := c.Param("id")
+	token, expiresAt, err := s.registry.RotateAgentCredentials(agentID, agentToken(c))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid agent credentials"})
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to rotate agent credentials", "agent_id", agentID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate credentials"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Actor: "agent:" + agentID, Action: registry.AuditAgentRotate, TargetType: "agent", TargetID: agentID,
+		After: gin.H{"previous_token_expires_at": expiresAt},
+	})
+	c.JSON(http.StatusOK, gin.H{"token": token, "previous_token_expires_at": expiresAt})
+}
+
+// rotateAgentCredentials queues a command telling an agent to fetch a new
+// token
+func (s *Server) rotateAgentCredentials(c *gin.Context) {
+	agentID := c.Param("id")
+	agent, err := s.registry.GetAgent(agentID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+	if agent.RevokedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Agent is revoked"})
+		return
+	}
+
+	commandID, err := s.registry.CreateCommand(agentID, rotateCredentialsCommand, nil)
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentRotate, TargetType: "agent", TargetID: agentID,
+		After: gin.H{"command_id": commandID}, Err: err,
+	})
+	if err != nil {
+		s.log(c).Error("Failed to create command", "agent_id", agentID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate credentials"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"command_id": commandID})
+}
+
+// revokeAgent blocks an agent at once: its tokens and client certificates
+// stop working and its pending commands are cancelled
+func (s *Server) revokeAgent(c *gin.Context) {
+	agentID := c.Param("id")
+	before, err := s.registry.GetAgent(agentID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	agent, err := s.registry.RevokeAgent(agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Agent is already revoked"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentRevoke, TargetType: "agent", TargetID: agentID,
+		Before: gin.H{"status": before.Status}, After: gin.H{"status": database.StatusRevoked}, Err: err,
+	})
+	if err != nil {
+		s.log(c).Error("Failed to revoke agent", "agent_id", agentID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke agent"})
+		return
+	}
+	c.JSON(http.StatusOK, agent)
+}
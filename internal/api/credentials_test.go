@@ -0,0 +1,39 @@
+package api
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+func TestDownloadRotatesOnlyOnPost(t *testing.T) {
+	ts := newTestServer(t, nil)
+	operator := ts.login("operator", auth.RoleOperator, database.DefaultOrg)
+	agent := ts.registerAgent("machine-1", database.DefaultOrg)
+	path := "/api/v1/agents/" + agent.ID + "/download"
+	heartbeat := "/api/v1/agents/" + agent.ID + "/heartbeat"
+
+	// A prefetched or retried GET must not touch the credentials
+	if rec := ts.do(http.MethodGet, path, operator, nil); rec.Code == http.StatusOK {
+		t.Fatalf("GET download: got 200, want no route")
+	}
+	if rec := ts.do(http.MethodPost, heartbeat, "Bearer token-machine-1", nil); rec.Code != http.StatusOK {
+		t.Fatalf("heartbeat after GET download: got %d, want 200", rec.Code)
+	}
+
+	rec := ts.do(http.MethodPost, path, operator, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), agent.ID) {
+		t.Fatalf("POST download: got %d %s", rec.Code, rec.Body)
+	}
+	token := regexp.MustCompile(`sra_[0-9a-f]{48}`).FindString(rec.Body.String())
+	if token == "" {
+		t.Fatalf("POST download carries no new token: %s", rec.Body)
+	}
+	if rec := ts.do(http.MethodPost, heartbeat, "Bearer "+token, nil); rec.Code != http.StatusOK {
+		t.Errorf("heartbeat with the downloaded token: got %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,69 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/registry"
+)
+
+// restoreAgent brings a decommissioned agent back. It stays revoked until
+// it enrolls again.
+func (s *Server) restoreAgent(c *gin.Context) {
+	agentID := c.Param("id")
+	agent, err := s.registry.RestoreAgent(agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Agent is not decommissioned"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentRestore, TargetType: "agent", TargetID: agentID, Err: err,
+	})
+	if err != nil {
+		s.log(c).Error("Failed to restore agent", "agent_id", agentID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore agent"})
+		return
+	}
+	c.JSON(http.StatusOK, agent)
+}
+
+// exportAgent downloads an agent with its metrics, commands, status
+// transitions and inventory versions as JSON, or as a zip archive of CSV
+// files with ?format=csv
+func (s *Server) exportAgent(c *gin.Context) {
+	agentID := c.Param("id")
+	format := c.DefaultQuery("format", registry.ExportJSON)
+	var contentType string
+	switch format {
+	case registry.ExportJSON:
+		contentType = "application/json"
+	case registry.ExportCSV:
+		contentType = "application/zip"
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json or csv"})
+		return
+	}
+
+	agent, err := s.registry.GetAgent(agentID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentExport, TargetType: "agent", TargetID: agentID,
+		After: gin.H{"format": format},
+	})
+
+	c.Header("Content-Type", contentType)
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", registry.ExportFileName(agentID, format, time.Now())))
+	c.Status(http.StatusOK)
+	if err := s.registry.ExportAgent(c.Writer, agent, format); err != nil {
+		// Headers are sent; the truncated export is all we can signal
+		s.log(c).Error("Failed to export agent", "agent_id", agentID, "error", err)
+	}
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/registry"
+)
+
+// errNoSigningKeys is returned by the signing key endpoints in HS256 mode
+const errNoSigningKeys = "Tokens are signed with the HMAC secret; set jwt.algorithm to RS256 or EdDSA to use signing keys"
+
+// jwks publishes the public keys that verify access tokens
+func (s *Server) jwks(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": s.auth.JWKS()})
+}
+
+func (s *Server) listSigningKeys(c *gin.Context) {
+	if s.keys == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errNoSigningKeys})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"algorithm": s.config.Current().JWT.Algorithm,
+		"keys":      s.keys.Keys(),
+	})
+}
+
+// rotateSigningKey replaces the current signing key ahead of schedule
+func (s *Server) rotateSigningKey(c *gin.Context) {
+	if s.keys == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": errNoSigningKeys})
+		return
+	}
+	var req struct {
+		// DropPrevious rejects tokens of earlier keys at once, e.g. after
+		// a key was leaked
+		DropPrevious bool `json:"drop_previous"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	key, err := s.keys.Rotate(req.DropPrevious)
+	rec := registry.AuditRecord{Action: registry.AuditSigningKeyRotate, TargetType: "signing_key", After: gin.H{"drop_previous": req.DropPrevious}, Err: err}
+	if key != nil {
+		rec.TargetID = key.ID
+	}
+	s.audit(c, rec)
+	if err != nil {
+		s.log(c).Error("Failed to rotate signing key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate signing key"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"kid": key.ID, "keys": s.keys.Keys()})
+}
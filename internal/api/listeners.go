@@ -0,0 +1,137 @@
+package api
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/config"
+	"silentrig/internal/tlsutil"
+)
+
+// listenerKey is the gin context key holding the name of the listener that
+// received the request
+const listenerKey = "listener"
+
+// listener is one HTTP server mounting a selection of route sets
+type listener struct {
+	config config.ListenerConfig
+	cors   atomic.Pointer[gin.HandlerFunc]
+	server *http.Server
+}
+
+// setupListeners creates an HTTP server for every configured listener.
+// Listeners sharing certificate files share one reloader.
+func (s *Server) setupListeners(cfg *config.Config) error {
+	reloaders := make(map[string]*tlsutil.Reloader)
+	for _, lc := range cfg.Server.EffectiveListeners() {
+		l := &listener{config: lc}
+		l.server = &http.Server{
+			Addr:    net.JoinHostPort(lc.Address, strconv.Itoa(lc.Port)),
+			Handler: s.setupRouter(l),
+		}
+
+		if lc.TLS.Enabled {
+			key := lc.TLS.CertFile + "\x00" + lc.TLS.KeyFile
+			reloader, ok := reloaders[key]
+			if !ok {
+				var err error
+				reloader, err = tlsutil.NewReloader(lc.TLS.CertFile, lc.TLS.KeyFile, s.logger)
+				if err != nil {
+					return fmt.Errorf("listener %s: %w", lc.Name, err)
+				}
+				reloaders[key] = reloader
+				s.supervisor.Add("tls-reloader-"+lc.Name, reloader.Watch)
+			}
+			l.server.TLSConfig = tlsutil.ServerConfig(lc.TLS.TLSConfig, reloader)
+		}
+
+		if lc.TLS.ClientAuth == config.ClientAuthAgent {
+			if s.ca == nil || l.server.TLSConfig == nil {
+				return fmt.Errorf("listener %s: client certificates require TLS and the certificate authority", lc.Name)
+			}
+			l.server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+			l.server.TLSConfig.ClientCAs = s.ca.Pool()
+			l.server.TLSConfig.VerifyConnection = s.ca.VerifyConnection
+		}
+
+		s.listeners = append(s.listeners, l)
+	}
+	if len(s.listeners) == 0 {
+		return errors.New("no listeners configured")
+	}
+	return nil
+}
+
+// Listeners returns the configuration of the listeners being served
+func (s *Server) Listeners() []config.ListenerConfig {
+	configs := make([]config.ListenerConfig, len(s.listeners))
+	for i, l := range s.listeners {
+		configs[i] = l.config
+	}
+	return configs
+}
+
+// publicURL returns the base URL of the listener that received the
+// request: its configured public URL or one derived from the request
+func (s *Server) publicURL(c *gin.Context) string {
+	if l := s.listener(c.GetString(listenerKey)); l != nil && l.config.PublicURL != "" {
+		return l.config.PublicURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// agentURL returns the base URL agents should connect to. Listeners
+// authenticating agents by client certificate are preferred, then the
+// listener that received the request if it serves agents.
+func (s *Server) agentURL(c *gin.Context) string {
+	current := s.listener(c.GetString(listenerKey))
+	var target *listener
+	for _, l := range s.listeners {
+		if !l.config.Serves(config.RoutesAgent) {
+			continue
+		}
+		if l.config.TLS.ClientAuth == config.ClientAuthAgent {
+			target = l
+			break
+		}
+		if target == nil || l == current {
+			target = l
+		}
+	}
+
+	if target == nil || target == current {
+		return s.publicURL(c)
+	}
+	if target.config.PublicURL != "" {
+		return target.config.PublicURL
+	}
+	host, _, err := net.SplitHostPort(c.Request.Host)
+	if err != nil {
+		host = c.Request.Host
+	}
+	scheme := "http"
+	if target.config.TLS.Enabled {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, strconv.Itoa(target.config.Port)))
+}
+
+func (s *Server) listener(name string) *listener {
+	for _, l := range s.listeners {
+		if l.config.Name == name {
+			return l
+		}
+	}
+	return nil
+}
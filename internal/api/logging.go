@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/registry"
+)
+
+// getLogLevels returns the default log level and the component overrides
+func (s *Server) getLogLevels(c *gin.Context) {
+	level, components := s.logger.Levels()
+	c.JSON(http.StatusOK, gin.H{
+		"level":      level,
+		"components": components,
+		"available":  config.LogComponents,
+	})
+}
+
+// setLogLevels changes log levels until the next restart or until a
+// configuration reload changes them. Omitted fields are left unchanged; an
+// empty components object clears the overrides.
+func (s *Server) setLogLevels(c *gin.Context) {
+	var req struct {
+		Level      *string            `json:"level"`
+		Components *map[string]string `json:"components"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	// Validate everything before changing anything
+	if req.Level != nil {
+		if _, err := logrus.ParseLevel(*req.Level); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if req.Components != nil {
+		for component, level := range *req.Components {
+			if !config.IsLogComponent(component) {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown component " + component})
+				return
+			}
+			if _, err := logrus.ParseLevel(level); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+	}
+
+	beforeLevel, beforeComponents := s.logger.Levels()
+	if req.Level != nil {
+		s.logger.SetLevel(*req.Level)
+	}
+	if req.Components != nil {
+		s.logger.SetComponentLevels(*req.Components)
+	}
+
+	level, components := s.logger.Levels()
+	userID, _ := auth.GetUserIDFromContext(c)
+	s.log(c).Info("Log levels changed", "user_id", userID, "level", level, "components", components)
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditLoggingUpdate, TargetType: "logging",
+		Before: gin.H{"level": beforeLevel, "components": beforeComponents},
+		After:  gin.H{"level": level, "components": components},
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"level":      level,
+		"components": components,
+		"available":  config.LogComponents,
+	})
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/logger"
+)
+
+const (
+	// requestIDHeader carries the request ID. A valid ID sent by the client
+	// or a proxy is kept, otherwise one is generated; either way it is
+	// returned in the response.
+	requestIDHeader = "X-Request-ID"
+
+	// loggerKey is the gin context key of the request logger
+	loggerKey = "logger"
+	// agentIDKey is the gin context key handlers set when the agent a
+	// request acts on is not in the path, e.g. on registration
+	agentIDKey = "agent_id"
+	// agentOrgKey is the gin context key of the organization of the agent
+	// in the path, which audit events of the request are recorded under
+	agentOrgKey = "agent_org"
+
+	maxRequestIDLength = 128
+)
+
+// requestLogger assigns a request ID, stores a logger carrying it in the
+// gin and request contexts and writes an access log entry once the request
+// is handled. Health checks and metrics scrapes are logged at debug level.
+func (s *Server) requestLogger(listener string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Header(requestIDHeader, id)
+		c.Set(listenerKey, listener)
+
+		log := s.logger.With("request_id", id)
+		c.Set(loggerKey, log)
+
+		c.Next()
+
+		route := c.FullPath()
+		size := c.Writer.Size()
+		if size < 0 {
+			size = 0
+		}
+		keyvals := []interface{}{
+			"listener", listener,
+			"method", c.Request.Method,
+			"route", route,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"latency_ms", float64(time.Since(start).Microseconds()) / 1000,
+			"bytes", size,
+			"client_ip", c.ClientIP(),
+		}
+		if userID, ok := auth.GetUserIDFromContext(c); ok {
+			keyvals = append(keyvals, "user_id", userID)
+		}
+		if agentID := requestAgentID(c); agentID != "" {
+			keyvals = append(keyvals, "agent_id", agentID)
+		}
+		if len(c.Errors) > 0 {
+			keyvals = append(keyvals, "errors", c.Errors.String())
+		}
+
+		switch {
+		case c.Writer.Status() >= http.StatusInternalServerError:
+			log.Error("Request failed", keyvals...)
+		case route == "/health" || route == "/metrics":
+			log.Debug("Request handled", keyvals...)
+		default:
+			log.Info("Request handled", keyvals...)
+		}
+	}
+}
+
+// log returns the logger of the request, which adds its request ID
+func (s *Server) log(c *gin.Context) logger.Logger {
+	if l, ok := c.Get(loggerKey); ok {
+		return l.(logger.Logger)
+	}
+	return s.logger
+}
+
+// requestAgentID returns the agent a request acted on, if any
+func requestAgentID(c *gin.Context) string {
+	if id := c.GetString(agentIDKey); id != "" {
+		return id
+	}
+	if strings.HasPrefix(c.FullPath(), "/api/v1/agents/:id") {
+		return c.Param("id")
+	}
+	return ""
+}
+
+// validRequestID accepts IDs of printable ASCII without spaces so they
+// cannot forge log lines or response headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
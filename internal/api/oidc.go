@@ -0,0 +1,152 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// oidcDefaultRedirect is where users return after an OIDC login that did
+// not name a page
+const oidcDefaultRedirect = "/dashboard"
+
+// oidcInfo tells the login page whether to offer OIDC login
+func (s *Server) oidcInfo(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":      true,
+		"display_name": s.config.Current().OIDC.DisplayName,
+		"login_url":    "/api/v1/auth/oidc/login",
+	})
+}
+
+// oidcLogin sends the browser to the OIDC provider. The redirect query
+// parameter names the local page to return to afterwards.
+func (s *Server) oidcLogin(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not enabled"})
+		return
+	}
+
+	req, err := s.oidc.AuthCodeURL(c.Request.Context())
+	if err != nil {
+		s.log(c).Error("Failed to start OIDC login", "error", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "OIDC provider unavailable"})
+		return
+	}
+	if err := s.registry.SaveOIDCLogin(req, localRedirect(c.Query("redirect"))); err != nil {
+		s.log(c).Error("Failed to save OIDC login", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	c.Redirect(http.StatusFound, req.URL)
+}
+
+// oidcCallback completes an OIDC login when the provider redirects back. It
+// sends the browser to the page the login started from with a refresh
+// token in the URL fragment, which the page exchanges for an access token
+// at once, or with an oidc_error message.
+func (s *Server) oidcCallback(c *gin.Context) {
+	if s.oidc == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not enabled"})
+		return
+	}
+
+	login, err := s.registry.TakeOIDCLogin(c.Query("state"))
+	if errors.Is(err, database.ErrOIDCLoginInvalid) {
+		oidcRedirect(c, oidcDefaultRedirect, "oidc_error", "Login expired or invalid, please try again")
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to load OIDC login", "error", err)
+		oidcRedirect(c, oidcDefaultRedirect, "oidc_error", "Login failed")
+		return
+	}
+	if providerErr := c.Query("error"); providerErr != "" {
+		s.log(c).Warn("OIDC provider denied login", "error", providerErr, "description", c.Query("error_description"))
+		oidcRedirect(c, login.Redirect, "oidc_error", "Login was denied by the identity provider")
+		return
+	}
+
+	cfg := s.config.Current().OIDC
+	identity, err := s.oidc.Exchange(c.Request.Context(), c.Query("code"), login.CodeVerifier, login.Nonce, cfg.UsernameClaim, cfg.GroupsClaim)
+	if err != nil {
+		s.log(c).Warn("OIDC login failed", "error", err)
+		s.audit(c, registry.AuditRecord{Action: registry.AuditLogin, TargetType: "user", After: gin.H{"method": "oidc"}, Err: err})
+		oidcRedirect(c, login.Redirect, "oidc_error", "Login with the identity provider failed")
+		return
+	}
+
+	user, provisioning, err := s.registry.ProvisionOIDCUser(identity, cfg)
+	if err != nil {
+		var message string
+		switch {
+		case errors.Is(err, registry.ErrOIDCNoRole):
+			message = "Your account has no access to silentrig"
+		case errors.Is(err, registry.ErrOIDCNotProvisioned):
+			message = "Your account has not been set up in silentrig"
+		case errors.Is(err, registry.ErrOIDCUsernameTaken):
+			message = "Your username belongs to a local silentrig account"
+		default:
+			s.log(c).Error("Failed to provision OIDC user", "username", identity.Username, "error", err)
+			message = "Login failed"
+		}
+		s.audit(c, registry.AuditRecord{
+			Actor: identity.Username, Action: registry.AuditLogin, TargetType: "user", TargetID: identity.Username,
+			After: gin.H{"method": "oidc", "groups": identity.Groups}, Err: err,
+		})
+		oidcRedirect(c, login.Redirect, "oidc_error", message)
+		return
+	}
+	if provisioning.Created {
+		s.audit(c, registry.AuditRecord{
+			Actor: user.Username, Action: registry.AuditUserCreate, TargetType: "user", TargetID: user.Username,
+			After: gin.H{"role": user.Role, "oidc_subject": user.OIDCSubject},
+		})
+	}
+	if provisioning.PreviousRole != "" {
+		s.audit(c, registry.AuditRecord{
+			Actor: user.Username, Action: registry.AuditUserRole, TargetType: "user", TargetID: user.Username,
+			Before: gin.H{"role": provisioning.PreviousRole}, After: gin.H{"role": user.Role, "groups": identity.Groups},
+		})
+	}
+
+	jwtConfig := s.config.Current().JWT
+	refreshToken, _, err := s.registry.CreateSession(user.Username, c.ClientIP(), c.Request.UserAgent(), jwtConfig.RefreshExpiration, jwtConfig.SessionMaxAge)
+	if err != nil {
+		s.log(c).Error("Failed to create session", "error", err)
+		oidcRedirect(c, login.Redirect, "oidc_error", "Login failed")
+		return
+	}
+	s.audit(c, registry.AuditRecord{Actor: user.Username, Action: registry.AuditLogin, TargetType: "user", TargetID: user.Username, After: gin.H{"method": "oidc"}})
+
+	oidcRedirect(c, login.Redirect, "refresh_token", refreshToken)
+}
+
+// oidcRedirect sends the browser to a local page with a value in the URL
+// fragment, which is not sent to servers
+func oidcRedirect(c *gin.Context, page, key, value string) {
+	c.Header("Cache-Control", "no-store")
+	c.Redirect(http.StatusFound, page+"#"+url.Values{key: {value}}.Encode())
+}
+
+// localRedirect returns target if it is a path on this server, so logins
+// cannot be used to redirect elsewhere
+func localRedirect(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(u.Path, "/") ||
+		strings.HasPrefix(target, "//") || strings.Contains(target, "\\") {
+		return oidcDefaultRedirect
+	}
+	u.Fragment = ""
+	return u.String()
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+)
+
+const oidcClientID = "silentrig-test"
+
+// mockOIDC is an OpenID Connect provider serving discovery, a key set and a
+// token endpoint that checks PKCE
+type mockOIDC struct {
+	t   *testing.T
+	srv *httptest.Server
+	key *rsa.PrivateKey
+
+	// issuer is the issuer announced by discovery, the server URL unless
+	// set
+	issuer string
+	// idToken changes the claims of issued ID tokens, if set
+	idToken func(jwt.MapClaims)
+
+	mu    sync.Mutex
+	codes map[string]oidcGrant
+}
+
+// oidcGrant is an authorization code waiting to be redeemed
+type oidcGrant struct {
+	challenge, nonce  string
+	subject, username string
+	groups            []string
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	p := &mockOIDC{t: t, key: key, codes: map[string]oidcGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.discovery)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/token", p.token)
+	p.srv = httptest.NewServer(mux)
+	t.Cleanup(p.srv.Close)
+	return p
+}
+
+func (p *mockOIDC) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := p.issuer
+	if issuer == "" {
+		issuer = p.srv.URL
+	}
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 issuer,
+		"authorization_endpoint": p.srv.URL + "/authorize",
+		"token_endpoint":         p.srv.URL + "/token",
+		"jwks_uri":               p.srv.URL + "/jwks",
+	})
+}
+
+func (p *mockOIDC) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string][]auth.JWK{"keys": {{
+		KeyType: "RSA", KeyID: "test", Use: "sig", Algorithm: "RS256",
+		N: base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+	}}})
+}
+
+// token redeems a code once, if the code verifier matches its challenge
+func (p *mockOIDC) token(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	p.mu.Lock()
+	grant, ok := p.codes[r.PostForm.Get("code")]
+	delete(p.codes, r.PostForm.Get("code"))
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != grant.challenge || r.PostForm.Get("client_id") != oidcClientID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": p.srv.URL, "aud": oidcClientID, "sub": grant.subject, "nonce": grant.nonce,
+		"iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix(),
+		"preferred_username": grant.username, "groups": grant.groups,
+	}
+	if p.idToken != nil {
+		p.idToken(claims)
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		p.t.Errorf("sign ID token: %v", err)
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "access_token": "access", "token_type": "Bearer"})
+}
+
+// authorize plays the user logging in at the provider for the login URL the
+// server redirected to. It returns the callback query the provider
+// redirects back with.
+func (p *mockOIDC) authorize(loginURL, subject, username string, groups ...string) url.Values {
+	p.t.Helper()
+	u, err := url.Parse(loginURL)
+	if err != nil || !strings.HasPrefix(loginURL, p.srv.URL+"/authorize") {
+		p.t.Fatalf("login redirected to %q, want the provider", loginURL)
+	}
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" || q.Get("state") == "" || q.Get("nonce") == "" {
+		p.t.Fatalf("authorization request lacks PKCE, state or nonce: %s", u.RawQuery)
+	}
+	code := "code-" + q.Get("state")
+	p.mu.Lock()
+	p.codes[code] = oidcGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), subject: subject, username: username, groups: groups}
+	p.mu.Unlock()
+	return url.Values{"code": {code}, "state": {q.Get("state")}}
+}
+
+// newOIDCServer starts a server logging in with the mock provider
+func newOIDCServer(t *testing.T, autoProvision bool) (*testServer, *mockOIDC) {
+	p := newMockOIDC(t)
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.OIDC = config.OIDCConfig{
+			Enabled: true, Issuer: p.srv.URL, ClientID: oidcClientID,
+			RedirectURL: "http://silentrig.test/api/v1/auth/oidc/callback", Scopes: []string{"openid", "groups"},
+			UsernameClaim: "preferred_username", GroupsClaim: "groups",
+			RoleMapping: map[string][]string{
+				auth.RoleAdmin:    {"rig-admins"},
+				auth.RoleOperator: {"rig-operators"},
+				auth.RoleViewer:   {"rig-viewers"},
+			},
+			AutoProvision: autoProvision, Organization: database.DefaultOrg,
+		}
+	})
+	return ts, p
+}
+
+// oidcLogin starts a login and returns the provider URL it redirects to
+func (ts *testServer) oidcLogin() string {
+	ts.t.Helper()
+	rec := ts.do(http.MethodGet, "/api/v1/auth/oidc/login", "", nil)
+	if rec.Code != http.StatusFound {
+		ts.t.Fatalf("OIDC login: got %d %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")
+}
+
+// oidcCallback completes a login and returns the URL fragment the browser
+// is sent back with
+func (ts *testServer) oidcCallback(query url.Values) url.Values {
+	ts.t.Helper()
+	rec := ts.do(http.MethodGet, "/api/v1/auth/oidc/callback?"+query.Encode(), "", nil)
+	if rec.Code != http.StatusFound {
+		ts.t.Fatalf("OIDC callback: got %d %s", rec.Code, rec.Body)
+	}
+	_, fragment, _ := strings.Cut(rec.Header().Get("Location"), "#")
+	values, err := url.ParseQuery(fragment)
+	if err != nil {
+		ts.t.Fatalf("parse callback fragment: %v", err)
+	}
+	return values
+}
+
+// oidcSession exchanges the refresh token of a completed login for an
+// authorization header
+func (ts *testServer) oidcSession(fragment url.Values) string {
+	ts.t.Helper()
+	if fragment.Get("refresh_token") == "" {
+		ts.t.Fatalf("OIDC login failed: %v", fragment)
+	}
+	rec := ts.do(http.MethodPost, "/api/v1/auth/refresh", "", map[string]string{"refresh_token": fragment.Get("refresh_token")})
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+		ts.t.Fatalf("refresh after OIDC login: %d %s", rec.Code, rec.Body)
+	}
+	return "Bearer " + resp.Token
+}
+
+func TestOIDCLoginProvisionsMappedRole(t *testing.T) {
+	ts, p := newOIDCServer(t, true)
+	agent := ts.registerAgent("machine-1", database.DefaultOrg)
+
+	for _, tt := range []struct {
+		username, group, role string
+		canWrite              bool
+	}{
+		{"olivia", "rig-operators", auth.RoleOperator, true},
+		{"victor", "rig-viewers", auth.RoleViewer, false},
+	} {
+		fragment := ts.oidcCallback(p.authorize(ts.oidcLogin(), "sub-"+tt.username, tt.username, "unrelated", tt.group))
+		session := ts.oidcSession(fragment)
+
+		user, err := ts.registry.GetUser(tt.username)
+		if err != nil {
+			t.Fatalf("provisioned user %s: %v", tt.username, err)
+		}
+		if user.Role != tt.role || user.OrgID != database.DefaultOrg {
+			t.Errorf("user %s provisioned as %s in %s, want %s", tt.username, user.Role, user.OrgID, tt.role)
+		}
+
+		// The mapped role limits the session
+		rec := ts.do(http.MethodPatch, "/api/v1/agents/"+agent.ID, session, map[string]string{"name": "renamed-by-" + tt.username})
+		if (rec.Code == http.StatusOK) != tt.canWrite {
+			t.Errorf("%s renaming an agent: got %d", tt.role, rec.Code)
+		}
+	}
+}
+
+func TestOIDCRoleFollowsGroups(t *testing.T) {
+	ts, p := newOIDCServer(t, true)
+	ts.oidcSession(ts.oidcCallback(p.authorize(ts.oidcLogin(), "sub-1", "olivia", "rig-viewers")))
+	ts.oidcSession(ts.oidcCallback(p.authorize(ts.oidcLogin(), "sub-1", "olivia", "rig-viewers", "rig-admins")))
+	if user, err := ts.registry.GetUser("olivia"); err != nil || user.Role != auth.RoleAdmin {
+		t.Errorf("role after joining rig-admins: %v %v, want admin", user, err)
+	}
+
+	// Users in no mapped group are turned away without a default role
+	fragment := ts.oidcCallback(p.authorize(ts.oidcLogin(), "sub-2", "nobody", "unrelated"))
+	if fragment.Get("oidc_error") == "" || fragment.Get("refresh_token") != "" {
+		t.Errorf("login without a mapped group: %v", fragment)
+	}
+}
+
+func TestOIDCAutoProvisionOff(t *testing.T) {
+	ts, p := newOIDCServer(t, false)
+
+	fragment := ts.oidcCallback(p.authorize(ts.oidcLogin(), "sub-1", "olivia", "rig-operators"))
+	if !strings.Contains(fragment.Get("oidc_error"), "not been set up") {
+		t.Errorf("login of an unknown user: %v", fragment)
+	}
+	if _, err := ts.registry.GetUser("olivia"); err == nil {
+		t.Error("user was provisioned with auto_provision off")
+	}
+
+	// Accounts created beforehand can log in
+	if _, err := ts.registry.CreateOIDCUser("olivia", auth.RoleViewer, database.DefaultOrg, p.srv.URL, "sub-1"); err != nil {
+		t.Fatalf("create OIDC user: %v", err)
+	}
+	ts.oidcSession(ts.oidcCallback(p.authorize(ts.oidcLogin(), "sub-1", "olivia", "rig-operators")))
+}
+
+func TestOIDCStateChecks(t *testing.T) {
+	ts, p := newOIDCServer(t, true)
+
+	query := p.authorize(ts.oidcLogin(), "sub-1", "olivia", "rig-operators")
+	forged := url.Values{"code": query["code"], "state": {"forged"}}
+	if fragment := ts.oidcCallback(forged); !strings.Contains(fragment.Get("oidc_error"), "expired or invalid") {
+		t.Errorf("callback with an unknown state: %v", fragment)
+	}
+	ts.oidcSession(ts.oidcCallback(query))
+	// Each login completes once
+	if fragment := ts.oidcCallback(query); !strings.Contains(fragment.Get("oidc_error"), "expired or invalid") {
+		t.Errorf("replayed callback: %v", fragment)
+	}
+}
+
+func TestOIDCRejectsInvalidTokens(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		// query changes the callback query or the code it carries
+		query   func(*mockOIDC, url.Values)
+		idToken func(jwt.MapClaims)
+	}{
+		{name: "unknown code", query: func(p *mockOIDC, q url.Values) { q.Set("code", "unknown") }},
+		{name: "wrong code verifier", query: func(p *mockOIDC, q url.Values) {
+			grant := p.codes[q.Get("code")]
+			grant.challenge = base64.RawURLEncoding.EncodeToString(make([]byte, sha256.Size))
+			p.codes[q.Get("code")] = grant
+		}},
+		{name: "wrong nonce", idToken: func(c jwt.MapClaims) { c["nonce"] = "other" }},
+		{name: "wrong issuer", idToken: func(c jwt.MapClaims) { c["iss"] = "https://evil.test" }},
+		{name: "wrong audience", idToken: func(c jwt.MapClaims) { c["aud"] = "other-client" }},
+		{name: "other authorized party", idToken: func(c jwt.MapClaims) {
+			c["aud"] = []string{oidcClientID, "other-client"}
+			c["azp"] = "other-client"
+		}},
+		{name: "expired", idToken: func(c jwt.MapClaims) {
+			c["iat"] = time.Now().Add(-time.Hour).Unix()
+			c["exp"] = time.Now().Add(-10 * time.Minute).Unix()
+		}},
+		{name: "issued in the future", idToken: func(c jwt.MapClaims) { c["iat"] = time.Now().Add(time.Hour).Unix() }},
+		{name: "no expiry", idToken: func(c jwt.MapClaims) { delete(c, "exp") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, p := newOIDCServer(t, true)
+			p.idToken = tt.idToken
+			query := p.authorize(ts.oidcLogin(), "sub-1", "olivia", "rig-admins")
+			if tt.query != nil {
+				tt.query(p, query)
+			}
+			fragment := ts.oidcCallback(query)
+			if fragment.Get("oidc_error") == "" || fragment.Get("refresh_token") != "" {
+				t.Errorf("login succeeded: %v", fragment)
+			}
+			if _, err := ts.registry.GetUser("olivia"); err == nil {
+				t.Error("user was provisioned")
+			}
+		})
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	ts, p := newOIDCServer(t, true)
+	p.issuer = "https://evil.test"
+	if rec := ts.do(http.MethodGet, "/api/v1/auth/oidc/login", "", nil); rec.Code != http.StatusBadGateway {
+		t.Errorf("login with a mismatched discovered issuer: got %d, want 502", rec.Code)
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+func (s *Server) listOrganizations(c *gin.Context) {
+	orgs, err := s.registry.ListOrganizations()
+	if err != nil {
+		s.log(c).Error("Failed to list organizations", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list organizations"})
+		return
+	}
+	if orgs == nil {
+		orgs = []*database.Organization{}
+	}
+	c.JSON(http.StatusOK, gin.H{"organizations": orgs})
+}
+
+func (s *Server) createOrganization(c *gin.Context) {
+	var req struct {
+		ID   string `json:"id" binding:"required"`
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	org, err := s.registry.CreateOrganization(req.ID, req.Name)
+	s.audit(c, registry.AuditRecord{
+		OrgID: req.ID, Action: registry.AuditOrgCreate, TargetType: "organization", TargetID: req.ID,
+		After: gin.H{"name": req.Name}, Err: err,
+	})
+	switch {
+	case errors.Is(err, registry.ErrInvalidOrganization):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, database.ErrOrganizationExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Organization already exists"})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to create organization", "org_id", req.ID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create organization"})
+		return
+	}
+	c.JSON(http.StatusCreated, org)
+}
+
+// deleteOrganization removes an organization that no longer owns agents,
+// users or enrollment tokens
+func (s *Server) deleteOrganization(c *gin.Context) {
+	id := c.Param("id")
+	err := s.registry.DeleteOrganization(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Organization not found"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{OrgID: id, Action: registry.AuditOrgDelete, TargetType: "organization", TargetID: id, Err: err})
+	switch {
+	case errors.Is(err, registry.ErrInvalidOrganization):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	case errors.Is(err, database.ErrOrganizationNotEmpty):
+		c.JSON(http.StatusConflict, gin.H{"error": "Organization still owns agents, users or enrollment tokens"})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to delete organization", "org_id", id, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete organization"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+}
+
+// requireAgentInOrg responds to requests for an agent of another
+// organization as if the agent did not exist
+func (s *Server) requireAgentInOrg() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		agent, err := s.registry.GetAgentInOrg(auth.OrgScope(c), c.Param("id"))
+		if errors.Is(err, sql.ErrNoRows) {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+			return
+		}
+		if err != nil {
+			s.log(c).Error("Failed to get agent", "agent_id", c.Param("id"), "error", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to get agent"})
+			return
+		}
+		c.Set(agentOrgKey, agent.OrgID)
+		c.Next()
+	}
+}
+
+// targetOrg returns the organization something is created in: the
+// requested one for super admins, otherwise the caller's own. It responds
+// with 403 and returns false when anyone else requests another
+// organization.
+func targetOrg(c *gin.Context, requested string) (string, bool) {
+	own, _ := auth.GetOrgIDFromContext(c)
+	if requested == "" || requested == own {
+		return own, true
+	}
+	if role, _ := auth.GetRoleFromContext(c); role == auth.RoleSuperAdmin {
+		return requested, true
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "Only super admins can act on other organizations"})
+	return "", false
+}
+
+// managedUser returns an account the caller may administer: one of the
+// caller's organization that is not a super admin, or any account for
+// super admins. Other accounts are reported as sql.ErrNoRows.
+func (s *Server) managedUser(c *gin.Context, username string) (*database.User, error) {
+	user, err := s.registry.GetUserInOrg(auth.OrgScope(c), username)
+	if err != nil {
+		return nil, err
+	}
+	if role, _ := auth.GetRoleFromContext(c); user.Role == auth.RoleSuperAdmin && role != auth.RoleSuperAdmin {
+		return nil, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+// requireManagedUser looks up an account with managedUser and responds with
+// 404 or 500 when it cannot be administered by the caller
+func (s *Server) requireManagedUser(c *gin.Context, username string) (*database.User, bool) {
+	user, err := s.managedUser(c, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return nil, false
+	}
+	if err != nil {
+		s.log(c).Error("Failed to get user", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		return nil, false
+	}
+	return user, true
+}
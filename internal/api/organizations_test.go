@@ -0,0 +1,253 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// orgFixture has two organizations with an agent each, and credentials of
+// an administrator of the first
+type orgFixture struct {
+	*testServer
+	agentA, agentB *database.Agent
+	// commandB is a pending command of agent B
+	commandB int64
+	// credentials of org-a: a session and an API key with every scope
+	credentials map[string]string
+	superAdmin  string
+}
+
+func newOrgFixture(t *testing.T) *orgFixture {
+	ts := newTestServer(t, nil)
+	ts.createOrganization("org-a")
+	ts.createOrganization("org-b")
+	f := &orgFixture{
+		testServer: ts,
+		agentA:     ts.registerAgent("machine-a", "org-a"),
+		agentB:     ts.registerAgent("machine-b", "org-b"),
+	}
+
+	// Both agents are in the same group, so only the organization tells
+	// them apart
+	for _, agent := range []*database.Agent{f.agentA, f.agentB} {
+		if _, err := ts.registry.UpdateAgent(agent.ID, nil, nil, []string{"rigs"}); err != nil {
+			t.Fatalf("update agent: %v", err)
+		}
+	}
+
+	var err error
+	if f.commandB, err = ts.registry.CreateCommand(f.agentB.ID, "restart", nil); err != nil {
+		t.Fatalf("create command: %v", err)
+	}
+
+	session := ts.login("admin-a", auth.RoleAdmin, "org-a")
+	user, err := ts.registry.GetUser("admin-a")
+	if err != nil {
+		t.Fatalf("get user: %v", err)
+	}
+	key, _, err := ts.registry.CreateAPIKey(user, registry.APIKeyRequest{Name: "all", Scopes: auth.Scopes, CreatedBy: "admin-a"})
+	if err != nil {
+		t.Fatalf("create API key: %v", err)
+	}
+	f.credentials = map[string]string{"session": session, "api key": "ApiKey " + key}
+	f.superAdmin = ts.login("root", auth.RoleSuperAdmin, database.DefaultOrg)
+	return f
+}
+
+// leaks reports whether a response mentions agent B
+func (f *orgFixture) leaks(body string) bool {
+	return strings.Contains(body, f.agentB.ID) || strings.Contains(body, f.agentB.MachineID)
+}
+
+func TestOrganizationIsolationREST(t *testing.T) {
+	f := newOrgFixture(t)
+	agentB := "/api/v1/agents/" + f.agentB.ID
+
+	routes := []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodGet, agentB, nil},
+		{http.MethodGet, agentB + "/metrics", nil},
+		{http.MethodGet, agentB + "/inventory", nil},
+		{http.MethodGet, agentB + "/availability", nil},
+		{http.MethodGet, agentB + "/export", nil},
+		{http.MethodGet, agentB + "/certificates", nil},
+		{http.MethodPatch, agentB, map[string]string{"name": "taken"}},
+		{http.MethodDelete, agentB, nil},
+		{http.MethodPost, agentB + "/commands", map[string]string{"command": "stop"}},
+		{http.MethodPost, agentB + "/credentials/rotate", nil},
+		{http.MethodPost, agentB + "/revoke", nil},
+		{http.MethodPost, agentB + "/restore", nil},
+		{http.MethodPost, agentB + "/download", nil},
+		{http.MethodPost, "/api/v1/commands/" + strconv.FormatInt(f.commandB, 10) + "/cancel", nil},
+	}
+
+	for name, credential := range f.credentials {
+		for _, route := range routes {
+			rec := f.do(route.method, route.path, credential, route.body)
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("%s %s with org-a %s: got %d, want 404", route.method, route.path, name, rec.Code)
+			}
+			if f.leaks(rec.Body.String()) {
+				t.Errorf("%s %s with org-a %s leaked agent B: %s", route.method, route.path, name, rec.Body)
+			}
+		}
+
+		for _, path := range []string{"/api/v1/agents", "/api/v1/dashboard", "/api/v1/agent-conflicts", "/api/v1/reports/availability"} {
+			rec := f.do(http.MethodGet, path, credential, nil)
+			if rec.Code != http.StatusOK {
+				t.Errorf("GET %s with org-a %s: got %d", path, name, rec.Code)
+			}
+			if f.leaks(rec.Body.String()) {
+				t.Errorf("GET %s with org-a %s leaked agent B: %s", path, name, rec.Body)
+			}
+		}
+		if rec := f.do(http.MethodGet, "/api/v1/agents", credential, nil); !strings.Contains(rec.Body.String(), f.agentA.ID) {
+			t.Errorf("GET /api/v1/agents with org-a %s misses agent A: %s", name, rec.Body)
+		}
+
+		// A selector matching both agents only reaches the caller's
+		rec := f.do(http.MethodPost, "/api/v1/commands", credential, map[string]interface{}{
+			"command": "restart", "selector": map[string][]string{"groups": {"rigs"}},
+		})
+		if rec.Code != http.StatusOK || f.leaks(rec.Body.String()) || !strings.Contains(rec.Body.String(), f.agentA.ID) {
+			t.Errorf("POST /api/v1/commands with org-a %s: got %d %s", name, rec.Code, rec.Body)
+		}
+
+		// Super admin routes stay closed to organization administrators
+		if rec := f.do(http.MethodGet, "/api/v1/organizations", credential, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("GET /api/v1/organizations with org-a %s: got %d, want 403", name, rec.Code)
+		}
+		// So does creating agents in another organization
+		rec = f.do(http.MethodPost, "/api/v1/agents/generate", credential, map[string]string{"name": "rig", "platform": "linux", "arch": "amd64", "org_id": "org-b"})
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("POST /api/v1/agents/generate into org-b with org-a %s: got %d, want 403", name, rec.Code)
+		}
+	}
+
+	got, err := f.registry.GetAgent(f.agentB.ID)
+	if err != nil {
+		t.Fatalf("get agent B: %v", err)
+	}
+	if got.Name != f.agentB.Name || got.Status != f.agentB.Status || got.RevokedAt != nil || got.DecommissionedAt != nil {
+		t.Errorf("org-a changed agent B: %+v", got)
+	}
+	commands, err := f.registry.GetPendingCommands(f.agentB.ID)
+	if err != nil || len(commands) != 1 || commands[0].ID != f.commandB {
+		t.Errorf("org-a changed the commands of agent B: %v %v", commands, err)
+	}
+}
+
+func TestOrganizationIsolationJSONRPC(t *testing.T) {
+	f := newOrgFixture(t)
+	request := map[string]interface{}{"jsonrpc": "2.0", "method": "agent.list", "id": 1}
+
+	for name, credential := range f.credentials {
+		rec := f.do(http.MethodPost, "/rpc", credential, request)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), f.agentA.ID) {
+			t.Errorf("agent.list with org-a %s: got %d %s", name, rec.Code, rec.Body)
+		}
+		if f.leaks(rec.Body.String()) {
+			t.Errorf("agent.list with org-a %s leaked agent B: %s", name, rec.Body)
+		}
+	}
+
+	rec := f.do(http.MethodPost, "/rpc", f.superAdmin, request)
+	if !strings.Contains(rec.Body.String(), f.agentA.ID) || !strings.Contains(rec.Body.String(), f.agentB.ID) {
+		t.Errorf("agent.list as super admin should list both agents: %s", rec.Body)
+	}
+}
+
+func TestOrganizationIsolationWebSocket(t *testing.T) {
+	f := newOrgFixture(t)
+	srv := httptest.NewServer(f.handler)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	for name, credential := range f.credentials {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {credential}})
+		if err != nil {
+			t.Fatalf("dial with org-a %s: %v", name, err)
+		}
+		f.waitForWebSockets(1)
+
+		// Metrics of agent B are sent first; the first message the client
+		// receives must be those of agent A
+		for _, agent := range []*database.Agent{f.agentB, f.agentA} {
+			rec := f.do(http.MethodPost, "/api/v1/agents/"+agent.ID+"/metrics", "Bearer token-"+agent.MachineID, map[string]float64{"hashrate": 1})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("post metrics of %s: %d %s", agent.ID, rec.Code, rec.Body)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read with org-a %s: %v", name, err)
+		}
+		var got struct {
+			AgentID string `json:"agent_id"`
+		}
+		if err := json.Unmarshal(message, &got); err != nil || got.AgentID != f.agentA.ID {
+			t.Errorf("org-a %s received %s, want metrics of agent A only", name, message)
+		}
+		conn.Close()
+		f.waitForWebSockets(0)
+	}
+
+	// Super admins receive the metrics of every organization
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": {f.superAdmin}})
+	if err != nil {
+		t.Fatalf("dial as super admin: %v", err)
+	}
+	defer conn.Close()
+	f.waitForWebSockets(1)
+	f.do(http.MethodPost, "/api/v1/agents/"+f.agentB.ID+"/metrics", "Bearer token-"+f.agentB.MachineID, map[string]float64{"hashrate": 1})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, message, err := conn.ReadMessage(); err != nil || !strings.Contains(string(message), f.agentB.ID) {
+		t.Errorf("super admin received %s %v, want metrics of agent B", message, err)
+	}
+}
+
+// waitForWebSockets waits until n WebSocket clients are registered
+func (ts *testServer) waitForWebSockets(n int) {
+	ts.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		ts.server.wsMu.Lock()
+		count := len(ts.server.wsConnections)
+		ts.server.wsMu.Unlock()
+		if count == n {
+			return
+		}
+	}
+	ts.t.Fatalf("timed out waiting for %d WebSocket clients", n)
+}
+
+func TestSuperAdminSeesEveryOrganization(t *testing.T) {
+	f := newOrgFixture(t)
+
+	rec := f.do(http.MethodGet, "/api/v1/agents", f.superAdmin, nil)
+	if !strings.Contains(rec.Body.String(), f.agentA.ID) || !strings.Contains(rec.Body.String(), f.agentB.ID) {
+		t.Errorf("GET /api/v1/agents as super admin should list both agents: %s", rec.Body)
+	}
+	for _, agent := range []*database.Agent{f.agentA, f.agentB} {
+		if rec := f.do(http.MethodGet, "/api/v1/agents/"+agent.ID, f.superAdmin, nil); rec.Code != http.StatusOK {
+			t.Errorf("GET agent of %s as super admin: got %d", agent.OrgID, rec.Code)
+		}
+	}
+	rec = f.do(http.MethodPost, "/api/v1/commands/"+strconv.FormatInt(f.commandB, 10)+"/cancel", f.superAdmin, nil)
+	if rec.Code != http.StatusOK {
+		t.Errorf("cancel command of org-b as super admin: got %d %s", rec.Code, rec.Body)
+	}
+}
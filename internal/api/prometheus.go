@@ -0,0 +1,65 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/lifecycle"
+)
+
+// prometheusMetrics serves fleet and worker gauges in the Prometheus text
+// exposition format. The counts cover every organization, so scrapers must
+// present server.metrics_token when it is set.
+func (s *Server) prometheusMetrics(c *gin.Context) {
+	if want := s.config.Current().Server.MetricsToken; want != "" {
+		token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			c.Header("WWW-Authenticate", `Bearer realm="metrics"`)
+			c.String(http.StatusUnauthorized, "unauthorized\n")
+			return
+		}
+	}
+
+	counts, err := s.registry.CountAgentsByStatus("")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "failed to count agents\n")
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP silentrig_agents Number of agents by status.\n")
+	b.WriteString("# TYPE silentrig_agents gauge\n")
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+	for _, status := range statuses {
+		fmt.Fprintf(&b, "silentrig_agents{status=%q} %d\n", status, counts[status])
+	}
+
+	if s.supervisor != nil {
+		workers := s.supervisor.Health()
+		b.WriteString("# HELP silentrig_worker_up Whether a background worker is running.\n")
+		b.WriteString("# TYPE silentrig_worker_up gauge\n")
+		for _, w := range workers {
+			up := 0
+			if w.State == lifecycle.StateRunning {
+				up = 1
+			}
+			fmt.Fprintf(&b, "silentrig_worker_up{worker=%q} %d\n", w.Name, up)
+		}
+		b.WriteString("# HELP silentrig_worker_restarts_total Restarts of a background worker.\n")
+		b.WriteString("# TYPE silentrig_worker_restarts_total counter\n")
+		for _, w := range workers {
+			fmt.Fprintf(&b, "silentrig_worker_restarts_total{worker=%q} %d\n", w.Name, w.Restarts)
+		}
+	}
+
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+}
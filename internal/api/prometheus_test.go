@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"silentrig/internal/config"
+)
+
+func TestMetricsToken(t *testing.T) {
+	metricsListener := func(token string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.Server.Listeners = []config.ListenerConfig{{
+				Name:   "metrics",
+				Port:   9100,
+				Routes: []string{config.RoutesMetrics},
+				TLS:    config.ListenerTLSConfig{TLSConfig: cfg.Server.TLS},
+			}}
+			cfg.Server.MetricsToken = token
+		}
+	}
+
+	tests := []struct {
+		name          string
+		token         string
+		authorization string
+		want          int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"missing token", "scrape-token", "", http.StatusUnauthorized},
+		{"wrong token", "scrape-token", "Bearer other-token", http.StatusUnauthorized},
+		{"not a bearer token", "scrape-token", "scrape-token", http.StatusUnauthorized},
+		{"valid token", "scrape-token", "Bearer scrape-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t, metricsListener(tt.token))
+			ts.registerAgent("rig-1", "default")
+
+			rec := ts.do(http.MethodGet, "/metrics", tt.authorization, nil)
+			if rec.Code != tt.want {
+				t.Fatalf("GET /metrics = %d %s, want %d", rec.Code, rec.Body, tt.want)
+			}
+			if tt.want == http.StatusOK && !strings.Contains(rec.Body.String(), "silentrig_agents{") {
+				t.Errorf("no agent gauge in %s", rec.Body)
+			}
+			if tt.want == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header on 401")
+			}
+		})
+	}
+}
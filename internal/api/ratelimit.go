@@ -0,0 +1,181 @@
+package api
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/ratelimit"
+	"silentrig/internal/registry"
+)
+
+// rateLimitResultKey is the gin context key of the most restrictive rate
+// limit a request passed, which its RateLimit headers describe
+const rateLimitResultKey = "rate_limit"
+
+// errLoginLocked is audited when failed logins lock a username out
+var errLoginLocked = errors.New("account locked after failed logins")
+
+// rateLimit applies the rate limit rules keyed by client IP. It runs before
+// authentication, so it also covers rejected credentials.
+func (s *Server) rateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.applyRateLimits(c, config.RateLimitKeyIP)
+	}
+}
+
+// rateLimitCaller applies the rate limit rules keyed by user or API key.
+// It runs after AuthMiddleware.
+func (s *Server) rateLimitCaller() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.applyRateLimits(c, config.RateLimitKeyUser, config.RateLimitKeyAPIKey)
+	}
+}
+
+// rateLimitAgent applies the rate limit rules keyed by agent. It runs after
+// requireAgentToken so requests with someone else's agent ID cannot drain
+// the agent's bucket.
+func (s *Server) rateLimitAgent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s.applyRateLimits(c, config.RateLimitKeyAgent)
+	}
+}
+
+// applyRateLimits takes a token from the bucket of every matching rule with
+// one of the given keys and rejects the request with 429 if one is empty.
+// Store errors let the request pass.
+func (s *Server) applyRateLimits(c *gin.Context, keys ...string) {
+	cfg := s.config.Current().RateLimit
+	route := c.FullPath()
+	if !cfg.Enabled || route == "" {
+		return
+	}
+
+	now := time.Now()
+	for _, rule := range cfg.Rules {
+		if !slices.Contains(keys, rule.Key) || !rule.Matches(c.Request.Method, route) {
+			continue
+		}
+		client, ok := rateLimitClient(c, rule.Key)
+		if !ok {
+			continue
+		}
+
+		rate := ratelimit.Rate{Requests: rule.Requests, Period: rule.Period, Burst: rule.Burst}
+		if rate.Burst == 0 {
+			rate.Burst = rate.Requests
+		}
+		result, err := s.limits.Take(rule.Name+"|"+rule.Key+"|"+client, rate, now)
+		if err != nil {
+			s.log(c).Error("Failed to check rate limit", "rule", rule.Name, "error", err)
+			continue
+		}
+		if !result.Allowed {
+			setRateLimitHeaders(c, rule, result)
+			c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+			s.log(c).Info("Request rate limited", "rule", rule.Name, "key", rule.Key, "client", client)
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests, try again later"})
+			return
+		}
+		if prev, ok := c.Get(rateLimitResultKey); !ok || result.Remaining < prev.(ratelimit.Result).Remaining {
+			c.Set(rateLimitResultKey, result)
+			setRateLimitHeaders(c, rule, result)
+		}
+	}
+}
+
+// rateLimitClient returns the value of a rate limit key for a request, or
+// false if the request has none, e.g. no API key
+func rateLimitClient(c *gin.Context, key string) (string, bool) {
+	switch key {
+	case config.RateLimitKeyIP:
+		return c.ClientIP(), true
+	case config.RateLimitKeyAgent:
+		// Only set once the agent authenticated
+		id := c.GetString(agentIDKey)
+		return id, id != ""
+	case config.RateLimitKeyUser:
+		return auth.GetUserIDFromContext(c)
+	case config.RateLimitKeyAPIKey:
+		id, ok := auth.GetAPIKeyIDFromContext(c)
+		return strconv.FormatInt(id, 10), ok
+	}
+	return "", false
+}
+
+// setRateLimitHeaders describes a bucket with the RateLimit headers of the
+// IETF draft "RateLimit header fields for HTTP"
+func setRateLimitHeaders(c *gin.Context, rule config.RateLimitRule, result ratelimit.Result) {
+	c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	c.Header("RateLimit-Policy", strconv.Itoa(rule.Requests)+";w="+strconv.Itoa(ceilSeconds(rule.Period)))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// loginLockedOut responds with 429 and returns true while a username is
+// locked out for the client after failed logins. Refused attempts are not
+// audited; the lockout itself was.
+func (s *Server) loginLockedOut(c *gin.Context, username string) bool {
+	if s.config.Current().RateLimit.Lockout.MaxFailures == 0 {
+		return false
+	}
+	until, err := s.limits.LockedUntil(loginLockoutKey(c, username), time.Now())
+	if err != nil {
+		s.log(c).Error("Failed to check login lockout", "username", username, "error", err)
+		return false
+	}
+	if until.IsZero() {
+		return false
+	}
+	c.Header("Retry-After", strconv.Itoa(ceilSeconds(time.Until(until))))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many failed logins, try again later"})
+	return true
+}
+
+// loginFailed counts a failed password or second factor towards the
+// lockout of a username for the client. Lockouts are audited when they
+// start; attempts are refused before reaching here while they last.
+func (s *Server) loginFailed(c *gin.Context, username string) {
+	lockout := s.config.Current().RateLimit.Lockout
+	if lockout.MaxFailures == 0 {
+		return
+	}
+	until, err := s.limits.Fail(loginLockoutKey(c, username), ratelimit.Lockout{
+		MaxFailures: lockout.MaxFailures,
+		Duration:    lockout.Duration,
+		MaxDuration: lockout.MaxDuration,
+		ResetAfter:  lockout.ResetAfter,
+	}, time.Now())
+	if err != nil {
+		s.log(c).Error("Failed to record failed login", "username", username, "error", err)
+		return
+	}
+	if !until.IsZero() {
+		s.log(c).Warn("Login locked after failed attempts", "username", username, "locked_until", until.UTC())
+		s.audit(c, registry.AuditRecord{Actor: username, Action: registry.AuditLogin, TargetType: "user", TargetID: username, Err: errLoginLocked})
+	}
+}
+
+// loginSucceeded clears the failed logins of a username from the client
+func (s *Server) loginSucceeded(c *gin.Context, username string) {
+	if err := s.limits.Reset(loginLockoutKey(c, username)); err != nil {
+		s.log(c).Error("Failed to reset failed logins", "username", username, "error", err)
+	}
+}
+
+// loginLockoutKey counts failures per username and client IP, so failed
+// logins from one address cannot lock the account out everywhere
+func loginLockoutKey(c *gin.Context, username string) string {
+	return "login|" + username + "|" + c.ClientIP()
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+func TestAgentRateLimitAfterAuthentication(t *testing.T) {
+	heartbeat := []string{"POST /api/v1/agents/:id/heartbeat"}
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Rules = []config.RateLimitRule{
+			{Name: "agent", Routes: heartbeat, Key: config.RateLimitKeyAgent, Requests: 3, Period: time.Minute},
+			{Name: "agent-ip", Routes: heartbeat, Key: config.RateLimitKeyIP, Requests: 10, Period: time.Minute},
+		}
+	})
+	agent := ts.registerAgent("machine-1", database.DefaultOrg)
+	path := "/api/v1/agents/" + agent.ID + "/heartbeat"
+
+	// Requests with the agent's ID but without its token are turned away
+	// without touching the agent's bucket
+	for i := 0; i < 5; i++ {
+		if rec := ts.do(http.MethodPost, path, "Bearer wrong", nil); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("heartbeat with a wrong token: got %d, want 401", rec.Code)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if rec := ts.do(http.MethodPost, path, "Bearer token-machine-1", nil); rec.Code != http.StatusOK {
+			t.Fatalf("heartbeat %d of the agent: got %d, want 200: %s", i+1, rec.Code, rec.Body)
+		}
+	}
+	if rec := ts.do(http.MethodPost, path, "Bearer token-machine-1", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("heartbeat over the agent's limit: got %d, want 429", rec.Code)
+	}
+
+	// The address is limited before authentication
+	if rec := ts.do(http.MethodPost, path, "Bearer wrong", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("tenth request from the address: got %d, want 401", rec.Code)
+	}
+	if rec := ts.do(http.MethodPost, path, "Bearer wrong", nil); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("request over the address limit: got %d, want 429", rec.Code)
+	}
+}
+
+func TestLoginLockoutPerClient(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.RateLimit.Lockout = config.LoginLockoutConfig{MaxFailures: 3, Duration: time.Minute, MaxDuration: time.Hour, ResetAfter: time.Hour}
+	})
+	if _, err := ts.registry.CreateUser("admin", "password123", auth.RoleSuperAdmin, database.DefaultOrg); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	login := func(addr, password string) int {
+		return ts.doFrom(addr, http.MethodPost, "/api/v1/auth/login", "", map[string]string{"username": "admin", "password": password}).Code
+	}
+
+	const attacker, owner = "203.0.113.7:4000", "198.51.100.2:5000"
+	for i := 0; i < 3; i++ {
+		if code := login(attacker, "wrong"); code != http.StatusUnauthorized {
+			t.Fatalf("failed login %d: got %d, want 401", i+1, code)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if code := login(attacker, "password123"); code != http.StatusTooManyRequests {
+			t.Fatalf("login during the lockout: got %d, want 429", code)
+		}
+	}
+
+	// The lockout only applies to the address the failures came from
+	if code := login(owner, "password123"); code != http.StatusOK {
+		t.Errorf("login from another address: got %d, want 200", code)
+	}
+
+	// Refused attempts are not audited, only the start of the lockout
+	events, err := ts.registry.ListAuditEvents(database.AuditFilter{Action: registry.AuditLogin, Outcome: database.AuditFailure})
+	if err != nil {
+		t.Fatalf("list audit events: %v", err)
+	}
+	locked := 0
+	for _, e := range events {
+		if strings.Contains(string(e.After), errLoginLocked.Error()) {
+			locked++
+		}
+	}
+	if len(events) != 4 || locked != 1 {
+		t.Errorf("got %d failed login events with %d lockouts, want 3 failures and 1 lockout", len(events), locked)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	ts := newTestServer(t, func(cfg *config.Config) {
+		cfg.RateLimit.Enabled = true
+		cfg.RateLimit.Rules = []config.RateLimitRule{
+			{Name: "health", Routes: []string{"GET /health"}, Key: config.RateLimitKeyIP, Requests: 2, Period: time.Minute},
+		}
+	})
+
+	tests := []struct {
+		code                      int
+		remaining, reset, retryIn string
+	}{
+		{http.StatusOK, "1", "30", ""},
+		{http.StatusOK, "0", "60", ""},
+		{http.StatusTooManyRequests, "0", "60", "30"},
+	}
+	for i, tt := range tests {
+		rec := ts.do(http.MethodGet, "/health", "", nil)
+		if rec.Code != tt.code {
+			t.Fatalf("request %d: got %d, want %d", i+1, rec.Code, tt.code)
+		}
+		h := rec.Header()
+		if h.Get("RateLimit-Limit") != "2" || h.Get("RateLimit-Policy") != "2;w=60" {
+			t.Errorf("request %d: limit %q, policy %q", i+1, h.Get("RateLimit-Limit"), h.Get("RateLimit-Policy"))
+		}
+		if h.Get("RateLimit-Remaining") != tt.remaining || h.Get("RateLimit-Reset") != tt.reset || h.Get("Retry-After") != tt.retryIn {
+			t.Errorf("request %d: remaining %q, reset %q, retry after %q; want %q, %q, %q", i+1,
+				h.Get("RateLimit-Remaining"), h.Get("RateLimit-Reset"), h.Get("Retry-After"), tt.remaining, tt.reset, tt.retryIn)
+		}
+	}
+}
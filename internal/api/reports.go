@@ -0,0 +1,175 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/availability"
+	"silentrig/internal/registry"
+)
+
+// parseTimeRange reads the from/to query parameters (RFC 3339). Without
+// from, the range covers the duration given by range, or the last 24 hours.
+func parseTimeRange(c *gin.Context) (time.Time, time.Time, error) {
+	to := time.Now()
+	if toStr := c.Query("to"); toStr != "" {
+		t, err := time.Parse(time.RFC3339, toStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to timestamp %q", toStr)
+		}
+		to = t
+	}
+
+	window := 24 * time.Hour
+	if rangeStr := c.Query("range"); rangeStr != "" {
+		d, err := time.ParseDuration(rangeStr)
+		if err != nil || d <= 0 {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid range %q", rangeStr)
+		}
+		window = d
+	}
+	from := to.Add(-window)
+	if fromStr := c.Query("from"); fromStr != "" {
+		t, err := time.Parse(time.RFC3339, fromStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from timestamp %q", fromStr)
+		}
+		from = t
+	}
+
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+func availabilityOptions(c *gin.Context) availability.Options {
+	staleAsOnline, _ := strconv.ParseBool(c.Query("stale_as_online"))
+	return availability.Options{StaleAsOnline: staleAsOnline}
+}
+
+func (s *Server) getAgentAvailability(c *gin.Context) {
+	agent, err := s.registry.GetAgent(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	report, err := s.registry.AgentAvailability(agent, from, to, availabilityOptions(c))
+	if err != nil {
+		s.log(c).Error("Failed to compute availability", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute availability"})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeAgentAvailabilityCSV(c, []*availability.AgentReport{report})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "report": report})
+}
+
+// getAvailabilityReport returns availability per agent, or aggregated per
+// label value or group with group_by=label:<key> or group_by=group
+func (s *Server) getAvailabilityReport(c *gin.Context) {
+	filter, err := agentFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	from, to, err := parseTimeRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	groupBy := c.Query("group_by")
+	var labelKey string
+	switch {
+	case groupBy == "" || groupBy == "group":
+	case strings.HasPrefix(groupBy, "label:") && len(groupBy) > len("label:"):
+		labelKey = strings.TrimPrefix(groupBy, "label:")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_by must be group or label:<key>"})
+		return
+	}
+
+	reports, err := s.registry.AvailabilityReport(filter, from, to, availabilityOptions(c))
+	if err != nil {
+		s.log(c).Error("Failed to compute availability", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to compute availability"})
+		return
+	}
+
+	stats := make([]availability.Stats, 0, len(reports))
+	for _, report := range reports {
+		stats = append(stats, report.Stats)
+	}
+	total := availability.Aggregate(stats)
+
+	if groupBy != "" {
+		groups := registry.GroupAvailability(reports, labelKey)
+		if c.Query("format") == "csv" {
+			writeGroupAvailabilityCSV(c, groups)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "group_by": groupBy, "total": total, "groups": groups})
+		return
+	}
+
+	if c.Query("format") == "csv" {
+		writeAgentAvailabilityCSV(c, reports)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "total": total, "agents": reports})
+}
+
+var statsCSVHeader = []string{
+	"observed_seconds", "online_seconds", "availability_percent", "outages",
+	"outage_seconds", "longest_outage_seconds", "mtbf_seconds", "mttr_seconds",
+}
+
+func statsCSVRecord(s availability.Stats) []string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) }
+	return []string{
+		f(s.ObservedSeconds), f(s.OnlineSeconds), f(s.AvailabilityPercent), strconv.Itoa(s.Outages),
+		f(s.OutageSeconds), f(s.LongestOutageSeconds), f(s.MTBFSeconds), f(s.MTTRSeconds),
+	}
+}
+
+func writeAgentAvailabilityCSV(c *gin.Context, reports []*availability.AgentReport) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=availability.csv")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write(append([]string{"agent_id", "name"}, statsCSVHeader...))
+	for _, report := range reports {
+		w.Write(append([]string{report.AgentID, report.Name}, statsCSVRecord(report.Stats)...))
+	}
+	w.Flush()
+}
+
+func writeGroupAvailabilityCSV(c *gin.Context, groups []*availability.GroupReport) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", "attachment; filename=availability.csv")
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write(append([]string{"key", "agents"}, statsCSVHeader...))
+	for _, group := range groups {
+		w.Write(append([]string{group.Key, strconv.Itoa(group.Agents)}, statsCSVRecord(group.Stats)...))
+	}
+	w.Flush()
+}
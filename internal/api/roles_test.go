@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+// writeRoutes lists every operator route that changes agents or commands,
+// with the scope it needs
+func writeRoutes(agentID string) []struct {
+	method, path, scope string
+	body                interface{}
+} {
+	agent := "/api/v1/agents/" + agentID
+	return []struct {
+		method, path, scope string
+		body                interface{}
+	}{
+		{http.MethodPost, "/api/v1/commands", auth.ScopeCommandsWrite, map[string]interface{}{"command": "restart", "selector": map[string]string{}}},
+		{http.MethodPost, "/api/v1/commands/1/cancel", auth.ScopeCommandsWrite, nil},
+		{http.MethodPost, "/api/v1/agent-conflicts/1/resolve", auth.ScopeAgentsWrite, map[string]string{"resolution": "dismiss"}},
+		{http.MethodPost, "/api/v1/agents/generate", auth.ScopeAgentsWrite, map[string]string{"name": "rig", "platform": "linux"}},
+		{http.MethodPatch, agent, auth.ScopeAgentsWrite, map[string]string{"name": "renamed"}},
+		{http.MethodDelete, agent, auth.ScopeAgentsWrite, nil},
+		{http.MethodPost, agent + "/commands", auth.ScopeCommandsWrite, map[string]string{"command": "restart"}},
+		{http.MethodPost, agent + "/credentials/rotate", auth.ScopeAgentsWrite, nil},
+		{http.MethodPost, agent + "/revoke", auth.ScopeAgentsWrite, nil},
+		{http.MethodPost, agent + "/restore", auth.ScopeAgentsWrite, nil},
+		{http.MethodPost, agent + "/download", auth.ScopeAgentsWrite, nil},
+		{http.MethodPost, agent + "/certificates", auth.ScopeAgentsWrite, map[string]string{"csr": ""}},
+		{http.MethodPost, agent + "/certificates/revoke", auth.ScopeAgentsWrite, nil},
+	}
+}
+
+func TestViewerSessionCannotWrite(t *testing.T) {
+	ts := newTestServer(t, nil)
+	viewer := ts.login("viewer", auth.RoleViewer, database.DefaultOrg)
+	agent := ts.registerAgent("machine-1", database.DefaultOrg)
+
+	for _, route := range writeRoutes(agent.ID) {
+		rec := ts.do(route.method, route.path, viewer, route.body)
+		if rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s as viewer: got %d, want 403: %s", route.method, route.path, rec.Code, rec.Body)
+		}
+	}
+
+	got, err := ts.registry.GetAgent(agent.ID)
+	if err != nil {
+		t.Fatalf("get agent: %v", err)
+	}
+	if got.Name != agent.Name || got.Status != agent.Status || got.RevokedAt != nil || got.DecommissionedAt != nil {
+		t.Errorf("viewer changed the agent: %+v", got)
+	}
+	if commands, err := ts.registry.GetPendingCommands(agent.ID); err != nil || len(commands) != 0 {
+		t.Errorf("viewer queued commands: %v %v", commands, err)
+	}
+
+	if rec := ts.do(http.MethodGet, "/api/v1/agents/"+agent.ID, viewer, nil); rec.Code != http.StatusOK {
+		t.Errorf("viewer reading an agent: got %d, want 200", rec.Code)
+	}
+}
+
+func TestSessionScopesFollowRole(t *testing.T) {
+	ts := newTestServer(t, nil)
+	agent := ts.registerAgent("machine-1", database.DefaultOrg)
+
+	for _, role := range []string{auth.RoleViewer, auth.RoleOperator, auth.RoleAdmin} {
+		session := ts.login(role, role, database.DefaultOrg)
+		granted := auth.RoleScopes(role)
+		for _, route := range writeRoutes(agent.ID) {
+			// Routes that would remove the agent are left to the end
+			if route.method == http.MethodDelete || route.path == "/api/v1/agents/"+agent.ID+"/revoke" {
+				continue
+			}
+			rec := ts.do(route.method, route.path, session, route.body)
+			allowed := false
+			for _, scope := range granted {
+				allowed = allowed || scope == route.scope
+			}
+			if forbidden := rec.Code == http.StatusForbidden; forbidden == allowed {
+				t.Errorf("%s %s as %s: got %d, allowed %v: %s", route.method, route.path, role, rec.Code, allowed, rec.Body)
+			}
+		}
+
+		rec := ts.do(http.MethodGet, "/api/v1/audit", session, nil)
+		if want := auth.IsAdmin(role); (rec.Code == http.StatusOK) != want {
+			t.Errorf("GET /api/v1/audit as %s: got %d", role, rec.Code)
+		}
+	}
+}
@@ -2,10 +2,14 @@ package api
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -15,97 +19,308 @@ import (
 	"silentrig/internal/auth"
 	"silentrig/internal/config"
 	"silentrig/internal/database"
+	"silentrig/internal/lifecycle"
 	"silentrig/internal/logger"
+	"silentrig/internal/pki"
+	"silentrig/internal/ratelimit"
 	"silentrig/internal/registry"
 )
 
 type Server struct {
-	config         *config.Config
+	config         *config.Store
 	registry       *registry.Registry
 	logger         logger.Logger
 	auth           *auth.Auth
-	router         *gin.Engine
-	httpServer     *http.Server
+	// keys rotates the token signing keys; nil when signing with the
+	// HMAC secret
+	keys           *auth.KeyManager
+	// oidc runs OIDC logins; nil when disabled
+	oidc           *auth.OIDCProvider
+	// limits holds rate limit buckets and login failures
+	limits         ratelimit.Store
+	listeners      []*listener
 	upgrader       websocket.Upgrader
-	wsConnections  map[string]*websocket.Conn
+	wsConnections  map[string]*wsClient
+	wsMu           sync.Mutex
+	supervisor     *lifecycle.Supervisor
+
+	// ca issues agent client certificates; nil when the CA is disabled
+	ca *pki.CA
 }
 
-func New(cfg *config.Config, reg *registry.Registry, log logger.Logger) *Server {
-	auth := auth.New(cfg.JWT.Secret)
+// New creates the API server. ca may be nil when the built-in CA is
+// disabled. Certificate reloaders for TLS listeners are registered with the
+// supervisor.
+func New(store *config.Store, reg *registry.Registry, log logger.Logger, sup *lifecycle.Supervisor, ca *pki.CA) (*Server, error) {
+	authenticator := auth.New(store.Current().JWT.Secret, log.Component("auth"))
+	authenticator.SetRevocationCheck(func(claims *auth.Claims) (bool, error) {
+		return reg.TokenRevoked(claims.ID, claims.SessionID)
+	})
+	authenticator.SetAPIKeyCheck(reg.AuthenticateAPIKey)
+	limits := ratelimit.NewMemoryStore()
+	sup.Add("rate-limit-prune", limits.Run)
 	
 	server := &Server{
-		config:         cfg,
+		config:         store,
 		registry:       reg,
-		logger:         log,
-		auth:           auth,
-		wsConnections:  make(map[string]*websocket.Conn),
+		logger:         log.Component("api"),
+		auth:           authenticator,
+		limits:         limits,
+		supervisor:     sup,
+		ca:             ca,
+		wsConnections:  make(map[string]*wsClient),
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool { return true },
 		},
 	}
 
-	server.setupRouter()
-	return server
-}
+	if jwt := store.Current().JWT; jwt.Asymmetric() {
+		keys, err := auth.NewKeyManager(authenticator, reg, jwt, log.Component("auth"))
+		if err != nil {
+			return nil, err
+		}
+		server.keys = keys
+		store.Subscribe(func(cfg *config.Config) { keys.SetConfig(cfg.JWT) })
+		sup.Add("jwt-key-rotation", keys.Run)
+	}
+
+	if oidc := store.Current().OIDC; oidc.Enabled {
+		server.oidc = auth.NewOIDCProvider(oidc, log.Component("auth"))
+	}
 
-func (s *Server) setupRouter() {
 	gin.SetMode(gin.ReleaseMode)
-	s.router = gin.New()
-	s.router.Use(gin.Recovery())
-
-	// CORS middleware
-	s.router.Use(cors.New(cors.Config{
-		AllowOrigins:     s.config.CORS.AllowedOrigins,
-		AllowMethods:     s.config.CORS.AllowedMethods,
-		AllowHeaders:     s.config.CORS.AllowedHeaders,
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
-	}))
+	if err := server.setupListeners(store.Current()); err != nil {
+		return nil, err
+	}
+	server.setupCORS(store.Current())
+	store.Subscribe(server.setupCORS)
+	return server, nil
+}
+
+// setupCORS builds the CORS middleware of every listener from the given
+// configuration. It is called again after every configuration reload.
+func (s *Server) setupCORS(cfg *config.Config) {
+	for i, l := range s.listeners {
+		policy := cfg.CORS
+		if override := cfg.Server.EffectiveListeners()[i].CORS; override != nil {
+			policy = *override
+		}
+		handler := cors.New(cors.Config{
+			AllowOrigins:     policy.AllowedOrigins,
+			AllowMethods:     policy.AllowedMethods,
+			AllowHeaders:     policy.AllowedHeaders,
+			ExposeHeaders:    []string{"Content-Length"},
+			AllowCredentials: policy.AllowCredentials,
+			MaxAge:           12 * time.Hour,
+		})
+		l.cors.Store(&handler)
+	}
+}
+
+// setupRouter mounts the route sets selected for a listener
+func (s *Server) setupRouter(l *listener) *gin.Engine {
+	router := gin.New()
+	router.Use(s.requestLogger(l.config.Name))
+	router.Use(gin.Recovery())
+
+	// CORS middleware, swapped on configuration reload
+	router.Use(func(c *gin.Context) {
+		(*l.cors.Load())(c)
+	})
+	router.Use(s.rateLimit())
 
+	router.GET("/health", s.healthCheck)
+	if l.config.Serves(config.RoutesOperator) {
+		s.mountOperatorRoutes(router)
+	}
+	if l.config.Serves(config.RoutesAgent) {
+		s.mountAgentRoutes(router, l.config.TLS.ClientAuth == config.ClientAuthAgent)
+	}
+	if l.config.Serves(config.RoutesMetrics) {
+		router.GET("/metrics", s.prometheusMetrics)
+	}
+	return router
+}
+
+// mountOperatorRoutes mounts the operator API, login, JSON-RPC, WebSocket
+// and the dashboard
+func (s *Server) mountOperatorRoutes(router *gin.Engine) {
 	// Public routes
-	s.router.GET("/", s.rootHandler)
-	s.router.GET("/health", s.healthCheck)
-	s.router.POST("/api/v1/auth/login", s.login)
-	s.router.POST("/api/v1/agents/register", s.registerAgent)
-	s.router.POST("/api/v1/agents/:id/heartbeat", s.agentHeartbeat)
-	s.router.POST("/api/v1/agents/:id/metrics", s.agentMetrics)
-	s.router.GET("/api/v1/agents/:id/commands", s.getAgentCommands)
-	s.router.POST("/api/v1/agents/:id/commands/:commandId/status", s.updateCommandStatus)
-
-	// Protected routes
-	protected := s.router.Group("/api/v1")
-	protected.Use(s.auth.AuthMiddleware())
+	router.GET("/", s.rootHandler)
+	router.POST("/api/v1/auth/login", s.login)
+	router.POST("/api/v1/auth/refresh", s.refresh)
+	router.POST("/api/v1/auth/logout", s.auth.AuthMiddleware(), s.rateLimitCaller(), s.logout)
+	router.POST("/api/v1/auth/login/2fa", s.loginSecondFactor)
+	router.POST("/api/v1/auth/login/2fa/enroll", s.loginEnrollTOTP)
+	router.GET("/api/v1/auth/oidc", s.oidcInfo)
+	router.GET("/api/v1/auth/oidc/login", s.oidcLogin)
+	router.GET("/api/v1/auth/oidc/callback", s.oidcCallback)
+	router.GET("/.well-known/jwks.json", s.jwks)
+
+	// Protected routes need the scope of the route: API keys those they were
+	// created with, sessions those of their role
+	read := s.auth.RequireScope(auth.ScopeAgentsRead)
+	write := s.auth.RequireScope(auth.ScopeAgentsWrite)
+	commands := s.auth.RequireScope(auth.ScopeCommandsWrite)
+	protected := router.Group("/api/v1")
+	protected.Use(s.auth.AuthMiddleware(), s.rateLimitCaller())
+	{
+		protected.GET("/agents", read, s.listAgents)
+		protected.POST("/commands", commands, s.createSelectorCommand)
+		protected.POST("/commands/:id/cancel", commands, s.cancelCommand)
+		protected.GET("/dashboard", read, s.getDashboard)
+		protected.GET("/reports/availability", read, s.getAvailabilityReport)
+		protected.GET("/agent-conflicts", read, s.listConflicts)
+		protected.POST("/agent-conflicts/:id/resolve", write, s.resolveConflict)
+		protected.POST("/agents/generate", write, s.generateAgent)
+	}
+
+	// Routes of a single agent, which must belong to the caller's organization
+	agent := protected.Group("/agents/:id", s.requireAgentInOrg())
+	{
+		agent.GET("", read, s.getAgent)
+		agent.PATCH("", write, s.updateAgent)
+		agent.DELETE("", write, s.deleteAgent)
+		agent.GET("/metrics", read, s.getAgentMetrics)
+		agent.GET("/inventory", read, s.getAgentInventory)
+		agent.GET("/availability", read, s.getAgentAvailability)
+		agent.POST("/commands", commands, s.createCommand)
+		agent.POST("/credentials/rotate", write, s.rotateAgentCredentials)
+		agent.POST("/revoke", write, s.revokeAgent)
+		agent.POST("/restore", write, s.restoreAgent)
+		agent.GET("/export", read, s.exportAgent)
+		agent.POST("/download", write, s.downloadAgent)
+		agent.GET("/certificates", read, s.listAgentCertificates)
+		agent.POST("/certificates", write, s.issueAgentCertificate)
+		agent.POST("/certificates/revoke", write, s.revokeAgentCertificates)
+	}
+
+	// Two-factor authentication of the caller
+	twoFactor := router.Group("/api/v1/auth/2fa")
+	twoFactor.Use(s.auth.AuthMiddleware(), s.rateLimitCaller())
 	{
-		protected.GET("/agents", s.listAgents)
-		protected.GET("/agents/:id", s.getAgent)
-		protected.DELETE("/agents/:id", s.deleteAgent)
-		protected.GET("/agents/:id/metrics", s.getAgentMetrics)
-		protected.POST("/agents/:id/commands", s.createCommand)
-		protected.GET("/dashboard", s.getDashboard)
-		protected.POST("/agents/generate", s.generateAgent)
-		protected.GET("/agents/:id/download", s.downloadAgent)
+		twoFactor.GET("", s.getTwoFactor)
+		twoFactor.POST("/enroll", s.enrollTwoFactor)
+		twoFactor.POST("/confirm", s.confirmTwoFactor)
+		twoFactor.POST("/recovery-codes", s.regenerateRecoveryCodes)
+		twoFactor.POST("/disable", s.disableTwoFactor)
 	}
 
-	// JSON-RPC and WebSocket
-	s.router.POST("/rpc", s.jsonRPCHandler)
-	s.router.GET("/ws", s.auth.OptionalAuthMiddleware(), s.websocketHandler)
+	// API keys are managed with a session of any role or a key with the
+	// admin scope
+	apiKeys := router.Group("/api/v1/api-keys")
+	apiKeys.Use(s.auth.AuthMiddleware(), s.rateLimitCaller(), s.auth.RequireKeyScope(auth.ScopeAdmin))
+	{
+		apiKeys.GET("", s.listAPIKeys)
+		apiKeys.POST("", s.createAPIKey)
+		apiKeys.DELETE("/:id", s.revokeAPIKey)
+	}
+
+	// Administration. Server-wide settings are reserved to super admins.
+	superAdmin := s.auth.RequireRole(auth.RoleSuperAdmin)
+	admin := router.Group("/api/v1/admin")
+	admin.Use(s.auth.AuthMiddleware(), s.rateLimitCaller(), s.auth.RequireRole(auth.RoleAdmin), s.auth.RequireScope(auth.ScopeAdmin))
+	{
+		admin.GET("/logging", superAdmin, s.getLogLevels)
+		admin.PUT("/logging", superAdmin, s.setLogLevels)
+		admin.POST("/service-accounts", s.createServiceAccount)
+		admin.GET("/users/:username/sessions", s.listUserSessions)
+		admin.POST("/users/:username/sessions/revoke", s.revokeUserSessions)
+		admin.POST("/users/:username/2fa/reset", s.resetUserTwoFactor)
+		admin.GET("/jwt/keys", superAdmin, s.listSigningKeys)
+		admin.POST("/jwt/rotate", superAdmin, s.rotateSigningKey)
+	}
+
+	// Organizations
+	orgs := router.Group("/api/v1/organizations")
+	orgs.Use(s.auth.AuthMiddleware(), s.rateLimitCaller(), superAdmin, s.auth.RequireScope(auth.ScopeAdmin))
+	{
+		orgs.GET("", s.listOrganizations)
+		orgs.POST("", s.createOrganization)
+		orgs.DELETE("/:id", s.deleteOrganization)
+	}
+
+	// Audit log. The hash chain spans every organization.
+	audit := router.Group("/api/v1/audit")
+	audit.Use(s.auth.AuthMiddleware(), s.rateLimitCaller(), s.auth.RequireRole(auth.RoleAdmin), s.auth.RequireScope(auth.ScopeAuditRead))
+	{
+		audit.GET("", s.listAuditEvents)
+		audit.GET("/export", s.exportAuditEvents)
+		audit.GET("/verify", superAdmin, s.verifyAuditChain)
+	}
+
+	// JSON-RPC and WebSocket. Browsers cannot set headers on WebSocket
+	// requests, so /ws also accepts the token in the access_token parameter.
+	router.POST("/rpc", s.auth.AuthMiddleware(), s.rateLimitCaller(), read, s.jsonRPCHandler)
+	router.GET("/ws", s.auth.WebSocketAuthMiddleware(), s.rateLimitCaller(), read, s.websocketHandler)
 
 	// Static files
-	s.router.Static("/web", "./web")
-	s.router.StaticFile("/dashboard", "./web/index.html")
-	s.router.Static("/docs", "./docs")
+	router.Static("/web", "./web")
+	router.StaticFile("/dashboard", "./web/index.html")
+	router.Static("/docs", "./docs")
+}
+
+// mountAgentRoutes mounts the routes agents call. Agents authenticate with
+// their token and, with client certificate authentication, also their
+// certificate; either way an agent may only act on its own ID.
+func (s *Server) mountAgentRoutes(router *gin.Engine, clientCerts bool) {
+	router.POST("/api/v1/agents/register", s.registerAgent)
+
+	agents := router.Group("/api/v1/agents/:id")
+	if clientCerts {
+		agents.Use(s.requireAgentCertificate())
+	}
+	agents.Use(s.requireAgentToken(), s.rateLimitAgent())
+	{
+		agents.POST("/credentials", s.agentRotateCredentials)
+		agents.POST("/heartbeat", s.agentHeartbeat)
+		agents.POST("/metrics", s.agentMetrics)
+		agents.GET("/commands", s.getAgentCommands)
+		agents.POST("/commands/:commandId/status", s.updateCommandStatus)
+	}
 }
 
+// Start serves every listener until Shutdown is called. It returns nil
+// after a graceful shutdown and the first error if a listener fails.
 func (s *Server) Start() error {
-	addr := fmt.Sprintf("%s:%d", s.config.Server.Address, s.config.Server.Port)
-	s.httpServer = &http.Server{Addr: addr, Handler: s.router}
-	s.registry.StartCleanupRoutine()
-	return s.httpServer.ListenAndServe()
+	errCh := make(chan error, len(s.listeners))
+	for _, l := range s.listeners {
+		go func(srv *http.Server) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if errors.Is(err, http.ErrServerClosed) {
+				err = nil
+			}
+			errCh <- err
+		}(l.server)
+	}
+	for range s.listeners {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
+// Shutdown stops accepting connections on every listener, sends a close
+// frame to WebSocket clients and waits for in-flight requests to finish
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.httpServer.Shutdown(ctx)
+	s.closeWebSockets()
+	errs := make([]error, len(s.listeners))
+	var wg sync.WaitGroup
+	for i, l := range s.listeners {
+		wg.Add(1)
+		go func(i int, srv *http.Server) {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}(i, l.server)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
 // Root endpoint
@@ -115,10 +330,20 @@ func (s *Server) rootHandler(c *gin.Context) {
 
 // Health check
 func (s *Server) healthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"status":    "healthy",
+	status, code := "healthy", http.StatusOK
+	var workers []lifecycle.WorkerHealth
+	if s.supervisor != nil {
+		workers = s.supervisor.Health()
+		if !s.supervisor.Healthy() {
+			status, code = "degraded", http.StatusServiceUnavailable
+		}
+	}
+
+	c.JSON(code, gin.H{
+		"status":    status,
 		"timestamp": time.Now().UTC(),
 		"version":   "1.0.0",
+		"workers":   workers,
 	})
 }
 
@@ -134,29 +359,62 @@ func (s *Server) login(c *gin.Context) {
 		return
 	}
 
-	if req.Username == "admin" && req.Password == "admin123" {
-		token, err := s.auth.GenerateToken(req.Username, "admin", s.config.JWT.Expiration)
+	if s.loginLockedOut(c, req.Username) {
+		return
+	}
+	user, err := s.registry.Authenticate(req.Username, req.Password)
+	if errors.Is(err, registry.ErrInvalidCredentials) {
+		s.loginFailed(c, req.Username)
+		s.audit(c, registry.AuditRecord{Actor: req.Username, Action: registry.AuditLogin, TargetType: "user", TargetID: req.Username, Err: err})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to authenticate user", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+
+	// Users with a second factor, or whose role requires one, finish the
+	// login at /auth/login/2fa
+	status, err := s.registry.TwoFactorStatus(user.Username)
+	if err != nil {
+		s.log(c).Error("Failed to get two-factor status", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if status.Enabled || s.config.Current().TwoFactor.Requires(user.Role) {
+		token, expiresAt, err := s.registry.CreateMFAChallenge(user.Username)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			s.log(c).Error("Failed to create two-factor challenge", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
 			return
 		}
-
 		c.JSON(http.StatusOK, gin.H{
-			"token": token,
-			"user": gin.H{"username": req.Username, "role": "admin"},
+			"mfa_required":        true,
+			"mfa_token":           token,
+			"mfa_expires_at":      expiresAt,
+			"enrollment_required": !status.Enabled,
 		})
 		return
 	}
 
-	c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	s.loginSucceeded(c, user.Username)
+	s.startSession(c, user, "password", nil)
 }
 
 // Agent management
 func (s *Server) registerAgent(c *gin.Context) {
 	var req struct {
-		MachineID string `json:"machine_id" binding:"required"`
-		Token     string `json:"token" binding:"required"`
-		Name      string `json:"name"`
+		MachineID       string              `json:"machine_id" binding:"required"`
+		Token           string              `json:"token" binding:"required"`
+		EnrollmentToken string              `json:"enrollment_token"`
+		Name            string              `json:"name"`
+		Platform        string              `json:"platform"`
+		Architecture    string              `json:"architecture"`
+		Inventory       *database.Inventory `json:"inventory"`
+		// CSR is a PEM certificate request for the agent's own key
+		CSR string `json:"csr"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -164,19 +422,75 @@ func (s *Server) registerAgent(c *gin.Context) {
 		return
 	}
 
-	agent, err := s.registry.RegisterAgent(req.MachineID, req.Token, req.Name)
+	// Older agents only send platform and architecture at the top level
+	inventory := req.Inventory
+	if inventory == nil && (req.Platform != "" || req.Architecture != "") {
+		inventory = &database.Inventory{}
+	}
+	if inventory != nil {
+		if inventory.OS == "" {
+			inventory.OS = req.Platform
+		}
+		if inventory.Architecture == "" {
+			inventory.Architecture = req.Architecture
+		}
+	}
+
+	agent, created, err := s.registry.EnrollAgent(req.EnrollmentToken, req.MachineID, req.Token, req.Name, c.ClientIP(), inventory)
+	if errors.Is(err, registry.ErrEnrollmentRequired) || errors.Is(err, database.ErrEnrollmentTokenInvalid) || errors.Is(err, registry.ErrAgentRevoked) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, registry.ErrAgentConflict) || errors.Is(err, registry.ErrAgentDecommissioned) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		s.logger.Error("Failed to register agent", err)
+		s.log(c).Error("Failed to register agent", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register agent"})
 		return
 	}
+	c.Set(agentIDKey, agent.ID)
 
-	c.JSON(http.StatusOK, agent)
+	// New agents get a client certificate for the agent listener; existing
+	// ones can renew theirs by sending a CSR
+	if s.ca == nil || (!created && req.CSR == "") {
+		c.JSON(http.StatusOK, agent)
+		return
+	}
+	cert, err := s.ca.IssueForAgent(agent.ID, []byte(req.CSR))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, struct {
+		*database.Agent
+		Certificate *pki.IssuedCertificate `json:"certificate"`
+		AgentURL    string                 `json:"agent_url,omitempty"`
+	}{agent, cert, s.agentURL(c)})
 }
 
 func (s *Server) agentHeartbeat(c *gin.Context) {
 	agentID := c.Param("id")
-	if err := s.registry.UpdateAgentStatus(agentID, "active"); err != nil {
+
+	// The body is optional; agents may report their heartbeat interval
+	var req struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	err := s.registry.Heartbeat(agentID, req.HeartbeatInterval)
+	if errors.Is(err, database.ErrAgentRevoked) {
+		// Revoked after the token was checked
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid agent credentials"})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
 		return
 	}
@@ -192,7 +506,7 @@ func (s *Server) agentMetrics(c *gin.Context) {
 	}
 
 	if err := s.registry.StoreMetrics(agentID, &metrics); err != nil {
-		s.logger.Error("Failed to store metrics", err)
+		s.log(c).Error("Failed to store metrics", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store metrics"})
 		return
 	}
@@ -202,13 +516,119 @@ func (s *Server) agentMetrics(c *gin.Context) {
 }
 
 func (s *Server) listAgents(c *gin.Context) {
-	agents, err := s.registry.ListAgents()
+	filter, err := agentFilterFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	opts, err := listOptionsFromQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	page, err := s.registry.ListAgentsPage(filter, opts)
 	if err != nil {
-		s.logger.Error("Failed to list agents", err)
+		if errors.Is(err, database.ErrInvalidCursor) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		s.log(c).Error("Failed to list agents", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list agents"})
 		return
 	}
-	c.JSON(http.StatusOK, agents)
+	c.JSON(http.StatusOK, page)
+}
+
+// agentFilterFromQuery builds an agent filter from the query string of a
+// listing request, limited to the caller's organization
+func agentFilterFromQuery(c *gin.Context) (*database.AgentFilter, error) {
+	filter, err := registry.ParseSelector(c.QueryArray("label"), c.QueryArray("group"))
+	if err != nil {
+		return nil, err
+	}
+	filter.OrgID = auth.OrgScope(c)
+	filter.OS = c.Query("os")
+	filter.Architecture = c.Query("arch")
+	filter.CPUFeature = c.Query("cpu_feature")
+	filter.AgentVersion = c.Query("agent_version")
+	filter.MinerVersion = c.Query("miner_version")
+	filter.Search = c.Query("search")
+
+	for _, status := range c.QueryArray("status") {
+		for _, part := range strings.Split(status, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				filter.Statuses = append(filter.Statuses, part)
+			}
+		}
+	}
+
+	if within := c.Query("seen_within"); within != "" {
+		d, err := time.ParseDuration(within)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid seen_within duration %q", within)
+		}
+		after := time.Now().Add(-d)
+		filter.LastSeenAfter = &after
+	}
+	if after := c.Query("last_seen_after"); after != "" {
+		t, err := time.Parse(time.RFC3339, after)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last_seen_after timestamp %q", after)
+		}
+		filter.LastSeenAfter = &t
+	}
+	if before := c.Query("last_seen_before"); before != "" {
+		t, err := time.Parse(time.RFC3339, before)
+		if err != nil {
+			return nil, fmt.Errorf("invalid last_seen_before timestamp %q", before)
+		}
+		filter.LastSeenBefore = &t
+	}
+
+	return filter, nil
+}
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// listOptionsFromQuery reads sort, order, limit and cursor parameters
+func listOptionsFromQuery(c *gin.Context) (database.ListOptions, error) {
+	opts := database.ListOptions{
+		Sort:   c.DefaultQuery("sort", database.SortByCreatedAt),
+		Limit:  defaultPageSize,
+		Cursor: c.Query("cursor"),
+	}
+
+	switch order := c.DefaultQuery("order", "desc"); order {
+	case "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		return opts, fmt.Errorf("invalid order %q", order)
+	}
+
+	switch opts.Sort {
+	case database.SortByCreatedAt, database.SortByName, database.SortByLastSeen,
+		database.SortByStatus, database.SortByHashrate:
+	default:
+		return opts, fmt.Errorf("invalid sort key %q", opts.Sort)
+	}
+
+	if limitStr := c.Query("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			return opts, fmt.Errorf("invalid limit %q", limitStr)
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+		opts.Limit = limit
+	}
+
+	return opts, nil
 }
 
 func (s *Server) getAgent(c *gin.Context) {
@@ -221,13 +641,79 @@ func (s *Server) getAgent(c *gin.Context) {
 	c.JSON(http.StatusOK, agent)
 }
 
+func (s *Server) updateAgent(c *gin.Context) {
+	agentID := c.Param("id")
+	var req struct {
+		Name   *string           `json:"name"`
+		Labels map[string]string `json:"labels"`
+		Groups []string          `json:"groups"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	before, err := s.registry.GetAgent(agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update agent"})
+		return
+	}
+
+	agent, err := s.registry.UpdateAgent(agentID, req.Name, req.Labels, req.Groups)
+	if err != nil {
+		switch {
+		case errors.Is(err, registry.ErrInvalidSelector):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, sql.ErrNoRows):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		default:
+			s.log(c).Error("Failed to update agent", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update agent"})
+		}
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentUpdate, TargetType: "agent", TargetID: agentID,
+		Before: registry.AgentSummary(before), After: registry.AgentSummary(agent),
+	})
+
+	c.JSON(http.StatusOK, agent)
+}
+
+// deleteAgent decommissions an agent. It is purged after the retention
+// period, once a final export of its history was written.
 func (s *Server) deleteAgent(c *gin.Context) {
 	agentID := c.Param("id")
-	if err := s.registry.DeleteAgent(agentID); err != nil {
+	before, err := s.registry.GetAgent(agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete agent"})
+		return
+	}
+	if before.DecommissionedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Agent is already decommissioned"})
+		return
+	}
+
+	agent, err := s.registry.DecommissionAgent(agentID)
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentDelete, TargetType: "agent", TargetID: agentID,
+		Before: registry.AgentSummary(before), After: gin.H{"status": database.StatusDecommissioned}, Err: err,
+	})
+	if err != nil {
+		s.log(c).Error("Failed to decommission agent", "agent_id", agentID, "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete agent"})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"status": "deleted"})
+	c.JSON(http.StatusOK, gin.H{"status": database.StatusDecommissioned, "purge_after": s.registry.PurgeAfter(agent)})
 }
 
 func (s *Server) getAgentMetrics(c *gin.Context) {
@@ -246,6 +732,35 @@ func (s *Server) getAgentMetrics(c *gin.Context) {
 	c.JSON(http.StatusOK, metrics)
 }
 
+func (s *Server) getAgentInventory(c *gin.Context) {
+	agentID := c.Param("id")
+	if _, err := s.registry.GetAgent(agentID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
+
+	if c.Query("history") == "true" {
+		history, err := s.registry.GetInventoryHistory(agentID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get inventory"})
+			return
+		}
+		c.JSON(http.StatusOK, history)
+		return
+	}
+
+	inventory, err := s.registry.GetInventory(agentID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Agent has not reported an inventory"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get inventory"})
+		return
+	}
+	c.JSON(http.StatusOK, inventory)
+}
+
 func (s *Server) createCommand(c *gin.Context) {
 	agentID := c.Param("id")
 	var req struct {
@@ -259,15 +774,87 @@ func (s *Server) createCommand(c *gin.Context) {
 	}
 
 	commandID, err := s.registry.CreateCommand(agentID, req.Command, req.Parameters)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return
+	}
 	if err != nil {
-		s.logger.Error("Failed to create command", err)
+		s.log(c).Error("Failed to create command", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create command"})
 		return
 	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditCommandCreate, TargetType: "agent", TargetID: agentID,
+		After: gin.H{"command_id": commandID, "command": req.Command, "parameters": req.Parameters},
+	})
 
 	c.JSON(http.StatusOK, gin.H{"command_id": commandID})
 }
 
+// createSelectorCommand queues a command for every agent of the caller's
+// organization matching a label and group selector
+func (s *Server) createSelectorCommand(c *gin.Context) {
+	var req struct {
+		Command    string               `json:"command" binding:"required"`
+		Parameters interface{}          `json:"parameters"`
+		Selector   database.AgentFilter `json:"selector"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	req.Selector.OrgID = auth.OrgScope(c)
+
+	commandIDs, err := s.registry.CreateCommandForSelector(&req.Selector, req.Command, req.Parameters)
+	if err != nil {
+		if errors.Is(err, registry.ErrInvalidSelector) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		s.log(c).Error("Failed to create commands", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create commands"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditCommandCreate, TargetType: "selector",
+		After: gin.H{"selector": req.Selector, "command": req.Command, "parameters": req.Parameters, "command_ids": commandIDs},
+	})
+
+	c.JSON(http.StatusOK, gin.H{"command_ids": commandIDs, "count": len(commandIDs)})
+}
+
+// cancelCommand cancels a command that no agent picked up yet
+func (s *Server) cancelCommand(c *gin.Context) {
+	commandID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid command ID"})
+		return
+	}
+
+	cmd, err := s.registry.CancelCommand(commandID, auth.OrgScope(c))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Command not found"})
+		return
+	case errors.Is(err, database.ErrCommandNotPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Command is " + cmd.Status + " and can no longer be cancelled"})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to cancel command", "command_id", commandID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel command"})
+		return
+	}
+
+	s.audit(c, registry.AuditRecord{
+		OrgID: cmd.OrgID, Action: registry.AuditCommandCancel, TargetType: "command", TargetID: strconv.FormatInt(commandID, 10),
+		Before: gin.H{"agent_id": cmd.AgentID, "command": cmd.Command, "status": "pending"},
+		After:  gin.H{"status": cmd.Status},
+	})
+	c.JSON(http.StatusOK, cmd)
+}
+
 func (s *Server) getAgentCommands(c *gin.Context) {
 	agentID := c.Param("id")
 	commands, err := s.registry.GetPendingCommands(agentID)
@@ -295,7 +882,7 @@ func (s *Server) updateCommandStatus(c *gin.Context) {
 		return
 	}
 
-	if err := s.registry.UpdateCommandStatus(commandID, req.Status); err != nil {
+	if err := s.registry.UpdateCommandStatus(c.Param("id"), commandID, req.Status); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update command status"})
 		return
 	}
@@ -304,58 +891,109 @@ func (s *Server) updateCommandStatus(c *gin.Context) {
 }
 
 func (s *Server) getDashboard(c *gin.Context) {
-	agents, err := s.registry.ListAgents()
+	scope := auth.OrgScope(c)
+	counts, err := s.registry.CountAgentsByStatus(scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get dashboard data"})
+		return
+	}
+	byLabel, byGroup, err := s.registry.AgentBreakdowns(scope)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get dashboard data"})
+		return
+	}
+	conflicts, err := s.registry.CountOpenConflicts(scope)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get dashboard data"})
 		return
 	}
 
-	var totalAgents, activeAgents int
-	for _, agent := range agents {
-		totalAgents++
-		if agent.Status == "active" {
-			activeAgents++
-		}
+	// The dashboard only shows the most recently seen agents; the full
+	// fleet is available through the paginated agent listing
+	page, err := s.registry.ListAgentsPage(&database.AgentFilter{OrgID: scope}, database.ListOptions{
+		Sort:       database.SortByLastSeen,
+		Descending: true,
+		Limit:      defaultPageSize,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get dashboard data"})
+		return
+	}
+
+	var totalAgents int
+	for _, count := range counts {
+		totalAgents += count
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"summary": gin.H{
 			"total_agents":   totalAgents,
-			"active_agents":  activeAgents,
+			"active_agents":  counts[database.StatusActive],
 			"total_hashrate": 0.0,
+			"status_counts":  counts,
+			"open_conflicts": conflicts,
 		},
-		"agents": agents,
+		"breakdowns": gin.H{
+			"labels": byLabel,
+			"groups": byGroup,
+		},
+		"agents": page.Agents,
 	})
 }
 
-// Agent generation
+// Agent generation. The agent belongs to the caller's organization, or to
+// the one requested by a super admin.
 func (s *Server) generateAgent(c *gin.Context) {
 	var req struct {
 		Name     string `json:"name" binding:"required"`
 		Platform string `json:"platform" binding:"required"`
 		Arch     string `json:"arch" binding:"required"`
+		OrgID    string `json:"org_id"`
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 		return
 	}
+	orgID, ok := targetOrg(c, req.OrgID)
+	if !ok {
+		return
+	}
 
 	machineID := fmt.Sprintf("machine_%d_%s", time.Now().Unix(), generateRandomString(8))
-	token := fmt.Sprintf("token_%s_%s", generateRandomString(16), generateRandomString(8))
+	token, err := registry.GenerateAgentToken()
+	if err != nil {
+		s.log(c).Error("Failed to generate agent token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register agent"})
+		return
+	}
 
-	agent, err := s.registry.RegisterAgent(machineID, token, req.Name)
+	registered, err := s.registry.RegisterAgent(machineID, token, req.Name, orgID, &database.Inventory{
+		OS:           req.Platform,
+		Architecture: req.Arch,
+	})
+	if errors.Is(err, registry.ErrUnknownOrganization) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		s.logger.Error("Failed to register agent", err)
+		s.log(c).Error("Failed to register agent", "error", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register agent"})
 		return
 	}
+	// The token is only returned now; the registry keeps its hash
+	agent := *registered
+	agent.Token = token
+	s.audit(c, registry.AuditRecord{
+		OrgID: orgID, Action: registry.AuditAgentCreate, TargetType: "agent", TargetID: agent.ID,
+		After: gin.H{"name": agent.Name, "platform": req.Platform, "arch": req.Arch},
+	})
 
 	config := map[string]interface{}{
 		"agent_id":           agent.ID,
 		"machine_id":         agent.MachineID,
 		"token":              agent.Token,
-		"server_url":         "http://localhost:8080",
+		"server_url":         s.agentURL(c),
 		"platform":           req.Platform,
 		"arch":               req.Arch,
 		"log_level":          "info",
@@ -363,22 +1001,61 @@ func (s *Server) generateAgent(c *gin.Context) {
 		"heartbeat_interval": 30,
 	}
 
+	// The download URL takes a POST since every download issues new
+	// credentials
 	c.JSON(http.StatusOK, gin.H{
-		"agent":        agent,
+		"agent":        &agent,
 		"config":       config,
 		"download_url": fmt.Sprintf("/api/v1/agents/%s/download", agent.ID),
 	})
 }
 
+// downloadAgent returns an installer with new credentials. It is a POST so
+// prefetchers, retries and proxies cannot rotate an agent's credentials.
 func (s *Server) downloadAgent(c *gin.Context) {
 	agentID := c.Param("id")
-	agent, err := s.registry.GetAgent(agentID)
+	registered, err := s.registry.GetAgent(agentID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
 		return
 	}
 
-	script := generateAgentScript(agent)
+	// Every download carries a fresh token and client certificate since
+	// neither tokens nor private keys are kept on the server. An installed
+	// agent keeps working with its previous token for the grace window.
+	token, expiresAt, err := s.registry.RotateAgentCredentials(agentID, "")
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Agent is revoked"})
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to rotate agent credentials", "agent_id", agentID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate credentials"})
+		return
+	}
+	agent := *registered
+	agent.Token = token
+
+	var cert *pki.IssuedCertificate
+	if s.ca != nil {
+		cert, err = s.ca.IssueForAgent(agent.ID, nil)
+		if err != nil {
+			s.log(c).Error("Failed to issue agent certificate", "agent_id", agentID, "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to issue certificate"})
+			return
+		}
+	}
+
+	var serial string
+	if cert != nil {
+		serial = cert.Serial
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditAgentDownload, TargetType: "agent", TargetID: agent.ID,
+		After: gin.H{"certificate_serial": serial, "previous_token_expires_at": expiresAt},
+	})
+
+	script := generateAgentScript(&agent, s.agentURL(c), cert)
 	c.Header("Content-Type", "application/x-sh")
 	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=silentrig-agent-%s.sh", agentID))
 	c.String(http.StatusOK, script)
@@ -412,7 +1089,7 @@ func (s *Server) jsonRPCHandler(c *gin.Context) {
 }
 
 func (s *Server) handleAgentList(c *gin.Context, id interface{}) {
-	agents, err := s.registry.ListAgents()
+	agents, err := s.registry.ListAgents(&database.AgentFilter{OrgID: auth.OrgScope(c)})
 	if err != nil {
 		s.sendJSONRPCError(c, id, -32603, "Internal error", "Failed to list agents")
 		return
@@ -444,29 +1121,58 @@ func (s *Server) sendJSONRPCError(c *gin.Context, id interface{}, code int, mess
 func (s *Server) websocketHandler(c *gin.Context) {
 	conn, err := s.upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
-		s.logger.Error("Failed to upgrade connection to WebSocket", err)
+		s.log(c).Error("Failed to upgrade connection to WebSocket", "error", err)
 		return
 	}
 	defer conn.Close()
 
 	connID := fmt.Sprintf("ws_%d", time.Now().UnixNano())
-	s.wsConnections[connID] = conn
+	s.wsMu.Lock()
+	s.wsConnections[connID] = &wsClient{conn: conn, orgID: auth.OrgScope(c)}
+	s.wsMu.Unlock()
 
-	s.logger.Info("WebSocket client connected", "connection_id", connID)
+	s.log(c).Info("WebSocket client connected", "connection_id", connID)
 
 	for {
 		_, message, err := conn.ReadMessage()
 		if err != nil {
-			s.logger.Info("WebSocket client disconnected", "connection_id", connID)
+			s.log(c).Info("WebSocket client disconnected", "connection_id", connID)
 			break
 		}
-		s.logger.Debug("Received WebSocket message", "connection_id", connID, "message", string(message))
+		s.log(c).Debug("Received WebSocket message", "connection_id", connID, "message", string(message))
 	}
 
+	s.wsMu.Lock()
 	delete(s.wsConnections, connID)
+	s.wsMu.Unlock()
 }
 
+// closeWebSockets sends a going-away close frame to every WebSocket client
+// and closes the connections
+func (s *Server) closeWebSockets() {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+
+	frame := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	deadline := time.Now().Add(time.Second)
+	for connID, client := range s.wsConnections {
+		if err := client.conn.WriteControl(websocket.CloseMessage, frame, deadline); err != nil {
+			s.logger.Debug("Failed to send WebSocket close frame", "connection_id", connID, "error", err)
+		}
+		client.conn.Close()
+		delete(s.wsConnections, connID)
+	}
+}
+
+// broadcastMetrics sends an agent's metrics to the WebSocket clients that
+// may see the agent
 func (s *Server) broadcastMetrics(agentID string, metrics *database.Metrics) {
+	agent, err := s.registry.GetAgent(agentID)
+	if err != nil {
+		s.logger.Debug("Not broadcasting metrics of unknown agent", "agent_id", agentID, "error", err)
+		return
+	}
+
 	message := gin.H{
 		"type":      "metrics",
 		"agent_id":  agentID,
@@ -476,18 +1182,30 @@ func (s *Server) broadcastMetrics(agentID string, metrics *database.Metrics) {
 
 	messageBytes, err := json.Marshal(message)
 	if err != nil {
-		s.logger.Error("Failed to marshal metrics message", err)
+		s.logger.Error("Failed to marshal metrics message", "error", err)
 		return
 	}
 
-	for connID, conn := range s.wsConnections {
-		if err := conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
+	s.wsMu.Lock()
+	defer s.wsMu.Unlock()
+	for connID, client := range s.wsConnections {
+		if client.orgID != "" && client.orgID != agent.OrgID {
+			continue
+		}
+		if err := client.conn.WriteMessage(websocket.TextMessage, messageBytes); err != nil {
 			s.logger.Error("Failed to send WebSocket message", "connection_id", connID, "error", err)
 			delete(s.wsConnections, connID)
 		}
 	}
 }
 
+// wsClient is a WebSocket connection and the organization scope of the
+// caller that opened it
+type wsClient struct {
+	conn  *websocket.Conn
+	orgID string
+}
+
 // Helper functions
 func generateRandomString(length int) string {
 	const charset = "abcdefghijklmnopqrstuvwxyz0123456789"
@@ -498,7 +1216,7 @@ func generateRandomString(length int) string {
 	return string(b)
 }
 
-func generateAgentScript(agent *database.Agent) string {
+func generateAgentScript(agent *database.Agent, serverURL string, cert *pki.IssuedCertificate) string {
 	return fmt.Sprintf(`#!/bin/bash
 
 # SilentRig Mining Agent Installer
@@ -512,7 +1230,7 @@ echo "🚀 Installing SilentRig Mining Agent..."
 AGENT_ID="%s"
 MACHINE_ID="%s"
 TOKEN="%s"
-SERVER_URL="http://localhost:8080"
+SERVER_URL="%s"
 
 # Create installation directory
 INSTALL_DIR="/opt/silentrig-agent"
@@ -524,14 +1242,14 @@ echo "📦 Downloading agent binary..."
 # Download the Go agent binary
 curl -L -o silentrig-agent "https://github.com/yourusername/silentrig/releases/latest/download/silentrig-agent-linux-amd64"
 chmod +x silentrig-agent
-
+%s
 # Create configuration file
 cat > config.json << EOF
 {
   "agent_id": "%s",
   "machine_id": "%s",
   "token": "%s",
-  "server_url": "%s",
+  "server_url": "%s",%s
   "xmrig_path": "/usr/local/bin/xmrig",
   "log_level": "info",
   "metrics_interval": 10,
@@ -575,7 +1293,36 @@ echo ""
 echo "📝 Logs:"
 journalctl -u silentrig-agent -f --no-pager
 `, 
-		agent.ID, agent.ID, agent.MachineID, agent.Token, agent.ID, agent.MachineID, agent.Token, "http://localhost:8080")
+		agent.ID, agent.ID, agent.MachineID, agent.Token, serverURL, certificateFiles(cert), agent.ID, agent.MachineID, agent.Token, serverURL, certificateConfig(cert))
+}
+
+// certificateFiles returns the installer step writing the agent's client
+// certificate, key and CA certificate
+func certificateFiles(cert *pki.IssuedCertificate) string {
+	if cert == nil {
+		return ""
+	}
+	return fmt.Sprintf(`
+# Install the client certificate for the agent listener
+umask 077
+cat > client.crt << 'EOF'
+%sEOF
+cat > client.key << 'EOF'
+%sEOF
+cat > ca.crt << 'EOF'
+%sEOF
+umask 022
+`, cert.CertPEM, cert.KeyPEM, cert.CAPEM)
+}
+
+func certificateConfig(cert *pki.IssuedCertificate) string {
+	if cert == nil {
+		return ""
+	}
+	return `
+  "client_cert": "/opt/silentrig-agent/client.crt",
+  "client_key": "/opt/silentrig-agent/client.key",
+  "ca_cert": "/opt/silentrig-agent/ca.crt",`
 }
 
  
\ No newline at end of file
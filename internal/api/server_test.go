@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/lifecycle"
+	"silentrig/internal/logger"
+	"silentrig/internal/registry"
+)
+
+// testServer is an API server on a fresh database, called without a network
+type testServer struct {
+	t        *testing.T
+	server   *Server
+	registry *registry.Registry
+	handler  http.Handler
+}
+
+// newTestServer starts a server with the default configuration, changed by
+// configure if given
+func newTestServer(t *testing.T, configure func(*config.Config)) *testServer {
+	t.Helper()
+	cfg, err := config.Read()
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	cfg.Database.Path = filepath.Join(t.TempDir(), "silentrig.db")
+	cfg.JWT.Secret = "test-secret-of-at-least-thirty-two-bytes"
+	cfg.RateLimit.Enabled = false
+	cfg.Logging = config.LoggingConfig{Level: "error", Format: "json"}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	log, outputs, err := logger.Open(cfg.Logging)
+	if err != nil {
+		t.Fatalf("open logger: %v", err)
+	}
+	t.Cleanup(func() { outputs.Close() })
+	db, err := database.New(cfg.Database.Path, log)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	reg := registry.New(db, log, cfg.Liveness)
+	reg.SetCloneWindow(cfg.Enrollment.CloneWindow)
+	reg.SetDecommission(cfg.Decommission)
+	server, err := New(config.NewStore(cfg), reg, log, lifecycle.New(log), nil)
+	if err != nil {
+		t.Fatalf("create server: %v", err)
+	}
+	return &testServer{t: t, server: server, registry: reg, handler: server.listeners[0].server.Handler}
+}
+
+// do sends a request with an authorization header, if given, and a JSON
+// body, if not nil
+func (ts *testServer) do(method, path, authorization string, body interface{}) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	return ts.doFrom("", method, path, authorization, body)
+}
+
+// doFrom sends a request like do from the given client address, or from
+// httptest's default one if empty
+func (ts *testServer) doFrom(remoteAddr, method, path, authorization string, body interface{}) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			ts.t.Fatalf("encode body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &payload)
+	req.Header.Set("Content-Type", "application/json")
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	ts.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// login creates a user and returns the authorization header of a session
+func (ts *testServer) login(username, role, orgID string) string {
+	ts.t.Helper()
+	if _, err := ts.registry.CreateUser(username, "password123", role, orgID); err != nil {
+		ts.t.Fatalf("create user %s: %v", username, err)
+	}
+	rec := ts.do(http.MethodPost, "/api/v1/auth/login", "", map[string]string{"username": username, "password": "password123"})
+	if rec.Code != http.StatusOK {
+		ts.t.Fatalf("login %s: %d %s", username, rec.Code, rec.Body)
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		ts.t.Fatalf("decode login response: %v", err)
+	}
+	return "Bearer " + resp.Token
+}
+
+// createOrganization creates an organization
+func (ts *testServer) createOrganization(id string) {
+	ts.t.Helper()
+	if _, err := ts.registry.CreateOrganization(id, id); err != nil {
+		ts.t.Fatalf("create organization %s: %v", id, err)
+	}
+}
+
+// registerAgent registers an agent of an organization and returns it
+func (ts *testServer) registerAgent(machineID, orgID string) *database.Agent {
+	ts.t.Helper()
+	agent, err := ts.registry.RegisterAgent(machineID, "token-"+machineID, machineID, orgID, nil)
+	if err != nil {
+		ts.t.Fatalf("register agent %s: %v", machineID, err)
+	}
+	return agent
+}
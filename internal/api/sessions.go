@@ -0,0 +1,150 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// startSession starts a session for a user who completed the login with
+// the given method and responds with its tokens and any extra fields
+func (s *Server) startSession(c *gin.Context, user *database.User, method string, extra gin.H) {
+	jwtConfig := s.config.Current().JWT
+	refreshToken, session, err := s.registry.CreateSession(user.Username, c.ClientIP(), c.Request.UserAgent(), jwtConfig.RefreshExpiration, jwtConfig.SessionMaxAge)
+	if err != nil {
+		s.log(c).Error("Failed to create session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{Actor: user.Username, OrgID: user.OrgID, Action: registry.AuditLogin, TargetType: "user", TargetID: user.Username, After: gin.H{"method": method}})
+
+	s.respondWithTokens(c, user, session, refreshToken, extra)
+}
+
+// respondWithTokens issues an access token for a session and sends it with
+// the session's refresh token and any extra fields
+func (s *Server) respondWithTokens(c *gin.Context, user *database.User, session *database.Session, refreshToken string, extra gin.H) {
+	token, claims, err := s.auth.GenerateToken(user.Username, user.Role, user.OrgID, session.ID, s.config.Current().JWT.Expiration)
+	if err != nil {
+		s.log(c).Error("Failed to generate token", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	response := gin.H{
+		"token":              token,
+		"token_type":         "Bearer",
+		"expires_at":         claims.ExpiresAt.Time,
+		"refresh_token":      refreshToken,
+		"refresh_expires_at": session.ExpiresAt,
+		"user":               gin.H{"username": user.Username, "role": user.Role, "org_id": user.OrgID},
+	}
+	for k, v := range extra {
+		response[k] = v
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// refresh exchanges a refresh token for a new access token and refresh
+// token. Each refresh token can only be used once.
+func (s *Server) refresh(c *gin.Context) {
+	var req struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	jwtConfig := s.config.Current().JWT
+	refreshToken, session, err := s.registry.RefreshSession(req.RefreshToken, jwtConfig.RefreshExpiration, jwtConfig.SessionMaxAge)
+	switch {
+	case errors.Is(err, database.ErrRefreshTokenReused):
+		s.audit(c, registry.AuditRecord{Actor: session.Username, Action: registry.AuditRefresh, TargetType: "session", TargetID: session.ID, Err: err})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	case errors.Is(err, database.ErrRefreshTokenInvalid):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to refresh session", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	// The role may have changed since login, and the user may be gone
+	user, err := s.registry.GetUser(session.Username)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to get user", "username", session.Username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh session"})
+		return
+	}
+
+	s.respondWithTokens(c, user, session, refreshToken, nil)
+}
+
+// logout revokes the access token of the request and ends its session
+func (s *Server) logout(c *gin.Context) {
+	claims, ok := auth.GetClaimsFromContext(c)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "API keys have no session; revoke the key instead"})
+		return
+	}
+	if err := s.registry.EndSession(claims.SessionID, claims.ID, claims.ExpiresAt.Time); err != nil {
+		s.log(c).Error("Failed to end session", "session_id", claims.SessionID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to log out"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{Action: registry.AuditLogout, TargetType: "session", TargetID: claims.SessionID})
+
+	c.JSON(http.StatusOK, gin.H{"status": "logged_out"})
+}
+
+func (s *Server) listUserSessions(c *gin.Context) {
+	username := c.Param("username")
+	if _, ok := s.requireManagedUser(c, username); !ok {
+		return
+	}
+
+	sessions, err := s.registry.ListSessions(username)
+	if err != nil {
+		s.log(c).Error("Failed to list sessions", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+	if sessions == nil {
+		sessions = []*database.Session{}
+	}
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// revokeUserSessions ends every session of a user. Their access tokens are
+// rejected from the next request on.
+func (s *Server) revokeUserSessions(c *gin.Context) {
+	username := c.Param("username")
+	if _, ok := s.requireManagedUser(c, username); !ok {
+		return
+	}
+
+	n, err := s.registry.RevokeUserSessions(username)
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditSessionsRevoke, TargetType: "user", TargetID: username,
+		After: gin.H{"revoked": n}, Err: err,
+	})
+	if err != nil {
+		s.log(c).Error("Failed to revoke sessions", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": n})
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/registry"
+)
+
+// requireAgentCertificate only lets an agent act on its own ID, as named in
+// its client certificate, and rejects certificates revoked since the
+// connection was established
+func (s *Server) requireAgentCertificate() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Client certificate required"})
+			return
+		}
+		cert := c.Request.TLS.PeerCertificates[0]
+		if err := s.ca.CheckCertificate(cert); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Client certificate revoked"})
+			return
+		}
+		if cert.Subject.CommonName != c.Param("id") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Client certificate does not match agent"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// agentExists responds with 404 for unknown agents and 500 when the lookup
+// fails, and reports whether the handler may go on
+func (s *Server) agentExists(c *gin.Context, agentID string) bool {
+	_, err := s.registry.GetAgent(agentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Agent not found"})
+		return false
+	}
+	if err != nil {
+		s.log(c).Error("Failed to get agent", "agent_id", agentID, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get agent"})
+		return false
+	}
+	return true
+}
+
+func (s *Server) listAgentCertificates(c *gin.Context) {
+	agentID := c.Param("id")
+	if !s.agentExists(c, agentID) {
+		return
+	}
+
+	certs, err := s.registry.ListAgentCertificates(agentID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get certificates"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"certificates": certs})
+}
+
+func (s *Server) issueAgentCertificate(c *gin.Context) {
+	if s.ca == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Certificate authority is disabled"})
+		return
+	}
+	agentID := c.Param("id")
+	if !s.agentExists(c, agentID) {
+		return
+	}
+
+	// The body is optional; without a CSR a key is generated
+	var req struct {
+		CSR string `json:"csr"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+	}
+
+	cert, err := s.ca.IssueForAgent(agentID, []byte(req.CSR))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditCertificateIssue, TargetType: "agent", TargetID: agentID,
+		After: gin.H{"serial": cert.Serial, "not_after": cert.NotAfter, "csr": req.CSR != ""},
+	})
+	c.JSON(http.StatusOK, cert)
+}
+
+func (s *Server) revokeAgentCertificates(c *gin.Context) {
+	agentID := c.Param("id")
+	if !s.agentExists(c, agentID) {
+		return
+	}
+
+	n, err := s.registry.RevokeAgentCertificates(agentID)
+	s.audit(c, registry.AuditRecord{
+		Action: registry.AuditCertificateRevoke, TargetType: "agent", TargetID: agentID,
+		After: gin.H{"revoked": n}, Err: err,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke certificates"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": n})
+}
@@ -0,0 +1,310 @@
+package api
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// loginSecondFactor completes a password login with a TOTP or recovery
+// code. Users whose role requires a second factor but who have none yet
+// confirm the secret from loginEnrollTOTP instead and receive their
+// recovery codes.
+func (s *Server) loginSecondFactor(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+		Code     string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, status, ok := s.mfaChallengeUser(c, req.MFAToken)
+	if !ok || s.loginLockedOut(c, user.Username) {
+		return
+	}
+
+	var (
+		method        string
+		recoveryCodes []string
+		err           error
+	)
+	if status.Enabled {
+		method, err = s.registry.VerifySecondFactor(user.Username, req.Code)
+	} else {
+		method = "totp"
+		recoveryCodes, err = s.registry.ConfirmTOTP(user.Username, req.Code)
+	}
+	switch {
+	case errors.Is(err, registry.ErrMFANotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set up two-factor authentication at /api/v1/auth/login/2fa/enroll first"})
+		return
+	case errors.Is(err, registry.ErrMFACodeInvalid):
+		s.loginFailed(c, user.Username)
+		s.audit(c, registry.AuditRecord{Actor: user.Username, Action: registry.AuditLogin, TargetType: "user", TargetID: user.Username, Err: err})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to verify second factor", "username", user.Username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return
+	}
+	if err := s.registry.CompleteMFAChallenge(req.MFAToken); err != nil {
+		s.log(c).Warn("Failed to delete two-factor challenge", "error", err)
+	}
+
+	extra := gin.H{}
+	if recoveryCodes != nil {
+		s.audit(c, registry.AuditRecord{Actor: user.Username, Action: registry.AuditTwoFactorEnable, TargetType: "user", TargetID: user.Username})
+		extra["recovery_codes"] = recoveryCodes
+	}
+	if method == "recovery_code" {
+		remaining, err := s.registry.TwoFactorStatus(user.Username)
+		if err == nil {
+			extra["recovery_codes_remaining"] = remaining.RecoveryCodesRemaining
+		}
+	}
+	s.loginSucceeded(c, user.Username)
+	s.startSession(c, user, "password+"+method, extra)
+}
+
+// loginEnrollTOTP generates the TOTP secret of a user whose role requires a
+// second factor during their first login with that requirement
+func (s *Server) loginEnrollTOTP(c *gin.Context) {
+	var req struct {
+		MFAToken string `json:"mfa_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	user, status, ok := s.mfaChallengeUser(c, req.MFAToken)
+	if !ok {
+		return
+	}
+	if status.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	}
+	s.enrollTOTP(c, user.Username)
+}
+
+// mfaChallengeUser counts an attempt at a two-factor login and returns its
+// user. It responds with an error and returns false if the challenge is no
+// longer valid.
+func (s *Server) mfaChallengeUser(c *gin.Context, token string) (*database.User, *registry.TwoFactorStatus, bool) {
+	username, err := s.registry.AttemptMFAChallenge(token)
+	if errors.Is(err, database.ErrMFAChallengeInvalid) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login expired or too many attempts, sign in again"})
+		return nil, nil, false
+	}
+	if err != nil {
+		s.log(c).Error("Failed to check two-factor challenge", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return nil, nil, false
+	}
+
+	user, err := s.registry.GetUser(username)
+	if err != nil {
+		s.log(c).Error("Failed to get user", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return nil, nil, false
+	}
+	status, err := s.registry.TwoFactorStatus(username)
+	if err != nil {
+		s.log(c).Error("Failed to get two-factor status", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate"})
+		return nil, nil, false
+	}
+	return user, status, true
+}
+
+// enrollTOTP generates a TOTP secret and responds with it and its
+// provisioning URI for QR codes
+func (s *Server) enrollTOTP(c *gin.Context, username string) {
+	secret, uri, err := s.registry.BeginTOTPEnrollment(username, s.config.Current().TwoFactor.Issuer)
+	if errors.Is(err, registry.ErrMFAEnabled) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	}
+	if err != nil {
+		s.log(c).Error("Failed to start TOTP enrollment", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"secret": secret, "provisioning_uri": uri})
+}
+
+// sessionUser returns the user of a request authenticated with a session
+// token. Requests with API keys get 400, as the second factor belongs to
+// interactive logins.
+func (s *Server) sessionUser(c *gin.Context) (string, bool) {
+	if _, ok := auth.GetClaimsFromContext(c); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is managed from a login session"})
+		return "", false
+	}
+	username, _ := auth.GetUserIDFromContext(c)
+	return username, true
+}
+
+// getTwoFactor returns the caller's two-factor status
+func (s *Server) getTwoFactor(c *gin.Context) {
+	username, ok := s.sessionUser(c)
+	if !ok {
+		return
+	}
+	status, err := s.registry.TwoFactorStatus(username)
+	if err != nil {
+		s.log(c).Error("Failed to get two-factor status", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get two-factor status"})
+		return
+	}
+	role, _ := auth.GetRoleFromContext(c)
+	c.JSON(http.StatusOK, gin.H{
+		"enabled":                  status.Enabled,
+		"pending":                  status.Pending,
+		"enabled_at":               status.EnabledAt,
+		"recovery_codes_remaining": status.RecoveryCodesRemaining,
+		"required":                 s.config.Current().TwoFactor.Requires(role),
+	})
+}
+
+// enrollTwoFactor starts setting up TOTP for the caller
+func (s *Server) enrollTwoFactor(c *gin.Context) {
+	username, ok := s.sessionUser(c)
+	if !ok {
+		return
+	}
+	s.enrollTOTP(c, username)
+}
+
+// confirmTwoFactor enables the caller's pending TOTP secret with a first
+// code and returns their recovery codes
+func (s *Server) confirmTwoFactor(c *gin.Context) {
+	username, ok := s.sessionUser(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return
+	}
+
+	codes, err := s.registry.ConfirmTOTP(username, req.Code)
+	switch {
+	case errors.Is(err, registry.ErrMFAEnabled):
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already set up"})
+		return
+	case errors.Is(err, registry.ErrMFANotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start the enrollment first"})
+		return
+	case errors.Is(err, registry.ErrMFACodeInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return
+	case err != nil:
+		s.log(c).Error("Failed to confirm TOTP", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set up two-factor authentication"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{Action: registry.AuditTwoFactorEnable, TargetType: "user", TargetID: username})
+	c.JSON(http.StatusOK, gin.H{"status": "enabled", "recovery_codes": codes})
+}
+
+// verifyCallerCode checks a code of the caller before a change to their
+// second factor. It responds with an error and returns false if the code
+// is wrong.
+func (s *Server) verifyCallerCode(c *gin.Context, username string) bool {
+	var req struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return false
+	}
+	_, err := s.registry.VerifySecondFactor(username, req.Code)
+	switch {
+	case errors.Is(err, registry.ErrMFANotEnabled):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Two-factor authentication is not set up"})
+		return false
+	case errors.Is(err, registry.ErrMFACodeInvalid):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid code"})
+		return false
+	case err != nil:
+		s.log(c).Error("Failed to verify second factor", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return false
+	}
+	return true
+}
+
+// regenerateRecoveryCodes replaces the caller's recovery codes
+func (s *Server) regenerateRecoveryCodes(c *gin.Context) {
+	username, ok := s.sessionUser(c)
+	if !ok || !s.verifyCallerCode(c, username) {
+		return
+	}
+	codes, err := s.registry.RegenerateRecoveryCodes(username)
+	s.audit(c, registry.AuditRecord{Action: registry.AuditRecoveryCodes, TargetType: "user", TargetID: username, Err: err})
+	if err != nil {
+		s.log(c).Error("Failed to regenerate recovery codes", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to regenerate recovery codes"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+}
+
+// disableTwoFactor removes the caller's second factor unless their role
+// requires one
+func (s *Server) disableTwoFactor(c *gin.Context) {
+	username, ok := s.sessionUser(c)
+	if !ok {
+		return
+	}
+	if role, _ := auth.GetRoleFromContext(c); s.config.Current().TwoFactor.Requires(role) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Two-factor authentication is required for your role"})
+		return
+	}
+	if !s.verifyCallerCode(c, username) {
+		return
+	}
+	_, err := s.registry.DisableTwoFactor(username)
+	s.audit(c, registry.AuditRecord{Action: registry.AuditTwoFactorDisable, TargetType: "user", TargetID: username, Err: err})
+	if err != nil {
+		s.log(c).Error("Failed to disable two-factor authentication", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "disabled"})
+}
+
+// resetUserTwoFactor removes the second factor of a user who lost it and
+// ends their sessions
+func (s *Server) resetUserTwoFactor(c *gin.Context) {
+	username := c.Param("username")
+	if _, ok := s.requireManagedUser(c, username); !ok {
+		return
+	}
+	err := s.registry.ResetTwoFactor(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	s.audit(c, registry.AuditRecord{Action: registry.AuditTwoFactorReset, TargetType: "user", TargetID: username, Err: err})
+	if err != nil {
+		s.log(c).Error("Failed to reset two-factor authentication", "username", username, "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset two-factor authentication"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reset"})
+}
@@ -4,45 +4,157 @@ import (
 	"errors"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+
+	"silentrig/internal/database"
+	"silentrig/internal/logger"
 )
 
+// Claims of an access token. The registered ID claim (jti) identifies the
+// token for revocation.
 type Claims struct {
 	UserID string `json:"user_id"`
 	Role   string `json:"role"`
+	// OrgID is the organization of the user, which limits what the token
+	// can access unless the role is super admin
+	OrgID string `json:"org"`
+	// SessionID is the login session the token was issued for
+	SessionID string `json:"sid"`
 	jwt.RegisteredClaims
 }
 
+// RevocationCheck reports whether a validly signed token has been revoked
+type RevocationCheck func(claims *Claims) (bool, error)
+
+// APIKeyIdentity is the account an API key acts for and what it may do
+type APIKeyIdentity struct {
+	KeyID  int64
+	UserID string
+	Role   string
+	OrgID  string
+	Scopes []string
+}
+
+// APIKeyCheck looks up an API key presented from a client address. It
+// returns database.ErrAPIKeyInvalid or ErrAPIKeyAddress for keys that must
+// be rejected, the latter together with the identity.
+type APIKeyCheck func(key, clientIP string) (*APIKeyIdentity, error)
+
+// ErrAPIKeyAddress is returned for API keys used from an address outside
+// their allow-list
+var ErrAPIKeyAddress = errors.New("API key not allowed from this address")
+
 type Auth struct {
-	secret string
+	secret  string
+	logger  logger.Logger
+	revoked RevocationCheck
+	apiKeys APIKeyCheck
+
+	// keys replaces the secret when tokens are signed with key pairs
+	keys atomic.Pointer[keyRing]
+}
+
+// keyRing holds the key new tokens are signed with and every key that
+// still verifies tokens, newest first
+type keyRing struct {
+	current *SigningKey
+	keys    []*SigningKey
+	byID    map[string]*SigningKey
+}
+
+func New(secret string, log logger.Logger) *Auth {
+	return &Auth{secret: secret, logger: log}
+}
+
+// SetRevocationCheck sets the check the middlewares run on every token. It
+// must be called before requests are served.
+func (a *Auth) SetRevocationCheck(check RevocationCheck) {
+	a.revoked = check
+}
+
+// SetAPIKeyCheck enables "Authorization: ApiKey <key>" authentication. It
+// must be called before requests are served.
+func (a *Auth) SetAPIKeyCheck(check APIKeyCheck) {
+	a.apiKeys = check
 }
 
-func New(secret string) *Auth {
-	return &Auth{secret: secret}
+// setKeys switches to signing with current. Tokens are accepted if they
+// were signed by any of keys, which must include current.
+func (a *Auth) setKeys(current *SigningKey, keys []*SigningKey) {
+	ring := &keyRing{current: current, keys: keys, byID: make(map[string]*SigningKey, len(keys))}
+	for _, k := range keys {
+		ring.byID[k.ID] = k
+	}
+	a.keys.Store(ring)
+}
+
+// JWKS returns the public keys that verify tokens, for other services. It
+// is empty when tokens are signed with the HMAC secret.
+func (a *Auth) JWKS() []JWK {
+	jwks := []JWK{}
+	if ring := a.keys.Load(); ring != nil {
+		for _, k := range ring.keys {
+			jwks = append(jwks, k.JWK())
+		}
+	}
+	return jwks
 }
 
-// GenerateToken generates a new JWT token
-func (a *Auth) GenerateToken(userID, role string, expiration time.Duration) (string, error) {
-	claims := Claims{
-		UserID: userID,
-		Role:   role,
+// GenerateToken generates a new access token for a session and returns it
+// with its claims
+func (a *Auth) GenerateToken(userID, role, orgID, sessionID string, expiration time.Duration) (string, *Claims, error) {
+	now := time.Now()
+	claims := &Claims{
+		UserID:    userID,
+		Role:      role,
+		OrgID:     orgID,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiration)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        uuid.NewString(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiration)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(a.secret))
+	var (
+		signed string
+		err    error
+	)
+	if ring := a.keys.Load(); ring != nil {
+		token := jwt.NewWithClaims(ring.current.method(), claims)
+		token.Header["kid"] = ring.current.ID
+		signed, err = token.SignedString(ring.current.Private)
+	} else {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		signed, err = token.SignedString([]byte(a.secret))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return signed, claims, nil
 }
 
 // ValidateToken validates a JWT token and returns the claims
 func (a *Auth) ValidateToken(tokenString string) (*Claims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
+		// With key pairs, HMAC tokens are never accepted
+		if ring := a.keys.Load(); ring != nil {
+			kid, _ := token.Header["kid"].(string)
+			key, ok := ring.byID[kid]
+			if !ok {
+				return nil, errors.New("unknown signing key")
+			}
+			if token.Method != key.method() {
+				return nil, errors.New("unexpected signing method")
+			}
+			return key.Private.Public(), nil
+		}
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, errors.New("unexpected signing method")
 		}
@@ -54,12 +166,28 @@ func (a *Auth) ValidateToken(tokenString string) (*Claims, error) {
 	}
 
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+		// Tokens without an ID or session cannot be revoked
+		if claims.ID == "" || claims.SessionID == "" {
+			return nil, errors.New("token has no session")
+		}
+		// Tokens issued before organizations existed cannot be scoped
+		if claims.OrgID == "" {
+			return nil, errors.New("token has no organization")
+		}
 		return claims, nil
 	}
 
 	return nil, errors.New("invalid token")
 }
 
+// isRevoked runs the revocation check, if any
+func (a *Auth) isRevoked(claims *Claims) (bool, error) {
+	if a.revoked == nil {
+		return false, nil
+	}
+	return a.revoked(claims)
+}
+
 // AuthMiddleware is a Gin middleware for JWT authentication
 func (a *Auth) AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -70,6 +198,11 @@ func (a *Auth) AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		if key, ok := strings.CutPrefix(authHeader, "ApiKey "); ok && a.apiKeys != nil {
+			a.authenticateAPIKey(c, key)
+			return
+		}
+
 		// Check if the header starts with "Bearer "
 		if !strings.HasPrefix(authHeader, "Bearer ") {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header format"})
@@ -83,51 +216,86 @@ func (a *Auth) AuthMiddleware() gin.HandlerFunc {
 		// Validate the token
 		claims, err := a.ValidateToken(tokenString)
 		if err != nil {
+			a.logger.Debug("Rejected token", "path", c.FullPath(), "error", err)
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
+		// Reject tokens revoked at logout or with their session
+		revoked, err := a.isRevoked(claims)
+		if err != nil {
+			a.logger.Error("Failed to check token revocation", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate token"})
+			c.Abort()
+			return
+		}
+		if revoked {
+			a.logger.Debug("Rejected revoked token", "path", c.FullPath(), "user_id", claims.UserID, "session_id", claims.SessionID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token revoked"})
+			c.Abort()
+			return
+		}
+
 		// Set user information in context
 		c.Set("user_id", claims.UserID)
 		c.Set("role", claims.Role)
+		c.Set("org_id", claims.OrgID)
+		c.Set("scopes", RoleScopes(claims.Role))
 		c.Set("claims", claims)
 
 		c.Next()
 	}
 }
 
-// OptionalAuthMiddleware is a Gin middleware for optional JWT authentication
-func (a *Auth) OptionalAuthMiddleware() gin.HandlerFunc {
+// WebSocketAuthMiddleware authenticates like AuthMiddleware, additionally
+// accepting the access token in the access_token query parameter since
+// browsers cannot set headers on WebSocket connections
+func (a *Auth) WebSocketAuthMiddleware() gin.HandlerFunc {
+	authenticate := a.AuthMiddleware()
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.Next()
-			return
-		}
-
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			c.Next()
-			return
+		if token := c.Query("access_token"); token != "" && c.GetHeader("Authorization") == "" {
+			c.Request.Header.Set("Authorization", "Bearer "+token)
 		}
+		authenticate(c)
+	}
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-		claims, err := a.ValidateToken(tokenString)
-		if err != nil {
-			c.Next()
-			return
-		}
+// authenticateAPIKey authenticates a request with an API key
+func (a *Auth) authenticateAPIKey(c *gin.Context, key string) {
+	identity, err := a.apiKeys(key, c.ClientIP())
+	switch {
+	case errors.Is(err, database.ErrAPIKeyInvalid):
+		a.logger.Debug("Rejected API key", "path", c.FullPath(), "error", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	case errors.Is(err, ErrAPIKeyAddress):
+		a.logger.Warn("API key used from a disallowed address", "path", c.FullPath(), "client_ip", c.ClientIP(), "api_key_id", identity.KeyID)
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key not allowed from this address"})
+		c.Abort()
+		return
+	case err != nil:
+		a.logger.Error("Failed to check API key", "error", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to validate API key"})
+		c.Abort()
+		return
+	}
 
-		c.Set("user_id", claims.UserID)
-		c.Set("role", claims.Role)
-		c.Set("claims", claims)
+	setAPIKeyIdentity(c, identity)
+	c.Next()
+}
 
-		c.Next()
-	}
+func setAPIKeyIdentity(c *gin.Context, identity *APIKeyIdentity) {
+	c.Set("user_id", identity.UserID)
+	c.Set("role", identity.Role)
+	c.Set("org_id", identity.OrgID)
+	c.Set("scopes", identity.Scopes)
+	c.Set("api_key_id", identity.KeyID)
 }
 
-// RequireRole middleware checks if the user has the required role
+// RequireRole middleware checks if the user has the required role. Super
+// admins pass every role check.
 func (a *Auth) RequireRole(requiredRole string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		role, exists := c.Get("role")
@@ -137,7 +305,7 @@ func (a *Auth) RequireRole(requiredRole string) gin.HandlerFunc {
 			return
 		}
 
-		if role != requiredRole {
+		if role != requiredRole && role != RoleSuperAdmin {
 			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
 			c.Abort()
 			return
@@ -156,6 +324,51 @@ func GetUserIDFromContext(c *gin.Context) (string, bool) {
 	return userID.(string), true
 }
 
+// GetOrgIDFromContext returns the organization of the authenticated user
+func GetOrgIDFromContext(c *gin.Context) (string, bool) {
+	orgID, exists := c.Get("org_id")
+	if !exists {
+		return "", false
+	}
+	return orgID.(string), true
+}
+
+// noOrg matches no organization. OrgScope returns it for requests without
+// an organization so a missing authentication fails closed.
+const noOrg = "\x00"
+
+// OrgScope returns the organization a request is limited to, or "" for
+// super admins, who act across organizations
+func OrgScope(c *gin.Context) string {
+	if role, _ := GetRoleFromContext(c); role == RoleSuperAdmin {
+		return ""
+	}
+	if orgID, ok := GetOrgIDFromContext(c); ok && orgID != "" {
+		return orgID
+	}
+	return noOrg
+}
+
+// GetClaimsFromContext returns the claims of the token a request was
+// authenticated with
+func GetClaimsFromContext(c *gin.Context) (*Claims, bool) {
+	claims, exists := c.Get("claims")
+	if !exists {
+		return nil, false
+	}
+	return claims.(*Claims), true
+}
+
+// GetAPIKeyIDFromContext returns the ID of the API key a request was
+// authenticated with
+func GetAPIKeyIDFromContext(c *gin.Context) (int64, bool) {
+	id, exists := c.Get("api_key_id")
+	if !exists {
+		return 0, false
+	}
+	return id.(int64), true
+}
+
 // GetRoleFromContext extracts role from Gin context
 func GetRoleFromContext(c *gin.Context) (string, bool) {
 	role, exists := c.Get("role")
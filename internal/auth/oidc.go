@@ -0,0 +1,394 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"silentrig/internal/config"
+	"silentrig/internal/logger"
+)
+
+const (
+	// oidcTimeout bounds every request to the provider
+	oidcTimeout = 10 * time.Second
+	// oidcJWKSMinRefresh limits how often the provider's keys are fetched
+	// again for an unknown key ID
+	oidcJWKSMinRefresh = time.Minute
+	// oidcLeeway tolerates clock skew between us and the provider
+	oidcLeeway = time.Minute
+	// oidcMaxResponse caps the size of provider responses
+	oidcMaxResponse = 1 << 20
+)
+
+// oidcSigningMethods are the ID token algorithms accepted from providers
+var oidcSigningMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+// ErrOIDCProvider is wrapped by errors caused by the provider, such as an
+// unreachable discovery document or a rejected code
+var ErrOIDCProvider = errors.New("OIDC provider error")
+
+// OIDCIdentity is a user authenticated by the OpenID Connect provider
+type OIDCIdentity struct {
+	Issuer string
+	// Subject identifies the user at the provider; it is unique within
+	// the issuer
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// OIDCAuthRequest holds the secrets of a login in progress, kept by the
+// server until the provider redirects back
+type OIDCAuthRequest struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	// URL sends the user to the provider
+	URL string
+}
+
+// oidcDiscovery is the part of the provider configuration we use
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCProvider runs the authorization code flow with PKCE against an
+// OpenID Connect provider. The provider configuration is discovered on
+// first use, so the server starts while the provider is unreachable.
+type OIDCProvider struct {
+	cfg    config.OIDCConfig
+	client *http.Client
+	logger logger.Logger
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// NewOIDCProvider creates a provider client for the issuer, client and
+// redirect URL of cfg. Claim and role settings are passed per login so
+// they can be reloaded.
+func NewOIDCProvider(cfg config.OIDCConfig, log logger.Logger) *OIDCProvider {
+	return &OIDCProvider{cfg: cfg, client: &http.Client{Timeout: oidcTimeout}, logger: log}
+}
+
+// AuthCodeURL starts a login. The returned request must be kept until the
+// provider redirects back with its state.
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context) (*OIDCAuthRequest, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req := &OIDCAuthRequest{}
+	for _, v := range []*string{&req.State, &req.Nonce, &req.CodeVerifier} {
+		if *v, err = randomString(32); err != nil {
+			return nil, err
+		}
+	}
+
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	req.URL = d.AuthorizationEndpoint + sep + query.Encode()
+	return req, nil
+}
+
+// Exchange redeems an authorization code for tokens, verifies the ID token
+// against the nonce of the login and returns the user it identifies.
+// usernameClaim and groupsClaim name the claims read from the ID token or,
+// if missing there, from the userinfo endpoint.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, codeVerifier, nonce, usernameClaim, groupsClaim string) (*OIDCIdentity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"code_verifier": {codeVerifier},
+		"client_id":     {p.cfg.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		AccessToken      string `json:"access_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	status, err := p.do(req, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK || tokens.Error != "" {
+		return nil, fmt.Errorf("%w: token endpoint returned %d: %s", ErrOIDCProvider, status, strings.TrimSpace(tokens.Error+" "+tokens.ErrorDescription))
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no ID token in token response", ErrOIDCProvider)
+	}
+
+	claims, err := p.verifyIDToken(ctx, tokens.IDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// Providers often leave groups and profile claims to the userinfo
+	// endpoint
+	if (claims[usernameClaim] == nil || (groupsClaim != "" && claims[groupsClaim] == nil)) &&
+		d.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		info, err := p.userinfo(ctx, d.UserinfoEndpoint, tokens.AccessToken)
+		if err != nil {
+			p.logger.Warn("Failed to fetch OIDC userinfo", "error", err)
+		} else if info["sub"] == claims["sub"] {
+			for k, v := range info {
+				if claims[k] == nil {
+					claims[k] = v
+				}
+			}
+		}
+	}
+
+	identity := &OIDCIdentity{Issuer: d.Issuer}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Username, _ = claims[usernameClaim].(string)
+	if identity.Username == "" {
+		identity.Username = identity.Email
+	}
+	if identity.Subject == "" || identity.Username == "" {
+		return nil, fmt.Errorf("ID token has no sub or %s claim", usernameClaim)
+	}
+	switch groups := claims[groupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, s)
+			}
+		}
+	}
+	return identity, nil
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime and nonce
+// of an ID token and returns its claims
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, idToken, nonce string) (jwt.MapClaims, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	},
+		jwt.WithValidMethods(oidcSigningMethods),
+		jwt.WithIssuer(d.Issuer),
+		jwt.WithAudience(p.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(oidcLeeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if got, _ := claims["nonce"].(string); got != nonce {
+		return nil, errors.New("invalid ID token: nonce mismatch")
+	}
+	// With several audiences the token must have been issued to us
+	if aud, _ := claims.GetAudience(); len(aud) > 1 {
+		if azp, _ := claims["azp"].(string); azp != p.cfg.ClientID {
+			return nil, errors.New("invalid ID token: authorized party mismatch")
+		}
+	}
+	return claims, nil
+}
+
+// key returns the provider's public key with the given ID, fetching the key
+// set again when the ID is unknown
+func (p *OIDCProvider) key(ctx context.Context, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	find := func() (interface{}, bool) {
+		if kid == "" && len(p.keys) == 1 {
+			for _, k := range p.keys {
+				return k, true
+			}
+		}
+		k, ok := p.keys[kid]
+		return k, ok
+	}
+	if k, ok := find(); ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < oidcJWKSMinRefresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	status, err := p.do(req, &set)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: JWKS returned %d", ErrOIDCProvider, status)
+	}
+	p.keysFetched = time.Now()
+	p.keys = make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			p.logger.Debug("Skipping OIDC provider key", "kid", jwk.KeyID, "error", err)
+			continue
+		}
+		p.keys[jwk.KeyID] = pub
+	}
+	if k, ok := find(); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// discover fetches the provider configuration once
+func (p *OIDCProvider) discover(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	issuer := strings.TrimSuffix(p.cfg.Issuer, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	d := &oidcDiscovery{}
+	status, err := p.do(req, d)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: discovery returned %d", ErrOIDCProvider, status)
+	}
+	// The issuer in tokens must match the configured one (OpenID Connect
+	// Discovery 1.0, section 4.3)
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("%w: discovered issuer %q does not match %q", ErrOIDCProvider, d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: discovery document lacks endpoints", ErrOIDCProvider)
+	}
+	p.discovery = d
+	p.logger.Info("OIDC provider discovered", "issuer", d.Issuer)
+	return d, nil
+}
+
+// userinfo fetches the claims of the userinfo endpoint
+func (p *OIDCProvider) userinfo(ctx context.Context, endpoint, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	info := map[string]interface{}{}
+	status, err := p.do(req, &info)
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("%w: userinfo returned %d", ErrOIDCProvider, status)
+	}
+	return info, nil
+}
+
+// do sends a request to the provider and decodes its JSON response
+func (p *OIDCProvider) do(req *http.Request, v interface{}) (int, error) {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrOIDCProvider, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oidcMaxResponse))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrOIDCProvider, err)
+	}
+	if err := json.Unmarshal(body, v); err != nil && resp.StatusCode == http.StatusOK {
+		return 0, fmt.Errorf("%w: decoding %s: %v", ErrOIDCProvider, req.URL.Path, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// randomString returns n random bytes, base64url encoded
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// RoleForGroups returns the most privileged role mapped to any of groups,
+// or defaultRole if none is. mapping maps roles to the groups granting them.
+func RoleForGroups(groups []string, mapping map[string][]string, defaultRole string) string {
+	for _, role := range []string{RoleSuperAdmin, RoleAdmin, RoleOperator, RoleViewer} {
+		for _, granting := range mapping[role] {
+			for _, g := range groups {
+				if g == granting {
+					return role
+				}
+			}
+		}
+	}
+	return defaultRole
+}
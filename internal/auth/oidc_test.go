@@ -0,0 +1,34 @@
+package auth
+
+import "testing"
+
+func TestRoleForGroups(t *testing.T) {
+	mapping := map[string][]string{
+		RoleSuperAdmin: {"platform"},
+		RoleAdmin:      {"rig-admins"},
+		RoleOperator:   {"rig-operators", "night-shift"},
+		RoleViewer:     {"rig-viewers"},
+	}
+	tests := []struct {
+		name        string
+		groups      []string
+		defaultRole string
+		want        string
+	}{
+		{"single group", []string{"rig-operators"}, "", RoleOperator},
+		{"any group of a role", []string{"night-shift"}, "", RoleOperator},
+		{"most privileged role wins", []string{"rig-viewers", "rig-admins", "rig-operators"}, "", RoleAdmin},
+		{"super admin", []string{"rig-viewers", "platform"}, "", RoleSuperAdmin},
+		{"unmapped groups get the default role", []string{"finance"}, RoleViewer, RoleViewer},
+		{"no groups get the default role", nil, RoleViewer, RoleViewer},
+		{"no default role denies access", []string{"finance"}, "", ""},
+		{"groups are case sensitive", []string{"Rig-Admins"}, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RoleForGroups(tt.groups, mapping, tt.defaultRole); got != tt.want {
+				t.Errorf("RoleForGroups(%v) = %q, want %q", tt.groups, got, tt.want)
+			}
+		})
+	}
+}
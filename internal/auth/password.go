@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Operator roles carried in tokens. Super admins act across organizations;
+// the other roles are limited to their own.
+const (
+	RoleSuperAdmin = "superadmin"
+	RoleAdmin      = "admin"
+	RoleOperator   = "operator"
+	RoleViewer     = "viewer"
+)
+
+// MinPasswordLength is the shortest password accepted for an account
+const MinPasswordLength = 8
+
+// ErrInvalidRole is returned for roles other than the known ones
+var ErrInvalidRole = errors.New("invalid role")
+
+// ValidateRole checks that role is one of the known roles
+func ValidateRole(role string) error {
+	switch role {
+	case RoleSuperAdmin, RoleAdmin, RoleOperator, RoleViewer:
+		return nil
+	}
+	return fmt.Errorf("%w %q: must be %s, %s, %s or %s", ErrInvalidRole, role, RoleSuperAdmin, RoleAdmin, RoleOperator, RoleViewer)
+}
+
+// IsAdmin reports whether a role administers its organization, or every
+// organization
+func IsAdmin(role string) bool {
+	return role == RoleAdmin || role == RoleSuperAdmin
+}
+
+// HashPassword returns the bcrypt hash of a password
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("password must be at least %d characters", MinPasswordLength)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// CheckPassword reports whether password matches the bcrypt hash
+func CheckPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
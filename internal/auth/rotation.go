@@ -0,0 +1,177 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/logger"
+)
+
+// rotationCheckInterval is how often the key manager checks whether the
+// current key is due for rotation
+const rotationCheckInterval = time.Minute
+
+// KeyStore persists signing keys
+type KeyStore interface {
+	ListSigningKeys() ([]*database.SigningKey, error)
+	CreateSigningKey(key *database.SigningKey) error
+	RetireSigningKeys(exceptID string, at time.Time) error
+	DeleteSigningKeys(retiredBefore time.Time) (int, error)
+}
+
+// KeyInfo describes a signing key without its private half
+type KeyInfo struct {
+	ID        string     `json:"kid"`
+	Algorithm string     `json:"alg"`
+	Current   bool       `json:"current"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	// ExpiresAt is when a retired key stops verifying tokens
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// KeyManager keeps the signing keys of an Auth in a KeyStore. The current
+// key is replaced when it reaches the rotation interval; replaced keys keep
+// verifying tokens for the grace period and are then deleted.
+type KeyManager struct {
+	auth      *Auth
+	store     KeyStore
+	logger    logger.Logger
+	algorithm string
+	cfg       atomic.Pointer[config.JWTConfig]
+
+	// mu serializes rotations
+	mu sync.Mutex
+}
+
+// NewKeyManager loads the signing keys of cfg.Algorithm into a, generating
+// the first key if there is none
+func NewKeyManager(a *Auth, store KeyStore, cfg config.JWTConfig, log logger.Logger) (*KeyManager, error) {
+	m := &KeyManager{auth: a, store: store, logger: log, algorithm: cfg.Algorithm}
+	m.cfg.Store(&cfg)
+	if _, err := m.refresh(false, false); err != nil {
+		return nil, fmt.Errorf("loading signing keys: %w", err)
+	}
+	return m, nil
+}
+
+// SetConfig replaces the rotation interval and grace period, e.g. after a
+// configuration reload. The algorithm cannot change.
+func (m *KeyManager) SetConfig(cfg config.JWTConfig) {
+	m.cfg.Store(&cfg)
+}
+
+// Rotate replaces the current key now. With dropPrevious, tokens signed by
+// earlier keys are rejected at once instead of after the grace period.
+func (m *KeyManager) Rotate(dropPrevious bool) (*SigningKey, error) {
+	return m.refresh(true, dropPrevious)
+}
+
+// Keys describes the current key and the retired keys still verifying
+// tokens, newest first
+func (m *KeyManager) Keys() []KeyInfo {
+	ring := m.auth.keys.Load()
+	grace := m.cfg.Load().GracePeriod
+	infos := make([]KeyInfo, 0, len(ring.keys))
+	for _, k := range ring.keys {
+		info := KeyInfo{ID: k.ID, Algorithm: k.Algorithm, Current: k == ring.current, CreatedAt: k.CreatedAt, RetiredAt: k.RetiredAt}
+		if k.RetiredAt != nil {
+			expires := k.RetiredAt.Add(grace)
+			info.ExpiresAt = &expires
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Run rotates the current key when it is due and deletes keys past their
+// grace period until ctx is cancelled
+func (m *KeyManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(rotationCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := m.refresh(false, false); err != nil {
+				m.logger.Error("Failed to rotate signing keys", "error", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// refresh deletes expired keys, rotates the current key if forced, missing
+// or due, and installs the result in the Auth
+func (m *KeyManager) refresh(force, dropPrevious bool) (*SigningKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cfg := m.cfg.Load()
+	now := time.Now().UTC()
+	if n, err := m.store.DeleteSigningKeys(now.Add(-cfg.GracePeriod)); err != nil {
+		return nil, err
+	} else if n > 0 {
+		m.logger.Info("Retired signing keys deleted", "count", n)
+	}
+
+	records, err := m.store.ListSigningKeys()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		keys    []*SigningKey
+		current *SigningKey
+	)
+	for _, rec := range records {
+		key, err := parseSigningKey(rec)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %w", rec.ID, err)
+		}
+		keys = append(keys, key)
+		if current == nil && key.RetiredAt == nil && key.Algorithm == m.algorithm {
+			current = key
+		}
+	}
+
+	due := current != nil && cfg.RotationInterval > 0 && now.Sub(current.CreatedAt) >= cfg.RotationInterval
+	if force || current == nil || due {
+		next, err := GenerateSigningKey(m.algorithm)
+		if err != nil {
+			return nil, err
+		}
+		rec, err := next.record()
+		if err != nil {
+			return nil, err
+		}
+		if err := m.store.CreateSigningKey(rec); err != nil {
+			return nil, err
+		}
+		if err := m.store.RetireSigningKeys(next.ID, now); err != nil {
+			return nil, err
+		}
+		if dropPrevious {
+			if _, err := m.store.DeleteSigningKeys(now.Add(time.Nanosecond)); err != nil {
+				return nil, err
+			}
+			keys = nil
+		}
+		for _, k := range keys {
+			if k.RetiredAt == nil {
+				k.RetiredAt = &now
+			}
+		}
+		keys = append([]*SigningKey{next}, keys...)
+		current = next
+		m.logger.Info("Signing key rotated", "kid", next.ID, "algorithm", next.Algorithm, "previous_dropped", dropPrevious)
+	}
+
+	m.auth.setKeys(current, keys)
+	return current, nil
+}
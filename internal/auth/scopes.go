@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes an API key can be limited to
+const (
+	ScopeAgentsRead    = "agents:read"
+	ScopeAgentsWrite   = "agents:write"
+	ScopeCommandsWrite = "commands:write"
+	ScopeAuditRead     = "audit:read"
+	ScopeAdmin         = "admin"
+)
+
+// Scopes lists every scope
+var Scopes = []string{ScopeAgentsRead, ScopeAgentsWrite, ScopeCommandsWrite, ScopeAuditRead, ScopeAdmin}
+
+// RoleScopes returns the scopes a role holds. Sessions carry the scopes of
+// their role, and API keys may be granted no others.
+func RoleScopes(role string) []string {
+	switch role {
+	case RoleSuperAdmin, RoleAdmin:
+		return Scopes
+	case RoleOperator:
+		return []string{ScopeAgentsRead, ScopeAgentsWrite, ScopeCommandsWrite}
+	default:
+		return []string{ScopeAgentsRead}
+	}
+}
+
+// ValidateScopes checks that scopes are known and that an account with the
+// given role may grant them
+func ValidateScopes(scopes []string, role string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required: %s", strings.Join(Scopes, ", "))
+	}
+	allowed := RoleScopes(role)
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q: must be one of %s", scope, strings.Join(Scopes, ", "))
+		}
+		if !slices.Contains(allowed, scope) {
+			return fmt.Errorf("role %s cannot grant scope %s", role, scope)
+		}
+	}
+	return nil
+}
+
+// RequireScope middleware limits requests to credentials that carry the
+// scope: API keys the scopes they were created with and sessions those of
+// their role. Requests without scopes are rejected.
+func (a *Auth) RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scopes, _ := c.Get("scopes")
+		if granted, _ := scopes.([]string); !slices.Contains(granted, scope) {
+			message := "Insufficient permissions"
+			if _, ok := GetAPIKeyIDFromContext(c); ok {
+				message = "API key lacks the " + scope + " scope"
+			}
+			c.JSON(http.StatusForbidden, gin.H{"error": message})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequireKeyScope middleware limits requests authenticated with an API key
+// to keys that carry the scope, for self-service routes every session may
+// use whatever its role
+func (a *Auth) RequireKeyScope(scope string) gin.HandlerFunc {
+	requireScope := a.RequireScope(scope)
+	return func(c *gin.Context) {
+		if _, ok := GetAPIKeyIDFromContext(c); !ok {
+			c.Next()
+			return
+		}
+		requireScope(c)
+	}
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors,
+// "12345678901234567890", in base32
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestValidateTOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, truncated to the last six of the eight digits
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		at := time.Unix(tt.unix, 0)
+		step, ok := ValidateTOTP(rfc6238Secret, tt.code, at, 0)
+		if !ok || step != tt.unix/totpPeriod {
+			t.Errorf("ValidateTOTP(%s at %d) = %d, %v; want step %d", tt.code, tt.unix, step, ok, tt.unix/totpPeriod)
+		}
+	}
+}
+
+func TestValidateTOTPWindow(t *testing.T) {
+	key, err := totpEncoding.DecodeString(rfc6238Secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	now := time.Unix(1234567890, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name   string
+		offset int64
+		valid  bool
+	}{
+		{"current step", 0, true},
+		{"one step late", -1, true},
+		{"one step early", 1, true},
+		{"two steps late", -2, false},
+		{"two steps early", 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := totpCode(key, current+tt.offset)
+			step, ok := ValidateTOTP(rfc6238Secret, code, now, 0)
+			if ok != tt.valid || (ok && step != current+tt.offset) {
+				t.Errorf("got step %d, %v; want %v", step, ok, tt.valid)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step, ok := ValidateTOTP(rfc6238Secret, "005924", now, 0)
+	if !ok {
+		t.Fatal("first use rejected")
+	}
+
+	// The same code, in the same step or the next one, is used up
+	if _, ok := ValidateTOTP(rfc6238Secret, "005924", now, step); ok {
+		t.Error("code accepted twice in the same step")
+	}
+	if _, ok := ValidateTOTP(rfc6238Secret, "005924", now.Add(totpPeriod*time.Second), step); ok {
+		t.Error("code accepted again in the next step")
+	}
+
+	// A later code still works
+	key, _ := totpEncoding.DecodeString(rfc6238Secret)
+	if _, ok := ValidateTOTP(rfc6238Secret, totpCode(key, step+1), now, step); !ok {
+		t.Error("code of the next step rejected")
+	}
+}
+
+func TestValidateTOTPInput(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	tests := []struct {
+		name, secret, code string
+		valid              bool
+	}{
+		{"spaces in the code", rfc6238Secret, "005 924", true},
+		{"lower case secret", strings.ToLower(rfc6238Secret), "005924", true},
+		{"wrong code", rfc6238Secret, "005925", false},
+		{"too short", rfc6238Secret, "05924", false},
+		{"eight digits", rfc6238Secret, "89005924", false},
+		{"invalid secret", "not base32!", "005924", false},
+	}
+	for _, tt := range tests {
+		if _, ok := ValidateTOTP(tt.secret, tt.code, now, 0); ok != tt.valid {
+			t.Errorf("%s: valid = %v, want %v", tt.name, ok, tt.valid)
+		}
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI("SilentRig", "ops admin", rfc6238Secret)
+	for _, want := range []string{"otpauth://totp/SilentRig:ops%20admin?", "secret=" + rfc6238Secret, "issuer=SilentRig", "digits=6", "period=30", "algorithm=SHA1"} {
+		if !strings.Contains(uri, want) {
+			t.Errorf("URI %q lacks %q", uri, want)
+		}
+	}
+}
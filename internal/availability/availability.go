@@ -0,0 +1,163 @@
+package availability
+
+import (
+	"time"
+
+	"silentrig/internal/database"
+)
+
+// Interval is a period during which an agent kept the same status
+type Interval struct {
+	Status string    `json:"status"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+}
+
+// Duration returns the length of the interval
+func (i Interval) Duration() time.Duration {
+	return i.End.Sub(i.Start)
+}
+
+// Options controls how statuses are counted
+type Options struct {
+	// StaleAsOnline counts time spent stale as online instead of as part
+	// of an outage
+	StaleAsOnline bool
+}
+
+// Stats summarizes the availability of one agent or a set of agents. All
+// durations are in seconds so they serialize the same in JSON and CSV.
+type Stats struct {
+	ObservedSeconds      float64 `json:"observed_seconds"`
+	OnlineSeconds        float64 `json:"online_seconds"`
+	AvailabilityPercent  float64 `json:"availability_percent"`
+	Outages              int     `json:"outages"`
+	OutageSeconds        float64 `json:"outage_seconds"`
+	LongestOutageSeconds float64 `json:"longest_outage_seconds"`
+	MTBFSeconds          float64 `json:"mtbf_seconds"`
+	MTTRSeconds          float64 `json:"mttr_seconds"`
+}
+
+// AgentReport is the availability of a single agent over a time range
+type AgentReport struct {
+	AgentID   string            `json:"agent_id"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Groups    []string          `json:"groups"`
+	Stats     Stats             `json:"stats"`
+	Intervals []Interval        `json:"intervals,omitempty"`
+}
+
+// GroupReport aggregates the availability of agents sharing a label value
+// or group
+type GroupReport struct {
+	Key    string `json:"key"`
+	Agents int    `json:"agents"`
+	Stats  Stats  `json:"stats"`
+}
+
+// BuildIntervals turns the status an agent had at from and the transitions
+// recorded in [from, to) into contiguous status intervals covering the range
+func BuildIntervals(initial string, events []*database.StatusEvent, from, to time.Time) []Interval {
+	var intervals []Interval
+	status, start := initial, from
+
+	for _, e := range events {
+		if e.ChangedAt.Before(from) || !e.ChangedAt.Before(to) {
+			continue
+		}
+		if e.ChangedAt.After(start) && status != "" {
+			intervals = append(intervals, Interval{Status: status, Start: start, End: e.ChangedAt})
+		}
+		status, start = e.ToStatus, e.ChangedAt
+	}
+	if to.After(start) && status != "" {
+		intervals = append(intervals, Interval{Status: status, Start: start, End: to})
+	}
+
+	return mergeAdjacent(intervals)
+}
+
+func mergeAdjacent(intervals []Interval) []Interval {
+	var merged []Interval
+	for _, interval := range intervals {
+		if n := len(merged); n > 0 && merged[n-1].Status == interval.Status && merged[n-1].End.Equal(interval.Start) {
+			merged[n-1].End = interval.End
+			continue
+		}
+		merged = append(merged, interval)
+	}
+	return merged
+}
+
+// Compute derives availability statistics from status intervals. Time spent
+// inactive, i.e. before the agent ever connected, is not observed. An outage
+// is a maximal run of non-online time; outages still ongoing at the end of
+// the range are counted with the time observed so far.
+func Compute(intervals []Interval, opts Options) Stats {
+	var stats Stats
+	var current float64
+	inOutage := false
+
+	for _, interval := range intervals {
+		seconds := interval.Duration().Seconds()
+		switch {
+		case interval.Status == database.StatusInactive:
+			continue
+		case isOnline(interval.Status, opts):
+			stats.OnlineSeconds += seconds
+			if inOutage {
+				stats.closeOutage(current)
+				inOutage, current = false, 0
+			}
+		default:
+			inOutage = true
+			current += seconds
+		}
+		stats.ObservedSeconds += seconds
+	}
+	if inOutage {
+		stats.closeOutage(current)
+	}
+
+	stats.finish()
+	return stats
+}
+
+// Aggregate combines the statistics of several agents
+func Aggregate(all []Stats) Stats {
+	var total Stats
+	for _, s := range all {
+		total.ObservedSeconds += s.ObservedSeconds
+		total.OnlineSeconds += s.OnlineSeconds
+		total.Outages += s.Outages
+		total.OutageSeconds += s.OutageSeconds
+		if s.LongestOutageSeconds > total.LongestOutageSeconds {
+			total.LongestOutageSeconds = s.LongestOutageSeconds
+		}
+	}
+	total.finish()
+	return total
+}
+
+func (s *Stats) closeOutage(seconds float64) {
+	s.Outages++
+	s.OutageSeconds += seconds
+	if seconds > s.LongestOutageSeconds {
+		s.LongestOutageSeconds = seconds
+	}
+}
+
+func (s *Stats) finish() {
+	if s.ObservedSeconds > 0 {
+		s.AvailabilityPercent = s.OnlineSeconds / s.ObservedSeconds * 100
+	}
+	if s.Outages > 0 {
+		s.MTBFSeconds = s.OnlineSeconds / float64(s.Outages)
+		s.MTTRSeconds = s.OutageSeconds / float64(s.Outages)
+	}
+}
+
+func isOnline(status string, opts Options) bool {
+	return status == database.StatusActive || (opts.StaleAsOnline && status == database.StatusStale)
+}
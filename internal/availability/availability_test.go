@@ -0,0 +1,175 @@
+package availability
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+var base = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// at returns the time minutes after base
+func at(minutes int) time.Time {
+	return base.Add(time.Duration(minutes) * time.Minute)
+}
+
+func event(minutes int, from, to string) *database.StatusEvent {
+	return &database.StatusEvent{FromStatus: from, ToStatus: to, ChangedAt: at(minutes)}
+}
+
+func interval(status string, start, end int) Interval {
+	return Interval{Status: status, Start: at(start), End: at(end)}
+}
+
+const (
+	active   = database.StatusActive
+	stale    = database.StatusStale
+	offline  = database.StatusOffline
+	inactive = database.StatusInactive
+)
+
+func TestBuildIntervals(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial string
+		events  []*database.StatusEvent
+		want    []Interval
+	}{
+		{
+			name: "no heartbeats and no known status",
+		},
+		{
+			name:    "status unchanged over the window",
+			initial: active,
+			want:    []Interval{interval(active, 0, 60)},
+		},
+		{
+			name:    "never connected",
+			initial: inactive,
+			want:    []Interval{interval(inactive, 0, 60)},
+		},
+		{
+			name:   "first heartbeat inside the window",
+			events: []*database.StatusEvent{event(20, inactive, active)},
+			want:   []Interval{interval(active, 20, 60)},
+		},
+		{
+			name:    "transition at the start of the window",
+			initial: offline,
+			events:  []*database.StatusEvent{event(0, offline, active)},
+			want:    []Interval{interval(active, 0, 60)},
+		},
+		{
+			name:    "transitions outside the window are ignored",
+			initial: offline,
+			events:  []*database.StatusEvent{event(-10, active, offline), event(30, offline, active), event(60, active, offline), event(70, offline, active)},
+			want:    []Interval{interval(offline, 0, 30), interval(active, 30, 60)},
+		},
+		{
+			name:    "gap up to the end of the window",
+			initial: active,
+			events:  []*database.StatusEvent{event(40, active, stale), event(50, stale, offline)},
+			want:    []Interval{interval(active, 0, 40), interval(stale, 40, 50), interval(offline, 50, 60)},
+		},
+		{
+			name:    "simultaneous transitions keep the last",
+			initial: active,
+			events:  []*database.StatusEvent{event(10, active, stale), event(10, stale, offline), event(20, offline, active)},
+			want:    []Interval{interval(active, 0, 10), interval(offline, 10, 20), interval(active, 20, 60)},
+		},
+		{
+			name:    "repeated statuses merge",
+			initial: active,
+			events:  []*database.StatusEvent{event(10, active, active), event(20, offline, active)},
+			want:    []Interval{interval(active, 0, 60)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := BuildIntervals(tt.initial, tt.events, at(0), at(60))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompute(t *testing.T) {
+	tests := []struct {
+		name      string
+		intervals []Interval
+		opts      Options
+		want      Stats
+	}{
+		{
+			name: "no heartbeats",
+		},
+		{
+			name:      "never connected",
+			intervals: []Interval{interval(inactive, 0, 60)},
+		},
+		{
+			name:      "always online",
+			intervals: []Interval{interval(active, 0, 60)},
+			want:      Stats{ObservedSeconds: 3600, OnlineSeconds: 3600, AvailabilityPercent: 100},
+		},
+		{
+			name:      "inactive time is not observed",
+			intervals: []Interval{interval(inactive, 0, 30), interval(active, 30, 60)},
+			want:      Stats{ObservedSeconds: 1800, OnlineSeconds: 1800, AvailabilityPercent: 100},
+		},
+		{
+			name:      "outage at the start of the window",
+			intervals: []Interval{interval(offline, 0, 15), interval(active, 15, 60)},
+			want: Stats{ObservedSeconds: 3600, OnlineSeconds: 2700, AvailabilityPercent: 75,
+				Outages: 1, OutageSeconds: 900, LongestOutageSeconds: 900, MTBFSeconds: 2700, MTTRSeconds: 900},
+		},
+		{
+			name:      "outage still ongoing at the end of the window",
+			intervals: []Interval{interval(active, 0, 45), interval(stale, 45, 50), interval(offline, 50, 60)},
+			want: Stats{ObservedSeconds: 3600, OnlineSeconds: 2700, AvailabilityPercent: 75,
+				Outages: 1, OutageSeconds: 900, LongestOutageSeconds: 900, MTBFSeconds: 2700, MTTRSeconds: 900},
+		},
+		{
+			name:      "stale counted as online",
+			intervals: []Interval{interval(active, 0, 30), interval(stale, 30, 45), interval(offline, 45, 60)},
+			opts:      Options{StaleAsOnline: true},
+			want: Stats{ObservedSeconds: 3600, OnlineSeconds: 2700, AvailabilityPercent: 75,
+				Outages: 1, OutageSeconds: 900, LongestOutageSeconds: 900, MTBFSeconds: 2700, MTTRSeconds: 900},
+		},
+		{
+			name:      "separate outages",
+			intervals: []Interval{interval(active, 0, 10), interval(offline, 10, 20), interval(active, 20, 40), interval(stale, 40, 45), interval(active, 45, 60)},
+			want: Stats{ObservedSeconds: 3600, OnlineSeconds: 2700, AvailabilityPercent: 75,
+				Outages: 2, OutageSeconds: 900, LongestOutageSeconds: 600, MTBFSeconds: 1350, MTTRSeconds: 450},
+		},
+		{
+			name:      "inactive time does not split an outage",
+			intervals: []Interval{interval(offline, 0, 10), interval(inactive, 10, 20), interval(offline, 20, 30), interval(active, 30, 60)},
+			want: Stats{ObservedSeconds: 3000, OnlineSeconds: 1800, AvailabilityPercent: 60,
+				Outages: 1, OutageSeconds: 1200, LongestOutageSeconds: 1200, MTBFSeconds: 1800, MTTRSeconds: 1200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Compute(tt.intervals, tt.opts); got != tt.want {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	got := Aggregate([]Stats{
+		Compute([]Interval{interval(active, 0, 60)}, Options{}),
+		Compute([]Interval{interval(offline, 0, 30), interval(active, 30, 60)}, Options{}),
+		{},
+	})
+	want := Stats{ObservedSeconds: 7200, OnlineSeconds: 5400, AvailabilityPercent: 75,
+		Outages: 1, OutageSeconds: 1800, LongestOutageSeconds: 1800, MTBFSeconds: 5400, MTTRSeconds: 1800}
+	if got != want {
+		t.Errorf("got %+v\nwant %+v", got, want)
+	}
+}
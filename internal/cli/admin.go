@@ -0,0 +1,1127 @@
+package cli
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/registry"
+)
+
+// Build information, set with -ldflags "-X silentrig/internal/cli.Version=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+func runVersion(args []string) error {
+	fmt.Printf("silentrig %s (commit %s, built %s, %s %s/%s)\n", Version, Commit, BuildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig config check [flags]")
+		return errUsage
+	}
+	fs, cfgFlags := newFlagSet("config check", "config check [flags]")
+	positional, err := parse(fs, cfgFlags, args[1:])
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 0); err != nil {
+		return err
+	}
+
+	cfg, err := config.Read()
+	if err != nil {
+		return fmt.Errorf("reading configuration: %w", err)
+	}
+	ok, err := config.WriteCheck(os.Stdout, cfg)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("configuration is invalid")
+	}
+	return nil
+}
+
+func runMigrate(args []string) error {
+	fs, cfgFlags := newFlagSet("migrate", "migrate [flags]")
+	positional, err := parse(fs, cfgFlags, args)
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 0); err != nil {
+		return err
+	}
+
+	// Opening the database applies any pending migrations
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	fmt.Printf("Database %s is up to date\n", s.cfg.Database.Path)
+	return nil
+}
+
+func runUser(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig user add|passwd|list|revoke-sessions|reset-2fa ...")
+		return errUsage
+	}
+
+	switch args[0] {
+	case "add":
+		fs, cfgFlags := newFlagSet("user add", "user add [flags] <username>\n\nThe password is read from stdin.")
+		role := fs.String("role", auth.RoleAdmin, "role: superadmin, admin, operator or viewer")
+		org := fs.String("org", database.DefaultOrg, "organization the user belongs to")
+		service := fs.Bool("service", false, "create a service account that has no password and uses API keys")
+		oidcSubject := fs.String("oidc-subject", "", "create an account for the user with this subject at the configured OIDC provider")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+		if err := auth.ValidateRole(*role); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		if *oidcSubject != "" {
+			if *service {
+				return errors.New("--service and --oidc-subject cannot be combined")
+			}
+			if s.cfg.OIDC.Issuer == "" {
+				return errors.New("oidc.issuer is not configured")
+			}
+			user, err := s.registry.CreateOIDCUser(positional[0], *role, *org, s.cfg.OIDC.Issuer, *oidcSubject)
+			s.audit(registry.AuditRecord{
+				OrgID: *org, Action: registry.AuditUserCreate, TargetType: "user", TargetID: positional[0],
+				After: map[string]string{"role": *role, "oidc_subject": registry.OIDCSubject(s.cfg.OIDC.Issuer, *oidcSubject)}, Err: err,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created OIDC user %s with role %s in %s\n", user.Username, user.Role, user.OrgID)
+			return nil
+		}
+		if *service {
+			user, err := s.registry.CreateServiceAccount(positional[0], *role, *org)
+			s.audit(registry.AuditRecord{
+				OrgID: *org, Action: registry.AuditServiceAccount, TargetType: "user", TargetID: positional[0],
+				After: map[string]string{"role": *role}, Err: err,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Created service account %s with role %s in %s\n", user.Username, user.Role, user.OrgID)
+			return nil
+		}
+
+		password, err := readPassword("Password: ")
+		if err != nil {
+			return err
+		}
+		user, err := s.registry.CreateUser(positional[0], password, *role, *org)
+		s.audit(registry.AuditRecord{
+			OrgID: *org, Action: registry.AuditUserCreate, TargetType: "user", TargetID: positional[0],
+			After: map[string]string{"role": *role}, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created user %s with role %s in %s\n", user.Username, user.Role, user.OrgID)
+		return nil
+
+	case "passwd":
+		fs, cfgFlags := newFlagSet("user passwd", "user passwd [flags] <username>\n\nThe new password is read from stdin.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		user, err := s.registry.GetUser(positional[0])
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %s does not exist", positional[0])
+		} else if err != nil {
+			return err
+		}
+		if user.Service {
+			return fmt.Errorf("%s is a service account and has no password", user.Username)
+		}
+		if user.OIDCSubject != "" {
+			return fmt.Errorf("%s logs in through the OIDC provider and has no password", user.Username)
+		}
+
+		password, err := readPassword("New password: ")
+		if err != nil {
+			return err
+		}
+		err = s.registry.SetPassword(positional[0], password)
+		s.audit(registry.AuditRecord{Action: registry.AuditUserPassword, TargetType: "user", TargetID: positional[0], Err: err})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Password of %s changed\n", positional[0])
+		return nil
+
+	case "revoke-sessions":
+		fs, cfgFlags := newFlagSet("user revoke-sessions", "user revoke-sessions [flags] <username>")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		if _, err := s.registry.GetUser(positional[0]); errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %s does not exist", positional[0])
+		} else if err != nil {
+			return err
+		}
+		n, err := s.registry.RevokeUserSessions(positional[0])
+		s.audit(registry.AuditRecord{
+			Action: registry.AuditSessionsRevoke, TargetType: "user", TargetID: positional[0],
+			After: map[string]int{"revoked": n}, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked %d sessions of %s\n", n, positional[0])
+		return nil
+
+	case "reset-2fa":
+		fs, cfgFlags := newFlagSet("user reset-2fa", "user reset-2fa [flags] <username>")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		err = s.registry.ResetTwoFactor(positional[0])
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %s does not exist", positional[0])
+		}
+		s.audit(registry.AuditRecord{Action: registry.AuditTwoFactorReset, TargetType: "user", TargetID: positional[0], Err: err})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Two-factor authentication of %s reset and sessions revoked\n", positional[0])
+		return nil
+
+	case "list":
+		fs, cfgFlags := newFlagSet("user list", "user list [flags]")
+		asJSON := fs.Bool("json", false, "print JSON")
+		org := fs.String("org", "", "only list users of this organization")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 0); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		users, err := s.registry.ListUsers(*org)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(users)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tORG\tROLE\tTYPE\tCREATED")
+		for _, u := range users {
+			kind := "user"
+			if u.Service {
+				kind = "service"
+			} else if u.OIDCSubject != "" {
+				kind = "oidc"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", u.Username, u.OrgID, u.Role, kind, u.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown user command %q\n", args[0])
+	return errUsage
+}
+
+func runAgent(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig agent list|show|delete|restore|export|purge|label|revoke|certs|revoke-certs|conflicts|resolve ...")
+		return errUsage
+	}
+
+	switch args[0] {
+	case "list":
+		fs, cfgFlags := newFlagSet("agent list", "agent list [flags]")
+		var labels, groups, statuses stringList
+		fs.Var(&labels, "label", "only agents with this key=value label (repeatable)")
+		fs.Var(&groups, "group", "only agents in this group (repeatable)")
+		fs.Var(&statuses, "status", "only agents with this status (repeatable)")
+		search := fs.String("search", "", "only agents whose name, machine ID or ID contains this")
+		asJSON := fs.Bool("json", false, "print JSON")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 0); err != nil {
+			return err
+		}
+
+		filter, err := registry.ParseSelector(labels, groups)
+		if err != nil {
+			return err
+		}
+		filter.Statuses = statuses
+		filter.Search = *search
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agents, err := s.registry.ListAgents(filter)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(agents)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tSTATUS\tLAST SEEN\tLABELS\tGROUPS")
+		for _, a := range agents {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", a.ID, a.Name, a.Status, a.LastSeen.Format(time.RFC3339), formatLabels(a.Labels), strings.Join(a.Groups, ","))
+		}
+		return w.Flush()
+
+	case "show":
+		fs, cfgFlags := newFlagSet("agent show", "agent show [flags] <id>")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		inventory, err := s.registry.GetInventory(agent.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		return printJSON(struct {
+			*database.Agent
+			Inventory *database.Inventory `json:"inventory"`
+		}{agent, inventory})
+
+	case "delete":
+		fs, cfgFlags := newFlagSet("agent delete", "agent delete [flags] <id>\n\nThe agent is decommissioned: its credentials are revoked and it is hidden\nfrom listings. It is purged after decommission.retention.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		if agent.DecommissionedAt != nil {
+			return fmt.Errorf("agent %s is already decommissioned", agent.ID)
+		}
+		decommissioned, err := s.registry.DecommissionAgent(agent.ID)
+		s.audit(registry.AuditRecord{
+			OrgID: agent.OrgID, Action: registry.AuditAgentDelete, TargetType: "agent", TargetID: agent.ID,
+			Before: registry.AgentSummary(agent), After: map[string]string{"status": database.StatusDecommissioned}, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Decommissioned agent %s; it is purged after %s\n", agent.ID, s.registry.PurgeAfter(decommissioned).Format(time.RFC3339))
+		return nil
+
+	case "restore":
+		fs, cfgFlags := newFlagSet("agent restore", "agent restore [flags] <id>\n\nThe agent comes back revoked and needs an enrollment token to connect.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		if agent.DecommissionedAt == nil {
+			return fmt.Errorf("agent %s is not decommissioned", agent.ID)
+		}
+		_, err = s.registry.RestoreAgent(agent.ID)
+		s.audit(registry.AuditRecord{
+			OrgID: agent.OrgID, Action: registry.AuditAgentRestore, TargetType: "agent", TargetID: agent.ID, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Restored agent %s\n", agent.ID)
+		return nil
+
+	case "export":
+		fs, cfgFlags := newFlagSet("agent export", "agent export [flags] <id>")
+		format := fs.String("format", registry.ExportJSON, "json, or csv for a zip archive of CSV files")
+		output := fs.String("output", "", "file to write (default: standard output)")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+		if *format != registry.ExportJSON && *format != registry.ExportCSV {
+			return registry.ErrExportFormat
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		w := os.Stdout
+		if *output != "" {
+			if w, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600); err != nil {
+				return err
+			}
+			defer w.Close()
+		}
+		err = s.registry.ExportAgent(w, agent, *format)
+		s.audit(registry.AuditRecord{
+			OrgID: agent.OrgID, Action: registry.AuditAgentExport, TargetType: "agent", TargetID: agent.ID,
+			After: map[string]string{"format": *format}, Err: err,
+		})
+		return err
+
+	case "purge":
+		fs, cfgFlags := newFlagSet("agent purge", "agent purge [flags] <id>\n\nDelete a decommissioned agent and its history now, after writing a final\nexport to decommission.export_dir.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		if agent.DecommissionedAt == nil {
+			return fmt.Errorf("agent %s is not decommissioned; run agent delete first", agent.ID)
+		}
+		path, err := s.registry.PurgeAgent(agent)
+		s.audit(registry.AuditRecord{
+			OrgID: agent.OrgID, Action: registry.AuditAgentPurge, TargetType: "agent", TargetID: agent.ID,
+			Before: registry.AgentSummary(agent), Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Purged agent %s; final export written to %s\n", agent.ID, path)
+		return nil
+
+	case "label":
+		fs, cfgFlags := newFlagSet("agent label", "agent label [flags] <id> key=value... key-...\n\nkey=value sets a label, key- removes it.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if len(positional) < 2 {
+			fs.Usage()
+			return errUsage
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		labels := make(map[string]string, len(agent.Labels))
+		for k, v := range agent.Labels {
+			labels[k] = v
+		}
+		for _, expr := range positional[1:] {
+			if key, ok := strings.CutSuffix(expr, "-"); ok && !strings.Contains(expr, "=") {
+				delete(labels, key)
+				continue
+			}
+			key, value, ok := strings.Cut(expr, "=")
+			if !ok {
+				return fmt.Errorf("label %q must be key=value or key-", expr)
+			}
+			labels[key] = value
+		}
+
+		before := agent
+		agent, err = s.registry.UpdateAgent(agent.ID, nil, labels, nil)
+		if err != nil {
+			return err
+		}
+		s.audit(registry.AuditRecord{
+			Action: registry.AuditAgentUpdate, TargetType: "agent", TargetID: agent.ID,
+			Before: registry.AgentSummary(before), After: registry.AgentSummary(agent),
+		})
+		fmt.Printf("Labels of %s: %s\n", agent.ID, formatLabels(agent.Labels))
+		return nil
+
+	case "revoke":
+		fs, cfgFlags := newFlagSet("agent revoke", "agent revoke [flags] <id>\n\nThe agent's tokens and client certificates stop working at once and its\npending commands are cancelled. It needs an enrollment token to come back.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		if agent.RevokedAt != nil {
+			return fmt.Errorf("agent %s is already revoked", agent.ID)
+		}
+		_, err = s.registry.RevokeAgent(agent.ID)
+		s.audit(registry.AuditRecord{
+			OrgID: agent.OrgID, Action: registry.AuditAgentRevoke, TargetType: "agent", TargetID: agent.ID,
+			Before: map[string]string{"status": agent.Status}, After: map[string]string{"status": database.StatusRevoked}, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked agent %s\n", agent.ID)
+		return nil
+
+	case "certs", "revoke-certs":
+		fs, cfgFlags := newFlagSet("agent "+args[0], "agent "+args[0]+" [flags] <id>")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		agent, err := getAgent(s, positional[0])
+		if err != nil {
+			return err
+		}
+		if args[0] == "revoke-certs" {
+			n, err := s.registry.RevokeAgentCertificates(agent.ID)
+			s.audit(registry.AuditRecord{
+				Action: registry.AuditCertificateRevoke, TargetType: "agent", TargetID: agent.ID,
+				After: map[string]int{"revoked": n}, Err: err,
+			})
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Revoked %d certificates of %s\n", n, agent.ID)
+			return nil
+		}
+
+		certs, err := s.registry.ListAgentCertificates(agent.ID)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "SERIAL\tNOT AFTER\tREVOKED")
+		for _, cert := range certs {
+			revoked := "-"
+			if cert.RevokedAt != nil {
+				revoked = cert.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", cert.Serial, cert.NotAfter.Format(time.RFC3339), revoked)
+		}
+		return w.Flush()
+
+	case "conflicts":
+		fs, cfgFlags := newFlagSet("agent conflicts", "agent conflicts [flags]")
+		all := fs.Bool("all", false, "include resolved conflicts")
+		asJSON := fs.Bool("json", false, "print JSON")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 0); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		conflicts, err := s.registry.ListConflicts("", *all)
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(conflicts)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tAGENT\tKIND\tMACHINE ID\tSOURCE IP\tCOUNT\tLAST SEEN\tRESOLUTION")
+		for _, conflict := range conflicts {
+			resolution := "-"
+			if conflict.ResolvedAt != nil {
+				resolution = conflict.Resolution
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n", conflict.ID, conflict.AgentID, conflict.Kind, conflict.MachineID,
+				conflict.SourceIP, conflict.Count, conflict.LastSeenAt.Format(time.RFC3339), resolution)
+		}
+		return w.Flush()
+
+	case "resolve":
+		fs, cfgFlags := newFlagSet("agent resolve", "agent resolve [flags] <conflict-id> accept|dismiss|revoke\n\naccept lets the registering host take over the agent, dismiss leaves the\nagent as it is and revoke revokes it. Clones cannot be accepted.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 2); err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(positional[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid conflict ID %q", positional[0])
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		conflict, err := s.registry.GetConflictInOrg("", id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("conflict %d does not exist", id)
+		}
+		if err != nil {
+			return err
+		}
+		err = s.registry.ResolveConflict(conflict, positional[1], s.actor())
+		if errors.Is(err, registry.ErrInvalidResolution) {
+			return fmt.Errorf("%w: %s conflicts cannot be resolved with %q", err, conflict.Kind, positional[1])
+		}
+		s.audit(registry.AuditRecord{
+			OrgID: conflict.OrgID, Action: registry.AuditConflictResolve, TargetType: "agent", TargetID: conflict.AgentID,
+			Before: map[string]interface{}{"conflict_id": conflict.ID, "kind": conflict.Kind, "machine_id": conflict.MachineID, "source_ip": conflict.SourceIP},
+			After:  map[string]string{"resolution": positional[1]}, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Resolved conflict %d of %s: %s\n", conflict.ID, conflict.AgentID, positional[1])
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown agent command %q\n", args[0])
+	return errUsage
+}
+
+func getAgent(s *store, id string) (*database.Agent, error) {
+	agent, err := s.registry.GetAgent(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("agent %s does not exist", id)
+	}
+	return agent, err
+}
+
+func runOrg(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig org create|list|delete ...")
+		return errUsage
+	}
+
+	switch args[0] {
+	case "create":
+		fs, cfgFlags := newFlagSet("org create", "org create [flags] <id>")
+		name := fs.String("name", "", "display name, defaults to the ID")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		org, err := s.registry.CreateOrganization(positional[0], *name)
+		s.audit(registry.AuditRecord{
+			OrgID: positional[0], Action: registry.AuditOrgCreate, TargetType: "organization", TargetID: positional[0],
+			After: map[string]string{"name": *name}, Err: err,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created organization %s (%s)\n", org.ID, org.Name)
+		return nil
+
+	case "list":
+		fs, cfgFlags := newFlagSet("org list", "org list [flags]")
+		asJSON := fs.Bool("json", false, "print JSON")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 0); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		orgs, err := s.registry.ListOrganizations()
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(orgs)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tCREATED")
+		for _, o := range orgs {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", o.ID, o.Name, o.CreatedAt.Format(time.RFC3339))
+		}
+		return w.Flush()
+
+	case "delete":
+		fs, cfgFlags := newFlagSet("org delete", "org delete [flags] <id>\n\nOnly organizations without agents, users and enrollment tokens can be deleted.")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		err = s.registry.DeleteOrganization(positional[0])
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("organization %s does not exist", positional[0])
+		}
+		s.audit(registry.AuditRecord{OrgID: positional[0], Action: registry.AuditOrgDelete, TargetType: "organization", TargetID: positional[0], Err: err})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Deleted organization %s\n", positional[0])
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown org command %q\n", args[0])
+	return errUsage
+}
+
+func runToken(args []string) error {
+	if len(args) == 0 || args[0] != "create" {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig token create [flags]")
+		return errUsage
+	}
+	fs, cfgFlags := newFlagSet("token create", "token create [flags]")
+	description := fs.String("description", "", "what the token is for")
+	uses := fs.Int("uses", 1, "number of agents that may enroll with the token, 0 for unlimited")
+	ttl := fs.Duration("ttl", 24*time.Hour, "how long the token is valid, 0 for no expiry")
+	org := fs.String("org", database.DefaultOrg, "organization the enrolled agents belong to")
+	positional, err := parse(fs, cfgFlags, args[1:])
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 0); err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	token, record, err := s.registry.CreateEnrollmentToken(*org, *description, *uses, *ttl)
+	if err != nil {
+		return err
+	}
+	s.audit(registry.AuditRecord{
+		OrgID: *org, Action: registry.AuditEnrollmentToken, TargetType: "enrollment_token", TargetID: strconv.FormatInt(record.ID, 10),
+		After: record,
+	})
+	fmt.Println(token)
+	expiry := "never"
+	if record.ExpiresAt != nil {
+		expiry = record.ExpiresAt.Format(time.RFC3339)
+	}
+	fmt.Fprintf(os.Stderr, "Enrollment token %d created (uses: %d, expires: %s). It is not shown again.\n", record.ID, record.MaxUses, expiry)
+	return nil
+}
+
+func runAPIKey(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig apikey create|list|revoke ...")
+		return errUsage
+	}
+
+	switch args[0] {
+	case "create":
+		fs, cfgFlags := newFlagSet("apikey create", "apikey create [flags] <name>")
+		username := fs.String("user", "", "user or service account the key acts for (required)")
+		ttl := fs.Duration("ttl", 0, "how long the key is valid, 0 for no expiry")
+		var scopes, allowedIPs stringList
+		fs.Var(&scopes, "scope", "scope to grant: "+strings.Join(auth.Scopes, ", ")+" (repeatable)")
+		fs.Var(&allowedIPs, "allow-ip", "address or CIDR range the key may be used from (repeatable)")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+		if *username == "" || len(scopes) == 0 {
+			fs.Usage()
+			return errUsage
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		user, err := s.registry.GetUser(*username)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user %s does not exist", *username)
+		} else if err != nil {
+			return err
+		}
+		key, record, err := s.registry.CreateAPIKey(user, registry.APIKeyRequest{
+			Name:       positional[0],
+			Scopes:     splitCommas(scopes),
+			AllowedIPs: splitCommas(allowedIPs),
+			TTL:        *ttl,
+			CreatedBy:  s.actor(),
+		})
+		if err != nil {
+			return err
+		}
+		s.audit(registry.AuditRecord{
+			Action: registry.AuditAPIKeyCreate, TargetType: "api_key", TargetID: strconv.FormatInt(record.ID, 10),
+			After: record,
+		})
+		fmt.Println(key)
+		fmt.Fprintf(os.Stderr, "API key %d (%s) created for %s with scopes %s. It is not shown again.\n",
+			record.ID, record.Prefix, record.Username, strings.Join(record.Scopes, " "))
+		return nil
+
+	case "list":
+		fs, cfgFlags := newFlagSet("apikey list", "apikey list [flags]")
+		username := fs.String("user", "", "only keys of this user")
+		asJSON := fs.Bool("json", false, "print JSON")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 0); err != nil {
+			return err
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		keys, err := s.registry.ListAPIKeys(*username, "")
+		if err != nil {
+			return err
+		}
+		if *asJSON {
+			return printJSON(keys)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tPREFIX\tNAME\tUSER\tSCOPES\tEXPIRES\tLAST USED\tSTATE")
+		for _, k := range keys {
+			expires, lastUsed, state := "never", "never", "active"
+			if k.ExpiresAt != nil {
+				expires = k.ExpiresAt.Format(time.RFC3339)
+				if !time.Now().Before(*k.ExpiresAt) {
+					state = "expired"
+				}
+			}
+			if k.LastUsedAt != nil {
+				lastUsed = k.LastUsedAt.Format(time.RFC3339)
+			}
+			if k.RevokedAt != nil {
+				state = "revoked"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				k.ID, k.Prefix, k.Name, k.Username, strings.Join(k.Scopes, ","), expires, lastUsed, state)
+		}
+		return w.Flush()
+
+	case "revoke":
+		fs, cfgFlags := newFlagSet("apikey revoke", "apikey revoke [flags] <id>")
+		positional, err := parse(fs, cfgFlags, args[1:])
+		if err != nil {
+			return err
+		}
+		if err := expectArgs(fs, positional, 1); err != nil {
+			return err
+		}
+		id, err := strconv.ParseInt(positional[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid API key ID %q", positional[0])
+		}
+
+		s, err := openStore()
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+
+		err = s.registry.RevokeAPIKey(id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("API key %d does not exist", id)
+		}
+		s.audit(registry.AuditRecord{Action: registry.AuditAPIKeyRevoke, TargetType: "api_key", TargetID: positional[0], Err: err})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("API key %d revoked\n", id)
+		return nil
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown apikey command %q\n", args[0])
+	return errUsage
+}
+
+// splitCommas splits comma separated flag values into a single list
+func splitCommas(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				out = append(out, part)
+			}
+		}
+	}
+	return out
+}
+
+func runAudit(args []string) error {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: silentrig audit verify [flags]")
+		return errUsage
+	}
+	fs, cfgFlags := newFlagSet("audit verify", "audit verify [flags]")
+	positional, err := parse(fs, cfgFlags, args[1:])
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 0); err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	result, err := s.registry.VerifyAuditChain()
+	if err != nil {
+		return err
+	}
+	if !result.Valid {
+		return fmt.Errorf("audit log broken at event %d: %s", result.BrokenAt, result.Reason)
+	}
+	fmt.Printf("Audit log intact (%d events)\n", result.Events)
+	return nil
+}
+
+func runBackup(args []string) error {
+	fs, cfgFlags := newFlagSet("backup", "backup [flags] <file>")
+	positional, err := parse(fs, cfgFlags, args)
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 1); err != nil {
+		return err
+	}
+
+	s, err := openStore()
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	if err := s.db.Backup(positional[0]); err != nil {
+		return err
+	}
+	fmt.Printf("Backed up %s to %s\n", s.cfg.Database.Path, positional[0])
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs, cfgFlags := newFlagSet("restore", "restore [flags] <file>\n\nStop the server before restoring.")
+	force := fs.Bool("force", false, "replace an existing database")
+	positional, err := parse(fs, cfgFlags, args)
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 1); err != nil {
+		return err
+	}
+
+	cfg, _, err := config.Load()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(cfg.Database.Path); err == nil && !*force {
+		return fmt.Errorf("%s exists; stop the server and pass --force to replace it", cfg.Database.Path)
+	}
+
+	if err := database.Restore(positional[0], cfg.Database.Path); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %s from %s\n", cfg.Database.Path, positional[0])
+	return nil
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
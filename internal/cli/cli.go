@@ -0,0 +1,215 @@
+// Package cli implements the silentrig command line: the server itself and
+// the administration commands that work directly on the configured store.
+package cli
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/logger"
+	"silentrig/internal/registry"
+)
+
+// errUsage is returned by commands invoked with wrong arguments after they
+// printed their usage
+var errUsage = errors.New("usage")
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "serve [flags]", "run the server (default)", runServe},
+		{"migrate", "migrate [flags]", "create or upgrade the database schema", runMigrate},
+		{"org", "org create|list|delete ...", "manage organizations", runOrg},
+		{"user", "user add|passwd|list|revoke-sessions|reset-2fa ...", "manage operator and service accounts", runUser},
+		{"agent", "agent list|show|delete|restore|export|label|revoke|conflicts ...", "inspect and manage agents", runAgent},
+		{"token", "token create [flags]", "create agent enrollment tokens", runToken},
+		{"apikey", "apikey create|list|revoke ...", "manage API keys for automation", runAPIKey},
+		{"audit", "audit verify [flags]", "check the audit log hash chain", runAudit},
+		{"backup", "backup [flags] <file>", "write a consistent copy of the database", runBackup},
+		{"restore", "restore [flags] <file>", "replace the database with a backup", runRestore},
+		{"config", "config check [flags]", "print and validate the effective configuration", runConfig},
+		{"version", "version", "print version information", runVersion},
+	}
+}
+
+// Run executes the command line and returns the process exit code
+func Run(args []string) int {
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	if name == "help" {
+		usage(os.Stdout)
+		return 0
+	}
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		err := cmd.run(args)
+		switch {
+		case err == nil:
+			return 0
+		case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+			return 2
+		default:
+			fmt.Fprintln(os.Stderr, "Error:", err)
+			return 1
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage(os.Stderr)
+	return 2
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: silentrig <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-36s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command accepts the configuration flags --config, --address,")
+	fmt.Fprintln(w, "--port, --mode, --db and --log-level. Run a command with -h for details.")
+}
+
+// newFlagSet returns a flag set for a command with the configuration flags
+// registered
+func newFlagSet(name, usage string) (*flag.FlagSet, *config.Flags) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: silentrig %s\n\nFlags:\n", usage)
+		fs.PrintDefaults()
+	}
+	return fs, config.RegisterFlags(fs)
+}
+
+// parse parses flags interspersed with positional arguments, applies the
+// configuration flags and returns the positional arguments
+func parse(fs *flag.FlagSet, cfgFlags *config.Flags, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	cfgFlags.Apply()
+	return positional, nil
+}
+
+// expectArgs prints the usage of fs and returns errUsage unless exactly n
+// positional arguments were given
+func expectArgs(fs *flag.FlagSet, args []string, n int) error {
+	if len(args) != n {
+		fs.Usage()
+		return errUsage
+	}
+	return nil
+}
+
+// store is the configured database opened for an administration command
+type store struct {
+	cfg        *config.Config
+	db         *database.Database
+	registry   *registry.Registry
+	logOutputs io.Closer
+}
+
+// openStore loads the configuration and opens the database it points to.
+// Logs go to the configured outputs but are limited to errors so they do
+// not mix with command output.
+func openStore() (*store, error) {
+	cfg, _, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	logging := cfg.Logging
+	logging.Level = "error"
+	logging.Components = nil
+	log, logOutputs, err := logger.Open(logging)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up logging: %w", err)
+	}
+
+	db, err := database.New(cfg.Database.Path, log.Component("database"))
+	if err != nil {
+		logOutputs.Close()
+		return nil, fmt.Errorf("opening database %s: %w", cfg.Database.Path, err)
+	}
+	reg := registry.New(db, log.Component("registry"), cfg.Liveness)
+	reg.SetDecommission(cfg.Decommission)
+	return &store{cfg: cfg, db: db, registry: reg, logOutputs: logOutputs}, nil
+}
+
+// audit records an action taken through the command line
+func (s *store) audit(rec registry.AuditRecord) {
+	rec.Actor = s.actor()
+	s.registry.Audit(rec)
+}
+
+// actor names the operating system user running the command
+func (s *store) actor() string {
+	if u, err := user.Current(); err == nil {
+		return registry.ActorCLI + ":" + u.Username
+	}
+	return registry.ActorCLI
+}
+
+func (s *store) Close() error {
+	err := s.db.Close()
+	if cerr := s.logOutputs.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readPassword reads a password from the first line of stdin, prompting when
+// stdin is a terminal
+func readPassword(prompt string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprint(os.Stderr, prompt)
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", fmt.Errorf("reading password: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// stringList is a flag that can be repeated
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -0,0 +1,222 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"silentrig/internal/api"
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/lifecycle"
+	"silentrig/internal/logger"
+	"silentrig/internal/pki"
+	"silentrig/internal/registry"
+)
+
+// Development account created when a development server starts without any
+// operator accounts
+const (
+	devAdminUsername = "admin"
+	devAdminPassword = "admin123"
+)
+
+func runServe(args []string) error {
+	fs, cfgFlags := newFlagSet("serve", "serve [flags]")
+	positional, err := parse(fs, cfgFlags, args)
+	if err != nil {
+		return err
+	}
+	if err := expectArgs(fs, positional, 0); err != nil {
+		return err
+	}
+
+	// Load configuration
+	cfg, warnings, err := config.Load()
+	if err != nil {
+		var invalid config.ValidationErrors
+		if errors.As(err, &invalid) {
+			fmt.Fprintln(os.Stderr, "Refusing to start with an invalid configuration:")
+			for _, p := range invalid {
+				fmt.Fprintln(os.Stderr, "  "+p.String())
+			}
+			return errors.New("invalid configuration")
+		}
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	// Initialize logger
+	log, logOutputs, err := logger.Open(cfg.Logging)
+	if err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+	defer logOutputs.Close()
+	log.Info("Starting SilentRig server", "mode", cfg.Server.Mode, "version", Version)
+	for _, p := range warnings {
+		log.Warn("Insecure configuration", "field", p.Field, "problem", p.Message)
+	}
+
+	// Initialize database
+	db, err := database.New(cfg.Database.Path, log.Component("database"))
+	if err != nil {
+		log.Fatal("Failed to initialize database", "error", err)
+	}
+
+	// Initialize registry
+	reg := registry.New(db, log.Component("registry"), cfg.Liveness)
+	reg.SetEnrollmentRequired(cfg.Enrollment.Required)
+	reg.SetCredentialGrace(cfg.Enrollment.CredentialGrace)
+	reg.SetCloneWindow(cfg.Enrollment.CloneWindow)
+	reg.SetDecommission(cfg.Decommission)
+	if err := ensureOperator(reg, cfg, log); err != nil {
+		log.Fatal("Failed to check operator accounts", "error", err)
+	}
+
+	// Safe-to-change settings are applied on SIGHUP or when the config
+	// file changes
+	store := config.NewStore(cfg)
+	logging := cfg.Logging
+	store.Subscribe(func(next *config.Config) {
+		reg.SetLiveness(next.Liveness)
+		reg.SetEnrollmentRequired(next.Enrollment.Required)
+		reg.SetCredentialGrace(next.Enrollment.CredentialGrace)
+		reg.SetCloneWindow(next.Enrollment.CloneWindow)
+		reg.SetDecommission(next.Decommission)
+		// Levels changed at runtime through the API are kept unless the
+		// file changes them
+		if next.Logging.Level != logging.Level {
+			if err := log.SetLevel(next.Logging.Level); err != nil {
+				log.Warn("Invalid log level in reloaded configuration", "level", next.Logging.Level, "error", err)
+			}
+		}
+		if !maps.Equal(next.Logging.Components, logging.Components) {
+			if err := log.SetComponentLevels(next.Logging.Components); err != nil {
+				log.Warn("Invalid component log level in reloaded configuration", "error", err)
+			}
+		}
+		logging = next.Logging
+	})
+	onReload := func(changed []string, err error) {
+		switch {
+		case err != nil:
+			log.Error("Configuration reload rejected", "error", err)
+		case len(changed) == 0:
+			log.Info("Configuration reloaded without changes")
+		default:
+			log.Info("Configuration reloaded", "changed", changed)
+		}
+		if err != nil || len(changed) > 0 {
+			reg.Audit(registry.AuditRecord{
+				Actor: registry.ActorSystem, Action: registry.AuditConfigReload, TargetType: "config",
+				After: map[string][]string{"changed": changed}, Err: err,
+			})
+		}
+	}
+
+	// Background workers are owned by the supervisor and stopped in
+	// reverse order on shutdown
+	supervisor := lifecycle.New(log)
+	supervisor.Add("liveness", reg.RunLivenessChecks)
+	supervisor.Add("session-cleanup", reg.RunSessionCleanup)
+	supervisor.Add("decommission-purge", reg.RunDecommissionPurge)
+	supervisor.Add("config-watcher", func(ctx context.Context) error {
+		return store.Watch(ctx, onReload)
+	})
+
+	// The built-in CA issues client certificates for the agent listener
+	var ca *pki.CA
+	if cfg.CA.Enabled {
+		ca, err = pki.LoadOrCreate(cfg.CA.Dir, cfg.CA.CertValidity, db)
+		if err != nil {
+			log.Fatal("Failed to load certificate authority", "error", err)
+		}
+	}
+
+	// Initialize API server
+	server, err := api.New(store, reg, log, supervisor, ca)
+	if err != nil {
+		log.Fatal("Failed to set up listeners", "error", err)
+	}
+	for _, l := range server.Listeners() {
+		log.Info("Listening", "listener", l.Name, "address", l.Address, "port", l.Port, "routes", l.Routes, "tls", l.TLS.Enabled, "client_auth", l.TLS.ClientAuth)
+	}
+
+	ctx, cancelWorkers := context.WithCancel(context.Background())
+	defer cancelWorkers()
+	supervisor.Start(ctx)
+
+	// Start server in background
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Start()
+	}()
+
+	// Wait for shutdown signal, reloading the configuration on SIGHUP
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case sig := <-sigChan:
+			if sig == syscall.SIGHUP {
+				log.Info("Reloading configuration")
+				onReload(store.Reload())
+				continue
+			}
+			log.Info("Shutting down server...", "signal", sig.String())
+			break wait
+		case err := <-serverErr:
+			log.Error("Server stopped unexpectedly", "error", err)
+			break wait
+		}
+	}
+
+	// Graceful shutdown: stop accepting requests first, then the workers
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), store.Current().Server.ShutdownTimeout)
+	defer cancel()
+
+	failed := false
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error("Error during server shutdown", "error", err)
+		failed = true
+	}
+	if err := supervisor.Stop(shutdownCtx); err != nil {
+		log.Error("Error stopping background workers", "error", err)
+		failed = true
+	}
+	if err := db.Close(); err != nil {
+		log.Error("Error closing database", "error", err)
+		failed = true
+	}
+
+	if failed {
+		return errors.New("shutdown did not complete cleanly")
+	}
+	log.Info("Server shutdown complete")
+	return nil
+}
+
+// ensureOperator makes sure someone can log in. Development servers without
+// accounts get the well-known development admin; production servers only
+// warn, since accounts must be created with `silentrig user add`.
+func ensureOperator(reg *registry.Registry, cfg *config.Config, log logger.Logger) error {
+	n, err := reg.CountUsers()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	if cfg.Server.Mode == config.ModeProduction {
+		log.Warn("No operator accounts exist; create one with `silentrig user add`")
+		return nil
+	}
+	if _, err := reg.CreateUser(devAdminUsername, devAdminPassword, auth.RoleSuperAdmin, database.DefaultOrg); err != nil {
+		return err
+	}
+	log.Warn("Created development account; change its password with `silentrig user passwd`", "username", devAdminUsername)
+	return nil
+}
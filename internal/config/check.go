@@ -0,0 +1,87 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces the value of sensitive settings in printed output
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are the key suffixes whose values are never printed
+var sensitiveKeys = []string{"secret", "password", "private_key", "token"}
+
+// Effective returns the merged settings from defaults, the config file and
+// the environment, with sensitive values redacted
+func Effective() map[string]interface{} {
+	return redact(viper.AllSettings())
+}
+
+func redact(settings map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			out[key] = redact(v)
+		default:
+			if isSensitive(key) && fmt.Sprint(v) != "" {
+				out[key] = redacted
+			} else {
+				out[key] = v
+			}
+		}
+	}
+	return out
+}
+
+func isSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, suffix := range sensitiveKeys {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteCheck prints the effective configuration and the validation report
+// of cfg to w. It reports whether the configuration is free of errors.
+func WriteCheck(w io.Writer, cfg *Config) (bool, error) {
+	source := viper.ConfigFileUsed()
+	if source == "" {
+		source = "none, using defaults and environment"
+	}
+	fmt.Fprintf(w, "# config file: %s\n", source)
+
+	out, err := yaml.Marshal(Effective())
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Write(out); err != nil {
+		return false, err
+	}
+
+	report := cfg.Check()
+	fmt.Fprintln(w)
+	writeProblems(w, "warning", report.Warnings)
+	writeProblems(w, "error", report.Errors)
+	if report.OK() {
+		fmt.Fprintf(w, "configuration is valid (%s mode, %d warnings)\n", cfg.Server.Mode, len(report.Warnings))
+	} else {
+		fmt.Fprintf(w, "configuration is invalid: %d errors, %d warnings\n", len(report.Errors), len(report.Warnings))
+	}
+	return report.OK(), nil
+}
+
+func writeProblems(w io.Writer, kind string, problems []Problem) {
+	sorted := append([]Problem(nil), problems...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Field < sorted[j].Field })
+	for _, p := range sorted {
+		fmt.Fprintf(w, "%s: %s\n", kind, p)
+	}
+}
@@ -1,8 +1,11 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/spf13/viper"
@@ -13,76 +16,620 @@ type Config struct {
 	Database DatabaseConfig `mapstructure:"database"`
 	JWT      JWTConfig      `mapstructure:"jwt"`
 	CORS     CORSConfig     `mapstructure:"cors"`
+	Liveness LivenessConfig `mapstructure:"liveness"`
+	Logging  LoggingConfig  `mapstructure:"logging"`
+
+	Enrollment EnrollmentConfig `mapstructure:"enrollment"`
+	CA         CAConfig         `mapstructure:"ca"`
+	OIDC       OIDCConfig       `mapstructure:"oidc"`
+	TwoFactor  TwoFactorConfig  `mapstructure:"two_factor"`
+	RateLimit  RateLimitConfig  `mapstructure:"rate_limit"`
+
+	Decommission DecommissionConfig `mapstructure:"decommission"`
 }
 
 type ServerConfig struct {
+	// Mode is "development" or "production". Production refuses to start
+	// with insecure settings.
+	Mode            string        `mapstructure:"mode"`
 	Address         string        `mapstructure:"address"`
 	Port            int           `mapstructure:"port"`
 	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+	// PublicURL is the address agents use to reach the server, written into
+	// generated installers. Derived from the request when empty.
+	PublicURL string    `mapstructure:"public_url"`
+	TLS       TLSConfig `mapstructure:"tls"`
+
+	AgentListener AgentListenerConfig `mapstructure:"agent_listener"`
+
+	// Listeners replaces the single listener described by Address, Port,
+	// TLS and AgentListener when set
+	Listeners []ListenerConfig `mapstructure:"listeners"`
+
+	// MetricsToken is the bearer token required by /metrics. The endpoint
+	// is unauthenticated when empty.
+	MetricsToken string `mapstructure:"metrics_token"`
+}
+
+// TLSConfig enables HTTPS. The certificate and key are reloaded when the
+// files change.
+type TLSConfig struct {
+	Enabled  bool   `mapstructure:"enabled"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// MinVersion is "1.2" or "1.3"
+	MinVersion string `mapstructure:"min_version"`
+	// CipherPolicy is "default" for Go's defaults or "intermediate" to only
+	// allow forward-secret AEAD suites with TLS 1.2
+	CipherPolicy string `mapstructure:"cipher_policy"`
+}
+
+// AgentListenerConfig describes an optional separate HTTPS listener for
+// agents that requires client certificates issued by the built-in CA.
+// Without its own certificate it uses the one from server.tls.
+type AgentListenerConfig struct {
+	Enabled   bool   `mapstructure:"enabled"`
+	Address   string `mapstructure:"address"`
+	Port      int    `mapstructure:"port"`
+	PublicURL string `mapstructure:"public_url"`
+	CertFile  string `mapstructure:"cert_file"`
+	KeyFile   string `mapstructure:"key_file"`
+}
+
+// Route sets a listener can mount
+const (
+	// RoutesOperator is the operator API, WebSocket, JSON-RPC, login and
+	// the dashboard
+	RoutesOperator = "operator"
+	// RoutesAgent is agent registration, heartbeats, metrics and commands
+	RoutesAgent = "agent"
+	// RoutesMetrics is the Prometheus metrics endpoint
+	RoutesMetrics = "metrics"
+)
+
+// Client authentication modes of a listener
+const (
+	ClientAuthNone = "none"
+	// ClientAuthAgent requires client certificates issued by the built-in
+	// CA and limits agents to their own routes
+	ClientAuthAgent = "agent"
+)
+
+// ListenerConfig is one HTTP listener serving a selection of route sets
+// with its own TLS and CORS settings
+type ListenerConfig struct {
+	Name      string `mapstructure:"name"`
+	Address   string `mapstructure:"address"`
+	Port      int    `mapstructure:"port"`
+	PublicURL string `mapstructure:"public_url"`
+	// Routes lists the mounted route sets: "operator", "agent" and
+	// "metrics". /health is served on every listener.
+	Routes []string          `mapstructure:"routes"`
+	TLS    ListenerTLSConfig `mapstructure:"tls"`
+	// CORS replaces the global cors settings for this listener when set
+	CORS *CORSConfig `mapstructure:"cors"`
+}
+
+// ListenerTLSConfig is the TLS configuration of a listener. Empty
+// certificate, version and cipher settings are taken from server.tls.
+type ListenerTLSConfig struct {
+	TLSConfig `mapstructure:",squash"`
+	// ClientAuth is "none" or "agent"
+	ClientAuth string `mapstructure:"client_auth"`
+}
+
+// Serves reports whether the listener mounts the given route set
+func (l *ListenerConfig) Serves(routes string) bool {
+	for _, r := range l.Routes {
+		if r == routes {
+			return true
+		}
+	}
+	return false
+}
+
+// EffectiveListeners returns the listeners to start. Without explicit
+// listeners these are the main listener serving every route set except
+// metrics and, if enabled, the agent listener. Settings left empty are
+// inherited from the server section.
+func (s *ServerConfig) EffectiveListeners() []ListenerConfig {
+	listeners := s.Listeners
+	if len(listeners) == 0 {
+		listeners = []ListenerConfig{{
+			Name:      "main",
+			Address:   s.Address,
+			Port:      s.Port,
+			PublicURL: s.PublicURL,
+			Routes:    []string{RoutesOperator, RoutesAgent},
+			TLS:       ListenerTLSConfig{TLSConfig: s.TLS},
+		}}
+		if a := s.AgentListener; a.Enabled {
+			listeners = append(listeners, ListenerConfig{
+				Name:      "agent",
+				Address:   a.Address,
+				Port:      a.Port,
+				PublicURL: a.PublicURL,
+				Routes:    []string{RoutesAgent},
+				TLS: ListenerTLSConfig{
+					TLSConfig:  TLSConfig{Enabled: true, CertFile: a.CertFile, KeyFile: a.KeyFile},
+					ClientAuth: ClientAuthAgent,
+				},
+			})
+		}
+	}
+
+	effective := make([]ListenerConfig, len(listeners))
+	for i, l := range listeners {
+		if l.Address == "" {
+			l.Address = s.Address
+		}
+		if l.TLS.CertFile == "" && l.TLS.KeyFile == "" {
+			l.TLS.CertFile, l.TLS.KeyFile = s.TLS.CertFile, s.TLS.KeyFile
+		}
+		if l.TLS.MinVersion == "" {
+			l.TLS.MinVersion = s.TLS.MinVersion
+		}
+		if l.TLS.CipherPolicy == "" {
+			l.TLS.CipherPolicy = s.TLS.CipherPolicy
+		}
+		if l.TLS.ClientAuth == "" {
+			l.TLS.ClientAuth = ClientAuthNone
+		}
+		effective[i] = l
+	}
+	return effective
+}
+
+// CAConfig controls the built-in certificate authority issuing agent client
+// certificates
+type CAConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Dir     string `mapstructure:"dir"`
+	// CertValidity is the lifetime of issued agent certificates
+	CertValidity time.Duration `mapstructure:"cert_validity"`
 }
 
 type DatabaseConfig struct {
 	Path string `mapstructure:"path"`
 }
 
+// Token signing algorithms
+const (
+	JWTAlgorithmHS256 = "HS256"
+	JWTAlgorithmRS256 = "RS256"
+	JWTAlgorithmEdDSA = "EdDSA"
+)
+
 type JWTConfig struct {
-	Secret     string        `mapstructure:"secret"`
+	// Algorithm is HS256, signing with Secret, or RS256 or EdDSA, signing
+	// with generated keys that are published as a JWKS
+	Algorithm string `mapstructure:"algorithm"`
+	Secret    string `mapstructure:"secret"`
+	// Expiration is the lifetime of access tokens
 	Expiration time.Duration `mapstructure:"expiration"`
+	// RefreshExpiration is how long a session lasts without being refreshed
+	RefreshExpiration time.Duration `mapstructure:"refresh_expiration"`
+	// SessionMaxAge ends sessions this long after login however often they
+	// are refreshed, so a stolen refresh token is not good forever; zero
+	// disables it
+	SessionMaxAge time.Duration `mapstructure:"session_max_age"`
+	// RotationInterval is the age at which a signing key is replaced; zero
+	// disables scheduled rotation
+	RotationInterval time.Duration `mapstructure:"rotation_interval"`
+	// GracePeriod is how long a replaced key still verifies tokens
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+}
+
+// Asymmetric reports whether tokens are signed with generated key pairs
+func (j *JWTConfig) Asymmetric() bool {
+	return j.Algorithm != JWTAlgorithmHS256
 }
 
 type CORSConfig struct {
-	AllowedOrigins []string `mapstructure:"allowed_origins"`
-	AllowedMethods []string `mapstructure:"allowed_methods"`
-	AllowedHeaders []string `mapstructure:"allowed_headers"`
+	AllowedOrigins   []string `mapstructure:"allowed_origins"`
+	AllowedMethods   []string `mapstructure:"allowed_methods"`
+	AllowedHeaders   []string `mapstructure:"allowed_headers"`
+	AllowCredentials bool     `mapstructure:"allow_credentials"`
+}
+
+// LivenessConfig controls when agents that stop sending heartbeats are
+// considered stale and then offline. Agents that report their heartbeat
+// interval get thresholds derived from it; overrides take precedence over
+// both.
+type LivenessConfig struct {
+	CheckInterval           time.Duration      `mapstructure:"check_interval"`
+	StaleAfter              time.Duration      `mapstructure:"stale_after"`
+	OfflineAfter            time.Duration      `mapstructure:"offline_after"`
+	StaleMissedHeartbeats   int                `mapstructure:"stale_missed_heartbeats"`
+	OfflineMissedHeartbeats int                `mapstructure:"offline_missed_heartbeats"`
+	Overrides               []LivenessOverride `mapstructure:"overrides"`
+}
+
+// LivenessOverride applies custom thresholds to agents carrying all of the
+// given labels and groups
+type LivenessOverride struct {
+	Labels       map[string]string `mapstructure:"labels"`
+	Groups       []string          `mapstructure:"groups"`
+	StaleAfter   time.Duration     `mapstructure:"stale_after"`
+	OfflineAfter time.Duration     `mapstructure:"offline_after"`
+}
+
+// EnrollmentConfig controls how new agents join. When Required is set, an
+// agent registering for the first time must present an enrollment token
+// created with `silentrig token create`.
+type EnrollmentConfig struct {
+	Required bool `mapstructure:"required"`
+	// CredentialGrace is how long an agent's previous token stays valid
+	// after its credentials were rotated
+	CredentialGrace time.Duration `mapstructure:"credential_grace"`
+	// CloneWindow is how long an address an agent used counts as in use
+	// when detecting cloned agents; zero disables detection
+	CloneWindow time.Duration `mapstructure:"clone_window"`
+}
+
+// DecommissionConfig controls how long deleted agents are kept. Deleting an
+// agent decommissions it; it is purged once Retention has passed, after a
+// final export of its history was written to ExportDir.
+type DecommissionConfig struct {
+	Retention time.Duration `mapstructure:"retention"`
+	ExportDir string        `mapstructure:"export_dir"`
+	// ExportFormat is "json" or "csv"
+	ExportFormat string `mapstructure:"export_format"`
+}
+
+// OIDCConfig enables operator login through an OpenID Connect provider
+// with the authorization code flow and PKCE. Users are matched by the
+// provider's subject and, with AutoProvision, created on their first login.
+type OIDCConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Issuer is the provider's issuer URL; its configuration is discovered
+	// from /.well-known/openid-configuration below it
+	Issuer   string `mapstructure:"issuer"`
+	ClientID string `mapstructure:"client_id"`
+	// ClientSecret is empty for public clients
+	ClientSecret string `mapstructure:"client_secret"`
+	// RedirectURL is the callback registered with the provider, ending in
+	// /api/v1/auth/oidc/callback
+	RedirectURL string   `mapstructure:"redirect_url"`
+	Scopes      []string `mapstructure:"scopes"`
+	// DisplayName labels the login button
+	DisplayName string `mapstructure:"display_name"`
+
+	// UsernameClaim names the claim used as silentrig username, falling
+	// back to email
+	UsernameClaim string `mapstructure:"username_claim"`
+	// GroupsClaim names the claim listing the user's groups
+	GroupsClaim string `mapstructure:"groups_claim"`
+	// RoleMapping maps roles to the groups granting them. Users in groups
+	// of several roles get the most privileged one.
+	RoleMapping map[string][]string `mapstructure:"role_mapping"`
+	// DefaultRole is given to users in none of the mapped groups; empty
+	// denies them access
+	DefaultRole   string `mapstructure:"default_role"`
+	AutoProvision bool   `mapstructure:"auto_provision"`
+	// Organization is the organization provisioned users join
+	Organization string `mapstructure:"organization"`
+}
+
+// TwoFactorConfig controls TOTP two-factor authentication of password
+// logins. Users with a required role must set it up at their next login;
+// others may opt in.
+type TwoFactorConfig struct {
+	RequiredRoles []string `mapstructure:"required_roles"`
+	// Issuer names silentrig in authenticator apps
+	Issuer string `mapstructure:"issuer"`
+}
+
+// Requires reports whether users with the given role must use a second
+// factor
+func (t *TwoFactorConfig) Requires(role string) bool {
+	for _, r := range t.RequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Rate limit keys select whose requests share a token bucket
+const (
+	RateLimitKeyIP = "ip"
+	// RateLimitKeyAgent keys by the authenticated agent
+	RateLimitKeyAgent = "agent"
+	// RateLimitKeyUser keys by the authenticated user, including the owner
+	// of an API key
+	RateLimitKeyUser = "user"
+	// RateLimitKeyAPIKey keys by the API key of a request
+	RateLimitKeyAPIKey = "api_key"
+)
+
+// RateLimitConfig limits requests per client with token buckets and locks
+// usernames out after failed logins
+type RateLimitConfig struct {
+	Enabled bool            `mapstructure:"enabled"`
+	Rules   []RateLimitRule `mapstructure:"rules"`
+	// Lockout applies to logins even when Enabled is false
+	Lockout LoginLockoutConfig `mapstructure:"lockout"`
 }
 
-func Load() (*Config, error) {
+// RateLimitRule gives each client of the matching routes a token bucket.
+// Every matching rule applies.
+type RateLimitRule struct {
+	Name string `mapstructure:"name"`
+	// Routes are route patterns such as /api/v1/agents/:id, optionally
+	// preceded by a method as in "POST /api/v1/agents/:id/metrics". A
+	// trailing /* matches every route below.
+	Routes []string `mapstructure:"routes"`
+	// Key is one of the RateLimitKey constants. Rules keyed by IP apply
+	// before authentication, rules keyed by agent once an agent has
+	// authenticated and rules keyed by user or API key once a user has.
+	Key      string        `mapstructure:"key"`
+	Requests int           `mapstructure:"requests"`
+	Period   time.Duration `mapstructure:"period"`
+	// Burst is the bucket size; 0 means Requests
+	Burst int `mapstructure:"burst"`
+}
+
+// Matches reports whether the rule covers a request to a route pattern
+func (r *RateLimitRule) Matches(method, route string) bool {
+	for _, pattern := range r.Routes {
+		if m, path, ok := strings.Cut(pattern, " "); ok {
+			if !strings.EqualFold(m, method) {
+				continue
+			}
+			pattern = path
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+			if route == prefix || strings.HasPrefix(route, prefix+"/") {
+				return true
+			}
+		} else if route == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// LoginLockoutConfig locks a username out for a client IP after
+// MaxFailures failed logins in a row from it, for Duration at first and twice as long after every further
+// failure, up to MaxDuration. Failures are forgotten after ResetAfter.
+type LoginLockoutConfig struct {
+	// MaxFailures of 0 disables lockouts
+	MaxFailures int           `mapstructure:"max_failures"`
+	Duration    time.Duration `mapstructure:"duration"`
+	MaxDuration time.Duration `mapstructure:"max_duration"`
+	ResetAfter  time.Duration `mapstructure:"reset_after"`
+}
+
+type LoggingConfig struct {
+	Level string `mapstructure:"level"`
+	// Format is "json" or "text"
+	Format string `mapstructure:"format"`
+	// Components overrides the level of individual components, see
+	// LogComponents
+	Components map[string]string `mapstructure:"components"`
+	// Outputs lists where logs are written, stdout when empty
+	Outputs []LogOutputConfig `mapstructure:"outputs"`
+}
+
+// LogComponents are the components whose level can be set separately
+var LogComponents = []string{"api", "auth", "database", "registry"}
+
+// Log output types
+const (
+	LogOutputStdout = "stdout"
+	LogOutputStderr = "stderr"
+	LogOutputFile   = "file"
+	LogOutputSyslog = "syslog"
+)
+
+// LogOutputConfig is one destination for log entries
+type LogOutputConfig struct {
+	// Type is "stdout", "stderr", "file" or "syslog"
+	Type string `mapstructure:"type"`
+
+	// Path of a file output. The file is rotated once it grows beyond
+	// MaxSizeMB or gets older than MaxAge; MaxBackups limits the rotated
+	// files kept, 0 keeps all of them.
+	Path       string        `mapstructure:"path"`
+	MaxSizeMB  int           `mapstructure:"max_size_mb"`
+	MaxAge     time.Duration `mapstructure:"max_age"`
+	MaxBackups int           `mapstructure:"max_backups"`
+
+	// Network ("unixgram", "udp" or "tcp") and address of a syslog output.
+	// Both empty use the local syslog socket, which journald also serves.
+	Network string `mapstructure:"network"`
+	Address string `mapstructure:"address"`
+	// Tag of syslog messages, "silentrig" when empty
+	Tag string `mapstructure:"tag"`
+}
+
+// Load reads and validates the configuration and prepares the environment
+// it refers to. It returns the warnings about the configuration as read,
+// before the placeholder JWT secret is replaced. Validation problems are
+// returned as ValidationErrors.
+func Load() (*Config, []Problem, error) {
+	config, err := Read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	report := config.Check()
+	if !report.OK() {
+		return nil, nil, ValidationErrors(report.Errors)
+	}
+
+	// Ensure database directory exists
+	if err := ensureDatabaseDir(config.Database.Path); err != nil {
+		return nil, nil, err
+	}
+
+	// Generate JWT secret if not set
+	if config.JWT.Secret == defaultJWTSecret {
+		config.JWT.Secret = generateRandomSecret()
+	}
+
+	return config, report.Warnings, nil
+}
+
+// Read merges defaults, the config file, the environment and flags into a
+// Config without validating it or touching the file system
+func Read() (*Config, error) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
 	viper.AddConfigPath("./config")
 	viper.AddConfigPath(".")
+	if file := configFile(); file != "" {
+		viper.SetConfigFile(file)
+	}
 
 	// Set defaults
 	setDefaults()
 
-	// Read config file
+	// Bind environment variables
+	if err := bindEnv(); err != nil {
+		return nil, err
+	}
+
+	return read()
+}
+
+// read reads the config file, if any, and unmarshals the merged settings.
+// Precedence from lowest to highest is defaults, config file, environment
+// and command-line flags.
+func read() (*Config, error) {
 	if err := viper.ReadInConfig(); err != nil {
 		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
 			return nil, err
 		}
 	}
-
-	// Bind environment variables
-	viper.AutomaticEnv()
-
-	var config Config
-	if err := viper.Unmarshal(&config); err != nil {
+	if err := applyFileEnv(); err != nil {
 		return nil, err
 	}
 
-	// Ensure database directory exists
-	if err := ensureDatabaseDir(config.Database.Path); err != nil {
+	var config Config
+	if err := viper.Unmarshal(&config); err != nil {
 		return nil, err
 	}
-
-	// Generate JWT secret if not set
-	if config.JWT.Secret == "your-secret-key-change-this" {
-		config.JWT.Secret = generateRandomSecret()
-	}
-
 	return &config, nil
 }
 
+// defaultJWTSecret is the placeholder secret replaced at startup
+const defaultJWTSecret = "your-secret-key-change-this"
+
 func setDefaults() {
+	viper.SetDefault("server.mode", ModeDevelopment)
 	viper.SetDefault("server.address", "0.0.0.0")
 	viper.SetDefault("server.port", 8080)
 	viper.SetDefault("server.shutdown_timeout", "30s")
+	viper.SetDefault("server.public_url", "")
+	viper.SetDefault("server.tls.enabled", false)
+	viper.SetDefault("server.tls.cert_file", "")
+	viper.SetDefault("server.tls.key_file", "")
+	viper.SetDefault("server.tls.min_version", "1.2")
+	viper.SetDefault("server.tls.cipher_policy", "default")
+	viper.SetDefault("server.agent_listener.enabled", false)
+	viper.SetDefault("server.agent_listener.address", "0.0.0.0")
+	viper.SetDefault("server.agent_listener.port", 8443)
+	viper.SetDefault("server.agent_listener.public_url", "")
+	viper.SetDefault("server.agent_listener.cert_file", "")
+	viper.SetDefault("server.agent_listener.key_file", "")
+	viper.SetDefault("server.metrics_token", "")
 	viper.SetDefault("database.path", "./data/silentrig.db")
-	viper.SetDefault("jwt.secret", "your-secret-key-change-this")
-	viper.SetDefault("jwt.expiration", "24h")
+	viper.SetDefault("jwt.algorithm", JWTAlgorithmHS256)
+	viper.SetDefault("jwt.secret", defaultJWTSecret)
+	viper.SetDefault("jwt.expiration", "15m")
+	viper.SetDefault("jwt.refresh_expiration", "168h")
+	viper.SetDefault("jwt.session_max_age", "720h")
+	viper.SetDefault("jwt.rotation_interval", "720h")
+	viper.SetDefault("jwt.grace_period", "24h")
 	viper.SetDefault("cors.allowed_origins", []string{"*"})
-	viper.SetDefault("cors.allowed_methods", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
+	viper.SetDefault("cors.allowed_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
 	viper.SetDefault("cors.allowed_headers", []string{"*"})
+	viper.SetDefault("cors.allow_credentials", false)
+	viper.SetDefault("liveness.check_interval", "30s")
+	viper.SetDefault("liveness.stale_after", "2m")
+	viper.SetDefault("liveness.offline_after", "10m")
+	viper.SetDefault("liveness.stale_missed_heartbeats", 3)
+	viper.SetDefault("liveness.offline_missed_heartbeats", 20)
+	viper.SetDefault("enrollment.required", false)
+	viper.SetDefault("enrollment.credential_grace", "24h")
+	viper.SetDefault("enrollment.clone_window", "10m")
+	viper.SetDefault("decommission.retention", "720h")
+	viper.SetDefault("decommission.export_dir", "./data/exports")
+	viper.SetDefault("decommission.export_format", "json")
+	viper.SetDefault("ca.enabled", false)
+	viper.SetDefault("ca.dir", "./data/ca")
+	viper.SetDefault("ca.cert_validity", "8760h")
+	viper.SetDefault("oidc.enabled", false)
+	viper.SetDefault("oidc.issuer", "")
+	viper.SetDefault("oidc.client_id", "")
+	viper.SetDefault("oidc.client_secret", "")
+	viper.SetDefault("oidc.redirect_url", "")
+	viper.SetDefault("oidc.scopes", []string{"openid", "profile", "email"})
+	viper.SetDefault("oidc.display_name", "Single sign-on")
+	viper.SetDefault("oidc.username_claim", "preferred_username")
+	viper.SetDefault("oidc.groups_claim", "groups")
+	viper.SetDefault("oidc.default_role", "")
+	viper.SetDefault("oidc.auto_provision", true)
+	viper.SetDefault("oidc.organization", "default")
+	viper.SetDefault("two_factor.required_roles", []string{})
+	viper.SetDefault("two_factor.issuer", "silentrig")
+	viper.SetDefault("rate_limit.enabled", true)
+	viper.SetDefault("rate_limit.rules", defaultRateLimitRules)
+	viper.SetDefault("rate_limit.lockout.max_failures", 5)
+	viper.SetDefault("rate_limit.lockout.duration", "1m")
+	viper.SetDefault("rate_limit.lockout.max_duration", "1h")
+	viper.SetDefault("rate_limit.lockout.reset_after", "24h")
+
+	logLevel := os.Getenv("LOG_LEVEL")
+	if logLevel == "" {
+		logLevel = "info"
+	}
+	viper.SetDefault("logging.level", logLevel)
+	viper.SetDefault("logging.format", "json")
+}
+
+// defaultRateLimitRules throttle password guessing, registration floods,
+// chatty agents and runaway scripts
+var defaultRateLimitRules = []map[string]interface{}{
+	{
+		"name": "login",
+		"routes": []string{
+			"/api/v1/auth/login", "/api/v1/auth/login/2fa/*", "/api/v1/auth/refresh",
+			"/api/v1/auth/oidc/login", "/api/v1/auth/oidc/callback",
+		},
+		"key": RateLimitKeyIP, "requests": 10, "period": "1m", "burst": 10,
+	},
+	{
+		"name":   "register",
+		"routes": []string{"/api/v1/agents/register"},
+		"key":    RateLimitKeyIP, "requests": 60, "period": "1m", "burst": 30,
+	},
+	{
+		"name": "agent",
+		"routes": []string{
+			"POST /api/v1/agents/:id/heartbeat", "POST /api/v1/agents/:id/metrics",
+			"GET /api/v1/agents/:id/commands", "POST /api/v1/agents/:id/commands/:commandId/status",
+		},
+		"key": RateLimitKeyAgent, "requests": 120, "period": "1m", "burst": 60,
+	},
+	{
+		// Agent traffic per address before authentication; rigs behind
+		// one NAT address share the bucket
+		"name": "agent-ip",
+		"routes": []string{
+			"POST /api/v1/agents/:id/heartbeat", "POST /api/v1/agents/:id/metrics",
+			"GET /api/v1/agents/:id/commands", "POST /api/v1/agents/:id/commands/:commandId/status",
+			"POST /api/v1/agents/:id/credentials",
+		},
+		"key": RateLimitKeyIP, "requests": 1200, "period": "1m", "burst": 600,
+	},
+	{
+		"name":   "api",
+		"routes": []string{"/api/v1/*"},
+		"key":    RateLimitKeyUser, "requests": 600, "period": "1m", "burst": 120,
+	},
 }
 
 func ensureDatabaseDir(dbPath string) error {
@@ -90,7 +637,12 @@ func ensureDatabaseDir(dbPath string) error {
 	return os.MkdirAll(dir, 0755)
 }
 
+// generateRandomSecret returns a random secret for development setups that
+// keep the placeholder. Tokens signed with it do not survive a restart.
 func generateRandomSecret() string {
-	// In production, use a proper random generator
-	return "silentrig-secret-" + time.Now().Format("20060102150405")
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic("failed to generate JWT secret: " + err.Error())
+	}
+	return hex.EncodeToString(b)
 } 
\ No newline at end of file
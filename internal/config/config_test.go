@@ -0,0 +1,189 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// readLayers reads the configuration from a config file with the given
+// contents, if any, the given environment and command-line arguments
+func readLayers(t *testing.T, file string, env map[string]string, args []string) *Config {
+	t.Helper()
+	setLayers(t, file, env, args)
+	cfg, err := Read()
+	if err != nil {
+		t.Fatalf("read config: %v", err)
+	}
+	return cfg
+}
+
+// setLayers sets up a config file, environment and flags for Read
+func setLayers(t *testing.T, file string, env map[string]string, args []string) {
+	t.Helper()
+	viper.Reset()
+	configFileFlag = ""
+	flagOverrides = map[string]bool{}
+	t.Cleanup(func() {
+		viper.Reset()
+		configFileFlag = ""
+		flagOverrides = map[string]bool{}
+	})
+
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(file), 0o600); err != nil {
+			t.Fatalf("write config file: %v", err)
+		}
+		t.Setenv(configFileEnv, path)
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	flags.Apply()
+}
+
+func TestPrecedence(t *testing.T) {
+	const file = `
+server:
+  port: 9000
+  mode: production
+database:
+  path: /file/silentrig.db
+logging:
+  level: warn
+`
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		args []string
+
+		port        int
+		mode        string
+		dbPath      string
+		level       string
+		cloneWindow time.Duration
+	}{
+		{
+			name: "defaults",
+			port: 8080, mode: ModeDevelopment, dbPath: "./data/silentrig.db", level: "info", cloneWindow: 10 * time.Minute,
+		},
+		{
+			name: "file over defaults",
+			file: file,
+			port: 9000, mode: ModeProduction, dbPath: "/file/silentrig.db", level: "warn", cloneWindow: 10 * time.Minute,
+		},
+		{
+			name: "env over file",
+			file: file,
+			env:  map[string]string{"SILENTRIG_SERVER_PORT": "9100", "SILENTRIG_LOGGING_LEVEL": "error"},
+			port: 9100, mode: ModeProduction, dbPath: "/file/silentrig.db", level: "error", cloneWindow: 10 * time.Minute,
+		},
+		{
+			name: "env over defaults without a file",
+			env:  map[string]string{"SILENTRIG_SERVER_PORT": "9100", "SILENTRIG_DATABASE_PATH": "/env/silentrig.db"},
+			port: 9100, mode: ModeDevelopment, dbPath: "/env/silentrig.db", level: "info", cloneWindow: 10 * time.Minute,
+		},
+		{
+			name: "env-only key",
+			file: file,
+			env:  map[string]string{"SILENTRIG_ENROLLMENT_CLONE_WINDOW": "1m"},
+			port: 9000, mode: ModeProduction, dbPath: "/file/silentrig.db", level: "warn", cloneWindow: time.Minute,
+		},
+		{
+			name: "flags over env and file",
+			file: file,
+			env:  map[string]string{"SILENTRIG_SERVER_PORT": "9100", "SILENTRIG_DATABASE_PATH": "/env/silentrig.db"},
+			args: []string{"--port", "9200", "--db", "/flag/silentrig.db", "--log-level", "debug"},
+			port: 9200, mode: ModeProduction, dbPath: "/flag/silentrig.db", level: "debug", cloneWindow: 10 * time.Minute,
+		},
+		{
+			name: "flags over defaults",
+			args: []string{"--mode", ModeProduction},
+			port: 8080, mode: ModeProduction, dbPath: "./data/silentrig.db", level: "info", cloneWindow: 10 * time.Minute,
+		},
+		{
+			name: "flags not given do not override",
+			file: file,
+			env:  map[string]string{"SILENTRIG_DATABASE_PATH": "/env/silentrig.db"},
+			args: []string{"--log-level", "debug"},
+			port: 9000, mode: ModeProduction, dbPath: "/env/silentrig.db", level: "debug", cloneWindow: 10 * time.Minute,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// LOG_LEVEL changes the default level
+			t.Setenv("LOG_LEVEL", "")
+			cfg := readLayers(t, tt.file, tt.env, tt.args)
+			if cfg.Server.Port != tt.port {
+				t.Errorf("server.port = %d, want %d", cfg.Server.Port, tt.port)
+			}
+			if cfg.Server.Mode != tt.mode {
+				t.Errorf("server.mode = %q, want %q", cfg.Server.Mode, tt.mode)
+			}
+			if cfg.Database.Path != tt.dbPath {
+				t.Errorf("database.path = %q, want %q", cfg.Database.Path, tt.dbPath)
+			}
+			if cfg.Logging.Level != tt.level {
+				t.Errorf("logging.level = %q, want %q", cfg.Logging.Level, tt.level)
+			}
+			if cfg.Enrollment.CloneWindow != tt.cloneWindow {
+				t.Errorf("enrollment.clone_window = %s, want %s", cfg.Enrollment.CloneWindow, tt.cloneWindow)
+			}
+		})
+	}
+}
+
+func TestFileEnvPrecedence(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "jwt")
+	if err := os.WriteFile(secret, []byte("secret-from-file\n"), 0o600); err != nil {
+		t.Fatalf("write secret: %v", err)
+	}
+
+	// A _FILE variable overrides the config file like the variable itself
+	cfg := readLayers(t, "jwt:\n  secret: secret-from-config\n", map[string]string{"SILENTRIG_JWT_SECRET_FILE": secret}, nil)
+	if cfg.JWT.Secret != "secret-from-file" {
+		t.Errorf("jwt.secret = %q, want the contents of the _FILE variable", cfg.JWT.Secret)
+	}
+
+	// A flag overrides a _FILE variable
+	cfg = readLayers(t, "", map[string]string{"SILENTRIG_DATABASE_PATH_FILE": secret}, []string{"--db", "/flag/silentrig.db"})
+	if cfg.Database.Path != "/flag/silentrig.db" {
+		t.Errorf("database.path = %q, want the flag", cfg.Database.Path)
+	}
+}
+
+func TestLoadWarnsAboutPlaceholderSecret(t *testing.T) {
+	setLayers(t, "", map[string]string{
+		"SILENTRIG_JWT_SECRET":    defaultJWTSecret,
+		"SILENTRIG_DATABASE_PATH": filepath.Join(t.TempDir(), "silentrig.db"),
+	}, nil)
+
+	cfg, warnings, err := Load()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cfg.JWT.Secret == defaultJWTSecret {
+		t.Error("the placeholder secret was not replaced")
+	}
+	found := false
+	for _, p := range warnings {
+		found = found || (p.Field == "jwt.secret" && strings.Contains(p.Message, "placeholder"))
+	}
+	if !found {
+		t.Errorf("no warning about the placeholder secret in %v", warnings)
+	}
+}
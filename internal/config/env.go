@@ -0,0 +1,155 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// EnvPrefix prefixes every environment variable read by the server. The
+// variable for a setting is the prefix followed by its path with dots
+// replaced by underscores, e.g. SILENTRIG_SERVER_PORT for server.port.
+const EnvPrefix = "SILENTRIG"
+
+// fileSuffix marks an environment variable naming a file that holds the
+// value, as mounted by Docker and Kubernetes secrets
+const fileSuffix = "_FILE"
+
+// configFileEnv names an explicit config file, overriding the search paths
+const configFileEnv = EnvPrefix + "_CONFIG"
+
+var envReplacer = strings.NewReplacer(".", "_")
+
+// EnvName returns the environment variable that overrides a setting
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(envReplacer.Replace(key))
+}
+
+// Keys returns the path of every setting in Config, using the same keys as
+// the config file. Lists of structs such as liveness.overrides and maps such
+// as logging.components can only be set in the file and are left out.
+func Keys() []string {
+	var keys []string
+	collectKeys("", reflect.TypeOf(Config{}), &keys)
+	return keys
+}
+
+func collectKeys(prefix string, t reflect.Type, keys *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("mapstructure")
+		if name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		switch {
+		case field.Type.Kind() == reflect.Struct && field.Type.PkgPath() == t.PkgPath():
+			collectKeys(name, field.Type, keys)
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.Struct,
+			field.Type.Kind() == reflect.Map:
+			continue
+		default:
+			*keys = append(*keys, name)
+		}
+	}
+}
+
+// bindEnv maps every setting to its prefixed environment variable
+func bindEnv() error {
+	viper.SetEnvPrefix(EnvPrefix)
+	viper.SetEnvKeyReplacer(envReplacer)
+	viper.AutomaticEnv()
+
+	for _, key := range Keys() {
+		if err := viper.BindEnv(key, EnvName(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyFileEnv reads settings whose value is given in a file through a
+// <VAR>_FILE environment variable. It is called on every read so rotated
+// secrets are picked up on reload.
+func applyFileEnv() error {
+	for _, key := range Keys() {
+		name := EnvName(key)
+		path, ok := os.LookupEnv(name + fileSuffix)
+		if !ok || flagOverrides[key] {
+			continue
+		}
+		if _, set := os.LookupEnv(name); set {
+			return fmt.Errorf("both %s and %s are set", name, name+fileSuffix)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", name+fileSuffix, err)
+		}
+		viper.Set(key, strings.TrimRight(string(data), "\r\n"))
+	}
+	return nil
+}
+
+// configFileFlag is the config file given on the command line
+var configFileFlag string
+
+// configFile returns the explicitly requested config file, if any
+func configFile() string {
+	if configFileFlag != "" {
+		return configFileFlag
+	}
+	return os.Getenv(configFileEnv)
+}
+
+// flagOverrides records the settings given on the command line, which take
+// precedence over everything else
+var flagOverrides = map[string]bool{}
+
+// Flags holds the command-line flags that override settings
+type Flags struct {
+	fs         *flag.FlagSet
+	configFile string
+	values     map[string]*string
+}
+
+// flagKeys maps command-line flags to the settings they override
+var flagKeys = map[string]string{
+	"address":   "server.address",
+	"port":      "server.port",
+	"mode":      "server.mode",
+	"db":        "database.path",
+	"log-level": "logging.level",
+}
+
+// RegisterFlags adds the config file and setting override flags to fs
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs, values: make(map[string]*string)}
+	fs.StringVar(&f.configFile, "config", "", "path to the config file (env "+configFileEnv+")")
+	for name, key := range flagKeys {
+		f.values[name] = fs.String(name, "", "override "+key)
+	}
+	return f
+}
+
+// Apply makes the flags that were set on the command line override the
+// configuration. It must be called after fs.Parse and before Read.
+func (f *Flags) Apply() {
+	f.fs.Visit(func(fl *flag.Flag) {
+		if fl.Name == "config" {
+			configFileFlag = f.configFile
+			return
+		}
+		key, ok := flagKeys[fl.Name]
+		if !ok {
+			return
+		}
+		viper.Set(key, *f.values[fl.Name])
+		flagOverrides[key] = true
+	})
+}
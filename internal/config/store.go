@@ -0,0 +1,243 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// nonReloadable lists the settings that only take effect on restart. A
+// reload that changes any of them is rejected as a whole.
+var nonReloadable = []string{
+	"server.address",
+	"server.port",
+	"server.tls",
+	"server.agent_listener",
+	"server.listeners",
+	"database.path",
+	"ca",
+	"jwt.algorithm",
+	"jwt.secret",
+	"oidc.enabled",
+	"oidc.issuer",
+	"oidc.client_id",
+	"oidc.client_secret",
+	"oidc.redirect_url",
+	"oidc.scopes",
+	"logging.format",
+	"logging.outputs",
+}
+
+// reloadable reports whether a changed setting can be applied without a
+// restart. The CORS policy of a listener is, unlike the listener itself.
+func reloadable(field string) bool {
+	if listenerCORS.MatchString(field) {
+		return true
+	}
+	for _, prefix := range nonReloadable {
+		if field == prefix || strings.HasPrefix(field, prefix+".") || strings.HasPrefix(field, prefix+"[") {
+			return false
+		}
+	}
+	return true
+}
+
+var listenerCORS = regexp.MustCompile(`^server\.listeners\[\d+\]\.cors(\.|$)`)
+
+// NonReloadableError reports the settings that changed but require a restart
+type NonReloadableError struct {
+	Fields []string
+}
+
+func (e *NonReloadableError) Error() string {
+	return fmt.Sprintf("configuration not reloaded: %s cannot change without a restart", strings.Join(e.Fields, ", "))
+}
+
+// Store holds the active configuration and swaps it atomically on reload.
+// Subscribers are notified after every successful reload.
+type Store struct {
+	current atomic.Pointer[Config]
+
+	mu          sync.Mutex
+	subscribers []func(*Config)
+}
+
+func NewStore(cfg *Config) *Store {
+	s := &Store{}
+	s.current.Store(cfg)
+	return s
+}
+
+// Current returns the active configuration. Callers must treat it as
+// read-only.
+func (s *Store) Current() *Config {
+	return s.current.Load()
+}
+
+// Subscribe registers a function called with the new configuration after
+// each successful reload
+func (s *Store) Subscribe(fn func(*Config)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscribers = append(s.subscribers, fn)
+}
+
+// Reload re-reads the configuration, validates it and, if only reloadable
+// settings changed, makes it current. It returns the paths of the settings
+// that changed.
+func (s *Store) Reload() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old := s.current.Load()
+	next, err := read()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := next.Validate(); err != nil {
+		return nil, err
+	}
+
+	// Keep the secret generated at startup for the placeholder value
+	if next.JWT.Secret == defaultJWTSecret {
+		next.JWT.Secret = old.JWT.Secret
+	}
+
+	changed := Diff(old, next)
+	var blocked []string
+	for _, field := range changed {
+		if !reloadable(field) {
+			blocked = append(blocked, field)
+		}
+	}
+	if len(blocked) > 0 {
+		return changed, &NonReloadableError{Fields: blocked}
+	}
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	s.current.Store(next)
+	for _, fn := range s.subscribers {
+		fn(next)
+	}
+	return changed, nil
+}
+
+// Watch reloads the configuration whenever the config file changes until
+// ctx is cancelled. Bursts of file events are coalesced. The directory is
+// watched rather than the file so editors that replace the file on save
+// and Kubernetes ConfigMap updates are noticed.
+func (s *Store) Watch(ctx context.Context, onReload func(changed []string, err error)) error {
+	file := viper.ConfigFileUsed()
+	if file == "" {
+		<-ctx.Done()
+		return nil
+	}
+	file, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		return err
+	}
+
+	const debounce = 500 * time.Millisecond
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("config watcher closed")
+			}
+			if filepath.Clean(event.Name) != file && !strings.Contains(event.Name, "..data") {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("config watcher closed")
+			}
+			return err
+		case <-timer.C:
+			changed, err := s.Reload()
+			onReload(changed, err)
+		}
+	}
+}
+
+// Diff returns the dotted paths of the settings that differ between two
+// configurations, using the same keys as the config file
+func Diff(a, b *Config) []string {
+	var changed []string
+	diffValue("", reflect.ValueOf(*a), reflect.ValueOf(*b), &changed)
+	return changed
+}
+
+func diffValue(path string, a, b reflect.Value, changed *[]string) {
+	if a.Kind() == reflect.Struct {
+		t := a.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(field.Tag.Get("mapstructure"), ",")
+			if opts == "squash" {
+				diffValue(path, a.Field(i), b.Field(i), changed)
+				continue
+			}
+			if name == "" || name == "-" {
+				name = strings.ToLower(field.Name)
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			diffValue(name, a.Field(i), b.Field(i), changed)
+		}
+		return
+	}
+
+	// Lists of the same length and pointers set on both sides are compared
+	// element by element, so e.g. a listener's CORS policy is reported as
+	// such rather than the whole list
+	switch {
+	case a.Kind() == reflect.Slice && a.Type().Elem().Kind() == reflect.Struct && a.Len() == b.Len():
+		for i := 0; i < a.Len(); i++ {
+			diffValue(fmt.Sprintf("%s[%d]", path, i), a.Index(i), b.Index(i), changed)
+		}
+		return
+	case a.Kind() == reflect.Pointer && !a.IsNil() && !b.IsNil():
+		diffValue(path, a.Elem(), b.Elem(), changed)
+		return
+	}
+
+	if !reflect.DeepEqual(a.Interface(), b.Interface()) {
+		*changed = append(*changed, path)
+	}
+}
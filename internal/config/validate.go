@@ -0,0 +1,590 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server modes. Production turns insecure-setting warnings into errors.
+const (
+	ModeDevelopment = "development"
+	ModeProduction  = "production"
+)
+
+// minSecretLength is the shortest JWT secret accepted in production
+const minSecretLength = 32
+
+var validMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true, "CONNECT": true, "TRACE": true,
+}
+
+// Problem is a single validation finding for a setting
+type Problem struct {
+	Field   string `json:"field" yaml:"field"`
+	Message string `json:"message" yaml:"message"`
+}
+
+func (p Problem) String() string {
+	return p.Field + ": " + p.Message
+}
+
+// ValidationErrors lists every problem that prevents the configuration
+// from being used
+type ValidationErrors []Problem
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, p := range e {
+		msgs[i] = p.String()
+	}
+	return fmt.Sprintf("invalid configuration (%d problems): %s", len(e), strings.Join(msgs, "; "))
+}
+
+// Report is the result of checking a configuration. Warnings describe
+// insecure settings tolerated in development mode.
+type Report struct {
+	Errors   []Problem `json:"errors" yaml:"errors"`
+	Warnings []Problem `json:"warnings" yaml:"warnings"`
+}
+
+// OK reports whether the configuration has no errors
+func (r *Report) OK() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *Report) warnf(field, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *Report) errorf(field, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, Problem{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// insecure records a problem that is an error in production and a warning
+// otherwise
+func (r *Report) insecure(production bool, field, format string, args ...interface{}) {
+	p := Problem{Field: field, Message: fmt.Sprintf(format, args...)}
+	if production {
+		r.Errors = append(r.Errors, p)
+	} else {
+		r.Warnings = append(r.Warnings, p)
+	}
+}
+
+// Validate returns all problems that make the configuration unusable as
+// ValidationErrors, or nil
+func (c *Config) Validate() error {
+	report := c.Check()
+	if report.OK() {
+		return nil
+	}
+	return ValidationErrors(report.Errors)
+}
+
+// Check inspects every setting and collects all errors and warnings
+func (c *Config) Check() *Report {
+	r := &Report{}
+	production := c.Server.Mode == ModeProduction
+
+	// Server
+	if c.Server.Mode != ModeDevelopment && c.Server.Mode != ModeProduction {
+		r.errorf("server.mode", "must be %q or %q, got %q", ModeDevelopment, ModeProduction, c.Server.Mode)
+	}
+	if c.Server.Port <= 0 || c.Server.Port > 65535 {
+		r.errorf("server.port", "must be between 1 and 65535, got %d", c.Server.Port)
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		r.errorf("server.shutdown_timeout", "must be positive, got %s", c.Server.ShutdownTimeout)
+	}
+
+	if c.Server.PublicURL != "" && !isHTTPURL(c.Server.PublicURL) {
+		r.errorf("server.public_url", "must start with http:// or https://, got %q", c.Server.PublicURL)
+	}
+	c.checkTLS(r, production)
+
+	// Database
+	if strings.TrimSpace(c.Database.Path) == "" {
+		r.errorf("database.path", "must not be empty")
+	}
+
+	// JWT
+	switch c.JWT.Algorithm {
+	case JWTAlgorithmHS256, JWTAlgorithmRS256, JWTAlgorithmEdDSA:
+	default:
+		r.errorf("jwt.algorithm", "must be %q, %q or %q, got %q", JWTAlgorithmHS256, JWTAlgorithmRS256, JWTAlgorithmEdDSA, c.JWT.Algorithm)
+	}
+	switch {
+	case c.JWT.Asymmetric():
+		// The secret is not used
+	case c.JWT.Secret == defaultJWTSecret:
+		r.insecure(production, "jwt.secret", "is the placeholder value; a random secret is generated and tokens do not survive a restart")
+	case c.JWT.Secret == "":
+		r.errorf("jwt.secret", "must not be empty")
+	case len(c.JWT.Secret) < minSecretLength:
+		r.insecure(production, "jwt.secret", "must be at least %d characters, got %d", minSecretLength, len(c.JWT.Secret))
+	}
+	if c.JWT.Expiration <= 0 {
+		r.errorf("jwt.expiration", "must be positive, got %s", c.JWT.Expiration)
+	}
+	if c.JWT.Asymmetric() {
+		if c.JWT.RotationInterval < 0 {
+			r.errorf("jwt.rotation_interval", "must not be negative, got %s", c.JWT.RotationInterval)
+		}
+		// Tokens signed just before a rotation must stay verifiable
+		if c.JWT.GracePeriod < c.JWT.Expiration {
+			r.errorf("jwt.grace_period", "must be at least jwt.expiration (%s), got %s", c.JWT.Expiration, c.JWT.GracePeriod)
+		}
+	}
+	if c.JWT.RefreshExpiration < c.JWT.Expiration {
+		r.errorf("jwt.refresh_expiration", "must be at least jwt.expiration (%s), got %s", c.JWT.Expiration, c.JWT.RefreshExpiration)
+	}
+	if c.JWT.SessionMaxAge != 0 && c.JWT.SessionMaxAge < c.JWT.RefreshExpiration {
+		r.errorf("jwt.session_max_age", "must be 0 or at least jwt.refresh_expiration (%s), got %s", c.JWT.RefreshExpiration, c.JWT.SessionMaxAge)
+	}
+
+	// CORS
+	checkCORS(r, "cors", c.CORS, production)
+
+	// Liveness
+	if c.Liveness.CheckInterval <= 0 {
+		r.errorf("liveness.check_interval", "must be positive, got %s", c.Liveness.CheckInterval)
+	}
+	if c.Liveness.StaleAfter <= 0 {
+		r.errorf("liveness.stale_after", "must be positive, got %s", c.Liveness.StaleAfter)
+	}
+	if c.Liveness.OfflineAfter < c.Liveness.StaleAfter {
+		r.errorf("liveness.offline_after", "must be at least liveness.stale_after")
+	}
+	if c.Liveness.StaleMissedHeartbeats < 0 {
+		r.errorf("liveness.stale_missed_heartbeats", "must not be negative")
+	}
+	if c.Liveness.OfflineMissedHeartbeats < 0 {
+		r.errorf("liveness.offline_missed_heartbeats", "must not be negative")
+	}
+	if c.Liveness.StaleMissedHeartbeats > 0 && c.Liveness.OfflineMissedHeartbeats > 0 &&
+		c.Liveness.OfflineMissedHeartbeats < c.Liveness.StaleMissedHeartbeats {
+		r.errorf("liveness.offline_missed_heartbeats", "must be at least liveness.stale_missed_heartbeats")
+	}
+	for i, o := range c.Liveness.Overrides {
+		// Zero thresholds in an override inherit the global ones
+		prefix := fmt.Sprintf("liveness.overrides[%d]", i)
+		if len(o.Labels) == 0 && len(o.Groups) == 0 {
+			r.errorf(prefix, "must select agents by labels or groups")
+		}
+		if o.StaleAfter < 0 {
+			r.errorf(prefix+".stale_after", "must not be negative")
+		}
+		if o.OfflineAfter < 0 {
+			r.errorf(prefix+".offline_after", "must not be negative")
+		}
+		if o.StaleAfter > 0 && o.OfflineAfter > 0 && o.OfflineAfter < o.StaleAfter {
+			r.errorf(prefix+".offline_after", "must be at least %s.stale_after", prefix)
+		}
+	}
+
+	if c.Enrollment.CredentialGrace <= 0 {
+		r.errorf("enrollment.credential_grace", "must be positive, got %s", c.Enrollment.CredentialGrace)
+	}
+	if c.Enrollment.CloneWindow < 0 {
+		r.errorf("enrollment.clone_window", "must not be negative, got %s", c.Enrollment.CloneWindow)
+	}
+
+	if c.Decommission.Retention <= 0 {
+		r.errorf("decommission.retention", "must be positive, got %s", c.Decommission.Retention)
+	}
+	if c.Decommission.ExportDir == "" {
+		r.errorf("decommission.export_dir", "must be set; agents are exported there before they are purged")
+	}
+	if c.Decommission.ExportFormat != "json" && c.Decommission.ExportFormat != "csv" {
+		r.errorf("decommission.export_format", "must be json or csv, got %q", c.Decommission.ExportFormat)
+	}
+
+	// Logging
+	c.checkLogging(r)
+
+	c.checkOIDC(r, production)
+
+	// Two-factor authentication
+	for i, role := range c.TwoFactor.RequiredRoles {
+		if !isRole(role) {
+			r.errorf(fmt.Sprintf("two_factor.required_roles[%d]", i), "must be one of %s, got %q", strings.Join(roles, ", "), role)
+		}
+	}
+	if strings.TrimSpace(c.TwoFactor.Issuer) == "" {
+		r.errorf("two_factor.issuer", "must not be empty")
+	}
+
+	c.checkRateLimit(r, production)
+
+	return r
+}
+
+// rateLimitKeys are the RateLimitKey constants
+var rateLimitKeys = []string{RateLimitKeyIP, RateLimitKeyAgent, RateLimitKeyUser, RateLimitKeyAPIKey}
+
+func (c *Config) checkRateLimit(r *Report, production bool) {
+	rl := c.RateLimit
+	if !rl.Enabled {
+		r.insecure(production, "rate_limit.enabled", "is false; requests are not rate limited")
+	}
+	names := make(map[string]bool)
+	for i, rule := range rl.Rules {
+		prefix := fmt.Sprintf("rate_limit.rules[%d]", i)
+		switch {
+		case rule.Name == "":
+			r.errorf(prefix+".name", "must not be empty")
+		case names[rule.Name]:
+			r.errorf(prefix+".name", "duplicates another rule's name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if len(rule.Routes) == 0 {
+			r.errorf(prefix+".routes", "must not be empty")
+		}
+		for j, route := range rule.Routes {
+			if _, path, ok := strings.Cut(route, " "); ok {
+				route = path
+			}
+			if !strings.HasPrefix(route, "/") {
+				r.errorf(fmt.Sprintf("%s.routes[%d]", prefix, j), "must be a route such as /api/v1/agents/:id, optionally preceded by a method, got %q", rule.Routes[j])
+			}
+		}
+		if !slices.Contains(rateLimitKeys, rule.Key) {
+			r.errorf(prefix+".key", "must be one of %s, got %q", strings.Join(rateLimitKeys, ", "), rule.Key)
+		}
+		if rule.Requests <= 0 {
+			r.errorf(prefix+".requests", "must be positive, got %d", rule.Requests)
+		}
+		if rule.Period <= 0 {
+			r.errorf(prefix+".period", "must be positive, got %s", rule.Period)
+		}
+		if rule.Burst < 0 {
+			r.errorf(prefix+".burst", "must not be negative")
+		}
+	}
+
+	l := rl.Lockout
+	if l.MaxFailures < 0 {
+		r.errorf("rate_limit.lockout.max_failures", "must not be negative")
+	}
+	if l.MaxFailures == 0 {
+		r.insecure(production, "rate_limit.lockout.max_failures", "is 0; failed logins never lock an account")
+		return
+	}
+	if l.Duration <= 0 {
+		r.errorf("rate_limit.lockout.duration", "must be positive, got %s", l.Duration)
+	}
+	if l.MaxDuration < l.Duration {
+		r.errorf("rate_limit.lockout.max_duration", "must be at least rate_limit.lockout.duration")
+	}
+	if l.ResetAfter < l.MaxDuration {
+		r.errorf("rate_limit.lockout.reset_after", "must be at least rate_limit.lockout.max_duration")
+	}
+}
+
+// roles are the operator roles defined by the auth package, which cannot
+// be imported here
+var roles = []string{"superadmin", "admin", "operator", "viewer"}
+
+func isRole(role string) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOIDC validates the OpenID Connect login settings
+func (c *Config) checkOIDC(r *Report, production bool) {
+	o := c.OIDC
+	if !o.Enabled {
+		return
+	}
+	switch {
+	case !isHTTPURL(o.Issuer):
+		r.errorf("oidc.issuer", "must start with http:// or https://, got %q", o.Issuer)
+	case !strings.HasPrefix(o.Issuer, "https://"):
+		r.insecure(production, "oidc.issuer", "should use https")
+	}
+	if o.ClientID == "" {
+		r.errorf("oidc.client_id", "must not be empty")
+	}
+	switch {
+	case !isHTTPURL(o.RedirectURL):
+		r.errorf("oidc.redirect_url", "must start with http:// or https://, got %q", o.RedirectURL)
+	case !strings.HasSuffix(o.RedirectURL, "/api/v1/auth/oidc/callback"):
+		r.errorf("oidc.redirect_url", "must end with /api/v1/auth/oidc/callback, got %q", o.RedirectURL)
+	case !strings.HasPrefix(o.RedirectURL, "https://"):
+		r.insecure(production, "oidc.redirect_url", "should use https")
+	}
+	hasOpenID := false
+	for _, scope := range o.Scopes {
+		hasOpenID = hasOpenID || scope == "openid"
+	}
+	if !hasOpenID {
+		r.errorf("oidc.scopes", "must include openid")
+	}
+	if o.UsernameClaim == "" {
+		r.errorf("oidc.username_claim", "must not be empty")
+	}
+	for role := range o.RoleMapping {
+		if !isRole(role) {
+			r.errorf("oidc.role_mapping."+role, "is not a role; must be one of %s", strings.Join(roles, ", "))
+		}
+	}
+	if o.DefaultRole != "" && !isRole(o.DefaultRole) {
+		r.errorf("oidc.default_role", "must be empty or one of %s, got %q", strings.Join(roles, ", "), o.DefaultRole)
+	}
+	if o.Organization == "" {
+		r.errorf("oidc.organization", "must not be empty")
+	}
+	if len(o.RoleMapping) == 0 && o.DefaultRole == "" {
+		r.warnf("oidc.role_mapping", "is empty and oidc.default_role is not set; nobody can log in with OIDC")
+	}
+}
+
+// checkLogging validates the log levels and outputs
+func (c *Config) checkLogging(r *Report) {
+	l := c.Logging
+	if _, err := logrus.ParseLevel(l.Level); err != nil {
+		r.errorf("logging.level", "unknown level %q", l.Level)
+	}
+	if l.Format != "json" && l.Format != "text" {
+		r.errorf("logging.format", "must be \"json\" or \"text\", got %q", l.Format)
+	}
+	for component, level := range l.Components {
+		field := "logging.components." + component
+		if !IsLogComponent(component) {
+			r.errorf(field, "unknown component, must be one of %s", strings.Join(LogComponents, ", "))
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			r.errorf(field, "unknown level %q", level)
+		}
+	}
+
+	for i, o := range l.Outputs {
+		prefix := fmt.Sprintf("logging.outputs[%d]", i)
+		switch o.Type {
+		case LogOutputStdout, LogOutputStderr:
+		case LogOutputFile:
+			if strings.TrimSpace(o.Path) == "" {
+				r.errorf(prefix+".path", "must be set for file outputs")
+			}
+			if o.MaxSizeMB < 0 {
+				r.errorf(prefix+".max_size_mb", "must not be negative")
+			}
+			if o.MaxAge < 0 {
+				r.errorf(prefix+".max_age", "must not be negative")
+			}
+			if o.MaxBackups < 0 {
+				r.errorf(prefix+".max_backups", "must not be negative")
+			}
+		case LogOutputSyslog:
+			switch o.Network {
+			case "", "unixgram", "udp", "tcp":
+			default:
+				r.errorf(prefix+".network", "must be \"unixgram\", \"udp\" or \"tcp\", got %q", o.Network)
+			}
+			if (o.Network == "") != (o.Address == "") {
+				r.errorf(prefix+".address", "network and address must be set together")
+			}
+		default:
+			r.errorf(prefix+".type", "must be %q, %q, %q or %q, got %q", LogOutputStdout, LogOutputStderr, LogOutputFile, LogOutputSyslog, o.Type)
+		}
+	}
+}
+
+// IsLogComponent reports whether name is one of LogComponents
+func IsLogComponent(name string) bool {
+	for _, component := range LogComponents {
+		if component == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCORS validates a CORS policy, the global one or a listener's
+func checkCORS(r *Report, prefix string, cors CORSConfig, production bool) {
+	wildcard := false
+	for i, origin := range cors.AllowedOrigins {
+		if origin == "*" {
+			wildcard = true
+			continue
+		}
+		if !isHTTPURL(origin) {
+			r.errorf(fmt.Sprintf("%s.allowed_origins[%d]", prefix, i), "must start with http:// or https://, got %q", origin)
+		}
+	}
+	if wildcard && cors.AllowCredentials {
+		r.errorf(prefix+".allowed_origins", "wildcard origin cannot be combined with %s.allow_credentials", prefix)
+	} else if wildcard {
+		r.insecure(production, prefix+".allowed_origins", "wildcard origin allows any site to call the API")
+	}
+	for i, method := range cors.AllowedMethods {
+		if !validMethods[strings.ToUpper(method)] {
+			r.errorf(fmt.Sprintf("%s.allowed_methods[%d]", prefix, i), "unknown HTTP method %q", method)
+		}
+	}
+}
+
+// checkTLS validates the TLS, agent listener and CA settings
+func (c *Config) checkTLS(r *Report, production bool) {
+	t := c.Server.TLS
+	if t.Enabled {
+		checkFile(r, "server.tls.cert_file", t.CertFile)
+		checkFile(r, "server.tls.key_file", t.KeyFile)
+	} else if production && len(c.Server.Listeners) == 0 {
+		r.warnf("server.tls.enabled", "TLS is disabled; agent tokens and passwords travel in plaintext unless a proxy terminates TLS")
+	}
+	if t.MinVersion != "1.2" && t.MinVersion != "1.3" {
+		r.errorf("server.tls.min_version", "must be \"1.2\" or \"1.3\", got %q", t.MinVersion)
+	}
+	if t.CipherPolicy != "default" && t.CipherPolicy != "intermediate" {
+		r.errorf("server.tls.cipher_policy", "must be \"default\" or \"intermediate\", got %q", t.CipherPolicy)
+	}
+
+	a := c.Server.AgentListener
+	if a.Enabled {
+		if !c.CA.Enabled {
+			r.errorf("server.agent_listener.enabled", "requires ca.enabled to issue client certificates")
+		}
+		if a.Port <= 0 || a.Port > 65535 {
+			r.errorf("server.agent_listener.port", "must be between 1 and 65535, got %d", a.Port)
+		} else if a.Port == c.Server.Port {
+			r.errorf("server.agent_listener.port", "must differ from server.port")
+		}
+		switch {
+		case a.CertFile != "" || a.KeyFile != "":
+			checkFile(r, "server.agent_listener.cert_file", a.CertFile)
+			checkFile(r, "server.agent_listener.key_file", a.KeyFile)
+		case !t.Enabled:
+			r.errorf("server.agent_listener.cert_file", "must be set when server.tls is disabled")
+		}
+		if a.PublicURL != "" && !strings.HasPrefix(a.PublicURL, "https://") {
+			r.errorf("server.agent_listener.public_url", "must start with https://, got %q", a.PublicURL)
+		}
+	}
+
+	c.checkListeners(r, production)
+
+	if c.CA.Enabled {
+		if strings.TrimSpace(c.CA.Dir) == "" {
+			r.errorf("ca.dir", "must not be empty")
+		}
+		if c.CA.CertValidity <= 0 {
+			r.errorf("ca.cert_validity", "must be positive, got %s", c.CA.CertValidity)
+		}
+	}
+}
+
+// checkListeners validates explicitly configured listeners
+func (c *Config) checkListeners(r *Report, production bool) {
+	if len(c.Server.Listeners) == 0 {
+		return
+	}
+	if c.Server.AgentListener.Enabled {
+		r.errorf("server.agent_listener.enabled", "cannot be combined with server.listeners; add the agent listener there")
+	}
+
+	names := make(map[string]bool)
+	addresses := make(map[string]string)
+	for i, l := range c.Server.EffectiveListeners() {
+		prefix := fmt.Sprintf("server.listeners[%d]", i)
+
+		switch {
+		case l.Name == "":
+			r.errorf(prefix+".name", "must not be empty")
+		case names[l.Name]:
+			r.errorf(prefix+".name", "duplicate listener name %q", l.Name)
+		}
+		names[l.Name] = true
+
+		if l.Port <= 0 || l.Port > 65535 {
+			r.errorf(prefix+".port", "must be between 1 and 65535, got %d", l.Port)
+		} else {
+			address := net.JoinHostPort(l.Address, strconv.Itoa(l.Port))
+			if other, ok := addresses[address]; ok {
+				r.errorf(prefix+".port", "%s is already used by listener %q", address, other)
+			}
+			addresses[address] = l.Name
+		}
+		if l.PublicURL != "" && !isHTTPURL(l.PublicURL) {
+			r.errorf(prefix+".public_url", "must start with http:// or https://, got %q", l.PublicURL)
+		}
+
+		if len(l.Routes) == 0 {
+			r.errorf(prefix+".routes", "must mount at least one route set")
+		}
+		for j, routes := range l.Routes {
+			if routes != RoutesOperator && routes != RoutesAgent && routes != RoutesMetrics {
+				r.errorf(fmt.Sprintf("%s.routes[%d]", prefix, j), "must be %q, %q or %q, got %q", RoutesOperator, RoutesAgent, RoutesMetrics, routes)
+			}
+		}
+
+		t := l.TLS
+		if t.Enabled {
+			checkFile(r, prefix+".tls.cert_file", t.CertFile)
+			checkFile(r, prefix+".tls.key_file", t.KeyFile)
+		} else if production && !isLoopback(l.Address) && (l.Serves(RoutesOperator) || l.Serves(RoutesAgent)) {
+			r.warnf(prefix+".tls.enabled", "TLS is disabled on a non-loopback address; tokens and passwords travel in plaintext unless a proxy terminates TLS")
+		}
+		if t.MinVersion != "1.2" && t.MinVersion != "1.3" {
+			r.errorf(prefix+".tls.min_version", "must be \"1.2\" or \"1.3\", got %q", t.MinVersion)
+		}
+		if t.CipherPolicy != "default" && t.CipherPolicy != "intermediate" {
+			r.errorf(prefix+".tls.cipher_policy", "must be \"default\" or \"intermediate\", got %q", t.CipherPolicy)
+		}
+		switch t.ClientAuth {
+		case ClientAuthNone:
+		case ClientAuthAgent:
+			if !t.Enabled {
+				r.errorf(prefix+".tls.client_auth", "requires tls.enabled")
+			}
+			if !c.CA.Enabled {
+				r.errorf(prefix+".tls.client_auth", "requires ca.enabled to issue client certificates")
+			}
+			if l.Serves(RoutesOperator) {
+				r.errorf(prefix+".routes", "operator routes cannot be served with client_auth \"agent\"")
+			}
+		default:
+			r.errorf(prefix+".tls.client_auth", "must be %q or %q, got %q", ClientAuthNone, ClientAuthAgent, t.ClientAuth)
+		}
+
+		if l.CORS != nil {
+			checkCORS(r, prefix+".cors", *l.CORS, production)
+		}
+		if production && l.Serves(RoutesMetrics) && c.Server.MetricsToken == "" && !isLoopback(l.Address) {
+			r.warnf(prefix+".routes", "/metrics is served without server.metrics_token on a non-loopback address and exposes agent counts of every organization")
+		}
+	}
+}
+
+func isLoopback(address string) bool {
+	if address == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(address)
+	return ip != nil && ip.IsLoopback()
+}
+
+func checkFile(r *Report, field, path string) {
+	if path == "" {
+		r.errorf(field, "must be set")
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		r.errorf(field, "cannot be read: %v", err)
+	}
+}
+
+func isHTTPURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
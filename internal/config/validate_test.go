@@ -0,0 +1,236 @@
+package config
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// listenerProblems returns the fields of problems about listeners
+func listenerProblems(problems []Problem) []string {
+	var fields []string
+	for _, p := range problems {
+		if strings.HasPrefix(p.Field, "server.listeners") || strings.HasPrefix(p.Field, "server.agent_listener") {
+			fields = append(fields, p.Field)
+		}
+	}
+	return fields
+}
+
+func TestCheckListeners(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		errors   []string
+		warnings []string
+	}{
+		{
+			name: "valid",
+			file: `
+server:
+  listeners:
+    - name: "operator"
+      address: "127.0.0.1"
+      port: 8080
+      routes: ["operator"]
+    - name: "agents"
+      port: 8081
+      routes: ["agent"]
+    - name: "metrics"
+      address: "127.0.0.1"
+      port: 9100
+      routes: ["metrics"]
+`,
+		},
+		{
+			name: "duplicate name",
+			file: `
+server:
+  listeners:
+    - name: "api"
+      port: 8080
+      routes: ["operator"]
+    - name: "api"
+      port: 8081
+      routes: ["agent"]
+`,
+			errors: []string{"server.listeners[1].name"},
+		},
+		{
+			name: "duplicate address",
+			file: `
+server:
+  listeners:
+    - name: "operator"
+      address: "10.0.0.1"
+      port: 8080
+      routes: ["operator"]
+    - name: "agents"
+      address: "10.0.0.1"
+      port: 8080
+      routes: ["agent"]
+`,
+			errors: []string{"server.listeners[1].port"},
+		},
+		{
+			name: "same port on different addresses",
+			file: `
+server:
+  listeners:
+    - name: "operator"
+      address: "127.0.0.1"
+      port: 8080
+      routes: ["operator"]
+    - name: "agents"
+      address: "10.0.0.1"
+      port: 8080
+      routes: ["agent"]
+`,
+		},
+		{
+			name: "missing name and routes",
+			file: `
+server:
+  listeners:
+    - port: 8080
+`,
+			errors: []string{"server.listeners[0].name", "server.listeners[0].routes"},
+		},
+		{
+			name: "invalid port",
+			file: `
+server:
+  listeners:
+    - name: "operator"
+      port: 70000
+      routes: ["operator"]
+`,
+			errors: []string{"server.listeners[0].port"},
+		},
+		{
+			name: "unknown route set",
+			file: `
+server:
+  listeners:
+    - name: "operator"
+      port: 8080
+      routes: ["operator", "admin"]
+`,
+			errors: []string{"server.listeners[0].routes[1]"},
+		},
+		{
+			name: "invalid public url",
+			file: `
+server:
+  listeners:
+    - name: "agents"
+      port: 8080
+      public_url: "rigs.example.com"
+      routes: ["agent"]
+`,
+			errors: []string{"server.listeners[0].public_url"},
+		},
+		{
+			name: "invalid tls settings",
+			file: `
+server:
+  listeners:
+    - name: "agents"
+      port: 8080
+      routes: ["agent"]
+      tls:
+        min_version: "1.1"
+        cipher_policy: "modern"
+        client_auth: "optional"
+`,
+			errors: []string{
+				"server.listeners[0].tls.min_version",
+				"server.listeners[0].tls.cipher_policy",
+				"server.listeners[0].tls.client_auth",
+			},
+		},
+		{
+			name: "agent client auth without tls and ca on operator routes",
+			file: `
+server:
+  listeners:
+    - name: "all"
+      port: 8080
+      routes: ["operator", "agent"]
+      tls:
+        client_auth: "agent"
+`,
+			errors: []string{
+				"server.listeners[0].tls.client_auth",
+				"server.listeners[0].tls.client_auth",
+				"server.listeners[0].routes",
+			},
+		},
+		{
+			name: "combined with the agent listener",
+			file: `
+ca:
+  enabled: true
+server:
+  tls:
+    enabled: true
+    cert_file: "/nonexistent/cert.pem"
+    key_file: "/nonexistent/key.pem"
+  agent_listener:
+    enabled: true
+  listeners:
+    - name: "operator"
+      address: "127.0.0.1"
+      port: 9000
+      routes: ["operator"]
+`,
+			errors: []string{"server.agent_listener.enabled"},
+		},
+		{
+			name: "public metrics without token in production",
+			file: `
+server:
+  mode: "production"
+  listeners:
+    - name: "operator"
+      address: "127.0.0.1"
+      port: 8080
+      routes: ["operator"]
+    - name: "metrics"
+      address: "10.0.0.5"
+      port: 9100
+      routes: ["metrics"]
+`,
+			warnings: []string{"server.listeners[1].routes"},
+		},
+		{
+			name: "public metrics with token in production",
+			file: `
+server:
+  mode: "production"
+  metrics_token: "scrape-token"
+  listeners:
+    - name: "operator"
+      address: "127.0.0.1"
+      port: 8080
+      routes: ["operator"]
+    - name: "metrics"
+      address: "10.0.0.5"
+      port: 9100
+      routes: ["metrics"]
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := readLayers(t, tt.file, nil, nil)
+			report := cfg.Check()
+			if got := listenerProblems(report.Errors); !slices.Equal(got, tt.errors) {
+				t.Errorf("errors = %v, want %v (report: %+v)", got, tt.errors, report.Errors)
+			}
+			if got := listenerProblems(report.Warnings); !slices.Equal(got, tt.warnings) {
+				t.Errorf("warnings = %v, want %v (report: %+v)", got, tt.warnings, report.Warnings)
+			}
+		})
+	}
+}
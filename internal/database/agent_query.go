@@ -0,0 +1,315 @@
+package database
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded or
+// was issued for a different sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Sort keys accepted by ListAgentsPage
+const (
+	SortByCreatedAt = "created_at"
+	SortByName      = "name"
+	SortByLastSeen  = "last_seen"
+	SortByStatus    = "status"
+	SortByHashrate  = "hashrate"
+)
+
+// sortExpressions maps sort keys to the SQL expression agents are ordered by.
+// Timestamps are cast to text so the driver hands back the stored value
+// rather than a parsed time. Hashrate is taken from the most recent metrics
+// sample of each agent.
+var sortExpressions = map[string]string{
+	SortByCreatedAt: `CAST(agents.created_at AS TEXT)`,
+	SortByName:      `agents.name`,
+	SortByLastSeen:  `CAST(agents.last_seen AS TEXT)`,
+	SortByStatus:    `agents.status`,
+	SortByHashrate:  `COALESCE((SELECT m.hashrate FROM metrics m WHERE m.agent_id = agents.id ORDER BY m.created_at DESC LIMIT 1), 0)`,
+}
+
+// ListOptions controls ordering and pagination of agent listings
+type ListOptions struct {
+	Sort       string
+	Descending bool
+	Limit      int
+	Cursor     string
+}
+
+// AgentPage is one page of an agent listing
+type AgentPage struct {
+	Agents     []*Agent `json:"agents"`
+	Total      int      `json:"total"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// pageCursor identifies the last row of a page. SortValue holds the raw
+// value of the sort expression as returned by SQLite so it compares exactly
+// when fed back as a query argument.
+type pageCursor struct {
+	Sort       string      `json:"s"`
+	Descending bool        `json:"d"`
+	SortValue  interface{} `json:"v"`
+	ID         string      `json:"id"`
+}
+
+func (c *pageCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (*pageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &pageCursor{}
+	if err := json.Unmarshal(data, cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+// ListAgentsPage returns one page of agents matching the filter, ordered by
+// the requested key with the agent ID as tie-breaker. Pagination is keyset
+// based so pages stay stable while agents are added or removed.
+func (d *Database) ListAgentsPage(filter *AgentFilter, opts ListOptions) (*AgentPage, error) {
+	if opts.Sort == "" {
+		opts.Sort = SortByCreatedAt
+	}
+	sortExpr, ok := sortExpressions[opts.Sort]
+	if !ok {
+		return nil, fmt.Errorf("unknown sort key %q", opts.Sort)
+	}
+
+	conditions, args := filter.conditions()
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM agents`
+	if len(conditions) > 0 {
+		countQuery += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	if err := d.db.QueryRow(countQuery, args...).Scan(&total); err != nil {
+		return nil, err
+	}
+
+	cmp, direction := ">", "ASC"
+	if opts.Descending {
+		cmp, direction = "<", "DESC"
+	}
+
+	if opts.Cursor != "" {
+		cursor, err := decodeCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Sort != opts.Sort || cursor.Descending != opts.Descending {
+			return nil, ErrInvalidCursor
+		}
+		conditions = append(conditions, fmt.Sprintf(`(%[1]s %[2]s ? OR (%[1]s = ? AND agents.id %[2]s ?))`, sortExpr, cmp))
+		args = append(args, cursor.SortValue, cursor.SortValue, cursor.ID)
+	}
+
+	query := `SELECT ` + agentColumns + `, ` + sortExpr + ` AS sort_value FROM agents`
+	if len(conditions) > 0 {
+		query += ` WHERE ` + strings.Join(conditions, " AND ")
+	}
+	query += fmt.Sprintf(` ORDER BY sort_value %[1]s, agents.id %[1]s`, direction)
+	if opts.Limit > 0 {
+		// Fetch one extra row to know whether another page follows
+		query += fmt.Sprintf(` LIMIT %d`, opts.Limit+1)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &AgentPage{Agents: []*Agent{}, Total: total}
+	var lastSortValue interface{}
+	for rows.Next() {
+		if opts.Limit > 0 && len(page.Agents) == opts.Limit {
+			last := page.Agents[len(page.Agents)-1]
+			page.NextCursor = (&pageCursor{
+				Sort:       opts.Sort,
+				Descending: opts.Descending,
+				SortValue:  lastSortValue,
+				ID:         last.ID,
+			}).encode()
+			break
+		}
+
+		agent, err := scanAgent(rows, &lastSortValue)
+		if err != nil {
+			return nil, err
+		}
+		if raw, ok := lastSortValue.([]byte); ok {
+			lastSortValue = string(raw)
+		}
+		page.Agents = append(page.Agents, agent)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := d.loadTagsForAgents(page.Agents); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// CountAgentsByStatus returns the number of agents in each status, counting
+// the agents of one organization or of all when orgID is empty.
+// Decommissioned agents are not counted.
+func (d *Database) CountAgentsByStatus(orgID string) (map[string]int, error) {
+	rows, err := d.db.Query(`SELECT status, COUNT(*) FROM agents WHERE (? = '' OR org_id = ?) AND status != ? GROUP BY status`, orgID, orgID, StatusDecommissioned)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// Breakdown counts the agents sharing a label value or group
+type Breakdown struct {
+	Total  int `json:"total"`
+	Active int `json:"active"`
+}
+
+// AgentBreakdowns counts agents per label value and per group, counting the
+// agents of one organization or of all when orgID is empty. Decommissioned
+// agents are not counted.
+func (d *Database) AgentBreakdowns(orgID string) (map[string]map[string]*Breakdown, map[string]*Breakdown, error) {
+	byLabel := make(map[string]map[string]*Breakdown)
+	labelRows, err := d.db.Query(`SELECT l.key, l.value, COUNT(*), SUM(CASE WHEN a.status = 'active' THEN 1 ELSE 0 END)
+		FROM agent_labels l JOIN agents a ON a.id = l.agent_id WHERE (? = '' OR a.org_id = ?) AND a.status != ? GROUP BY l.key, l.value`, orgID, orgID, StatusDecommissioned)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer labelRows.Close()
+	for labelRows.Next() {
+		var key, value string
+		b := &Breakdown{}
+		if err := labelRows.Scan(&key, &value, &b.Total, &b.Active); err != nil {
+			return nil, nil, err
+		}
+		if byLabel[key] == nil {
+			byLabel[key] = make(map[string]*Breakdown)
+		}
+		byLabel[key][value] = b
+	}
+	if err := labelRows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	byGroup := make(map[string]*Breakdown)
+	groupRows, err := d.db.Query(`SELECT g.name, COUNT(*), SUM(CASE WHEN a.status = 'active' THEN 1 ELSE 0 END)
+		FROM agent_groups g JOIN agents a ON a.id = g.agent_id WHERE (? = '' OR a.org_id = ?) AND a.status != ? GROUP BY g.name`, orgID, orgID, StatusDecommissioned)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer groupRows.Close()
+	for groupRows.Next() {
+		var name string
+		b := &Breakdown{}
+		if err := groupRows.Scan(&name, &b.Total, &b.Active); err != nil {
+			return nil, nil, err
+		}
+		byGroup[name] = b
+	}
+	return byLabel, byGroup, groupRows.Err()
+}
+
+// loadTagsForAgents populates labels and groups of several agents with one
+// query per table instead of one per agent
+func (d *Database) loadTagsForAgents(agents []*Agent) error {
+	if len(agents) == 0 {
+		return nil
+	}
+
+	byID := make(map[string]*Agent, len(agents))
+	ids := make([]interface{}, 0, len(agents))
+	for _, agent := range agents {
+		agent.Labels = make(map[string]string)
+		agent.Groups = []string{}
+		byID[agent.ID] = agent
+		ids = append(ids, agent.ID)
+	}
+
+	// SQLite limits the number of bound parameters per statement
+	const batchSize = 500
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batch := ids[start:end]
+		in := placeholders(len(batch))
+
+		rows, err := d.db.Query(`SELECT agent_id, key, value FROM agent_labels WHERE agent_id IN (`+in+`)`, batch...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var agentID, key, value string
+			if err := rows.Scan(&agentID, &key, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			byID[agentID].Labels[key] = value
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		rows, err = d.db.Query(`SELECT agent_id, name FROM agent_groups WHERE agent_id IN (`+in+`) ORDER BY name`, batch...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var agentID, name string
+			if err := rows.Scan(&agentID, &name); err != nil {
+				rows.Close()
+				return err
+			}
+			byID[agentID].Groups = append(byID[agentID].Groups, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?, ", n-1) + "?"
+}
+
+// escapeLike escapes the LIKE wildcards in a search term using '\' as the
+// escape character
+func escapeLike(term string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(term)
+}
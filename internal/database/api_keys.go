@@ -0,0 +1,147 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrAPIKeyInvalid is returned for API keys that are unknown, revoked or
+// expired
+var ErrAPIKeyInvalid = errors.New("invalid API key")
+
+// APIKey is a long-lived credential of a user or service account. Only a
+// hash of the key is stored; Prefix identifies it in listings.
+type APIKey struct {
+	ID       int64    `json:"id"`
+	Name     string   `json:"name"`
+	Prefix   string   `json:"prefix"`
+	Username string   `json:"username"`
+	Scopes   []string `json:"scopes"`
+	// AllowedIPs are the addresses and CIDR ranges the key may be used
+	// from; empty allows any
+	AllowedIPs []string   `json:"allowed_ips"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	CreatedBy  string     `json:"created_by"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+const apiKeyColumns = `id, name, prefix, username, scopes, allowed_ips, expires_at, created_by, created_at, last_used_at, last_used_ip, revoked_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	k := &APIKey{}
+	var (
+		scopes, allowedIPs               string
+		expiresAt, lastUsedAt, revokedAt sql.NullTime
+	)
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Username, &scopes, &allowedIPs, &expiresAt, &k.CreatedBy, &k.CreatedAt, &lastUsedAt, &k.LastUsedIP, &revokedAt); err != nil {
+		return nil, err
+	}
+	k.Scopes = splitList(scopes)
+	k.AllowedIPs = splitList(allowedIPs)
+	if expiresAt.Valid {
+		k.ExpiresAt = &expiresAt.Time
+	}
+	if lastUsedAt.Valid {
+		k.LastUsedAt = &lastUsedAt.Time
+	}
+	if revokedAt.Valid {
+		k.RevokedAt = &revokedAt.Time
+	}
+	return k, nil
+}
+
+// splitList splits a space separated column into its values
+func splitList(s string) []string {
+	fields := strings.Fields(s)
+	if fields == nil {
+		return []string{}
+	}
+	return fields
+}
+
+// CreateAPIKey stores a new API key under the hash of the key
+func (d *Database) CreateAPIKey(k *APIKey, keyHash string) error {
+	result, err := d.db.Exec(`INSERT INTO api_keys (name, prefix, key_hash, username, scopes, allowed_ips, expires_at, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		k.Name, k.Prefix, keyHash, k.Username, strings.Join(k.Scopes, " "), strings.Join(k.AllowedIPs, " "), k.ExpiresAt, k.CreatedBy, k.CreatedAt)
+	if err != nil {
+		return err
+	}
+	k.ID, err = result.LastInsertId()
+	return err
+}
+
+// GetAPIKey returns the API key with the given ID
+func (d *Database) GetAPIKey(id int64) (*APIKey, error) {
+	return scanAPIKey(d.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+// GetAPIKeyByHash returns the usable API key with the given hash. It returns
+// ErrAPIKeyInvalid if there is none or it is revoked or expired at the given
+// time.
+func (d *Database) GetAPIKeyByHash(keyHash string, at time.Time) (*APIKey, error) {
+	k, err := scanAPIKey(d.db.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if k.RevokedAt != nil || (k.ExpiresAt != nil && !at.Before(*k.ExpiresAt)) {
+		return nil, ErrAPIKeyInvalid
+	}
+	return k, nil
+}
+
+// ListAPIKeys returns the API keys of a user, or of every user of an
+// organization when username is empty, newest first. An empty orgID
+// matches every organization.
+func (d *Database) ListAPIKeys(username, orgID string) ([]*APIKey, error) {
+	query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE (? = '' OR username IN (SELECT username FROM users WHERE org_id = ?))`
+	args := []interface{}{orgID, orgID}
+	if username != "" {
+		query += ` AND username = ?`
+		args = append(args, username)
+	}
+	rows, err := d.db.Query(query+` ORDER BY id DESC`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*APIKey
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// TouchAPIKey records a use of an API key. Uses within a minute of the last
+// recorded one are not written to keep authentication cheap.
+func (d *Database) TouchAPIKey(id int64, ip string, at time.Time) error {
+	_, err := d.db.Exec(`UPDATE api_keys SET last_used_at = ?, last_used_ip = ? WHERE id = ? AND (last_used_at IS NULL OR last_used_at < ? OR last_used_ip != ?)`,
+		at, ip, id, at.Add(-time.Minute), ip)
+	return err
+}
+
+// RevokeAPIKey revokes an API key. It returns sql.ErrNoRows if the key does
+// not exist and reports whether it was active.
+func (d *Database) RevokeAPIKey(id int64, at time.Time) (bool, error) {
+	if _, err := d.GetAPIKey(id); err != nil {
+		return false, err
+	}
+	result, err := d.db.Exec(`UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`, at, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,295 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Audit event outcomes
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// errStopIteration ends EachAuditEvent early without an error
+var errStopIteration = errors.New("stop iteration")
+
+// auditGenesisHash is the previous hash of the first event in the chain
+var auditGenesisHash = strings.Repeat("0", 64)
+
+// AuditEvent records one state-changing operator action. Events form a
+// hash chain: each hash covers the event and the hash of the event before
+// it, so changing or removing a stored event breaks the chain from there.
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	Time       time.Time       `json:"time"`
+	OrgID      string          `json:"org_id,omitempty"`
+	Actor      string          `json:"actor"`
+	SourceIP   string          `json:"source_ip,omitempty"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Outcome    string          `json:"outcome"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
+
+// AuditFilter selects audit events. Action matches exactly, or as a prefix
+// when it ends with a dot, e.g. "agent.".
+type AuditFilter struct {
+	// OrgID limits the events to one organization; empty matches all
+	OrgID      string
+	Actor      string
+	Action     string
+	TargetType string
+	TargetID   string
+	Outcome    string
+	From       *time.Time
+	To         *time.Time
+	// BeforeID pages backwards through the newest-first listing
+	BeforeID int64
+	Limit    int
+}
+
+// computeHash returns the chain hash of the event. The fields are hashed as
+// JSON in a fixed order together with the previous hash. The organization
+// is only hashed when set so events written before it existed still verify.
+func (e *AuditEvent) computeHash() string {
+	fields := []interface{}{
+		e.PrevHash,
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.SourceIP,
+		e.Action,
+		e.TargetType,
+		e.TargetID,
+		e.Outcome,
+		string(e.Before),
+		string(e.After),
+	}
+	if e.OrgID != "" {
+		fields = append(fields, e.OrgID)
+	}
+	payload, _ := json.Marshal(fields)
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// AppendAuditEvent adds an event to the end of the chain, setting its ID,
+// time (unless set), previous hash and hash. The unique previous hash keeps
+// concurrent writers, e.g. the server and a CLI command, from forking the
+// chain; the loser retries on the new end. It also retries when SQLite
+// refuses the write because another connection is writing.
+func (d *Database) AppendAuditEvent(e *AuditEvent) error {
+	d.auditMu.Lock()
+	defer d.auditMu.Unlock()
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	// Stored and hashed with microsecond precision in UTC so the hash can
+	// be recomputed from what is read back
+	e.Time = e.Time.UTC().Truncate(time.Microsecond)
+	if e.Outcome == "" {
+		e.Outcome = AuditSuccess
+	}
+
+	const attempts = 10
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = d.appendAuditEvent(e)
+		var sqliteErr sqlite3.Error
+		switch {
+		case errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique:
+		case errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrBusy:
+			// Upgrading to a write lock fails at once rather than waiting
+			time.Sleep(time.Duration(i+1) * 10 * time.Millisecond)
+		default:
+			return err
+		}
+	}
+	return err
+}
+
+func (d *Database) appendAuditEvent(e *AuditEvent) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT hash FROM audit_events ORDER BY id DESC LIMIT 1`).Scan(&e.PrevHash)
+	if errors.Is(err, sql.ErrNoRows) {
+		e.PrevHash = auditGenesisHash
+	} else if err != nil {
+		return err
+	}
+	e.Hash = e.computeHash()
+
+	result, err := tx.Exec(`INSERT INTO audit_events (time, org_id, actor, source_ip, action, target_type, target_id, outcome, before, after, prev_hash, hash)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.Time, e.OrgID, e.Actor, e.SourceIP, e.Action, e.TargetType, e.TargetID, e.Outcome,
+		nullJSON(e.Before), nullJSON(e.After), e.PrevHash, e.Hash)
+	if err != nil {
+		return err
+	}
+	if e.ID, err = result.LastInsertId(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListAuditEvents returns matching events, newest first
+func (d *Database) ListAuditEvents(filter AuditFilter) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	err := d.queryAuditEvents(filter, true, func(e *AuditEvent) error {
+		events = append(events, e)
+		return nil
+	})
+	return events, err
+}
+
+// EachAuditEvent calls fn for every matching event, oldest first, without
+// loading them all into memory
+func (d *Database) EachAuditEvent(filter AuditFilter, fn func(*AuditEvent) error) error {
+	return d.queryAuditEvents(filter, false, fn)
+}
+
+func (d *Database) queryAuditEvents(filter AuditFilter, newestFirst bool, fn func(*AuditEvent) error) error {
+	var (
+		where []string
+		args  []interface{}
+	)
+	add := func(clause string, arg interface{}) {
+		where = append(where, clause)
+		args = append(args, arg)
+	}
+	if filter.OrgID != "" {
+		add("org_id = ?", filter.OrgID)
+	}
+	if filter.Actor != "" {
+		add("actor = ?", filter.Actor)
+	}
+	if strings.HasSuffix(filter.Action, ".") {
+		add("action LIKE ? ESCAPE '\\'", escapeLike(filter.Action)+"%")
+	} else if filter.Action != "" {
+		add("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		add("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		add("target_id = ?", filter.TargetID)
+	}
+	if filter.Outcome != "" {
+		add("outcome = ?", filter.Outcome)
+	}
+	if filter.From != nil {
+		add("time >= ?", filter.From.UTC())
+	}
+	if filter.To != nil {
+		add("time < ?", filter.To.UTC())
+	}
+	if filter.BeforeID > 0 {
+		add("id < ?", filter.BeforeID)
+	}
+
+	query := `SELECT id, time, org_id, actor, source_ip, action, target_type, target_id, outcome, before, after, prev_hash, hash FROM audit_events`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if newestFirst {
+		query += " ORDER BY id DESC"
+	} else {
+		query += " ORDER BY id ASC"
+	}
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanAuditEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func scanAuditEvent(rows *sql.Rows) (*AuditEvent, error) {
+	var (
+		e             AuditEvent
+		before, after sql.NullString
+	)
+	err := rows.Scan(&e.ID, &e.Time, &e.OrgID, &e.Actor, &e.SourceIP, &e.Action, &e.TargetType, &e.TargetID, &e.Outcome, &before, &after, &e.PrevHash, &e.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if before.Valid {
+		e.Before = json.RawMessage(before.String)
+	}
+	if after.Valid {
+		e.After = json.RawMessage(after.String)
+	}
+	return &e, nil
+}
+
+// AuditVerification is the result of checking the audit hash chain
+type AuditVerification struct {
+	Valid  bool `json:"valid"`
+	Events int  `json:"events"`
+	// BrokenAt is the ID of the first event whose hash or link does not
+	// match
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// VerifyAuditChain recomputes every hash and checks that each event links
+// to the one before it
+func (d *Database) VerifyAuditChain() (*AuditVerification, error) {
+	result := &AuditVerification{Valid: true}
+	prev := auditGenesisHash
+	err := d.EachAuditEvent(AuditFilter{}, func(e *AuditEvent) error {
+		result.Events++
+		switch {
+		case e.PrevHash != prev:
+			result.Valid, result.BrokenAt, result.Reason = false, e.ID, "previous hash does not match the preceding event"
+		case e.computeHash() != e.Hash:
+			result.Valid, result.BrokenAt, result.Reason = false, e.ID, "hash does not match the event"
+		default:
+			prev = e.Hash
+			return nil
+		}
+		return errStopIteration
+	})
+	if err != nil && !errors.Is(err, errStopIteration) {
+		return nil, err
+	}
+	return result, nil
+}
+
+func nullJSON(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	return string(raw)
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"silentrig/internal/config"
+	"silentrig/internal/logger"
+)
+
+// appendAuditEvents appends n events and returns them
+func appendAuditEvents(t *testing.T, db *Database, n int) []*AuditEvent {
+	t.Helper()
+	events := make([]*AuditEvent, n)
+	for i := range events {
+		events[i] = &AuditEvent{Actor: "admin", Action: "agent.update", TargetType: "agent", TargetID: fmt.Sprintf("agent-%d", i)}
+		if err := db.AppendAuditEvent(events[i]); err != nil {
+			t.Fatalf("append audit event: %v", err)
+		}
+	}
+	return events
+}
+
+func verifyAuditChain(t *testing.T, db *Database) *AuditVerification {
+	t.Helper()
+	result, err := db.VerifyAuditChain()
+	if err != nil {
+		t.Fatalf("verify audit chain: %v", err)
+	}
+	return result
+}
+
+func TestAuditChainLinks(t *testing.T) {
+	db := newTestDatabase(t)
+	events := appendAuditEvents(t, db, 3)
+
+	if events[0].PrevHash != auditGenesisHash {
+		t.Errorf("first event links to %q, want the genesis hash", events[0].PrevHash)
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].PrevHash != events[i-1].Hash {
+			t.Errorf("event %d links to %q, want %q", i, events[i].PrevHash, events[i-1].Hash)
+		}
+	}
+	if result := verifyAuditChain(t, db); !result.Valid || result.Events != 3 {
+		t.Errorf("verification = %+v, want 3 valid events", result)
+	}
+}
+
+func TestAuditEventsAppendOnly(t *testing.T) {
+	db := newTestDatabase(t)
+	events := appendAuditEvents(t, db, 2)
+
+	statements := []string{
+		`UPDATE audit_events SET actor = 'intruder' WHERE id = ?`,
+		`DELETE FROM audit_events WHERE id = ?`,
+	}
+	for _, stmt := range statements {
+		_, err := db.db.Exec(stmt, events[0].ID)
+		if err == nil || !strings.Contains(err.Error(), "append-only") {
+			t.Errorf("%s: got %v, want the append-only error", stmt, err)
+		}
+	}
+	if result := verifyAuditChain(t, db); !result.Valid || result.Events != 2 {
+		t.Errorf("verification = %+v, want 2 valid events", result)
+	}
+}
+
+func TestVerifyAuditChainDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper string
+		// brokenAt is the index of the event reported as broken
+		brokenAt int
+		reason   string
+	}{
+		{"modified row", `UPDATE audit_events SET actor = 'intruder' WHERE id = ?`, 1, "hash does not match"},
+		{"modified hash", `UPDATE audit_events SET hash = 'forged' WHERE id = ?`, 1, "hash does not match"},
+		{"deleted row", `DELETE FROM audit_events WHERE id = ?`, 2, "previous hash does not match"},
+		{"broken link", `UPDATE audit_events SET prev_hash = 'forged' WHERE id = ?`, 1, "previous hash does not match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDatabase(t)
+			events := appendAuditEvents(t, db, 3)
+
+			// Someone with write access to the file can drop the triggers
+			for _, trigger := range []string{"audit_events_no_update", "audit_events_no_delete"} {
+				if _, err := db.db.Exec(`DROP TRIGGER ` + trigger); err != nil {
+					t.Fatalf("drop trigger: %v", err)
+				}
+			}
+			if _, err := db.db.Exec(tt.tamper, events[1].ID); err != nil {
+				t.Fatalf("tamper: %v", err)
+			}
+
+			result := verifyAuditChain(t, db)
+			if result.Valid || result.BrokenAt != events[tt.brokenAt].ID || !strings.Contains(result.Reason, tt.reason) {
+				t.Errorf("verification = %+v, want broken at %d: %s", result, events[tt.brokenAt].ID, tt.reason)
+			}
+		})
+	}
+}
+
+func TestConcurrentAuditAppends(t *testing.T) {
+	// Two databases on one file stand in for the server and a CLI command,
+	// which do not share auditMu
+	path := filepath.Join(t.TempDir(), "silentrig.db")
+	log, outputs, err := logger.Open(config.LoggingConfig{Level: "error", Format: "json"})
+	if err != nil {
+		t.Fatalf("open logger: %v", err)
+	}
+	t.Cleanup(func() { outputs.Close() })
+	var dbs []*Database
+	for i := 0; i < 2; i++ {
+		db, err := New(path, log)
+		if err != nil {
+			t.Fatalf("open database: %v", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		dbs = append(dbs, db)
+	}
+
+	const writers, perWriter = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*perWriter)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db := dbs[w%len(dbs)]
+			for i := 0; i < perWriter; i++ {
+				errs <- db.AppendAuditEvent(&AuditEvent{Actor: fmt.Sprintf("writer-%d", w), Action: "agent.update"})
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("append: %v", err)
+		}
+	}
+
+	// Conflicting appends are retried on the new end of the chain
+	result := verifyAuditChain(t, dbs[0])
+	if !result.Valid || result.Events != writers*perWriter {
+		t.Errorf("verification = %+v, want %d valid events", result, writers*perWriter)
+	}
+}
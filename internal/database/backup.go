@@ -0,0 +1,82 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Backup writes a consistent copy of the database to path while it stays
+// usable. The target file must not exist.
+func (d *Database) Backup(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("backup target %s already exists", path)
+	}
+	_, err := d.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// Restore replaces the database file at dbPath with the backup at
+// backupPath after checking the backup's integrity. The server must not be
+// running while the database is restored.
+func Restore(backupPath, dbPath string) error {
+	if err := checkIntegrity(backupPath); err != nil {
+		return err
+	}
+
+	src, err := os.Open(backupPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Copy next to the target and rename so a failed copy never leaves a
+	// truncated database behind
+	tmp, err := os.CreateTemp(filepath.Dir(dbPath), filepath.Base(dbPath)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	// Journal files belong to the database being replaced
+	for _, suffix := range []string{"-wal", "-shm", "-journal"} {
+		if err := os.Remove(dbPath + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), dbPath)
+}
+
+func checkIntegrity(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow(`PRAGMA integrity_check`).Scan(&result); err != nil {
+		return fmt.Errorf("%s is not a valid database: %w", path, err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("%s failed the integrity check: %s", path, result)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// AgentCertificate records a client certificate issued to an agent by the
+// built-in CA. Serials are hex encoded.
+type AgentCertificate struct {
+	Serial    string     `json:"serial"`
+	AgentID   string     `json:"agent_id"`
+	NotBefore time.Time  `json:"not_before"`
+	NotAfter  time.Time  `json:"not_after"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// StoreCertificate records an issued certificate
+func (d *Database) StoreCertificate(cert *AgentCertificate) error {
+	_, err := d.db.Exec(`INSERT INTO agent_certificates (serial, agent_id, not_before, not_after, created_at) VALUES (?, ?, ?, ?, ?)`,
+		cert.Serial, cert.AgentID, cert.NotBefore, cert.NotAfter, cert.CreatedAt)
+	return err
+}
+
+// GetCertificate returns the certificate with the given serial
+func (d *Database) GetCertificate(serial string) (*AgentCertificate, error) {
+	cert := &AgentCertificate{}
+	var revokedAt sql.NullTime
+	err := d.db.QueryRow(`SELECT serial, agent_id, not_before, not_after, revoked_at, created_at FROM agent_certificates WHERE serial = ?`, serial).
+		Scan(&cert.Serial, &cert.AgentID, &cert.NotBefore, &cert.NotAfter, &revokedAt, &cert.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		cert.RevokedAt = &revokedAt.Time
+	}
+	return cert, nil
+}
+
+// ListAgentCertificates returns the certificates issued to an agent, newest
+// first
+func (d *Database) ListAgentCertificates(agentID string) ([]*AgentCertificate, error) {
+	rows, err := d.db.Query(`SELECT serial, agent_id, not_before, not_after, revoked_at, created_at FROM agent_certificates WHERE agent_id = ? ORDER BY julianday(created_at) DESC`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var certs []*AgentCertificate
+	for rows.Next() {
+		cert := &AgentCertificate{}
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&cert.Serial, &cert.AgentID, &cert.NotBefore, &cert.NotAfter, &revokedAt, &cert.CreatedAt); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			cert.RevokedAt = &revokedAt.Time
+		}
+		certs = append(certs, cert)
+	}
+	return certs, rows.Err()
+}
+
+// RevokeAgentCertificates revokes every certificate of an agent that is not
+// revoked yet and returns how many were revoked
+func (d *Database) RevokeAgentCertificates(agentID string, at time.Time) (int, error) {
+	result, err := d.db.Exec(`UPDATE agent_certificates SET revoked_at = ? WHERE agent_id = ? AND revoked_at IS NULL`, at, agentID)
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// RevokeCertificate revokes a single certificate. It returns sql.ErrNoRows
+// if the serial is unknown.
+func (d *Database) RevokeCertificate(serial string, at time.Time) error {
+	result, err := d.db.Exec(`UPDATE agent_certificates SET revoked_at = COALESCE(revoked_at, ?) WHERE serial = ?`, at, serial)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
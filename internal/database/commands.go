@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// ErrCommandNotPending is returned when cancelling a command that an agent
+// already picked up or that has finished
+var ErrCommandNotPending = errors.New("command is not pending")
+
+const commandColumns = `id, agent_id, org_id, command, parameters, status, created_at, updated_at`
+
+// GetCommand returns a command by ID
+func (d *Database) GetCommand(id int64) (*Command, error) {
+	cmd := &Command{}
+	err := d.db.QueryRow(`SELECT `+commandColumns+` FROM commands WHERE id = ?`, id).
+		Scan(&cmd.ID, &cmd.AgentID, &cmd.OrgID, &cmd.Command, &cmd.Parameters, &cmd.Status, &cmd.CreatedAt, &cmd.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// CancelCommand marks a pending command of an organization, or of any
+// organization when orgID is empty, as cancelled so it is no longer
+// delivered. It returns sql.ErrNoRows for unknown commands and
+// ErrCommandNotPending for commands that are no longer pending.
+func (d *Database) CancelCommand(id int64, orgID string) (*Command, error) {
+	cmd, err := d.GetCommand(id)
+	if err != nil {
+		return nil, err
+	}
+	if orgID != "" && cmd.OrgID != orgID {
+		return nil, sql.ErrNoRows
+	}
+
+	now := time.Now()
+	result, err := d.db.Exec(`UPDATE commands SET status = 'cancelled', updated_at = ? WHERE id = ? AND status = 'pending'`, now, id)
+	if err != nil {
+		return nil, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd, err = d.GetCommand(id); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return cmd, ErrCommandNotPending
+	}
+	return cmd, nil
+}
+
+// CreateCommandForAgents queues a command for every agent matching the
+// filter in one transaction and returns the command IDs keyed by agent ID.
+// Revoked and decommissioned agents are never selected, whatever statuses
+// the filter asks for.
+func (d *Database) CreateCommandForAgents(filter *AgentFilter, command, parameters string) (map[string]int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	conditions, args := filter.conditions()
+	conditions = append(conditions, `status NOT IN (?, ?)`)
+	args = append(args, StatusRevoked, StatusDecommissioned)
+	rows, err := tx.Query(`SELECT id FROM agents WHERE `+strings.Join(conditions, " AND "), args...)
+	if err != nil {
+		return nil, err
+	}
+	var agentIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		agentIDs = append(agentIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	commandIDs := make(map[string]int64, len(agentIDs))
+	for _, agentID := range agentIDs {
+		result, err := tx.Exec(`INSERT INTO commands (agent_id, org_id, command, parameters) SELECT id, org_id, ?, ? FROM agents WHERE id = ?`,
+			command, parameters, agentID)
+		if err != nil {
+			return nil, err
+		}
+		if commandIDs[agentID], err = result.LastInsertId(); err != nil {
+			return nil, err
+		}
+	}
+	return commandIDs, tx.Commit()
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrAgentExists is returned when an agent is created for a machine that
+// already has one
+var ErrAgentExists = errors.New("agent already exists for this machine")
+
+// ErrConflictResolved is returned when resolving a conflict that was already
+// resolved
+var ErrConflictResolved = errors.New("conflict is already resolved")
+
+// Kinds of agent identity conflicts
+const (
+	// ConflictCredentials: a known machine registered with a token that does
+	// not belong to its agent
+	ConflictCredentials = "credential_mismatch"
+	// ConflictMachineID: an agent's token was presented for another machine
+	ConflictMachineID = "machine_id_mismatch"
+	// ConflictClone: an agent's credentials are used from two addresses at
+	// the same time
+	ConflictClone = "clone"
+)
+
+// Ways an operator resolves a conflict
+const (
+	// ResolutionAccept lets the registering host take over the agent
+	ResolutionAccept = "accept"
+	// ResolutionDismiss closes the conflict without changing the agent
+	ResolutionDismiss = "dismiss"
+	// ResolutionRevoke revokes the agent
+	ResolutionRevoke = "revoke"
+)
+
+// AgentConflict records an identity conflict of an agent for an operator to
+// resolve. Repeated detections of the same conflict update one record.
+type AgentConflict struct {
+	ID      int64  `json:"id"`
+	AgentID string `json:"agent_id"`
+	OrgID   string `json:"org_id"`
+	Kind    string `json:"kind"`
+	// MachineID is the machine ID the conflicting host presented
+	MachineID string `json:"machine_id"`
+	// TokenHash is the hash of the token the conflicting host presented
+	TokenHash string `json:"-"`
+	SourceIP  string `json:"source_ip"`
+	// OtherIP is the address the agent used before a suspected clone showed up
+	OtherIP    string     `json:"other_ip,omitempty"`
+	Count      int        `json:"count"`
+	DetectedAt time.Time  `json:"detected_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+	Resolution string     `json:"resolution,omitempty"`
+}
+
+const conflictColumns = `id, agent_id, org_id, kind, machine_id, token_hash, source_ip, other_ip, count, detected_at, last_seen_at, resolved_at, resolved_by, resolution`
+
+func scanConflict(row interface{ Scan(...interface{}) error }) (*AgentConflict, error) {
+	c := &AgentConflict{}
+	var resolvedAt sql.NullTime
+	if err := row.Scan(&c.ID, &c.AgentID, &c.OrgID, &c.Kind, &c.MachineID, &c.TokenHash, &c.SourceIP, &c.OtherIP,
+		&c.Count, &c.DetectedAt, &c.LastSeenAt, &resolvedAt, &c.ResolvedBy, &c.Resolution); err != nil {
+		return nil, err
+	}
+	if resolvedAt.Valid {
+		c.ResolvedAt = &resolvedAt.Time
+	}
+	return c, nil
+}
+
+// RecordConflict stores a conflict, or counts it again when the same agent
+// already has an open conflict of that kind from the same host, or an open
+// clone conflict. It reports whether the conflict is new.
+func (d *Database) RecordConflict(conflict *AgentConflict, at time.Time) (*AgentConflict, bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	// A clone alternates between addresses, so it is one conflict whatever
+	// address it was last seen from
+	err = tx.QueryRow(`SELECT id FROM agent_conflicts WHERE agent_id = ? AND kind = ? AND machine_id = ? AND (kind = ? OR source_ip = ?) AND resolved_at IS NULL`,
+		conflict.AgentID, conflict.Kind, conflict.MachineID, ConflictClone, conflict.SourceIP).Scan(&id)
+	created := errors.Is(err, sql.ErrNoRows)
+	switch {
+	case created:
+		result, err := tx.Exec(`INSERT INTO agent_conflicts (agent_id, org_id, kind, machine_id, token_hash, source_ip, other_ip, detected_at, last_seen_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			conflict.AgentID, conflict.OrgID, conflict.Kind, conflict.MachineID, conflict.TokenHash, conflict.SourceIP, conflict.OtherIP, at, at)
+		if err != nil {
+			return nil, false, err
+		}
+		if id, err = result.LastInsertId(); err != nil {
+			return nil, false, err
+		}
+	case err != nil:
+		return nil, false, err
+	default:
+		// The latest token is the one an accepted host keeps using
+		if _, err := tx.Exec(`UPDATE agent_conflicts SET count = count + 1, last_seen_at = ?, token_hash = ?, source_ip = ?, other_ip = ? WHERE id = ?`,
+			at, conflict.TokenHash, conflict.SourceIP, conflict.OtherIP, id); err != nil {
+			return nil, false, err
+		}
+	}
+
+	recorded, err := scanConflict(tx.QueryRow(`SELECT `+conflictColumns+` FROM agent_conflicts WHERE id = ?`, id))
+	if err != nil {
+		return nil, false, err
+	}
+	return recorded, created, tx.Commit()
+}
+
+// GetConflict returns a conflict by ID
+func (d *Database) GetConflict(id int64) (*AgentConflict, error) {
+	return scanConflict(d.db.QueryRow(`SELECT `+conflictColumns+` FROM agent_conflicts WHERE id = ?`, id))
+}
+
+// ListConflicts returns the conflicts of an organization, or of all of them
+// when orgID is empty, newest first. Resolved conflicts are only included
+// when all is set.
+func (d *Database) ListConflicts(orgID string, all bool) ([]*AgentConflict, error) {
+	query := `SELECT ` + conflictColumns + ` FROM agent_conflicts WHERE (? = '' OR org_id = ?)`
+	if !all {
+		query += ` AND resolved_at IS NULL`
+	}
+	query += ` ORDER BY last_seen_at DESC, id DESC`
+
+	rows, err := d.db.Query(query, orgID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conflicts := []*AgentConflict{}
+	for rows.Next() {
+		conflict, err := scanConflict(rows)
+		if err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, conflict)
+	}
+	return conflicts, rows.Err()
+}
+
+// CountOpenConflicts returns the number of unresolved conflicts of an
+// organization, or of all of them when orgID is empty
+func (d *Database) CountOpenConflicts(orgID string) (int, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM agent_conflicts WHERE resolved_at IS NULL AND (? = '' OR org_id = ?)`, orgID, orgID).Scan(&n)
+	return n, err
+}
+
+// ResolveConflict closes an open conflict. It returns ErrConflictResolved
+// when the conflict was already resolved.
+func (d *Database) ResolveConflict(id int64, resolution, resolvedBy string, at time.Time) error {
+	result, err := d.db.Exec(`UPDATE agent_conflicts SET resolved_at = ?, resolved_by = ?, resolution = ? WHERE id = ? AND resolved_at IS NULL`,
+		at, resolvedBy, resolution, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrConflictResolved
+	}
+	return nil
+}
+
+// ReplaceAgentToken makes tokenHash the only valid token of an agent that is
+// not revoked. It returns sql.ErrNoRows for unknown and revoked agents.
+func (d *Database) ReplaceAgentToken(id, tokenHash string) error {
+	result, err := d.db.Exec(`UPDATE agents SET token_hash = ?, previous_token_hash = '', previous_token_expires_at = NULL, updated_at = ? WHERE id = ? AND revoked_at IS NULL`,
+		tokenHash, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetAgentMachineID moves an agent to another machine. It returns
+// ErrAgentExists when that machine already has an agent.
+func (d *Database) SetAgentMachineID(id, machineID string) error {
+	result, err := d.db.Exec(`UPDATE OR IGNORE agents SET machine_id = ?, updated_at = ? WHERE id = ?`, machineID, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		if _, err := d.GetAgentByMachineID(machineID); err == nil {
+			return ErrAgentExists
+		}
+		return sql.ErrNoRows
+	}
+	return nil
+}
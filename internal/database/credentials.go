@@ -0,0 +1,157 @@
+package database
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"time"
+)
+
+// GetAgentByTokenHash returns the agent authenticating with the token of the
+// given hash: its current token, or its previous one until the grace window
+// after a rotation ends
+func (d *Database) GetAgentByTokenHash(tokenHash string, at time.Time) (*Agent, error) {
+	if tokenHash == "" {
+		return nil, sql.ErrNoRows
+	}
+	query := `SELECT ` + agentColumns + ` FROM agents WHERE token_hash = ? OR (previous_token_hash = ? AND julianday(previous_token_expires_at) > julianday(?))`
+	agent, err := scanAgent(d.db.QueryRow(query, tokenHash, tokenHash, at))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.loadAgentTags(agent); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// GetAgentByMachineID returns the agent registered for a machine
+func (d *Database) GetAgentByMachineID(machineID string) (*Agent, error) {
+	query := `SELECT ` + agentColumns + ` FROM agents WHERE machine_id = ?`
+	agent, err := scanAgent(d.db.QueryRow(query, machineID))
+	if err != nil {
+		return nil, err
+	}
+	if err := d.loadAgentTags(agent); err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// RotateAgentToken replaces the token of an agent that is not revoked. The
+// token the agent still holds stays valid until previousExpiresAt: the
+// presented one when the agent authenticated with its previous token, so a
+// lost rotation response does not lock it out, or else the current one. It
+// returns sql.ErrNoRows for unknown and revoked agents.
+func (d *Database) RotateAgentToken(id, presentedHash, tokenHash string, previousExpiresAt time.Time) error {
+	result, err := d.db.Exec(`UPDATE agents SET
+		previous_token_hash = CASE WHEN ? != '' AND previous_token_hash = ? THEN previous_token_hash ELSE token_hash END,
+		previous_token_expires_at = ?, token_hash = ?, updated_at = ?
+		WHERE id = ? AND revoked_at IS NULL`,
+		presentedHash, presentedHash, previousExpiresAt, tokenHash, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeAgent discards the tokens of an agent, moves it to the revoked
+// status and cancels its pending commands. It returns the number of
+// cancelled commands, and sql.ErrNoRows for unknown or already revoked
+// agents.
+func (d *Database) RevokeAgent(id string, at time.Time) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var revokedAt sql.NullTime
+	if err := tx.QueryRow(`SELECT status, revoked_at FROM agents WHERE id = ?`, id).Scan(&status, &revokedAt); err != nil {
+		return 0, err
+	}
+	if revokedAt.Valid {
+		return 0, sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`UPDATE agents SET token_hash = '', previous_token_hash = '', previous_token_expires_at = NULL, revoked_at = ? WHERE id = ?`, at, id); err != nil {
+		return 0, err
+	}
+	if err := transitionStatus(tx, id, status, StatusRevoked, at); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`UPDATE commands SET status = 'cancelled', updated_at = ? WHERE agent_id = ? AND status = 'pending'`, at, id)
+	if err != nil {
+		return 0, err
+	}
+	cancelled, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return cancelled, tx.Commit()
+}
+
+// ReinstateAgent gives a revoked agent a new token and moves it back to the
+// inactive status until its next heartbeat. It returns sql.ErrNoRows unless
+// the agent is revoked.
+func (d *Database) ReinstateAgent(id, tokenHash string, at time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE agents SET token_hash = ?, revoked_at = NULL WHERE id = ? AND revoked_at IS NOT NULL`, tokenHash, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := transitionStatus(tx, id, StatusRevoked, StatusInactive, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// hashLegacyAgentTokens replaces the plain text tokens of agents registered
+// before tokens were hashed by their hash. The hash matches the one the
+// registry stores for new tokens.
+func (d *Database) hashLegacyAgentTokens() error {
+	rows, err := d.db.Query(`SELECT id, token FROM agents WHERE token IS NOT NULL AND token != ''`)
+	if err != nil {
+		return err
+	}
+	tokens := map[string]string{}
+	for rows.Next() {
+		var id, token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = token
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, token := range tokens {
+		sum := sha256.Sum256([]byte(token))
+		if _, err := d.db.Exec(`UPDATE agents SET token_hash = ?, token = NULL WHERE id = ?`, hex.EncodeToString(sum[:]), id); err != nil {
+			return err
+		}
+	}
+	if len(tokens) > 0 {
+		d.logger.Info("Hashed stored agent tokens", "count", len(tokens))
+	}
+	return nil
+}
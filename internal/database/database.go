@@ -2,24 +2,105 @@ package database
 
 import (
 	"database/sql"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+
+	"silentrig/internal/logger"
 )
 
 type Database struct {
-	db *sql.DB
+	db     *sql.DB
+	logger logger.Logger
+
+	// auditMu serializes appends to the audit hash chain
+	auditMu sync.Mutex
 }
 
 type Agent struct {
-	ID         string    `json:"id"`
-	MachineID  string    `json:"machine_id"`
-	Token      string    `json:"token"`
-	Name       string    `json:"name"`
-	Status     string    `json:"status"`
-	LastSeen   time.Time `json:"last_seen"`
-	CreatedAt  time.Time `json:"created_at"`
-	UpdatedAt  time.Time `json:"updated_at"`
+	ID         string            `json:"id"`
+	MachineID  string            `json:"machine_id"`
+	// Token is the agent's credential in plain text. It is only set right
+	// after it was issued; the database keeps its hash.
+	Token      string            `json:"token,omitempty"`
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	LastSeen   time.Time         `json:"last_seen"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+	Labels     map[string]string `json:"labels"`
+	Groups     []string          `json:"groups"`
+
+	StatusChangedAt   time.Time `json:"status_changed_at"`
+	HeartbeatInterval int       `json:"heartbeat_interval"`
+	OrgID             string    `json:"org_id"`
+	// RevokedAt is set while the agent's credentials are revoked
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// DecommissionedAt is set while the agent is decommissioned and waits
+	// to be purged
+	DecommissionedAt *time.Time `json:"decommissioned_at,omitempty"`
+}
+
+const agentColumns = `id, machine_id, name, status, last_seen, created_at, updated_at, status_changed_at, heartbeat_interval, org_id, revoked_at, decommissioned_at`
+
+func scanAgent(row rowScanner, extra ...interface{}) (*Agent, error) {
+	agent := &Agent{}
+	var revokedAt, decommissionedAt sql.NullTime
+	dest := []interface{}{
+		&agent.ID, &agent.MachineID, &agent.Name,
+		&agent.Status, &agent.LastSeen, &agent.CreatedAt, &agent.UpdatedAt,
+		&agent.StatusChangedAt, &agent.HeartbeatInterval, &agent.OrgID, &revokedAt, &decommissionedAt,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		agent.RevokedAt = &revokedAt.Time
+	}
+	if decommissionedAt.Valid {
+		agent.DecommissionedAt = &decommissionedAt.Time
+	}
+	return agent, nil
+}
+
+// AgentFilter narrows agent listings and doubles as a selector for
+// operations that target several agents at once. Every label and group
+// must match for an agent to be selected.
+type AgentFilter struct {
+	Labels map[string]string `json:"labels"`
+	Groups []string          `json:"groups"`
+
+	// OrgID limits the filter to the agents of an organization. It is set
+	// from the caller's identity, never from the request.
+	OrgID string `json:"-"`
+
+	// Inventory filters match against the latest reported inventory
+	OS           string `json:"os,omitempty"`
+	Architecture string `json:"architecture,omitempty"`
+	CPUFeature   string `json:"cpu_feature,omitempty"`
+	AgentVersion string `json:"agent_version,omitempty"`
+	MinerVersion string `json:"miner_version,omitempty"`
+
+	// Statuses matches any of the listed statuses
+	Statuses []string `json:"statuses,omitempty"`
+	// Search matches a substring of the agent name, machine ID or ID
+	Search string `json:"search,omitempty"`
+	// LastSeenAfter and LastSeenBefore bound the last heartbeat time
+	LastSeenAfter  *time.Time `json:"last_seen_after,omitempty"`
+	LastSeenBefore *time.Time `json:"last_seen_before,omitempty"`
+}
+
+// IsEmpty reports whether the filter selects every agent of its
+// organization
+func (f *AgentFilter) IsEmpty() bool {
+	return f == nil || (len(f.Labels) == 0 && len(f.Groups) == 0 &&
+		f.OS == "" && f.Architecture == "" && f.CPUFeature == "" &&
+		f.AgentVersion == "" && f.MinerVersion == "" &&
+		len(f.Statuses) == 0 && f.Search == "" &&
+		f.LastSeenAfter == nil && f.LastSeenBefore == nil)
 }
 
 type Metrics struct {
@@ -41,6 +122,7 @@ type Metrics struct {
 type Command struct {
 	ID         int64     `json:"id"`
 	AgentID    string    `json:"agent_id"`
+	OrgID      string    `json:"org_id"`
 	Command    string    `json:"command"`
 	Parameters string    `json:"parameters"`
 	Status     string    `json:"status"`
@@ -48,7 +130,7 @@ type Command struct {
 	UpdatedAt  time.Time `json:"updated_at"`
 }
 
-func New(dbPath string) (*Database, error) {
+func New(dbPath string, log logger.Logger) (*Database, error) {
 	db, err := sql.Open("sqlite3", dbPath)
 	if err != nil {
 		return nil, err
@@ -58,11 +140,12 @@ func New(dbPath string) (*Database, error) {
 		return nil, err
 	}
 
-	database := &Database{db: db}
+	database := &Database{db: db, logger: log}
 	if err := database.migrate(); err != nil {
 		return nil, err
 	}
 
+	log.Debug("Database opened", "path", dbPath)
 	return database, nil
 }
 
@@ -108,6 +191,198 @@ func (d *Database) migrate() error {
 			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
 			FOREIGN KEY (agent_id) REFERENCES agents (id) ON DELETE CASCADE
 		)`,
+		`CREATE TABLE IF NOT EXISTS agent_labels (
+			agent_id TEXT NOT NULL,
+			key TEXT NOT NULL,
+			value TEXT NOT NULL,
+			PRIMARY KEY (agent_id, key),
+			FOREIGN KEY (agent_id) REFERENCES agents (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS agent_groups (
+			agent_id TEXT NOT NULL,
+			name TEXT NOT NULL,
+			PRIMARY KEY (agent_id, name),
+			FOREIGN KEY (agent_id) REFERENCES agents (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS agent_inventory (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			version INTEGER NOT NULL,
+			os TEXT DEFAULT '',
+			architecture TEXT DEFAULT '',
+			kernel TEXT DEFAULT '',
+			cpu_model TEXT DEFAULT '',
+			cpu_cores INTEGER DEFAULT 0,
+			cpu_threads INTEGER DEFAULT 0,
+			memory_bytes INTEGER DEFAULT 0,
+			huge_pages_enabled BOOLEAN DEFAULT 0,
+			huge_pages_total INTEGER DEFAULT 0,
+			cpu_features TEXT DEFAULT '',
+			miner_version TEXT DEFAULT '',
+			agent_version TEXT DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			UNIQUE (agent_id, version),
+			FOREIGN KEY (agent_id) REFERENCES agents (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS agent_status_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			from_status TEXT NOT NULL,
+			to_status TEXT NOT NULL,
+			changed_at TIMESTAMP NOT NULL,
+			FOREIGN KEY (agent_id) REFERENCES agents (id) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS users (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			username TEXT NOT NULL UNIQUE,
+			password_hash TEXT NOT NULL,
+			role TEXT NOT NULL DEFAULT 'admin',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS enrollment_tokens (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			token_hash TEXT NOT NULL UNIQUE,
+			description TEXT DEFAULT '',
+			max_uses INTEGER DEFAULT 0,
+			uses INTEGER DEFAULT 0,
+			expires_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS agent_certificates (
+			serial TEXT PRIMARY KEY,
+			agent_id TEXT NOT NULL,
+			not_before TIMESTAMP NOT NULL,
+			not_after TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS audit_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			time TIMESTAMP NOT NULL,
+			actor TEXT NOT NULL,
+			source_ip TEXT NOT NULL DEFAULT '',
+			action TEXT NOT NULL,
+			target_type TEXT NOT NULL DEFAULT '',
+			target_id TEXT NOT NULL DEFAULT '',
+			outcome TEXT NOT NULL,
+			before TEXT,
+			after TEXT,
+			prev_hash TEXT NOT NULL UNIQUE,
+			hash TEXT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS sessions (
+			id TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			source_ip TEXT NOT NULL DEFAULT '',
+			user_agent TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP,
+			revoked_reason TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE TABLE IF NOT EXISTS refresh_tokens (
+			token_hash TEXT PRIMARY KEY,
+			session_id TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS revoked_tokens (
+			jti TEXT PRIMARY KEY,
+			expires_at TIMESTAMP NOT NULL,
+			revoked_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS signing_keys (
+			id TEXT PRIMARY KEY,
+			algorithm TEXT NOT NULL,
+			private_key TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			retired_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS api_keys (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT NOT NULL,
+			prefix TEXT NOT NULL,
+			key_hash TEXT NOT NULL UNIQUE,
+			username TEXT NOT NULL,
+			scopes TEXT NOT NULL,
+			allowed_ips TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMP,
+			created_by TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			last_used_at TIMESTAMP,
+			last_used_ip TEXT NOT NULL DEFAULT '',
+			revoked_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS oidc_logins (
+			state TEXT PRIMARY KEY,
+			nonce TEXT NOT NULL,
+			code_verifier TEXT NOT NULL,
+			redirect TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS totp_credentials (
+			username TEXT PRIMARY KEY,
+			secret TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			enabled_at TIMESTAMP,
+			last_step INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS recovery_codes (
+			code_hash TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS mfa_challenges (
+			token_hash TEXT PRIMARY KEY,
+			username TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			attempts INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE IF NOT EXISTS organizations (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			created_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS agent_conflicts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			agent_id TEXT NOT NULL,
+			org_id TEXT NOT NULL,
+			kind TEXT NOT NULL,
+			machine_id TEXT NOT NULL DEFAULT '',
+			token_hash TEXT NOT NULL DEFAULT '',
+			source_ip TEXT NOT NULL DEFAULT '',
+			other_ip TEXT NOT NULL DEFAULT '',
+			count INTEGER NOT NULL DEFAULT 1,
+			detected_at TIMESTAMP NOT NULL,
+			last_seen_at TIMESTAMP NOT NULL,
+			resolved_at TIMESTAMP,
+			resolved_by TEXT NOT NULL DEFAULT '',
+			resolution TEXT NOT NULL DEFAULT ''
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_conflicts_agent ON agent_conflicts (agent_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_conflicts_org ON agent_conflicts (org_id, resolved_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_recovery_codes_username ON recovery_codes (username)`,
+		`CREATE INDEX IF NOT EXISTS idx_api_keys_username ON api_keys (username)`,
+		`CREATE INDEX IF NOT EXISTS idx_sessions_username ON sessions (username)`,
+		`CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session ON refresh_tokens (session_id)`,
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END`,
+		`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+		BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_time ON audit_events (time)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_target ON audit_events (target_type, target_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_certificates_agent ON agent_certificates (agent_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_status_events_agent ON agent_status_events (agent_id, changed_at)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_labels_key_value ON agent_labels (key, value)`,
+		`CREATE INDEX IF NOT EXISTS idx_agent_groups_name ON agent_groups (name)`,
+		`CREATE INDEX IF NOT EXISTS idx_agents_status ON agents (status)`,
+		`CREATE INDEX IF NOT EXISTS idx_agents_last_seen ON agents (last_seen)`,
+		`CREATE INDEX IF NOT EXISTS idx_metrics_agent_created ON metrics (agent_id, created_at)`,
 	}
 
 	for _, query := range queries {
@@ -116,45 +391,128 @@ func (d *Database) migrate() error {
 		}
 	}
 
-	return nil
+	// Columns added after the initial schema. The upgrade query runs once,
+	// when the column is added to an existing table.
+	columns := []struct {
+		table, column, definition string
+		upgrade                   string
+	}{
+		{"agents", "status_changed_at", "TIMESTAMP", ""},
+		{"agents", "heartbeat_interval", "INTEGER DEFAULT 0", ""},
+		{"users", "service", "INTEGER NOT NULL DEFAULT 0", ""},
+		{"users", "oidc_subject", "TEXT NOT NULL DEFAULT ''", ""},
+		{"agents", "org_id", "TEXT NOT NULL DEFAULT '" + DefaultOrg + "'", ""},
+		{"enrollment_tokens", "org_id", "TEXT NOT NULL DEFAULT '" + DefaultOrg + "'", ""},
+		{"commands", "org_id", "TEXT NOT NULL DEFAULT '" + DefaultOrg + "'", ""},
+		// Administrators of a single-tenant server keep access to
+		// everything
+		{"users", "org_id", "TEXT NOT NULL DEFAULT '" + DefaultOrg + "'", `UPDATE users SET role = 'superadmin' WHERE role = 'admin'`},
+		// Events from before organizations are visible to super admins only
+		{"audit_events", "org_id", "TEXT NOT NULL DEFAULT ''", ""},
+		{"agents", "token_hash", "TEXT NOT NULL DEFAULT ''", ""},
+		{"agents", "previous_token_hash", "TEXT NOT NULL DEFAULT ''", ""},
+		{"agents", "previous_token_expires_at", "TIMESTAMP", ""},
+		{"agents", "revoked_at", "TIMESTAMP", ""},
+		{"agents", "decommissioned_at", "TIMESTAMP", ""},
+	}
+	for _, col := range columns {
+		added, err := d.addColumnIfMissing(col.table, col.column, col.definition)
+		if err != nil {
+			return err
+		}
+		if added && col.upgrade != "" {
+			if _, err := d.db.Exec(col.upgrade); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Data and indexes that depend on the added columns
+	backfills := []string{
+		`UPDATE agents SET status_changed_at = updated_at WHERE status_changed_at IS NULL`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS idx_users_oidc_subject ON users (oidc_subject) WHERE oidc_subject != ''`,
+		`INSERT OR IGNORE INTO organizations (id, name, created_at) VALUES ('` + DefaultOrg + `', 'Default', CURRENT_TIMESTAMP)`,
+		`CREATE INDEX IF NOT EXISTS idx_agents_org ON agents (org_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_users_org ON users (org_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_audit_events_org ON audit_events (org_id)`,
+		`CREATE INDEX IF NOT EXISTS idx_agents_token_hash ON agents (token_hash)`,
+		`CREATE INDEX IF NOT EXISTS idx_agents_previous_token_hash ON agents (previous_token_hash)`,
+	}
+	for _, query := range backfills {
+		if _, err := d.db.Exec(query); err != nil {
+			return err
+		}
+	}
+
+	return d.hashLegacyAgentTokens()
 }
 
-// Agent operations
-func (d *Database) CreateAgent(id, machineID, token, name string) error {
-	query := `INSERT OR REPLACE INTO agents (id, machine_id, token, name, last_seen, updated_at) VALUES (?, ?, ?, ?, ?, ?)`
-	_, err := d.db.Exec(query, id, machineID, token, name, time.Now(), time.Now())
-	return err
+// addColumnIfMissing adds a column to an existing table unless a previous
+// migration already did. It reports whether the column was added.
+func (d *Database) addColumnIfMissing(table, column, definition string) (bool, error) {
+	rows, err := d.db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return false, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+
+	if _, err := d.db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + definition); err != nil {
+		return false, err
+	}
+	d.logger.Info("Added database column", "table", table, "column", column)
+	return true, nil
 }
 
-func (d *Database) GetAgent(id string) (*Agent, error) {
-	query := `SELECT id, machine_id, token, name, status, last_seen, created_at, updated_at FROM agents WHERE id = ?`
-	agent := &Agent{}
-	err := d.db.QueryRow(query, id).Scan(
-		&agent.ID, &agent.MachineID, &agent.Token, &agent.Name,
-		&agent.Status, &agent.LastSeen, &agent.CreatedAt, &agent.UpdatedAt,
-	)
+// Agent operations
+
+// CreateAgent adds an agent authenticating with the token of the given
+// hash. It returns ErrAgentExists when the machine already has an agent,
+// which is never replaced.
+func (d *Database) CreateAgent(id, machineID, tokenHash, name, orgID string) error {
+	now := time.Now()
+	query := `INSERT OR IGNORE INTO agents (id, machine_id, token_hash, name, org_id, last_seen, updated_at, status_changed_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := d.db.Exec(query, id, machineID, tokenHash, name, orgID, now, now, now)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return agent, nil
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrAgentExists
+	}
+	return nil
 }
 
-func (d *Database) GetAgentByToken(token string) (*Agent, error) {
-	query := `SELECT id, machine_id, token, name, status, last_seen, created_at, updated_at FROM agents WHERE token = ?`
-	agent := &Agent{}
-	err := d.db.QueryRow(query, token).Scan(
-		&agent.ID, &agent.MachineID, &agent.Token, &agent.Name,
-		&agent.Status, &agent.LastSeen, &agent.CreatedAt, &agent.UpdatedAt,
-	)
+func (d *Database) GetAgent(id string) (*Agent, error) {
+	query := `SELECT ` + agentColumns + ` FROM agents WHERE id = ?`
+	agent, err := scanAgent(d.db.QueryRow(query, id))
 	if err != nil {
 		return nil, err
 	}
+	if err := d.loadAgentTags(agent); err != nil {
+		return nil, err
+	}
 	return agent, nil
 }
 
-func (d *Database) ListAgents() ([]*Agent, error) {
-	query := `SELECT id, machine_id, token, name, status, last_seen, created_at, updated_at FROM agents ORDER BY created_at DESC`
-	rows, err := d.db.Query(query)
+func (d *Database) ListAgents(filter *AgentFilter) ([]*Agent, error) {
+	where, args := filter.whereClause()
+	query := `SELECT ` + agentColumns + ` FROM agents` + where + ` ORDER BY created_at DESC`
+	rows, err := d.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -162,29 +520,224 @@ func (d *Database) ListAgents() ([]*Agent, error) {
 
 	var agents []*Agent
 	for rows.Next() {
-		agent := &Agent{}
-		err := rows.Scan(
-			&agent.ID, &agent.MachineID, &agent.Token, &agent.Name,
-			&agent.Status, &agent.LastSeen, &agent.CreatedAt, &agent.UpdatedAt,
-		)
+		agent, err := scanAgent(rows)
 		if err != nil {
 			return nil, err
 		}
 		agents = append(agents, agent)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := d.loadTagsForAgents(agents); err != nil {
+		return nil, err
+	}
 	return agents, nil
 }
 
-func (d *Database) UpdateAgentStatus(id, status string) error {
-	query := `UPDATE agents SET status = ?, last_seen = ?, updated_at = ? WHERE id = ?`
-	_, err := d.db.Exec(query, status, time.Now(), time.Now(), id)
-	return err
+// whereClause renders the filter as a SQL WHERE clause on the agents table
+func (f *AgentFilter) whereClause() (string, []interface{}) {
+	conditions, args := f.conditions()
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// conditions renders the filter as a list of SQL predicates on the agents
+// table, to be joined with AND. Decommissioned agents are left out unless
+// the filter asks for their status. Times are compared with julianday since
+// they are stored with the UTC offset of the host that wrote them.
+func (f *AgentFilter) conditions() ([]string, []interface{}) {
+	if f == nil {
+		return []string{`status != ?`}, []interface{}{StatusDecommissioned}
+	}
+
+	var conditions []string
+	var args []interface{}
+
+	if f.OrgID != "" {
+		conditions = append(conditions, `agents.org_id = ?`)
+		args = append(args, f.OrgID)
+	}
+
+	keys := make([]string, 0, len(f.Labels))
+	for key := range f.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM agent_labels l WHERE l.agent_id = agents.id AND l.key = ? AND l.value = ?)`)
+		args = append(args, key, f.Labels[key])
+	}
+	for _, group := range f.Groups {
+		conditions = append(conditions, `EXISTS (SELECT 1 FROM agent_groups g WHERE g.agent_id = agents.id AND g.name = ?)`)
+		args = append(args, group)
+	}
+
+	if f.OS != "" {
+		conditions = append(conditions, latestInventoryCondition(`i.os = ?`))
+		args = append(args, f.OS)
+	}
+	if f.Architecture != "" {
+		conditions = append(conditions, latestInventoryCondition(`i.architecture = ?`))
+		args = append(args, f.Architecture)
+	}
+	if f.CPUFeature != "" {
+		conditions = append(conditions, latestInventoryCondition(`i.cpu_features LIKE ?`))
+		args = append(args, "%,"+strings.ToLower(f.CPUFeature)+",%")
+	}
+	if f.AgentVersion != "" {
+		conditions = append(conditions, latestInventoryCondition(`i.agent_version = ?`))
+		args = append(args, f.AgentVersion)
+	}
+	if f.MinerVersion != "" {
+		conditions = append(conditions, latestInventoryCondition(`i.miner_version = ?`))
+		args = append(args, f.MinerVersion)
+	}
+
+	if len(f.Statuses) > 0 {
+		conditions = append(conditions, `status IN (`+placeholders(len(f.Statuses))+`)`)
+		for _, status := range f.Statuses {
+			args = append(args, status)
+		}
+	} else {
+		conditions = append(conditions, `status != ?`)
+		args = append(args, StatusDecommissioned)
+	}
+	if f.Search != "" {
+		pattern := "%" + escapeLike(f.Search) + "%"
+		conditions = append(conditions, `(name LIKE ? ESCAPE '\' OR machine_id LIKE ? ESCAPE '\' OR id LIKE ? ESCAPE '\')`)
+		args = append(args, pattern, pattern, pattern)
+	}
+	if f.LastSeenAfter != nil {
+		conditions = append(conditions, `julianday(last_seen) >= julianday(?)`)
+		args = append(args, *f.LastSeenAfter)
+	}
+	if f.LastSeenBefore != nil {
+		conditions = append(conditions, `julianday(last_seen) < julianday(?)`)
+		args = append(args, *f.LastSeenBefore)
+	}
+
+	return conditions, args
+}
+
+// loadAgentTags populates the labels and groups of an agent
+func (d *Database) loadAgentTags(agent *Agent) error {
+	agent.Labels = make(map[string]string)
+	agent.Groups = []string{}
+
+	rows, err := d.db.Query(`SELECT key, value FROM agent_labels WHERE agent_id = ?`, agent.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return err
+		}
+		agent.Labels[key] = value
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	groupRows, err := d.db.Query(`SELECT name FROM agent_groups WHERE agent_id = ? ORDER BY name`, agent.ID)
+	if err != nil {
+		return err
+	}
+	defer groupRows.Close()
+	for groupRows.Next() {
+		var name string
+		if err := groupRows.Scan(&name); err != nil {
+			return err
+		}
+		agent.Groups = append(agent.Groups, name)
+	}
+	return groupRows.Err()
 }
 
+// UpdateAgentTags replaces the name, labels and groups of an agent. Nil
+// arguments leave the corresponding attribute untouched.
+func (d *Database) UpdateAgentTags(id string, name *string, labels map[string]string, groups []string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE agents SET updated_at = ? WHERE id = ?`, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	if name != nil {
+		if _, err := tx.Exec(`UPDATE agents SET name = ? WHERE id = ?`, *name, id); err != nil {
+			return err
+		}
+	}
+
+	if labels != nil {
+		if _, err := tx.Exec(`DELETE FROM agent_labels WHERE agent_id = ?`, id); err != nil {
+			return err
+		}
+		for key, value := range labels {
+			if _, err := tx.Exec(`INSERT INTO agent_labels (agent_id, key, value) VALUES (?, ?, ?)`, id, key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	if groups != nil {
+		if _, err := tx.Exec(`DELETE FROM agent_groups WHERE agent_id = ?`, id); err != nil {
+			return err
+		}
+		for _, group := range groups {
+			if _, err := tx.Exec(`INSERT OR IGNORE INTO agent_groups (agent_id, name) VALUES (?, ?)`, id, group); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// DeleteAgent purges an agent together with its metrics, commands and other
+// history
 func (d *Database) DeleteAgent(id string) error {
-	query := `DELETE FROM agents WHERE id = ?`
-	_, err := d.db.Exec(query, id)
-	return err
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Certificates stay on record, revoked, so a deleted agent cannot connect
+	if _, err := tx.Exec(`UPDATE agent_certificates SET revoked_at = ? WHERE agent_id = ? AND revoked_at IS NULL`, time.Now(), id); err != nil {
+		return err
+	}
+
+	for _, query := range []string{
+		`DELETE FROM agent_labels WHERE agent_id = ?`,
+		`DELETE FROM agent_groups WHERE agent_id = ?`,
+		`DELETE FROM agent_inventory WHERE agent_id = ?`,
+		`DELETE FROM agent_status_events WHERE agent_id = ?`,
+		`DELETE FROM agent_conflicts WHERE agent_id = ?`,
+		`DELETE FROM metrics WHERE agent_id = ?`,
+		`DELETE FROM commands WHERE agent_id = ?`,
+		`DELETE FROM agents WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 // Metrics operations
@@ -215,17 +768,25 @@ func (d *Database) GetMetrics(agentID string, limit int) ([]*Metrics, error) {
 }
 
 // Command operations
+
+// CreateCommand queues a command for an agent in the agent's organization.
+// It returns sql.ErrNoRows if the agent does not exist.
 func (d *Database) CreateCommand(agentID, command, parameters string) (int64, error) {
-	query := `INSERT INTO commands (agent_id, command, parameters) VALUES (?, ?, ?)`
-	result, err := d.db.Exec(query, agentID, command, parameters)
+	query := `INSERT INTO commands (agent_id, org_id, command, parameters) SELECT id, org_id, ?, ? FROM agents WHERE id = ?`
+	result, err := d.db.Exec(query, command, parameters, agentID)
 	if err != nil {
 		return 0, err
 	}
+	if n, err := result.RowsAffected(); err != nil {
+		return 0, err
+	} else if n == 0 {
+		return 0, sql.ErrNoRows
+	}
 	return result.LastInsertId()
 }
 
 func (d *Database) GetPendingCommands(agentID string) ([]*Command, error) {
-	query := `SELECT id, agent_id, command, parameters, status, created_at, updated_at FROM commands WHERE agent_id = ? AND status = 'pending' ORDER BY created_at ASC`
+	query := `SELECT ` + commandColumns + ` FROM commands WHERE agent_id = ? AND status = 'pending' ORDER BY created_at ASC`
 	rows, err := d.db.Query(query, agentID)
 	if err != nil {
 		return nil, err
@@ -235,7 +796,7 @@ func (d *Database) GetPendingCommands(agentID string) ([]*Command, error) {
 	var commands []*Command
 	for rows.Next() {
 		cmd := &Command{}
-		err := rows.Scan(&cmd.ID, &cmd.AgentID, &cmd.Command, &cmd.Parameters, &cmd.Status, &cmd.CreatedAt, &cmd.UpdatedAt)
+		err := rows.Scan(&cmd.ID, &cmd.AgentID, &cmd.OrgID, &cmd.Command, &cmd.Parameters, &cmd.Status, &cmd.CreatedAt, &cmd.UpdatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -244,8 +805,10 @@ func (d *Database) GetPendingCommands(agentID string) ([]*Command, error) {
 	return commands, nil
 }
 
-func (d *Database) UpdateCommandStatus(id int64, status string) error {
-	query := `UPDATE commands SET status = ?, updated_at = ? WHERE id = ?`
-	_, err := d.db.Exec(query, status, time.Now(), id)
+// UpdateCommandStatus records the status an agent reported for one of its
+// commands. Commands of other agents are left alone.
+func (d *Database) UpdateCommandStatus(agentID string, id int64, status string) error {
+	query := `UPDATE commands SET status = ?, updated_at = ? WHERE id = ? AND agent_id = ?`
+	_, err := d.db.Exec(query, status, time.Now(), id, agentID)
 	return err
 } 
\ No newline at end of file
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListAgentsLastSeenAcrossTimeZones(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.CreateAgent("agent-1", "machine-1", "hash", "rig", DefaultOrg); err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+
+	// Written by a host five hours ahead of UTC: 12:00+05:00 is 07:00Z
+	seen := time.Date(2026, 3, 1, 12, 0, 0, 0, time.FixedZone("", 5*60*60))
+	if _, err := db.RecordHeartbeat("agent-1", seen, 30); err != nil {
+		t.Fatalf("record heartbeat: %v", err)
+	}
+
+	at := func(hour int) *time.Time {
+		t := time.Date(2026, 3, 1, hour, 0, 0, 0, time.UTC)
+		return &t
+	}
+	tests := []struct {
+		name   string
+		filter AgentFilter
+		want   bool
+	}{
+		{"after a bound before it", AgentFilter{LastSeenAfter: at(6)}, true},
+		{"after a bound past it", AgentFilter{LastSeenAfter: at(8)}, false},
+		{"before a bound past it", AgentFilter{LastSeenBefore: at(8)}, true},
+		{"before a bound before it", AgentFilter{LastSeenBefore: at(6)}, false},
+		{"within bounds", AgentFilter{LastSeenAfter: at(7), LastSeenBefore: at(9)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agents, err := db.ListAgents(&tt.filter)
+			if err != nil {
+				t.Fatalf("list agents: %v", err)
+			}
+			if got := len(agents) == 1; got != tt.want {
+				t.Errorf("agent selected = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
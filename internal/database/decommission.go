@@ -0,0 +1,137 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// DecommissionAgent retires an agent without deleting it: its tokens and
+// client certificates are revoked, its pending commands cancelled and it
+// moves to the decommissioned status, which hides it from listings. Its
+// history is kept until it is purged. It returns the number of cancelled
+// commands, and sql.ErrNoRows for unknown or already decommissioned agents.
+func (d *Database) DecommissionAgent(id string, at time.Time) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var status string
+	var decommissionedAt sql.NullTime
+	if err := tx.QueryRow(`SELECT status, decommissioned_at FROM agents WHERE id = ?`, id).Scan(&status, &decommissionedAt); err != nil {
+		return 0, err
+	}
+	if decommissionedAt.Valid {
+		return 0, sql.ErrNoRows
+	}
+
+	if _, err := tx.Exec(`UPDATE agents SET token_hash = '', previous_token_hash = '', previous_token_expires_at = NULL,
+		revoked_at = COALESCE(revoked_at, ?), decommissioned_at = ? WHERE id = ?`, at, at, id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE agent_certificates SET revoked_at = ? WHERE agent_id = ? AND revoked_at IS NULL`, at, id); err != nil {
+		return 0, err
+	}
+	if err := transitionStatus(tx, id, status, StatusDecommissioned, at); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`UPDATE commands SET status = 'cancelled', updated_at = ? WHERE agent_id = ? AND status = 'pending'`, at, id)
+	if err != nil {
+		return 0, err
+	}
+	cancelled, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return cancelled, tx.Commit()
+}
+
+// RestoreAgent brings a decommissioned agent back. It stays revoked until it
+// enrolls again. It returns sql.ErrNoRows unless the agent is decommissioned.
+func (d *Database) RestoreAgent(id string, at time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE agents SET decommissioned_at = NULL, updated_at = ? WHERE id = ? AND decommissioned_at IS NOT NULL`, at, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	if err := transitionStatus(tx, id, StatusDecommissioned, StatusRevoked, at); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListDecommissionedAgents returns the agents decommissioned before the
+// given time, oldest first
+func (d *Database) ListDecommissionedAgents(before time.Time) ([]*Agent, error) {
+	rows, err := d.db.Query(`SELECT `+agentColumns+` FROM agents WHERE decommissioned_at IS NOT NULL AND julianday(decommissioned_at) < julianday(?) ORDER BY julianday(decommissioned_at) ASC`, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var agents []*Agent
+	for rows.Next() {
+		agent, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, agent)
+	}
+	return agents, rows.Err()
+}
+
+// EachMetric calls fn for every metrics report of an agent, oldest first,
+// without loading them all into memory
+func (d *Database) EachMetric(agentID string, fn func(*Metrics) error) error {
+	rows, err := d.db.Query(`SELECT id, agent_id, hashrate, accepted_shares, rejected_shares, temperature, power_consumption, pool_url, algorithm, cpu_usage, memory_usage, uptime, created_at FROM metrics WHERE agent_id = ? ORDER BY id ASC`, agentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		m := &Metrics{}
+		var poolURL, algorithm sql.NullString
+		if err := rows.Scan(&m.ID, &m.AgentID, &m.Hashrate, &m.AcceptedShares, &m.RejectedShares, &m.Temperature, &m.PowerConsumption, &poolURL, &algorithm, &m.CPUUsage, &m.MemoryUsage, &m.Uptime, &m.CreatedAt); err != nil {
+			return err
+		}
+		m.PoolURL, m.Algorithm = poolURL.String, algorithm.String
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EachCommand calls fn for every command of an agent, oldest first
+func (d *Database) EachCommand(agentID string, fn func(*Command) error) error {
+	rows, err := d.db.Query(`SELECT `+commandColumns+` FROM commands WHERE agent_id = ? ORDER BY id ASC`, agentID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		cmd := &Command{}
+		var parameters sql.NullString
+		if err := rows.Scan(&cmd.ID, &cmd.AgentID, &cmd.OrgID, &cmd.Command, &parameters, &cmd.Status, &cmd.CreatedAt, &cmd.UpdatedAt); err != nil {
+			return err
+		}
+		cmd.Parameters = parameters.String
+		if err := fn(cmd); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -0,0 +1,75 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrEnrollmentTokenInvalid is returned when an enrollment token is unknown,
+// expired or used up
+var ErrEnrollmentTokenInvalid = errors.New("invalid enrollment token")
+
+// EnrollmentToken allows new agents to register in its organization. Only
+// a hash of the token is stored; the token itself is shown once when it is
+// created.
+type EnrollmentToken struct {
+	ID          int64      `json:"id"`
+	OrgID       string     `json:"org_id"`
+	Description string     `json:"description"`
+	MaxUses     int        `json:"max_uses"`
+	Uses        int        `json:"uses"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// CreateEnrollmentToken stores a new enrollment token. A zero maxUses allows
+// unlimited registrations and a nil expiresAt never expires.
+func (d *Database) CreateEnrollmentToken(tokenHash, orgID, description string, maxUses int, expiresAt *time.Time) (*EnrollmentToken, error) {
+	now := time.Now()
+	result, err := d.db.Exec(`INSERT INTO enrollment_tokens (token_hash, org_id, description, max_uses, uses, expires_at, created_at) VALUES (?, ?, ?, ?, 0, ?, ?)`, tokenHash, orgID, description, maxUses, expiresAt, now)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	return &EnrollmentToken{ID: id, OrgID: orgID, Description: description, MaxUses: maxUses, ExpiresAt: expiresAt, CreatedAt: now}, nil
+}
+
+// ConsumeEnrollmentToken records one use of the token with the given hash
+// and returns the organization the enrolling agent joins. It returns
+// ErrEnrollmentTokenInvalid if the token cannot be used at the given time.
+func (d *Database) ConsumeEnrollmentToken(tokenHash string, at time.Time) (string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var (
+		id            int64
+		orgID         string
+		maxUses, uses int
+		expiresAt     sql.NullTime
+	)
+	err = tx.QueryRow(`SELECT id, org_id, max_uses, uses, expires_at FROM enrollment_tokens WHERE token_hash = ?`, tokenHash).Scan(&id, &orgID, &maxUses, &uses, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrEnrollmentTokenInvalid
+	}
+	if err != nil {
+		return "", err
+	}
+	if expiresAt.Valid && !at.Before(expiresAt.Time) {
+		return "", ErrEnrollmentTokenInvalid
+	}
+	if maxUses > 0 && uses >= maxUses {
+		return "", ErrEnrollmentTokenInvalid
+	}
+
+	if _, err := tx.Exec(`UPDATE enrollment_tokens SET uses = uses + 1 WHERE id = ?`, id); err != nil {
+		return "", err
+	}
+	return orgID, tx.Commit()
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Inventory is a versioned snapshot of the hardware and software facts an
+// agent reports about the rig it runs on
+type Inventory struct {
+	ID               int64     `json:"id"`
+	AgentID          string    `json:"agent_id"`
+	Version          int       `json:"version"`
+	OS               string    `json:"os"`
+	Architecture     string    `json:"architecture"`
+	Kernel           string    `json:"kernel"`
+	CPUModel         string    `json:"cpu_model"`
+	CPUCores         int       `json:"cpu_cores"`
+	CPUThreads       int       `json:"cpu_threads"`
+	MemoryBytes      int64     `json:"memory_bytes"`
+	HugePagesEnabled bool      `json:"huge_pages_enabled"`
+	HugePagesTotal   int64     `json:"huge_pages_total"`
+	CPUFeatures      []string  `json:"cpu_features"`
+	MinerVersion     string    `json:"miner_version"`
+	AgentVersion     string    `json:"agent_version"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// SameFacts reports whether two inventories describe the same rig state,
+// ignoring identifiers, version numbers and timestamps
+func (i *Inventory) SameFacts(other *Inventory) bool {
+	if i == nil || other == nil {
+		return i == other
+	}
+	return i.OS == other.OS &&
+		i.Architecture == other.Architecture &&
+		i.Kernel == other.Kernel &&
+		i.CPUModel == other.CPUModel &&
+		i.CPUCores == other.CPUCores &&
+		i.CPUThreads == other.CPUThreads &&
+		i.MemoryBytes == other.MemoryBytes &&
+		i.HugePagesEnabled == other.HugePagesEnabled &&
+		i.HugePagesTotal == other.HugePagesTotal &&
+		encodeFeatures(i.CPUFeatures) == encodeFeatures(other.CPUFeatures) &&
+		i.MinerVersion == other.MinerVersion &&
+		i.AgentVersion == other.AgentVersion
+}
+
+const inventoryColumns = `id, agent_id, version, os, architecture, kernel, cpu_model, cpu_cores, cpu_threads, memory_bytes, huge_pages_enabled, huge_pages_total, cpu_features, miner_version, agent_version, created_at`
+
+// StoreInventory appends a new inventory version for an agent and returns it
+func (d *Database) StoreInventory(agentID string, inv *Inventory) (*Inventory, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(version), 0) + 1 FROM agent_inventory WHERE agent_id = ?`, agentID).Scan(&version); err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO agent_inventory (agent_id, version, os, architecture, kernel, cpu_model, cpu_cores, cpu_threads, memory_bytes, huge_pages_enabled, huge_pages_total, cpu_features, miner_version, agent_version, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, agentID, version, inv.OS, inv.Architecture, inv.Kernel, inv.CPUModel, inv.CPUCores, inv.CPUThreads, inv.MemoryBytes, inv.HugePagesEnabled, inv.HugePagesTotal, encodeFeatures(inv.CPUFeatures), inv.MinerVersion, inv.AgentVersion, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return d.getInventory(`SELECT `+inventoryColumns+` FROM agent_inventory WHERE id = ?`, id)
+}
+
+// GetLatestInventory returns the most recent inventory version of an agent
+func (d *Database) GetLatestInventory(agentID string) (*Inventory, error) {
+	return d.getInventory(`SELECT `+inventoryColumns+` FROM agent_inventory WHERE agent_id = ? ORDER BY version DESC LIMIT 1`, agentID)
+}
+
+// GetInventoryHistory returns every inventory version of an agent, newest first
+func (d *Database) GetInventoryHistory(agentID string) ([]*Inventory, error) {
+	rows, err := d.db.Query(`SELECT `+inventoryColumns+` FROM agent_inventory WHERE agent_id = ? ORDER BY version DESC`, agentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []*Inventory
+	for rows.Next() {
+		inv, err := scanInventory(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, inv)
+	}
+	return history, rows.Err()
+}
+
+func (d *Database) getInventory(query string, args ...interface{}) (*Inventory, error) {
+	return scanInventory(d.db.QueryRow(query, args...))
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanInventory(row rowScanner) (*Inventory, error) {
+	inv := &Inventory{}
+	var features string
+	err := row.Scan(
+		&inv.ID, &inv.AgentID, &inv.Version, &inv.OS, &inv.Architecture, &inv.Kernel,
+		&inv.CPUModel, &inv.CPUCores, &inv.CPUThreads, &inv.MemoryBytes,
+		&inv.HugePagesEnabled, &inv.HugePagesTotal, &features,
+		&inv.MinerVersion, &inv.AgentVersion, &inv.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	inv.CPUFeatures = decodeFeatures(features)
+	return inv, nil
+}
+
+// encodeFeatures stores CPU features as a lower-cased, comma-delimited list
+// with leading and trailing commas so single features can be matched with
+// LIKE '%,aes,%'
+func encodeFeatures(features []string) string {
+	if len(features) == 0 {
+		return ""
+	}
+	normalized := make([]string, 0, len(features))
+	seen := make(map[string]bool, len(features))
+	for _, feature := range features {
+		feature = strings.ToLower(strings.TrimSpace(feature))
+		if feature == "" || seen[feature] {
+			continue
+		}
+		seen[feature] = true
+		normalized = append(normalized, feature)
+	}
+	sort.Strings(normalized)
+	if len(normalized) == 0 {
+		return ""
+	}
+	return "," + strings.Join(normalized, ",") + ","
+}
+
+func decodeFeatures(encoded string) []string {
+	features := []string{}
+	for _, feature := range strings.Split(strings.Trim(encoded, ","), ",") {
+		if feature != "" {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// latestInventoryCondition matches agents whose most recent inventory
+// satisfies the given predicate on the alias i
+func latestInventoryCondition(predicate string) string {
+	return `EXISTS (SELECT 1 FROM agent_inventory i WHERE i.agent_id = agents.id AND i.version = (SELECT MAX(version) FROM agent_inventory WHERE agent_id = agents.id) AND ` + predicate + `)`
+}
@@ -0,0 +1,61 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrOIDCLoginInvalid is returned for OIDC logins that are unknown, already
+// completed or expired
+var ErrOIDCLoginInvalid = errors.New("invalid OIDC login state")
+
+// OIDCLogin is a login waiting for the OIDC provider to redirect back. It
+// is found by its state and holds the secrets to complete the login.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	// Redirect is the local path the user returns to
+	Redirect  string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// CreateOIDCLogin stores a login in progress
+func (d *Database) CreateOIDCLogin(l *OIDCLogin) error {
+	_, err := d.db.Exec(`INSERT INTO oidc_logins (state, nonce, code_verifier, redirect, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		l.State, l.Nonce, l.CodeVerifier, l.Redirect, l.CreatedAt, l.ExpiresAt)
+	return err
+}
+
+// TakeOIDCLogin removes and returns the login with the given state, so each
+// can be completed once. It returns ErrOIDCLoginInvalid if there is none or
+// it has expired at the given time.
+func (d *Database) TakeOIDCLogin(state string, at time.Time) (*OIDCLogin, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	l := &OIDCLogin{}
+	err = tx.QueryRow(`SELECT state, nonce, code_verifier, redirect, created_at, expires_at FROM oidc_logins WHERE state = ?`, state).
+		Scan(&l.State, &l.Nonce, &l.CodeVerifier, &l.Redirect, &l.CreatedAt, &l.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOIDCLoginInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM oidc_logins WHERE state = ?`, state); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	if !at.Before(l.ExpiresAt) {
+		return nil, ErrOIDCLoginInvalid
+	}
+	return l, nil
+}
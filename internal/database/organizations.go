@@ -0,0 +1,103 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// DefaultOrg owns the agents, users and tokens that existed before
+// organizations were introduced, and agents registering without an
+// enrollment token
+const DefaultOrg = "default"
+
+// ErrOrganizationExists is returned when creating an organization whose ID
+// is taken
+var ErrOrganizationExists = errors.New("organization already exists")
+
+// ErrOrganizationNotEmpty is returned when deleting an organization that
+// still owns agents, users or enrollment tokens
+var ErrOrganizationNotEmpty = errors.New("organization still owns agents, users or enrollment tokens")
+
+// Organization is a tenant owning agents, users, enrollment tokens and
+// commands. Its members only see what it owns.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CreateOrganization adds an organization
+func (d *Database) CreateOrganization(id, name string) (*Organization, error) {
+	now := time.Now()
+	result, err := d.db.Exec(`INSERT OR IGNORE INTO organizations (id, name, created_at) VALUES (?, ?, ?)`, id, name, now)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, ErrOrganizationExists
+	}
+	return &Organization{ID: id, Name: name, CreatedAt: now}, nil
+}
+
+// GetOrganization returns the organization with the given ID
+func (d *Database) GetOrganization(id string) (*Organization, error) {
+	o := &Organization{}
+	err := d.db.QueryRow(`SELECT id, name, created_at FROM organizations WHERE id = ?`, id).Scan(&o.ID, &o.Name, &o.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// ListOrganizations returns every organization ordered by ID
+func (d *Database) ListOrganizations() ([]*Organization, error) {
+	rows, err := d.db.Query(`SELECT id, name, created_at FROM organizations ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []*Organization
+	for rows.Next() {
+		o := &Organization{}
+		if err := rows.Scan(&o.ID, &o.Name, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, o)
+	}
+	return orgs, rows.Err()
+}
+
+// DeleteOrganization removes an empty organization. It returns
+// sql.ErrNoRows if it does not exist and ErrOrganizationNotEmpty while it
+// owns agents, users or enrollment tokens.
+func (d *Database) DeleteOrganization(id string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owned int
+	err = tx.QueryRow(`SELECT (SELECT COUNT(*) FROM agents WHERE org_id = ?) + (SELECT COUNT(*) FROM users WHERE org_id = ?) + (SELECT COUNT(*) FROM enrollment_tokens WHERE org_id = ?)`, id, id, id).Scan(&owned)
+	if err != nil {
+		return err
+	}
+	if owned > 0 {
+		return ErrOrganizationNotEmpty
+	}
+
+	result, err := tx.Exec(`DELETE FROM organizations WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,230 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrRefreshTokenInvalid is returned when a refresh token is unknown or
+	// its session has ended
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was already
+	// exchanged is presented again. The session is revoked since the token
+	// has probably been stolen.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Session reasons for revocation
+const (
+	RevokedLogout          = "logout"
+	RevokedByAdmin         = "revoked"
+	RevokedPasswordChanged = "password changed"
+	RevokedTokenReuse      = "refresh token reused"
+	RevokedTwoFactorReset  = "two-factor reset"
+)
+
+// Session is a login of an operator. It is extended every time its refresh
+// token is exchanged for a new one.
+type Session struct {
+	ID            string     `json:"id"`
+	Username      string     `json:"username"`
+	SourceIP      string     `json:"source_ip,omitempty"`
+	UserAgent     string     `json:"user_agent,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	LastUsedAt    time.Time  `json:"last_used_at"`
+	ExpiresAt     time.Time  `json:"expires_at"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	RevokedReason string     `json:"revoked_reason,omitempty"`
+}
+
+const sessionColumns = `id, username, source_ip, user_agent, created_at, last_used_at, expires_at, revoked_at, revoked_reason`
+
+func scanSession(row rowScanner) (*Session, error) {
+	s := &Session{}
+	var revokedAt sql.NullTime
+	if err := row.Scan(&s.ID, &s.Username, &s.SourceIP, &s.UserAgent, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &revokedAt, &s.RevokedReason); err != nil {
+		return nil, err
+	}
+	if revokedAt.Valid {
+		s.RevokedAt = &revokedAt.Time
+	}
+	return s, nil
+}
+
+// CreateSession stores a new session together with its first refresh token
+func (d *Database) CreateSession(s *Session, refreshHash string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO sessions (id, username, source_ip, user_agent, created_at, last_used_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.Username, s.SourceIP, s.UserAgent, s.CreatedAt, s.LastUsedAt, s.ExpiresAt); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)`, refreshHash, s.ID, s.CreatedAt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RotateRefreshToken exchanges the refresh token with hash oldHash for
+// newHash and extends its session until expiresAt, but not beyond maxAge
+// after it was created when maxAge is positive. Presenting a token that was
+// already exchanged revokes the session and returns ErrRefreshTokenReused
+// along with it.
+func (d *Database) RotateRefreshToken(oldHash, newHash string, now, expiresAt time.Time, maxAge time.Duration) (*Session, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		sessionID string
+		usedAt    sql.NullTime
+	)
+	err = tx.QueryRow(`SELECT session_id, used_at FROM refresh_tokens WHERE token_hash = ?`, oldHash).Scan(&sessionID, &usedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, sessionID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+
+	if usedAt.Valid {
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at = ?, revoked_reason = ? WHERE id = ?`, now, RevokedTokenReuse, sessionID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		session.RevokedAt, session.RevokedReason = &now, RevokedTokenReuse
+		return session, ErrRefreshTokenReused
+	}
+
+	if end := session.CreatedAt.Add(maxAge); maxAge > 0 && expiresAt.After(end) {
+		expiresAt = end
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at = ? WHERE token_hash = ?`, now, oldHash); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`INSERT INTO refresh_tokens (token_hash, session_id, created_at) VALUES (?, ?, ?)`, newHash, sessionID, now); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`UPDATE sessions SET last_used_at = ?, expires_at = ? WHERE id = ?`, now, expiresAt, sessionID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	session.LastUsedAt, session.ExpiresAt = now, expiresAt
+	return session, nil
+}
+
+// GetSession returns the session with the given ID
+func (d *Database) GetSession(id string) (*Session, error) {
+	return scanSession(d.db.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, id))
+}
+
+// ListSessions returns the sessions of a user that are neither revoked nor
+// expired, most recently used first
+func (d *Database) ListSessions(username string, now time.Time) ([]*Session, error) {
+	rows, err := d.db.Query(`SELECT `+sessionColumns+` FROM sessions WHERE username = ? AND revoked_at IS NULL AND expires_at > ? ORDER BY last_used_at DESC`, username, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession ends a session. It reports whether the session was active.
+func (d *Database) RevokeSession(id, reason string, now time.Time) (bool, error) {
+	result, err := d.db.Exec(`UPDATE sessions SET revoked_at = ?, revoked_reason = ? WHERE id = ? AND revoked_at IS NULL`, now, reason, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// RevokeUserSessions ends every active session of a user and returns how
+// many there were
+func (d *Database) RevokeUserSessions(username, reason string, now time.Time) (int, error) {
+	result, err := d.db.Exec(`UPDATE sessions SET revoked_at = ?, revoked_reason = ? WHERE username = ? AND revoked_at IS NULL AND expires_at > ?`, now, reason, username, now)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
+
+// RevokeToken adds an access token to the revocation list until it expires
+func (d *Database) RevokeToken(jti string, expiresAt, now time.Time) error {
+	_, err := d.db.Exec(`INSERT OR IGNORE INTO revoked_tokens (jti, expires_at, revoked_at) VALUES (?, ?, ?)`, jti, expiresAt, now)
+	return err
+}
+
+// TokenRevoked reports whether an access token may no longer be used, either
+// because it was revoked itself or because its session has ended
+func (d *Database) TokenRevoked(jti, sessionID string, now time.Time) (bool, error) {
+	var revoked bool
+	err := d.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM revoked_tokens WHERE jti = ?)
+		OR NOT EXISTS (SELECT 1 FROM sessions WHERE id = ? AND revoked_at IS NULL AND expires_at > ?)`, jti, sessionID, now).Scan(&revoked)
+	return revoked, err
+}
+
+// PruneSessions deletes expired sessions with their refresh tokens, revoked
+// access tokens that have expired anyway, and abandoned OIDC and two-factor
+// logins. It returns the number of sessions deleted.
+func (d *Database) PruneSessions(now time.Time) (int64, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE session_id IN (SELECT id FROM sessions WHERE expires_at <= ?)`, now); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM revoked_tokens WHERE expires_at <= ?`, now); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM oidc_logins WHERE expires_at <= ?`, now); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`DELETE FROM mfa_challenges WHERE expires_at <= ?`, now); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
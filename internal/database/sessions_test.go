@@ -0,0 +1,110 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func newTestSession(t *testing.T, db *Database, refreshHash string, createdAt time.Time, ttl time.Duration) *Session {
+	t.Helper()
+	s := &Session{ID: "session-1", Username: "admin", CreatedAt: createdAt, LastUsedAt: createdAt, ExpiresAt: createdAt.Add(ttl)}
+	if err := db.CreateSession(s, refreshHash); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	return s
+}
+
+func TestRotateRefreshToken(t *testing.T) {
+	db := newTestDatabase(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTestSession(t, db, "hash-1", start, time.Hour)
+
+	now := start.Add(30 * time.Minute)
+	session, err := db.RotateRefreshToken("hash-1", "hash-2", now, now.Add(time.Hour), 0)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if !session.ExpiresAt.Equal(now.Add(time.Hour)) || !session.LastUsedAt.Equal(now) {
+		t.Errorf("session not extended: %+v", session)
+	}
+
+	// The new token works once, the old one no longer rotates
+	now = now.Add(time.Minute)
+	if _, err := db.RotateRefreshToken("hash-2", "hash-3", now, now.Add(time.Hour), 0); err != nil {
+		t.Fatalf("rotate the new token: %v", err)
+	}
+	if _, err := db.RotateRefreshToken("unknown", "hash-4", now, now.Add(time.Hour), 0); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("unknown token: got %v, want ErrRefreshTokenInvalid", err)
+	}
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	db := newTestDatabase(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTestSession(t, db, "hash-1", start, time.Hour)
+
+	now := start.Add(time.Minute)
+	if _, err := db.RotateRefreshToken("hash-1", "hash-2", now, now.Add(time.Hour), 0); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+
+	// Someone replays the exchanged token
+	session, err := db.RotateRefreshToken("hash-1", "hash-3", now, now.Add(time.Hour), 0)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("reuse: got %v, want ErrRefreshTokenReused", err)
+	}
+	if session == nil || session.RevokedAt == nil || session.RevokedReason != RevokedTokenReuse {
+		t.Errorf("reuse returned %+v, want the revoked session", session)
+	}
+
+	// The whole session ends: the current token and its access tokens too
+	if _, err := db.RotateRefreshToken("hash-2", "hash-4", now, now.Add(time.Hour), 0); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("current token after reuse: got %v, want ErrRefreshTokenInvalid", err)
+	}
+	if revoked, err := db.TokenRevoked("jti", "session-1", now); err != nil || !revoked {
+		t.Errorf("access tokens of the session revoked = %v, %v; want true", revoked, err)
+	}
+	if stored, err := db.GetSession("session-1"); err != nil || stored.RevokedReason != RevokedTokenReuse {
+		t.Errorf("stored session = %+v, %v; want revoked for reuse", stored, err)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	db := newTestDatabase(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTestSession(t, db, "hash-1", start, time.Hour)
+
+	now := start.Add(time.Hour)
+	if _, err := db.RotateRefreshToken("hash-1", "hash-2", now, now.Add(time.Hour), 0); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("token of an expired session: got %v, want ErrRefreshTokenInvalid", err)
+	}
+	if revoked, err := db.TokenRevoked("jti", "session-1", now); err != nil || !revoked {
+		t.Errorf("access tokens of an expired session revoked = %v, %v; want true", revoked, err)
+	}
+	if n, err := db.PruneSessions(now); err != nil || n != 1 {
+		t.Errorf("pruned %d sessions, %v; want 1", n, err)
+	}
+}
+
+func TestRefreshTokenMaxAge(t *testing.T) {
+	db := newTestDatabase(t)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	newTestSession(t, db, "hash-1", start, time.Hour)
+	const maxAge = 90 * time.Minute
+
+	// Refreshed in time, but the session cannot outlive maxAge
+	now := start.Add(50 * time.Minute)
+	session, err := db.RotateRefreshToken("hash-1", "hash-2", now, now.Add(time.Hour), maxAge)
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if want := start.Add(maxAge); !session.ExpiresAt.Equal(want) {
+		t.Errorf("expires at %s, want %s", session.ExpiresAt, want)
+	}
+
+	now = start.Add(maxAge)
+	if _, err := db.RotateRefreshToken("hash-2", "hash-3", now, now.Add(time.Hour), maxAge); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("refresh past the maximum age: got %v, want ErrRefreshTokenInvalid", err)
+	}
+}
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SigningKey is a private key used to sign access tokens. Retired keys no
+// longer sign but still verify tokens until their grace period ends.
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	// PrivateKey is the PEM encoded PKCS #8 key
+	PrivateKey string
+	CreatedAt  time.Time
+	RetiredAt  *time.Time
+}
+
+// CreateSigningKey stores a new signing key
+func (d *Database) CreateSigningKey(key *SigningKey) error {
+	_, err := d.db.Exec(`INSERT INTO signing_keys (id, algorithm, private_key, created_at, retired_at) VALUES (?, ?, ?, ?, ?)`,
+		key.ID, key.Algorithm, key.PrivateKey, key.CreatedAt, key.RetiredAt)
+	return err
+}
+
+// ListSigningKeys returns every signing key, newest first
+func (d *Database) ListSigningKeys() ([]*SigningKey, error) {
+	rows, err := d.db.Query(`SELECT id, algorithm, private_key, created_at, retired_at FROM signing_keys ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		k := &SigningKey{}
+		var retiredAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Algorithm, &k.PrivateKey, &k.CreatedAt, &retiredAt); err != nil {
+			return nil, err
+		}
+		if retiredAt.Valid {
+			k.RetiredAt = &retiredAt.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// RetireSigningKeys retires every active key except the one with the given
+// ID
+func (d *Database) RetireSigningKeys(exceptID string, at time.Time) error {
+	_, err := d.db.Exec(`UPDATE signing_keys SET retired_at = ? WHERE id != ? AND retired_at IS NULL`, at, exceptID)
+	return err
+}
+
+// DeleteSigningKeys deletes keys retired before the given time and returns
+// how many there were
+func (d *Database) DeleteSigningKeys(retiredBefore time.Time) (int, error) {
+	result, err := d.db.Exec(`DELETE FROM signing_keys WHERE retired_at IS NOT NULL AND retired_at < ?`, retiredBefore)
+	if err != nil {
+		return 0, err
+	}
+	affected, err := result.RowsAffected()
+	return int(affected), err
+}
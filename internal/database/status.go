@@ -0,0 +1,150 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Agent statuses. Agents start out inactive until their first heartbeat,
+// become stale when heartbeats stop arriving and offline after a longer
+// silence. Revoked agents can no longer authenticate. Decommissioned agents
+// are revoked as well, hidden from listings and purged after the retention
+// period.
+const (
+	StatusInactive       = "inactive"
+	StatusActive         = "active"
+	StatusStale          = "stale"
+	StatusOffline        = "offline"
+	StatusRevoked        = "revoked"
+	StatusDecommissioned = "decommissioned"
+)
+
+// ErrAgentRevoked is returned for heartbeats of agents that were revoked or
+// decommissioned after they authenticated
+var ErrAgentRevoked = errors.New("agent is revoked or decommissioned")
+
+// StatusEvent records a single status transition of an agent
+type StatusEvent struct {
+	ID         int64     `json:"id"`
+	AgentID    string    `json:"agent_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// RecordHeartbeat marks an agent as seen at the given time and active. A
+// positive interval updates the heartbeat interval the agent reported. It
+// returns the status the agent had before, which differs from active when
+// the heartbeat caused a transition. Revoked and decommissioned agents are
+// left alone and ErrAgentRevoked is returned, since a revocation can commit
+// between authenticating a heartbeat and recording it.
+func (d *Database) RecordHeartbeat(id string, at time.Time, interval int) (string, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var previous string
+	if err := tx.QueryRow(`SELECT status FROM agents WHERE id = ?`, id).Scan(&previous); err != nil {
+		return "", err
+	}
+	if previous == StatusRevoked || previous == StatusDecommissioned {
+		return previous, ErrAgentRevoked
+	}
+
+	if _, err := tx.Exec(`UPDATE agents SET last_seen = ?, updated_at = ? WHERE id = ?`, at, at, id); err != nil {
+		return "", err
+	}
+	if interval > 0 {
+		if _, err := tx.Exec(`UPDATE agents SET heartbeat_interval = ? WHERE id = ?`, interval, id); err != nil {
+			return "", err
+		}
+	}
+	if previous != StatusActive {
+		if err := transitionStatus(tx, id, previous, StatusActive, at); err != nil {
+			return "", err
+		}
+	}
+
+	return previous, tx.Commit()
+}
+
+// TransitionAgentStatus moves an agent from one status to another and records
+// the transition. It reports false without error when the agent is no longer
+// in the expected status, e.g. because a heartbeat arrived concurrently.
+func (d *Database) TransitionAgentStatus(id, from, to string, at time.Time) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRow(`SELECT status FROM agents WHERE id = ?`, id).Scan(&current); err != nil {
+		return false, err
+	}
+	if current != from {
+		return false, nil
+	}
+
+	if err := transitionStatus(tx, id, from, to, at); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+func transitionStatus(tx *sql.Tx, id, from, to string, at time.Time) error {
+	if _, err := tx.Exec(`UPDATE agents SET status = ?, status_changed_at = ?, updated_at = ? WHERE id = ?`, to, at, at, id); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO agent_status_events (agent_id, from_status, to_status, changed_at) VALUES (?, ?, ?, ?)`, id, from, to, at)
+	return err
+}
+
+// GetStatusEvents returns the status transitions of an agent between since
+// and until, oldest first. Timestamps are compared with julianday so values
+// written in different time zones still order correctly.
+func (d *Database) GetStatusEvents(agentID string, since, until time.Time) ([]*StatusEvent, error) {
+	query := `SELECT id, agent_id, from_status, to_status, changed_at FROM agent_status_events WHERE agent_id = ? AND julianday(changed_at) >= julianday(?) AND julianday(changed_at) < julianday(?) ORDER BY julianday(changed_at) ASC, id ASC`
+	rows, err := d.db.Query(query, agentID, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*StatusEvent
+	for rows.Next() {
+		e := &StatusEvent{}
+		if err := rows.Scan(&e.ID, &e.AgentID, &e.FromStatus, &e.ToStatus, &e.ChangedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// GetStatusAt returns the status an agent had at the given time, based on
+// the recorded transitions and falling back to its current status
+func (d *Database) GetStatusAt(agentID string, at time.Time) (string, error) {
+	var status string
+	err := d.db.QueryRow(`SELECT to_status FROM agent_status_events WHERE agent_id = ? AND julianday(changed_at) < julianday(?) ORDER BY julianday(changed_at) DESC, id DESC LIMIT 1`, agentID, at).Scan(&status)
+	if err == nil {
+		return status, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	err = d.db.QueryRow(`SELECT from_status FROM agent_status_events WHERE agent_id = ? ORDER BY julianday(changed_at) ASC, id ASC LIMIT 1`, agentID).Scan(&status)
+	if err == nil {
+		return status, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	err = d.db.QueryRow(`SELECT status FROM agents WHERE id = ?`, agentID).Scan(&status)
+	return status, err
+}
@@ -0,0 +1,89 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"silentrig/internal/config"
+	"silentrig/internal/logger"
+)
+
+func newTestDatabase(t *testing.T) *Database {
+	t.Helper()
+	log, outputs, err := logger.Open(config.LoggingConfig{Level: "error", Format: "json"})
+	if err != nil {
+		t.Fatalf("open logger: %v", err)
+	}
+	t.Cleanup(func() { outputs.Close() })
+	db, err := New(filepath.Join(t.TempDir(), "silentrig.db"), log)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestRecordHeartbeatKeepsRemovedAgents(t *testing.T) {
+	tests := []struct {
+		status string
+		remove func(*Database, string, time.Time) (int64, error)
+	}{
+		{StatusRevoked, (*Database).RevokeAgent},
+		{StatusDecommissioned, (*Database).DecommissionAgent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			db := newTestDatabase(t)
+			if err := db.CreateAgent("agent-1", "machine-1", "hash", "rig", DefaultOrg); err != nil {
+				t.Fatalf("create agent: %v", err)
+			}
+			removedAt := time.Now().UTC().Add(-time.Minute)
+			if _, err := tt.remove(db, "agent-1", removedAt); err != nil {
+				t.Fatalf("remove agent: %v", err)
+			}
+			before, err := db.GetAgent("agent-1")
+			if err != nil {
+				t.Fatalf("get agent: %v", err)
+			}
+
+			// A heartbeat authenticated just before the agent was removed
+			previous, err := db.RecordHeartbeat("agent-1", time.Now().UTC().Add(time.Minute), 30)
+			if !errors.Is(err, ErrAgentRevoked) {
+				t.Errorf("RecordHeartbeat: got %v, want ErrAgentRevoked", err)
+			}
+			if previous != tt.status {
+				t.Errorf("RecordHeartbeat: previous status %q, want %q", previous, tt.status)
+			}
+
+			agent, err := db.GetAgent("agent-1")
+			if err != nil {
+				t.Fatalf("get agent: %v", err)
+			}
+			if agent.Status != tt.status {
+				t.Errorf("status = %q, want %q", agent.Status, tt.status)
+			}
+			if !agent.LastSeen.Equal(before.LastSeen) {
+				t.Errorf("last_seen moved to %s", agent.LastSeen)
+			}
+		})
+	}
+}
+
+func TestRecordHeartbeatActivates(t *testing.T) {
+	db := newTestDatabase(t)
+	if err := db.CreateAgent("agent-1", "machine-1", "hash", "rig", DefaultOrg); err != nil {
+		t.Fatalf("create agent: %v", err)
+	}
+	if _, err := db.RecordHeartbeat("agent-1", time.Now().UTC(), 30); err != nil {
+		t.Fatalf("RecordHeartbeat: %v", err)
+	}
+	agent, err := db.GetAgent("agent-1")
+	if err != nil {
+		t.Fatalf("get agent: %v", err)
+	}
+	if agent.Status != StatusActive {
+		t.Errorf("status = %q, want %q", agent.Status, StatusActive)
+	}
+}
@@ -0,0 +1,167 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrMFAChallengeInvalid is returned for two-factor login challenges that
+// are unknown, expired or out of attempts
+var ErrMFAChallengeInvalid = errors.New("invalid two-factor challenge")
+
+// TOTPCredential is the TOTP secret of a user. It is pending until the user
+// proves with a first code that their authenticator app has it.
+type TOTPCredential struct {
+	Username  string
+	Secret    string
+	CreatedAt time.Time
+	EnabledAt *time.Time
+	// LastStep is the time step of the last accepted code; codes up to it
+	// are rejected
+	LastStep int64
+}
+
+// Enabled reports whether the credential has been confirmed
+func (t *TOTPCredential) Enabled() bool {
+	return t.EnabledAt != nil
+}
+
+// SetPendingTOTP stores a new, unconfirmed TOTP secret for a user,
+// replacing an unconfirmed one. An enabled credential is left alone, which
+// is reported by returning false.
+func (d *Database) SetPendingTOTP(username, secret string, at time.Time) (bool, error) {
+	result, err := d.db.Exec(`INSERT INTO totp_credentials (username, secret, created_at) VALUES (?, ?, ?)
+		ON CONFLICT (username) DO UPDATE SET secret = excluded.secret, created_at = excluded.created_at, last_step = 0
+		WHERE totp_credentials.enabled_at IS NULL`, username, secret, at)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// GetTOTP returns the TOTP credential of a user
+func (d *Database) GetTOTP(username string) (*TOTPCredential, error) {
+	t := &TOTPCredential{}
+	var enabledAt sql.NullTime
+	err := d.db.QueryRow(`SELECT username, secret, created_at, enabled_at, last_step FROM totp_credentials WHERE username = ?`, username).
+		Scan(&t.Username, &t.Secret, &t.CreatedAt, &enabledAt, &t.LastStep)
+	if err != nil {
+		return nil, err
+	}
+	if enabledAt.Valid {
+		t.EnabledAt = &enabledAt.Time
+	}
+	return t, nil
+}
+
+// UseTOTPStep records that the code of a time step was accepted, enabling a
+// pending credential. It reports false if a code of the same or a later
+// step was used already, so concurrent logins cannot replay a code.
+func (d *Database) UseTOTPStep(username string, step int64, at time.Time) (bool, error) {
+	result, err := d.db.Exec(`UPDATE totp_credentials SET last_step = ?, enabled_at = COALESCE(enabled_at, ?) WHERE username = ? AND last_step < ?`,
+		step, at, username, step)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// DeleteTOTP removes the TOTP credential and recovery codes of a user and
+// reports whether there was a credential
+func (d *Database) DeleteTOTP(username string) (bool, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`DELETE FROM totp_credentials WHERE username = ?`, username)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ?`, username); err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, tx.Commit()
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user with the given
+// hashes
+func (d *Database) ReplaceRecoveryCodes(username string, hashes []string, at time.Time) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE username = ?`, username); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := tx.Exec(`INSERT INTO recovery_codes (code_hash, username, created_at) VALUES (?, ?, ?)`, hash, username, at); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used and
+// reports whether there was one
+func (d *Database) UseRecoveryCode(username, hash string, at time.Time) (bool, error) {
+	result, err := d.db.Exec(`UPDATE recovery_codes SET used_at = ? WHERE code_hash = ? AND username = ? AND used_at IS NULL`, at, hash, username)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+// CountRecoveryCodes returns the number of unused recovery codes of a user
+func (d *Database) CountRecoveryCodes(username string) (int, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM recovery_codes WHERE username = ? AND used_at IS NULL`, username).Scan(&n)
+	return n, err
+}
+
+// CreateMFAChallenge stores the hash of a token that lets a user who
+// passed the password check complete the login with a second factor
+func (d *Database) CreateMFAChallenge(tokenHash, username string, at, expiresAt time.Time) error {
+	_, err := d.db.Exec(`INSERT INTO mfa_challenges (token_hash, username, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		tokenHash, username, at, expiresAt)
+	return err
+}
+
+// AttemptMFAChallenge counts an attempt at a challenge and returns its
+// user. It returns ErrMFAChallengeInvalid if the challenge does not exist,
+// has expired at the given time or has had maxAttempts attempts.
+func (d *Database) AttemptMFAChallenge(tokenHash string, at time.Time, maxAttempts int) (string, error) {
+	result, err := d.db.Exec(`UPDATE mfa_challenges SET attempts = attempts + 1 WHERE token_hash = ? AND expires_at > ? AND attempts < ?`,
+		tokenHash, at, maxAttempts)
+	if err != nil {
+		return "", err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if affected == 0 {
+		return "", ErrMFAChallengeInvalid
+	}
+	var username string
+	err = d.db.QueryRow(`SELECT username FROM mfa_challenges WHERE token_hash = ?`, tokenHash).Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrMFAChallengeInvalid
+	}
+	return username, err
+}
+
+// DeleteMFAChallenge removes a challenge once the login completed
+func (d *Database) DeleteMFAChallenge(tokenHash string) error {
+	_, err := d.db.Exec(`DELETE FROM mfa_challenges WHERE token_hash = ?`, tokenHash)
+	return err
+}
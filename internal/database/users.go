@@ -0,0 +1,153 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// ErrUserExists is returned when creating a user whose username is taken
+var ErrUserExists = errors.New("user already exists")
+
+// User is an operator account. The password is only stored as a hash.
+// Service accounts have no password and authenticate with API keys only;
+// accounts with an OIDC subject log in through the OIDC provider.
+type User struct {
+	ID           int64  `json:"id"`
+	Username     string `json:"username"`
+	PasswordHash string `json:"-"`
+	Role         string `json:"role"`
+	OrgID        string `json:"org_id"`
+	Service      bool   `json:"service"`
+	// OIDCSubject is the issuer and subject of the provider's user,
+	// separated by a space
+	OIDCSubject string    `json:"oidc_subject,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+const userColumns = `id, username, password_hash, role, org_id, service, oidc_subject, created_at, updated_at`
+
+func scanUser(row rowScanner) (*User, error) {
+	u := &User{}
+	if err := row.Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Role, &u.OrgID, &u.Service, &u.OIDCSubject, &u.CreatedAt, &u.UpdatedAt); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// CreateUser adds an operator account, or a service account without a
+// password hash, to an organization
+func (d *Database) CreateUser(username, passwordHash, role, orgID string, service bool) (*User, error) {
+	return d.insertUser(&User{Username: username, PasswordHash: passwordHash, Role: role, OrgID: orgID, Service: service})
+}
+
+// CreateOIDCUser adds an account without a password for a user of the
+// OIDC provider to an organization
+func (d *Database) CreateOIDCUser(username, role, orgID, subject string) (*User, error) {
+	return d.insertUser(&User{Username: username, Role: role, OrgID: orgID, OIDCSubject: subject})
+}
+
+func (d *Database) insertUser(u *User) (*User, error) {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var exists int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM users WHERE username = ?`, u.Username).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if exists > 0 {
+		return nil, ErrUserExists
+	}
+
+	now := time.Now()
+	result, err := tx.Exec(`INSERT INTO users (username, password_hash, role, org_id, service, oidc_subject, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		u.Username, u.PasswordHash, u.Role, u.OrgID, u.Service, u.OIDCSubject, now, now)
+	if err != nil {
+		return nil, err
+	}
+	if u.ID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	u.CreatedAt, u.UpdatedAt = now, now
+	return u, nil
+}
+
+// GetUserByOIDCSubject returns the account linked to a user of the OIDC
+// provider
+func (d *Database) GetUserByOIDCSubject(subject string) (*User, error) {
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE oidc_subject = ? AND oidc_subject != ''`, subject))
+}
+
+// GetUserByUsername returns the account with the given username
+func (d *Database) GetUserByUsername(username string) (*User, error) {
+	return scanUser(d.db.QueryRow(`SELECT `+userColumns+` FROM users WHERE username = ?`, username))
+}
+
+// ListUsers returns the accounts of an organization, or every account when
+// orgID is empty, ordered by username
+func (d *Database) ListUsers(orgID string) ([]*User, error) {
+	rows, err := d.db.Query(`SELECT `+userColumns+` FROM users WHERE ? = '' OR org_id = ? ORDER BY username`, orgID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// CountUsers returns the number of accounts
+func (d *Database) CountUsers() (int, error) {
+	var n int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n)
+	return n, err
+}
+
+// UpdateUserPassword replaces the password hash of an account. It returns
+// sql.ErrNoRows if the user does not exist.
+func (d *Database) UpdateUserPassword(username, passwordHash string) error {
+	result, err := d.db.Exec(`UPDATE users SET password_hash = ?, updated_at = ? WHERE username = ?`, passwordHash, time.Now(), username)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// UpdateUserRole changes the role of an account. It returns sql.ErrNoRows if
+// the user does not exist.
+func (d *Database) UpdateUserRole(username, role string) error {
+	result, err := d.db.Exec(`UPDATE users SET role = ?, updated_at = ? WHERE username = ?`, role, time.Now(), username)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
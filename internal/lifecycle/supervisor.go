@@ -0,0 +1,214 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"silentrig/internal/logger"
+)
+
+// Worker states reported by Health
+const (
+	StateIdle       = "idle"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateStopped    = "stopped"
+	StateFailed     = "failed"
+)
+
+// RunFunc is the body of a background worker. It must return once ctx is
+// cancelled. Returning earlier, with or without an error, makes the
+// supervisor restart it after a backoff.
+type RunFunc func(ctx context.Context) error
+
+// WorkerHealth describes the state of a supervised worker
+type WorkerHealth struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	StartedAt time.Time `json:"started_at"`
+	Restarts  int       `json:"restarts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type worker struct {
+	name string
+	run  RunFunc
+	// cancel and done are guarded by the supervisor's mu
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu     sync.Mutex
+	health WorkerHealth
+}
+
+// Supervisor owns the background workers of the server. Workers are started
+// in the order they were added and stopped in reverse order.
+type Supervisor struct {
+	logger  logger.Logger
+	backoff time.Duration
+
+	mu      sync.Mutex
+	workers []*worker
+	started bool
+	// ctx is the context given to Start, for workers added later
+	ctx context.Context
+}
+
+func New(log logger.Logger) *Supervisor {
+	return &Supervisor{
+		logger:  log,
+		backoff: 5 * time.Second,
+	}
+}
+
+// Add registers a worker. Workers added after Start are started immediately
+// with a context derived from the one given to Start.
+func (s *Supervisor) Add(name string, run RunFunc) {
+	w := &worker{
+		name:   name,
+		run:    run,
+		health: WorkerHealth{Name: name, State: StateIdle},
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.workers = append(s.workers, w)
+	if s.started {
+		s.start(s.ctx, w)
+	}
+}
+
+// Start launches every registered worker with a context derived from ctx
+func (s *Supervisor) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.started = true
+	s.ctx = ctx
+	for _, w := range s.workers {
+		s.start(ctx, w)
+	}
+}
+
+// start launches a worker. The caller holds s.mu.
+func (s *Supervisor) start(parent context.Context, w *worker) {
+	ctx, cancel := context.WithCancel(parent)
+	done := make(chan struct{})
+	w.cancel = cancel
+	w.done = done
+
+	go func() {
+		defer close(done)
+		for {
+			w.setState(StateRunning, nil, true)
+			s.logger.Debug("Worker started", "worker", w.name)
+
+			err := w.runSafely(ctx)
+			if ctx.Err() != nil {
+				w.setState(StateStopped, nil, false)
+				s.logger.Info("Worker stopped", "worker", w.name)
+				return
+			}
+
+			if err == nil {
+				err = errors.New("worker exited unexpectedly")
+			}
+			w.setState(StateRestarting, err, false)
+			s.logger.Error("Worker failed, restarting", "worker", w.name, "error", err, "backoff", s.backoff)
+
+			select {
+			case <-time.After(s.backoff):
+				w.mu.Lock()
+				w.health.Restarts++
+				w.mu.Unlock()
+			case <-ctx.Done():
+				// Stopped while waiting to restart; err stays the last error
+				w.setState(StateStopped, err, false)
+				s.logger.Info("Worker stopped", "worker", w.name)
+				return
+			}
+		}
+	}()
+}
+
+// Stop cancels the workers in reverse registration order, waiting for each
+// to return before stopping the next. It gives up once ctx expires.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	type running struct {
+		name   string
+		cancel context.CancelFunc
+		done   chan struct{}
+	}
+	s.mu.Lock()
+	var workers []running
+	for _, w := range s.workers {
+		if w.cancel != nil {
+			workers = append(workers, running{w.name, w.cancel, w.done})
+		}
+	}
+	s.started = false
+	s.ctx = nil
+	s.mu.Unlock()
+
+	for i := len(workers) - 1; i >= 0; i-- {
+		w := workers[i]
+		w.cancel()
+
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return fmt.Errorf("timed out stopping worker %s: %w", w.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+// Health returns the state of every worker in registration order
+func (s *Supervisor) Health() []WorkerHealth {
+	s.mu.Lock()
+	workers := append([]*worker(nil), s.workers...)
+	s.mu.Unlock()
+
+	health := make([]WorkerHealth, 0, len(workers))
+	for _, w := range workers {
+		w.mu.Lock()
+		health = append(health, w.health)
+		w.mu.Unlock()
+	}
+	return health
+}
+
+// Healthy reports whether every started worker is running
+func (s *Supervisor) Healthy() bool {
+	for _, h := range s.Health() {
+		if h.State == StateRestarting || h.State == StateFailed {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *worker) setState(state string, err error, started bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.health.State = state
+	if started {
+		w.health.StartedAt = time.Now()
+	}
+	if err != nil {
+		w.health.LastError = err.Error()
+	}
+}
+
+// runSafely converts a panic in the worker into an error so it is restarted
+// instead of taking down the process
+func (w *worker) runSafely(ctx context.Context) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return w.run(ctx)
+}
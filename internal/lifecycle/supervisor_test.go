@@ -0,0 +1,128 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"silentrig/internal/config"
+	"silentrig/internal/logger"
+)
+
+func newTestSupervisor(t *testing.T) *Supervisor {
+	t.Helper()
+	log, outputs, err := logger.Open(config.LoggingConfig{Level: "error", Format: "json"})
+	if err != nil {
+		t.Fatalf("open logger: %v", err)
+	}
+	t.Cleanup(func() { outputs.Close() })
+	return New(log)
+}
+
+// waitForState polls the health of the only worker until it reaches state
+func waitForState(t *testing.T, s *Supervisor, state string) WorkerHealth {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		health := s.Health()[0]
+		if health.State == state {
+			return health
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("worker state = %q, want %q", health.State, state)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStopDuringRestartBackoff(t *testing.T) {
+	s := newTestSupervisor(t)
+	s.backoff = time.Hour
+	s.Add("failing", func(ctx context.Context) error {
+		return errors.New("boom")
+	})
+
+	s.Start(context.Background())
+	waitForState(t, s, StateRestarting)
+	if err := s.Stop(context.Background()); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+
+	health := waitForState(t, s, StateStopped)
+	if health.LastError != "boom" {
+		t.Errorf("last error = %q, want %q", health.LastError, "boom")
+	}
+	if !s.Healthy() {
+		t.Error("a stopped supervisor reports unhealthy")
+	}
+}
+
+func TestAddAfterStartUsesStartContext(t *testing.T) {
+	s := newTestSupervisor(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+
+	done := make(chan struct{})
+	s.Add("late", func(ctx context.Context) error {
+		<-ctx.Done()
+		close(done)
+		return nil
+	})
+	waitForState(t, s, StateRunning)
+
+	// Cancelling the Start context stops workers added later too
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("worker added after Start outlived the Start context")
+	}
+	waitForState(t, s, StateStopped)
+}
+
+func TestAddDuringStop(t *testing.T) {
+	var running atomic.Int32
+	run := func(ctx context.Context) error {
+		running.Add(1)
+		defer running.Add(-1)
+		<-ctx.Done()
+		return nil
+	}
+
+	for round := 0; round < 50; round++ {
+		s := newTestSupervisor(t)
+		s.Start(context.Background())
+
+		ready := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-ready
+				s.Add(fmt.Sprintf("worker-%d", i), run)
+			}()
+		}
+		close(ready)
+		// Spread Stop over the window in which the workers are added
+		time.Sleep(time.Duration(round) * 2 * time.Microsecond)
+		if err := s.Stop(context.Background()); err != nil {
+			t.Fatalf("stop: %v", err)
+		}
+		wg.Wait()
+
+		// Workers added before Stop were waited for, later ones never started
+		if n := running.Load(); n != 0 {
+			t.Fatalf("%d workers still running after Stop", n)
+		}
+		for _, h := range s.Health() {
+			if h.State != StateIdle && h.State != StateStopped {
+				t.Fatalf("worker %s is %s after Stop", h.Name, h.State)
+			}
+		}
+	}
+}
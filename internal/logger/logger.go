@@ -1,31 +1,58 @@
 package logger
 
 import (
+	"fmt"
 	"os"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
 
+// Logger logs messages with structured fields. The arguments after the
+// message are alternating keys and values:
+//
+//	log.Info("Agent registered", "agent_id", id, "platform", platform)
 type Logger interface {
-	Info(args ...interface{})
-	Error(args ...interface{})
-	Fatal(args ...interface{})
-	Debug(args ...interface{})
-	Warn(args ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+	Fatal(msg string, keyvals ...interface{})
+	Debug(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	// With returns a logger adding the given key/value pairs to every
+	// message
+	With(keyvals ...interface{}) Logger
 	WithField(key string, value interface{}) Logger
 	WithFields(fields map[string]interface{}) Logger
+	// Component returns a logger for a component, e.g. "registry", whose
+	// level can be set separately. Its entries carry a component field.
+	Component(name string) Logger
+	// SetLevel changes the default minimum level of every logger derived
+	// from the same root
+	SetLevel(level string) error
+	// SetComponentLevels replaces the per-component level overrides
+	SetComponentLevels(levels map[string]string) error
+	// Levels returns the default level and the component overrides
+	Levels() (string, map[string]string)
 }
 
+// badKey is the key used for a trailing value without a key
+const badKey = "!BADKEY"
+
 type logger struct {
-	*logrus.Logger
+	root      *logrus.Logger
+	entry     *logrus.Entry
+	levels    *levels
+	component string
 }
 
+// New returns a logger writing JSON to stdout at the level from $LOG_LEVEL,
+// info by default
 func New() Logger {
 	l := logrus.New()
-	
+
 	// Set output to stdout
 	l.SetOutput(os.Stdout)
-	
+
 	// Set log level
 	level := os.Getenv("LOG_LEVEL")
 	switch level {
@@ -40,19 +67,146 @@ func New() Logger {
 	default:
 		l.SetLevel(logrus.InfoLevel)
 	}
-	
+
 	// Set formatter
-	l.SetFormatter(&logrus.JSONFormatter{
+	l.SetFormatter(jsonFormatter())
+
+	return newLogger(l)
+}
+
+// newLogger wraps a logrus logger, taking over its level. Levels are
+// checked by the wrapper so components can log below the default level.
+func newLogger(l *logrus.Logger) *logger {
+	lv := &levels{level: l.GetLevel()}
+	l.SetLevel(logrus.TraceLevel)
+	return &logger{root: l, entry: logrus.NewEntry(l), levels: lv}
+}
+
+func jsonFormatter() logrus.Formatter {
+	return &logrus.JSONFormatter{
 		TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
-	})
-	
-	return &logger{l}
+	}
+}
+
+// levels holds the default level and the component overrides shared by all
+// loggers derived from one root
+type levels struct {
+	mu         sync.RWMutex
+	level      logrus.Level
+	components map[string]logrus.Level
+}
+
+func (lv *levels) enabled(component string, level logrus.Level) bool {
+	lv.mu.RLock()
+	defer lv.mu.RUnlock()
+	min, ok := lv.components[component]
+	if !ok {
+		min = lv.level
+	}
+	return min >= level
+}
+
+func (l *logger) Info(msg string, keyvals ...interface{}) {
+	l.log(logrus.InfoLevel, msg, keyvals)
+}
+
+func (l *logger) Error(msg string, keyvals ...interface{}) {
+	l.log(logrus.ErrorLevel, msg, keyvals)
+}
+
+// Fatal logs the message and exits the process
+func (l *logger) Fatal(msg string, keyvals ...interface{}) {
+	l.entry.WithFields(fields(keyvals)).Fatal(msg)
+}
+
+func (l *logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(logrus.DebugLevel, msg, keyvals)
+}
+
+func (l *logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(logrus.WarnLevel, msg, keyvals)
+}
+
+func (l *logger) log(level logrus.Level, msg string, keyvals []interface{}) {
+	if !l.levels.enabled(l.component, level) {
+		return
+	}
+	l.entry.WithFields(fields(keyvals)).Log(level, msg)
+}
+
+func (l *logger) With(keyvals ...interface{}) Logger {
+	return l.derive(l.entry.WithFields(fields(keyvals)), l.component)
 }
 
 func (l *logger) WithField(key string, value interface{}) Logger {
-	return &logger{l.Logger.WithField(key, value).Logger}
+	return l.derive(l.entry.WithField(key, value), l.component)
 }
 
 func (l *logger) WithFields(fields map[string]interface{}) Logger {
-	return &logger{l.Logger.WithFields(logrus.Fields(fields)).Logger}
-} 
\ No newline at end of file
+	return l.derive(l.entry.WithFields(logrus.Fields(fields)), l.component)
+}
+
+func (l *logger) Component(name string) Logger {
+	return l.derive(l.entry.WithField("component", name), name)
+}
+
+func (l *logger) derive(entry *logrus.Entry, component string) *logger {
+	return &logger{root: l.root, entry: entry, levels: l.levels, component: component}
+}
+
+// SetLevel changes the minimum level of messages that are logged
+func (l *logger) SetLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l.levels.mu.Lock()
+	l.levels.level = parsed
+	l.levels.mu.Unlock()
+	return nil
+}
+
+// SetComponentLevels replaces the component overrides. Nothing changes if
+// any level is invalid.
+func (l *logger) SetComponentLevels(components map[string]string) error {
+	parsed := make(map[string]logrus.Level, len(components))
+	for component, level := range components {
+		lvl, err := logrus.ParseLevel(level)
+		if err != nil {
+			return fmt.Errorf("component %s: %w", component, err)
+		}
+		parsed[component] = lvl
+	}
+	l.levels.mu.Lock()
+	l.levels.components = parsed
+	l.levels.mu.Unlock()
+	return nil
+}
+
+func (l *logger) Levels() (string, map[string]string) {
+	l.levels.mu.RLock()
+	defer l.levels.mu.RUnlock()
+	components := make(map[string]string, len(l.levels.components))
+	for component, level := range l.levels.components {
+		components[component] = level.String()
+	}
+	return l.levels.level.String(), components
+}
+
+// fields turns alternating keys and values into logrus fields. Keys that
+// are not strings are formatted; a trailing value is logged under badKey.
+func fields(keyvals []interface{}) logrus.Fields {
+	f := make(logrus.Fields, (len(keyvals)+1)/2)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 == len(keyvals) {
+			f[badKey] = keyvals[i]
+			break
+		}
+		key, ok := keyvals[i].(string)
+		if !ok {
+			key = fmt.Sprint(keyvals[i])
+		}
+		f[key] = keyvals[i+1]
+	}
+	return f
+}
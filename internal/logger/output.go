@@ -0,0 +1,145 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+
+	"silentrig/internal/config"
+)
+
+// Open returns a logger writing to the configured outputs in the configured
+// format and with the configured levels. The closer releases the outputs.
+func Open(cfg config.LoggingConfig) (Logger, io.Closer, error) {
+	var formatter logrus.Formatter = jsonFormatter()
+	if cfg.Format == "text" {
+		formatter = &logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+			DisableColors:   true,
+		}
+	}
+
+	outputs := cfg.Outputs
+	if len(outputs) == 0 {
+		outputs = []config.LogOutputConfig{{Type: config.LogOutputStdout}}
+	}
+	var closers outputClosers
+	root := logrus.New()
+	root.SetOutput(io.Discard)
+	root.SetFormatter(discardFormatter{})
+	for _, o := range outputs {
+		hook, err := openOutput(o, formatter)
+		if err != nil {
+			closers.Close()
+			return nil, nil, fmt.Errorf("opening %s log output: %w", o.Type, err)
+		}
+		root.AddHook(hook)
+		if c, ok := hook.write.(io.Closer); ok {
+			closers = append(closers, c)
+		}
+	}
+
+	l := newLogger(root)
+	if err := l.SetLevel(cfg.Level); err != nil {
+		closers.Close()
+		return nil, nil, err
+	}
+	if err := l.SetComponentLevels(cfg.Components); err != nil {
+		closers.Close()
+		return nil, nil, err
+	}
+	return l, closers, nil
+}
+
+// levelWriter receives formatted entries with their level
+type levelWriter interface {
+	WriteLevel(level logrus.Level, line []byte) error
+}
+
+// outputHook formats every entry and hands it to one output. The root
+// logger itself discards everything, so an entry is formatted once per
+// output only.
+type outputHook struct {
+	formatter logrus.Formatter
+	write     levelWriter
+}
+
+func (h *outputHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *outputHook) Fire(entry *logrus.Entry) error {
+	line, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	return h.write.WriteLevel(entry.Level, line)
+}
+
+func openOutput(o config.LogOutputConfig, formatter logrus.Formatter) (*outputHook, error) {
+	hook := &outputHook{formatter: formatter}
+	switch o.Type {
+	case config.LogOutputStdout:
+		hook.write = streamWriter{os.Stdout}
+	case config.LogOutputStderr:
+		hook.write = streamWriter{os.Stderr}
+	case config.LogOutputFile:
+		file, err := OpenRotatingFile(o.Path, int64(o.MaxSizeMB)<<20, o.MaxAge, o.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		hook.write = streamWriter{file}
+	case config.LogOutputSyslog:
+		tag := o.Tag
+		if tag == "" {
+			tag = "silentrig"
+		}
+		w, err := dialSyslog(o.Network, o.Address, tag)
+		if err != nil {
+			return nil, err
+		}
+		hook.write = w
+	default:
+		return nil, fmt.Errorf("unknown output type %q", o.Type)
+	}
+	return hook, nil
+}
+
+// streamWriter writes entries regardless of their level
+type streamWriter struct {
+	io.Writer
+}
+
+func (w streamWriter) WriteLevel(_ logrus.Level, line []byte) error {
+	_, err := w.Write(line)
+	return err
+}
+
+func (w streamWriter) Close() error {
+	if c, ok := w.Writer.(io.Closer); ok && w.Writer != os.Stdout && w.Writer != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// discardFormatter keeps the root logger from formatting entries that are
+// discarded anyway
+type discardFormatter struct{}
+
+func (discardFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+type outputClosers []io.Closer
+
+func (c outputClosers) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,190 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat names rotated files, e.g. silentrig.log.20240101-120000
+const backupTimeFormat = "20060102-150405"
+
+// RotatingFile is a log file that is renamed with a timestamp suffix and
+// replaced by a new file once it grows beyond a size or gets older than a
+// maximum age. A zero size or age disables that limit.
+type RotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// OpenRotatingFile opens or creates the log file at path, appending to an
+// existing file
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*RotatingFile, error) {
+	// Cleaned like the names returned by filepath.Glob
+	path = filepath.Clean(path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f := &RotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	// The modification time of an existing file approximates its age
+	f.created = time.Now()
+	if info.Size() > 0 {
+		f.created = info.ModTime()
+	}
+	return nil
+}
+
+// Write appends p, rotating the file first if p would exceed the size
+// limit or the file is too old
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.size > 0 && f.needsRotation(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) needsRotation(next int64) bool {
+	if f.maxSize > 0 && f.size+next > f.maxSize {
+		return true
+	}
+	return f.maxAge > 0 && time.Since(f.created) > f.maxAge
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	backup, err := f.nextBackup(time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	return f.removeOldBackups()
+}
+
+// nextBackup names the file rotated at t. Files rotated within the same
+// second get a counter above the highest one in use, never a name freed by
+// removeOldBackups, which would sort the newest file first.
+func (f *RotatingFile) nextBackup(t time.Time) (string, error) {
+	backup := f.path + "." + t.Format(backupTimeFormat)
+	existing, err := filepath.Glob(backup + "*")
+	if err != nil {
+		return "", err
+	}
+	last := -1
+	for _, name := range existing {
+		suffix := strings.TrimPrefix(name, backup)
+		if suffix == "" {
+			last = max(last, 0)
+		} else if n, err := strconv.Atoi(strings.TrimPrefix(suffix, ".")); err == nil && strings.HasPrefix(suffix, ".") {
+			last = max(last, n)
+		}
+	}
+	if last < 0 {
+		return backup, nil
+	}
+	return fmt.Sprintf("%s.%d", backup, last+1), nil
+}
+
+// removeOldBackups deletes the oldest rotated files beyond maxBackups
+func (f *RotatingFile) removeOldBackups() error {
+	if f.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	var rotated []string
+	for _, b := range backups {
+		suffix := strings.TrimPrefix(b, f.path+".")
+		if len(suffix) >= len(backupTimeFormat) {
+			if _, err := time.Parse(backupTimeFormat, suffix[:len(backupTimeFormat)]); err == nil {
+				rotated = append(rotated, b)
+			}
+		}
+	}
+	if len(rotated) <= f.maxBackups {
+		return nil
+	}
+
+	sort.Slice(rotated, func(i, j int) bool {
+		return f.backupLess(rotated[i], rotated[j])
+	})
+	for _, b := range rotated[:len(rotated)-f.maxBackups] {
+		if err := os.Remove(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backupLess orders rotated files by time, then by their collision counter
+func (f *RotatingFile) backupLess(a, b string) bool {
+	a, b = strings.TrimPrefix(a, f.path+"."), strings.TrimPrefix(b, f.path+".")
+	ta, tb := a[:len(backupTimeFormat)], b[:len(backupTimeFormat)]
+	if ta != tb {
+		return ta < tb
+	}
+	ca, _ := strconv.Atoi(strings.TrimPrefix(a[len(backupTimeFormat):], "."))
+	cb, _ := strconv.Atoi(strings.TrimPrefix(b[len(backupTimeFormat):], "."))
+	return ca < cb
+}
+
+// Close closes the file
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
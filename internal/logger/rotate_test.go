@@ -0,0 +1,127 @@
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// backupName matches rotated files, with the counter added when several
+// rotations happen within a second
+var backupName = regexp.MustCompile(`^silentrig\.log\.\d{8}-\d{6}(\.\d+)?$`)
+
+// backups returns the contents of the rotated files, oldest first
+func backups(t *testing.T, f *RotatingFile) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		if backupName.MatchString(e.Name()) {
+			names = append(names, filepath.Join(filepath.Dir(f.path), e.Name()))
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return f.backupLess(names[i], names[j]) })
+
+	contents := make([]string, len(names))
+	for i, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read backup: %v", err)
+		}
+		contents[i] = string(data)
+	}
+	return contents
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "silentrig.log")
+	// Not a rotated file, so never removed
+	other := filepath.Join(dir, "silentrig.log.keep")
+	if err := os.WriteFile(other, []byte("keep"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	f, err := OpenRotatingFile(path, 100, 0, 2)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	// 40 byte lines, two to a file
+	line := func(i int) string { return fmt.Sprintf("line %02d %s\n", i, strings.Repeat("x", 31)) }
+	for i := 1; i <= 10; i++ {
+		if _, err := f.Write([]byte(line(i))); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	// Four rotations happened; the two newest backups are kept
+	got := backups(t, f)
+	want := []string{line(5) + line(6), line(7) + line(8)}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("backups = %q, want %q", got, want)
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != line(9)+line(10) {
+		t.Errorf("current file = %q, %v; want lines 9 and 10", data, err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file removed: %v", err)
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "silentrig.log")
+	f, err := OpenRotatingFile(path, 0, 20*time.Millisecond, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+
+	f.Write([]byte("old\n"))
+	f.Write([]byte("still young\n"))
+	time.Sleep(30 * time.Millisecond)
+	f.Write([]byte("new\n"))
+
+	if got := backups(t, f); len(got) != 1 || got[0] != "old\nstill young\n" {
+		t.Errorf("backups = %q, want the first two lines", got)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("current file = %q", data)
+	}
+}
+
+func TestRotatingFileAppendsAndKeepsAllBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "silentrig.log")
+	if err := os.WriteFile(path, []byte("before restart\n"), 0o600); err != nil {
+		t.Fatalf("write file: %v", err)
+	}
+
+	// No backup limit
+	f, err := OpenRotatingFile(path, 20, 0, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	for i := 0; i < 5; i++ {
+		f.Write([]byte("after restart\n"))
+	}
+
+	got := backups(t, f)
+	if len(got) != 5 || got[0] != "before restart\n" {
+		t.Errorf("backups = %q, want the existing file and four more", got)
+	}
+
+	f.Close()
+	if _, err := f.Write([]byte("closed\n")); err == nil {
+		t.Error("write after close succeeded")
+	}
+}
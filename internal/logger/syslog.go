@@ -0,0 +1,41 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"log/syslog"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// syslogWriter sends entries to syslog with the severity of their level
+type syslogWriter struct {
+	*syslog.Writer
+}
+
+// dialSyslog connects to a syslog server, or to the local syslog socket
+// when network and address are empty
+func dialSyslog(network, address, tag string) (levelWriter, error) {
+	w, err := syslog.Dial(network, address, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return syslogWriter{w}, nil
+}
+
+func (w syslogWriter) WriteLevel(level logrus.Level, line []byte) error {
+	msg := strings.TrimSuffix(string(line), "\n")
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return w.Crit(msg)
+	case logrus.ErrorLevel:
+		return w.Err(msg)
+	case logrus.WarnLevel:
+		return w.Warning(msg)
+	case logrus.InfoLevel:
+		return w.Info(msg)
+	default:
+		return w.Debug(msg)
+	}
+}
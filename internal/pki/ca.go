@@ -0,0 +1,245 @@
+// Package pki implements the built-in certificate authority that issues
+// client certificates to agents for the mutual TLS agent listener.
+package pki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+const (
+	caCertFile = "ca.crt"
+	caKeyFile  = "ca.key"
+
+	// caValidity is the lifetime of a generated CA certificate
+	caValidity = 10 * 365 * 24 * time.Hour
+)
+
+// ErrCertificateRevoked is returned when a client presents a revoked or
+// unknown certificate
+var ErrCertificateRevoked = errors.New("client certificate revoked")
+
+// IssuedCertificate is a client certificate issued to an agent. KeyPEM is
+// empty when the agent supplied its own key in a CSR.
+type IssuedCertificate struct {
+	Serial    string    `json:"serial"`
+	CertPEM   string    `json:"certificate"`
+	KeyPEM    string    `json:"private_key,omitempty"`
+	CAPEM     string    `json:"ca_certificate"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+}
+
+// CA signs agent client certificates and checks presented certificates
+// against the issued ones in the database
+type CA struct {
+	db       *database.Database
+	cert     *x509.Certificate
+	key      crypto.Signer
+	certPEM  []byte
+	validity time.Duration
+}
+
+// LoadOrCreate loads the CA from dir, generating a new key and self-signed
+// certificate on first use
+func LoadOrCreate(dir string, validity time.Duration, db *database.Database) (*CA, error) {
+	certPath, keyPath := filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile)
+
+	if _, err := os.Stat(certPath); errors.Is(err, os.ErrNotExist) {
+		if err := generate(dir, certPath, keyPath); err != nil {
+			return nil, fmt.Errorf("generating CA: %w", err)
+		}
+	}
+
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA from %s: %w", dir, err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot sign")
+	}
+
+	return &CA{db: db, cert: cert, key: key, certPEM: certPEM, validity: validity}, nil
+}
+
+func generate(dir, certPath, keyPath string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "SilentRig Agent CA"},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// CertPEM returns the PEM encoded CA certificate
+func (ca *CA) CertPEM() []byte {
+	return ca.certPEM
+}
+
+// Pool returns a pool holding the CA certificate, for verifying clients
+func (ca *CA) Pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// IssueForAgent issues a client certificate whose common name is the agent
+// ID. With a PEM encoded CSR the agent's own key is certified; otherwise a
+// key is generated and returned with the certificate.
+func (ca *CA) IssueForAgent(agentID string, csrPEM []byte) (*IssuedCertificate, error) {
+	var (
+		pub    crypto.PublicKey
+		keyPEM []byte
+	)
+	if len(csrPEM) > 0 {
+		block, _ := pem.Decode(csrPEM)
+		if block == nil || block.Type != "CERTIFICATE REQUEST" {
+			return nil, errors.New("csr must be a PEM encoded certificate request")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing csr: %w", err)
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return nil, fmt.Errorf("csr signature: %w", err)
+		}
+		pub = csr.PublicKey
+	} else {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		pub = &key.PublicKey
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: agentID, OrganizationalUnit: []string{"agents"}},
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(ca.validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &database.AgentCertificate{
+		Serial:    hex.EncodeToString(serial.Bytes()),
+		AgentID:   agentID,
+		NotBefore: template.NotBefore,
+		NotAfter:  template.NotAfter,
+		CreatedAt: now,
+	}
+	if err := ca.db.StoreCertificate(record); err != nil {
+		return nil, err
+	}
+
+	return &IssuedCertificate{
+		Serial:    record.Serial,
+		CertPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		KeyPEM:    string(keyPEM),
+		CAPEM:     string(ca.certPEM),
+		NotBefore: record.NotBefore,
+		NotAfter:  record.NotAfter,
+	}, nil
+}
+
+// VerifyConnection rejects client certificates that were revoked or are not
+// on record. The chain itself is verified by crypto/tls against Pool.
+func (ca *CA) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return ca.CheckCertificate(state.PeerCertificates[0])
+}
+
+// CheckCertificate reports ErrCertificateRevoked unless cert was issued by
+// this CA and is not revoked
+func (ca *CA) CheckCertificate(cert *x509.Certificate) error {
+	record, err := ca.db.GetCertificate(hex.EncodeToString(cert.SerialNumber.Bytes()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrCertificateRevoked
+	}
+	if err != nil {
+		return err
+	}
+	if record.RevokedAt != nil || record.AgentID != cert.Subject.CommonName {
+		return ErrCertificateRevoked
+	}
+	return nil
+}
+
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
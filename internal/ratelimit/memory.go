@@ -0,0 +1,146 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often MemoryStore.Run drops unused state
+const pruneInterval = time.Minute
+
+// MemoryStore keeps limits in memory. They are lost on restart and not
+// shared with other servers.
+type MemoryStore struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	failures map[string]*failures
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket is full again, after which it can be dropped
+	full time.Time
+}
+
+type failures struct {
+	count       int
+	lockedUntil time.Time
+	// expires is when the failures are forgotten
+	expires time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]*bucket),
+		failures: make(map[string]*failures),
+	}
+}
+
+// Take implements Store
+func (m *MemoryStore) Take(key string, rate Rate, now time.Time) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	capacity := float64(rate.Burst)
+	interval := rate.interval()
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updated: now}
+		m.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+float64(elapsed)/float64(interval))
+		b.updated = now
+	}
+
+	result := Result{Limit: rate.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - b.tokens) * float64(interval))
+	}
+	result.Remaining = int(b.tokens)
+	result.Reset = time.Duration((capacity - b.tokens) * float64(interval))
+	b.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// Fail implements Store
+func (m *MemoryStore) Fail(key string, policy Lockout, now time.Time) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, ok := m.failures[key]
+	if !ok || now.After(f.expires) {
+		f = &failures{}
+		m.failures[key] = f
+	}
+	f.count++
+	if d := policy.lockout(f.count); d > 0 {
+		f.lockedUntil = now.Add(d)
+	}
+	f.expires = now.Add(policy.ResetAfter)
+	if f.lockedUntil.After(f.expires) {
+		f.expires = f.lockedUntil
+	}
+	if f.lockedUntil.After(now) {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+// LockedUntil implements Store
+func (m *MemoryStore) LockedUntil(key string, now time.Time) (time.Time, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if f, ok := m.failures[key]; ok && f.lockedUntil.After(now) {
+		return f.lockedUntil, nil
+	}
+	return time.Time{}, nil
+}
+
+// Reset implements Store
+func (m *MemoryStore) Reset(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.failures, key)
+	return nil
+}
+
+// Run drops full buckets and forgotten failures until ctx is done
+func (m *MemoryStore) Run(ctx context.Context) error {
+	ticker := time.NewTicker(pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			m.prune(now)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (m *MemoryStore) prune(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, b := range m.buckets {
+		if now.After(b.full) {
+			delete(m.buckets, key)
+		}
+	}
+	for key, f := range m.failures {
+		if now.After(f.expires) {
+			delete(m.failures, key)
+		}
+	}
+}
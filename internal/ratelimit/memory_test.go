@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTake(t *testing.T) {
+	// One token every 10 seconds, up to 3 at once
+	rate := Rate{Requests: 6, Period: time.Minute, Burst: 3}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		after time.Duration
+		want  Result
+	}{
+		{"first request", 0, Result{Allowed: true, Limit: 3, Remaining: 2, Reset: 10 * time.Second}},
+		{"burst", 0, Result{Allowed: true, Limit: 3, Remaining: 1, Reset: 20 * time.Second}},
+		{"end of burst", 0, Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 30 * time.Second}},
+		{"empty bucket", 0, Result{Limit: 3, Remaining: 0, Reset: 30 * time.Second, RetryAfter: 10 * time.Second}},
+		{"partly refilled", 5 * time.Second, Result{Limit: 3, Remaining: 0, Reset: 25 * time.Second, RetryAfter: 5 * time.Second}},
+		{"one token refilled", 10 * time.Second, Result{Allowed: true, Limit: 3, Remaining: 0, Reset: 30 * time.Second}},
+		{"refill stops at the burst", 10 * time.Minute, Result{Allowed: true, Limit: 3, Remaining: 2, Reset: 10 * time.Second}},
+	}
+
+	m := NewMemoryStore()
+	for _, tt := range tests {
+		got, err := m.Take("client", rate, start.Add(tt.after))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	// Keys have separate buckets
+	if got, _ := m.Take("other", rate, start); !got.Allowed || got.Remaining != 2 {
+		t.Errorf("other key: got %+v, want a full bucket", got)
+	}
+}
+
+func TestFail(t *testing.T) {
+	policy := Lockout{MaxFailures: 2, Duration: time.Minute, MaxDuration: time.Hour, ResetAfter: 10 * time.Minute}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemoryStore()
+
+	fail := func(want time.Duration) {
+		t.Helper()
+		until, err := m.Fail("user", policy, now)
+		if err != nil {
+			t.Fatalf("fail: %v", err)
+		}
+		if want == 0 && !until.IsZero() {
+			t.Errorf("locked until %s, want no lockout", until)
+		}
+		if want != 0 && !until.Equal(now.Add(want)) {
+			t.Errorf("locked until %s, want %s", until, now.Add(want))
+		}
+		if locked, _ := m.LockedUntil("user", now); !locked.Equal(until) {
+			t.Errorf("LockedUntil = %s, want %s", locked, until)
+		}
+	}
+
+	fail(0)
+	fail(time.Minute)
+	// The lockout ends, and the next failure doubles it
+	now = now.Add(time.Minute)
+	if until, _ := m.LockedUntil("user", now); !until.IsZero() {
+		t.Errorf("still locked after the lockout: %s", until)
+	}
+	fail(2 * time.Minute)
+	now = now.Add(2 * time.Minute)
+	fail(4 * time.Minute)
+
+	// Failures are forgotten ResetAfter after the last one
+	now = now.Add(policy.ResetAfter + time.Second)
+	fail(0)
+
+	// A successful attempt forgets them too
+	fail(time.Minute)
+	if err := m.Reset("user"); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if until, _ := m.LockedUntil("user", now); !until.IsZero() {
+		t.Errorf("locked after reset until %s", until)
+	}
+	fail(0)
+}
+
+func TestPrune(t *testing.T) {
+	rate := Rate{Requests: 60, Period: time.Minute, Burst: 2}
+	policy := Lockout{MaxFailures: 1, Duration: time.Minute, MaxDuration: time.Hour, ResetAfter: 5 * time.Minute}
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemoryStore()
+
+	m.Take("drained", rate, now)
+	m.Take("drained", rate, now)
+	m.Take("used", rate, now)
+	m.Fail("user", policy, now)
+
+	// "used" is full again after a second, "drained" after two
+	m.prune(now.Add(1500 * time.Millisecond))
+	if _, ok := m.buckets["used"]; ok {
+		t.Error("full bucket was kept")
+	}
+	if _, ok := m.buckets["drained"]; !ok {
+		t.Error("bucket that is not full yet was dropped")
+	}
+	if _, ok := m.failures["user"]; !ok {
+		t.Error("failures were dropped before they expired")
+	}
+
+	// Failures expire ResetAfter after the last one
+	m.prune(now.Add(5*time.Minute + time.Second))
+	if len(m.buckets) != 0 || len(m.failures) != 0 {
+		t.Errorf("state left after expiry: %d buckets, %d failures", len(m.buckets), len(m.failures))
+	}
+}
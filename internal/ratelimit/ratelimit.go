@@ -0,0 +1,74 @@
+// Package ratelimit implements token bucket rate limits and progressive
+// lockouts after failed attempts. State is kept in a Store; MemoryStore
+// serves a single server, while servers sharing their limits implement
+// Store on top of a shared database such as Redis.
+package ratelimit
+
+import "time"
+
+// Store keeps the token buckets and failure counts of clients. Keys are
+// opaque strings chosen by the caller. Implementations must be safe for
+// concurrent use.
+type Store interface {
+	// Take removes a token from the bucket of key if one is left
+	Take(key string, rate Rate, now time.Time) (Result, error)
+	// Fail records a failed attempt of key and returns the end of the
+	// lockout it causes, or the zero time if key is not locked out
+	Fail(key string, policy Lockout, now time.Time) (time.Time, error)
+	// LockedUntil returns the end of the current lockout of key, or the
+	// zero time if key is not locked out
+	LockedUntil(key string, now time.Time) (time.Time, error)
+	// Reset forgets the failures of key, e.g. after a successful login
+	Reset(key string) error
+}
+
+// Rate allows Requests per Period on average and bursts of up to Burst
+// requests
+type Rate struct {
+	Requests int
+	Period   time.Duration
+	Burst    int
+}
+
+// interval returns the time it takes to refill one token
+func (r Rate) interval() time.Duration {
+	return r.Period / time.Duration(r.Requests)
+}
+
+// Result is the outcome of taking a token
+type Result struct {
+	Allowed bool
+	// Limit is the size of the bucket
+	Limit int
+	// Remaining is the number of tokens left
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time until the next token when Allowed is false
+	RetryAfter time.Duration
+}
+
+// Lockout locks a key out for Duration after MaxFailures failures. Every
+// further failure doubles the lockout up to MaxDuration. Failures are
+// forgotten after ResetAfter without another one.
+type Lockout struct {
+	MaxFailures int
+	Duration    time.Duration
+	MaxDuration time.Duration
+	ResetAfter  time.Duration
+}
+
+// lockout returns the lockout after the given number of failures in a row
+func (l Lockout) lockout(failures int) time.Duration {
+	if l.MaxFailures <= 0 || failures < l.MaxFailures {
+		return 0
+	}
+	d := l.Duration
+	for i := l.MaxFailures; i < failures && d < l.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > l.MaxDuration {
+		return l.MaxDuration
+	}
+	return d
+}
@@ -0,0 +1,32 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutEscalation(t *testing.T) {
+	policy := Lockout{MaxFailures: 3, Duration: time.Minute, MaxDuration: 10 * time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 8 * time.Minute},
+		{7, 10 * time.Minute},
+		{20, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := policy.lockout(tt.failures); got != tt.want {
+			t.Errorf("lockout after %d failures = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+
+	if got := (Lockout{Duration: time.Minute, MaxDuration: time.Hour}).lockout(100); got != 0 {
+		t.Errorf("lockout without MaxFailures = %s, want 0", got)
+	}
+}
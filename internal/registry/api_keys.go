@@ -0,0 +1,169 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+// apiKeyPrefix makes API keys recognizable in logs and secret scanners
+const apiKeyPrefix = "srk_"
+
+// apiKeyDisplayLength is how much of a key is kept to identify it
+const apiKeyDisplayLength = len(apiKeyPrefix) + 8
+
+// APIKeyRequest describes an API key to create
+type APIKeyRequest struct {
+	Name       string
+	Scopes     []string
+	AllowedIPs []string
+	// TTL is how long the key is valid; zero for no expiry
+	TTL       time.Duration
+	CreatedBy string
+}
+
+// CreateAPIKey issues an API key for a user or service account. The scopes
+// must be allowed for the account's role. The key is only returned here; the
+// database keeps its hash.
+func (r *Registry) CreateAPIKey(user *database.User, req APIKeyRequest) (string, *database.APIKey, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return "", nil, errors.New("name must not be empty")
+	}
+	if err := auth.ValidateScopes(req.Scopes, user.Role); err != nil {
+		return "", nil, err
+	}
+	allowedIPs, err := parseAllowedIPs(req.AllowedIPs)
+	if err != nil {
+		return "", nil, err
+	}
+	if req.TTL < 0 {
+		return "", nil, errors.New("expiry must not be negative")
+	}
+
+	key, err := generateToken(apiKeyPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	record := &database.APIKey{
+		Name:       req.Name,
+		Prefix:     key[:apiKeyDisplayLength],
+		Username:   user.Username,
+		Scopes:     slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		AllowedIPs: allowedIPs,
+		CreatedBy:  req.CreatedBy,
+		CreatedAt:  time.Now().UTC(),
+	}
+	if req.TTL > 0 {
+		expiresAt := record.CreatedAt.Add(req.TTL)
+		record.ExpiresAt = &expiresAt
+	}
+	if err := r.db.CreateAPIKey(record, hashToken(key)); err != nil {
+		return "", nil, err
+	}
+	r.logger.Info("API key created", "api_key_id", record.ID, "prefix", record.Prefix, "username", user.Username, "scopes", record.Scopes)
+	return key, record, nil
+}
+
+// AuthenticateAPIKey checks an API key used from clientIP and returns the
+// account it acts for. Its scopes are narrowed to what the account's
+// current role allows.
+func (r *Registry) AuthenticateAPIKey(key, clientIP string) (*auth.APIKeyIdentity, error) {
+	now := time.Now().UTC()
+	record, err := r.db.GetAPIKeyByHash(hashToken(key), now)
+	if err != nil {
+		return nil, err
+	}
+	user, err := r.db.GetUserByUsername(record.Username)
+	if err != nil {
+		// Keys of deleted accounts stop working
+		return nil, database.ErrAPIKeyInvalid
+	}
+
+	allowed := auth.RoleScopes(user.Role)
+	identity := &auth.APIKeyIdentity{KeyID: record.ID, UserID: user.Username, Role: user.Role, OrgID: user.OrgID, Scopes: []string{}}
+	for _, scope := range record.Scopes {
+		if slices.Contains(allowed, scope) {
+			identity.Scopes = append(identity.Scopes, scope)
+		}
+	}
+	if !ipAllowed(record.AllowedIPs, clientIP) {
+		return identity, auth.ErrAPIKeyAddress
+	}
+
+	if err := r.db.TouchAPIKey(record.ID, clientIP, now); err != nil {
+		r.logger.Warn("Failed to record API key use", "api_key_id", record.ID, "error", err)
+	}
+	return identity, nil
+}
+
+// GetAPIKey returns the API key with the given ID
+func (r *Registry) GetAPIKey(id int64) (*database.APIKey, error) {
+	return r.db.GetAPIKey(id)
+}
+
+// ListAPIKeys returns the API keys of a user, or of everyone in an
+// organization when username is empty. An empty orgID matches every
+// organization.
+func (r *Registry) ListAPIKeys(username, orgID string) ([]*database.APIKey, error) {
+	return r.db.ListAPIKeys(username, orgID)
+}
+
+// RevokeAPIKey revokes an API key. It returns sql.ErrNoRows if the key does
+// not exist.
+func (r *Registry) RevokeAPIKey(id int64) error {
+	revoked, err := r.db.RevokeAPIKey(id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if revoked {
+		r.logger.Info("API key revoked", "api_key_id", id)
+	}
+	return nil
+}
+
+// parseAllowedIPs normalizes an allow-list of addresses and CIDR ranges
+func parseAllowedIPs(list []string) ([]string, error) {
+	normalized := []string{}
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			normalized = append(normalized, prefix.Masked().String())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("allowed IP %q is neither an address nor a CIDR range", entry)
+		}
+		normalized = append(normalized, netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+	return normalized, nil
+}
+
+// ipAllowed reports whether ip is within one of the allowed ranges. An
+// empty list allows every address.
+func ipAllowed(allowed []string, ip string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, entry := range allowed {
+		prefix, err := netip.ParsePrefix(entry)
+		if err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package registry
+
+import (
+	"encoding/json"
+
+	"silentrig/internal/database"
+)
+
+// Audited actions
+const (
+	AuditLogin             = "auth.login"
+	AuditLogout            = "auth.logout"
+	AuditRefresh           = "auth.refresh"
+	AuditAgentCreate       = "agent.create"
+	AuditAgentUpdate       = "agent.update"
+	AuditAgentDelete       = "agent.delete"
+	AuditAgentRestore      = "agent.restore"
+	AuditAgentPurge        = "agent.purge"
+	AuditAgentExport       = "agent.export"
+	AuditAgentDownload     = "agent.download"
+	AuditAgentRotate       = "agent.credentials.rotate"
+	AuditAgentRevoke       = "agent.revoke"
+	AuditConflictResolve   = "agent.conflict.resolve"
+	AuditCertificateIssue  = "agent.certificate.issue"
+	AuditCertificateRevoke = "agent.certificate.revoke"
+	AuditCommandCreate     = "command.create"
+	AuditCommandCancel     = "command.cancel"
+	AuditUserCreate        = "user.create"
+	AuditServiceAccount    = "user.service_account.create"
+	AuditAPIKeyCreate      = "api_key.create"
+	AuditAPIKeyRevoke      = "api_key.revoke"
+	AuditUserRole          = "user.role"
+	AuditUserPassword      = "user.password"
+	AuditSessionsRevoke    = "user.sessions.revoke"
+	AuditTwoFactorEnable   = "user.2fa.enable"
+	AuditTwoFactorDisable  = "user.2fa.disable"
+	AuditTwoFactorReset    = "user.2fa.reset"
+	AuditRecoveryCodes     = "user.2fa.recovery_codes"
+	AuditEnrollmentToken   = "enrollment_token.create"
+	AuditOrgCreate         = "organization.create"
+	AuditOrgDelete         = "organization.delete"
+	AuditConfigReload      = "config.reload"
+	AuditSigningKeyRotate  = "jwt.key.rotate"
+	AuditLoggingUpdate     = "logging.update"
+)
+
+// Actors of actions not performed through the API by a user
+const (
+	ActorSystem = "system"
+	ActorCLI    = "cli"
+)
+
+// AuditRecord describes an action for the audit log
+type AuditRecord struct {
+	// OrgID is the organization whose members may see the record; empty
+	// for records only super admins see
+	OrgID      string
+	Actor      string
+	SourceIP   string
+	Action     string
+	TargetType string
+	TargetID   string
+	// Err records the action as failed, with the error in place of After
+	Err error
+	// Before and After summarize the target's state and are stored as JSON
+	Before interface{}
+	After  interface{}
+}
+
+// Audit appends a record to the audit log. A failure to write it is logged
+// rather than returned, since the action itself already happened.
+func (r *Registry) Audit(rec AuditRecord) {
+	event := &database.AuditEvent{
+		OrgID:      rec.OrgID,
+		Actor:      rec.Actor,
+		SourceIP:   rec.SourceIP,
+		Action:     rec.Action,
+		TargetType: rec.TargetType,
+		TargetID:   rec.TargetID,
+		Outcome:    database.AuditSuccess,
+		Before:     auditJSON(rec.Before),
+		After:      auditJSON(rec.After),
+	}
+	if rec.Err != nil {
+		event.Outcome = database.AuditFailure
+		event.After = auditJSON(map[string]string{"error": rec.Err.Error()})
+	}
+
+	if err := r.db.AppendAuditEvent(event); err != nil {
+		r.logger.Error("Failed to write audit event", "action", rec.Action, "actor", rec.Actor, "target_id", rec.TargetID, "error", err)
+	}
+}
+
+// AgentSummary is the state of an agent recorded in audit events
+func AgentSummary(agent *database.Agent) map[string]interface{} {
+	return map[string]interface{}{
+		"name":   agent.Name,
+		"status": agent.Status,
+		"labels": agent.Labels,
+		"groups": agent.Groups,
+	}
+}
+
+func auditJSON(v interface{}) json.RawMessage {
+	if v == nil {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// ListAuditEvents returns matching audit events, newest first
+func (r *Registry) ListAuditEvents(filter database.AuditFilter) ([]*database.AuditEvent, error) {
+	return r.db.ListAuditEvents(filter)
+}
+
+// EachAuditEvent calls fn for every matching audit event, oldest first
+func (r *Registry) EachAuditEvent(filter database.AuditFilter, fn func(*database.AuditEvent) error) error {
+	return r.db.EachAuditEvent(filter, fn)
+}
+
+// VerifyAuditChain checks the audit log for modified or removed events
+func (r *Registry) VerifyAuditChain() (*database.AuditVerification, error) {
+	return r.db.VerifyAuditChain()
+}
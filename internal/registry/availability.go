@@ -0,0 +1,94 @@
+package registry
+
+import (
+	"sort"
+	"time"
+
+	"silentrig/internal/availability"
+	"silentrig/internal/database"
+)
+
+// AgentAvailability computes the availability of a single agent over
+// [from, to), including the status intervals it was built from
+func (r *Registry) AgentAvailability(agent *database.Agent, from, to time.Time, opts availability.Options) (*availability.AgentReport, error) {
+	now := time.Now()
+	if to.After(now) {
+		to = now
+	}
+	if agent.CreatedAt.After(from) {
+		from = agent.CreatedAt
+	}
+
+	report := &availability.AgentReport{
+		AgentID:   agent.ID,
+		Name:      agent.Name,
+		Labels:    agent.Labels,
+		Groups:    agent.Groups,
+		Intervals: []availability.Interval{},
+	}
+	if !to.After(from) {
+		return report, nil
+	}
+
+	initial, err := r.db.GetStatusAt(agent.ID, from)
+	if err != nil {
+		return nil, err
+	}
+	events, err := r.db.GetStatusEvents(agent.ID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	report.Intervals = availability.BuildIntervals(initial, events, from, to)
+	report.Stats = availability.Compute(report.Intervals, opts)
+	return report, nil
+}
+
+// AvailabilityReport computes the availability of every agent matching the
+// filter over [from, to). Status intervals are omitted to keep fleet-wide
+// reports small.
+func (r *Registry) AvailabilityReport(filter *database.AgentFilter, from, to time.Time, opts availability.Options) ([]*availability.AgentReport, error) {
+	agents, err := r.db.ListAgents(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := make([]*availability.AgentReport, 0, len(agents))
+	for _, agent := range agents {
+		report, err := r.AgentAvailability(agent, from, to, opts)
+		if err != nil {
+			return nil, err
+		}
+		report.Intervals = nil
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// GroupAvailability aggregates agent reports by the value of a label or, if
+// labelKey is empty, by group. Agents without the label are reported under
+// an empty key; agents in several groups count towards each of them.
+func GroupAvailability(reports []*availability.AgentReport, labelKey string) []*availability.GroupReport {
+	stats := make(map[string][]availability.Stats)
+	for _, report := range reports {
+		if labelKey != "" {
+			key := report.Labels[labelKey]
+			stats[key] = append(stats[key], report.Stats)
+			continue
+		}
+		for _, group := range report.Groups {
+			stats[group] = append(stats[group], report.Stats)
+		}
+	}
+
+	groups := make([]*availability.GroupReport, 0, len(stats))
+	for key, all := range stats {
+		groups = append(groups, &availability.GroupReport{
+			Key:    key,
+			Agents: len(all),
+			Stats:  availability.Aggregate(all),
+		})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Key < groups[j].Key })
+	return groups
+}
@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+// ErrAgentConflict is returned when a registration does not match an
+// agent's identity; the conflict is recorded for an operator to resolve
+var ErrAgentConflict = errors.New("agent identity conflict; an operator has to resolve it")
+
+// ErrInvalidResolution is returned when a conflict cannot be resolved the
+// requested way
+var ErrInvalidResolution = errors.New("invalid conflict resolution")
+
+// agentAddresses tracks the addresses an agent's credentials were recently
+// used from
+type agentAddresses struct {
+	last string
+	seen map[string]time.Time
+}
+
+// SetCloneWindow sets how long an address an agent used counts as in use.
+// An agent switching back to such an address while another one is in use
+// is flagged as cloned. Zero disables clone detection.
+func (r *Registry) SetCloneWindow(window time.Duration) {
+	r.cloneWindow.Store(int64(window))
+}
+
+// ObserveAgentAddress records the address an authenticated agent connected
+// from. Credentials that alternate between addresses within the clone
+// window are used by more than one host at a time, which is recorded as a
+// clone conflict. The agent is not blocked.
+func (r *Registry) ObserveAgentAddress(agent *database.Agent, ip string) {
+	window := time.Duration(r.cloneWindow.Load())
+	if window <= 0 || ip == "" {
+		return
+	}
+
+	now := time.Now()
+	r.addressMu.Lock()
+	if r.addresses == nil {
+		r.addresses = map[string]*agentAddresses{}
+	}
+	addrs := r.addresses[agent.ID]
+	if addrs == nil {
+		addrs = &agentAddresses{seen: map[string]time.Time{}}
+		r.addresses[agent.ID] = addrs
+	}
+	for addr, seen := range addrs.seen {
+		if now.Sub(seen) > window {
+			delete(addrs.seen, addr)
+		}
+	}
+	previous := addrs.last
+	_, returning := addrs.seen[ip]
+	addrs.seen[ip] = now
+	addrs.last = ip
+	r.addressMu.Unlock()
+
+	if previous == "" || previous == ip || !returning {
+		return
+	}
+	err := r.recordConflict(&database.AgentConflict{
+		AgentID: agent.ID, OrgID: agent.OrgID, Kind: database.ConflictClone,
+		MachineID: agent.MachineID, SourceIP: ip, OtherIP: previous,
+	})
+	if !errors.Is(err, ErrAgentConflict) {
+		r.logger.Error("Failed to record agent conflict", "agent_id", agent.ID, "error", err)
+	}
+}
+
+// forgetAgentAddresses drops the addresses tracked for an agent
+func (r *Registry) forgetAgentAddresses(id string) {
+	r.addressMu.Lock()
+	delete(r.addresses, id)
+	r.addressMu.Unlock()
+}
+
+// recordConflict stores a conflict and returns ErrAgentConflict, or the
+// error that kept it from being stored
+func (r *Registry) recordConflict(conflict *database.AgentConflict) error {
+	recorded, created, err := r.db.RecordConflict(conflict, time.Now())
+	if err != nil {
+		return err
+	}
+	if created {
+		r.logger.Warn("Agent identity conflict detected", "conflict_id", recorded.ID, "agent_id", recorded.AgentID,
+			"kind", recorded.Kind, "machine_id", recorded.MachineID, "source_ip", recorded.SourceIP, "other_ip", recorded.OtherIP)
+	}
+	return ErrAgentConflict
+}
+
+// ListConflicts returns the open conflicts of an organization, or of all of
+// them when orgID is empty. Resolved conflicts are included when all is set.
+func (r *Registry) ListConflicts(orgID string, all bool) ([]*database.AgentConflict, error) {
+	return r.db.ListConflicts(orgID, all)
+}
+
+// GetConflictInOrg returns a conflict of an organization, or of any
+// organization when orgID is empty. Conflicts of other organizations are
+// reported as sql.ErrNoRows.
+func (r *Registry) GetConflictInOrg(orgID string, id int64) (*database.AgentConflict, error) {
+	conflict, err := r.db.GetConflict(id)
+	if err != nil {
+		return nil, err
+	}
+	if orgID != "" && conflict.OrgID != orgID {
+		return nil, sql.ErrNoRows
+	}
+	return conflict, nil
+}
+
+// CountOpenConflicts returns the number of unresolved conflicts of an
+// organization, or of all of them when orgID is empty
+func (r *Registry) CountOpenConflicts(orgID string) (int, error) {
+	return r.db.CountOpenConflicts(orgID)
+}
+
+// ResolveConflict applies an operator's decision on a conflict. Accepting
+// a credential mismatch makes the registering host's token the agent's only
+// token; accepting a machine ID mismatch moves the agent to the presented
+// machine ID. Clones can only be dismissed or revoked. Revoking revokes
+// the agent, which has to enroll again.
+func (r *Registry) ResolveConflict(conflict *database.AgentConflict, resolution, resolvedBy string) error {
+	if conflict.ResolvedAt != nil {
+		return database.ErrConflictResolved
+	}
+
+	switch resolution {
+	case database.ResolutionAccept:
+		var err error
+		switch conflict.Kind {
+		case database.ConflictCredentials:
+			if err = r.db.ReplaceAgentToken(conflict.AgentID, conflict.TokenHash); errors.Is(err, sql.ErrNoRows) {
+				err = ErrAgentRevoked
+			}
+		case database.ConflictMachineID:
+			err = r.db.SetAgentMachineID(conflict.AgentID, conflict.MachineID)
+		default:
+			err = ErrInvalidResolution
+		}
+		if err != nil {
+			return err
+		}
+		r.agents.Delete(conflict.AgentID)
+		r.forgetAgentAddresses(conflict.AgentID)
+	case database.ResolutionRevoke:
+		if _, err := r.RevokeAgent(conflict.AgentID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		r.forgetAgentAddresses(conflict.AgentID)
+	case database.ResolutionDismiss:
+	default:
+		return ErrInvalidResolution
+	}
+
+	if err := r.db.ResolveConflict(conflict.ID, resolution, resolvedBy, time.Now()); err != nil {
+		return err
+	}
+	r.logger.Info("Agent conflict resolved", "conflict_id", conflict.ID, "agent_id", conflict.AgentID, "resolution", resolution, "resolved_by", resolvedBy)
+	return nil
+}
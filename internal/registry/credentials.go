@@ -0,0 +1,127 @@
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+// ErrAgentCredentials is returned when an agent presents a token that does
+// not belong to it, or none at all
+var ErrAgentCredentials = errors.New("invalid agent credentials")
+
+// ErrAgentRevoked is returned when a revoked agent registers again without
+// an enrollment token of its organization
+var ErrAgentRevoked = errors.New("agent is revoked; register it again with an enrollment token")
+
+// agentTokenPrefix makes agent tokens issued by the server recognizable in
+// logs and secret scanners
+const agentTokenPrefix = "sra_"
+
+// defaultCredentialGrace is how long a replaced agent token stays valid when
+// no grace window is configured
+const defaultCredentialGrace = 24 * time.Hour
+
+// SetCredentialGrace sets how long an agent's previous token stays valid
+// after its credentials were rotated
+func (r *Registry) SetCredentialGrace(grace time.Duration) {
+	r.credentialGrace.Store(int64(grace))
+}
+
+func (r *Registry) credentialGraceWindow() time.Duration {
+	if grace := time.Duration(r.credentialGrace.Load()); grace > 0 {
+		return grace
+	}
+	return defaultCredentialGrace
+}
+
+// GenerateAgentToken returns a new random agent token
+func GenerateAgentToken() (string, error) {
+	return generateToken(agentTokenPrefix)
+}
+
+// AuthenticateAgent returns the agent with the given ID if token is its
+// current token, or its previous one within the grace window. Revoked agents
+// have no valid tokens.
+func (r *Registry) AuthenticateAgent(id, token string) (*database.Agent, error) {
+	if token == "" {
+		return nil, ErrAgentCredentials
+	}
+	agent, err := r.db.GetAgentByTokenHash(hashToken(token), time.Now())
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && agent.ID != id) {
+		return nil, ErrAgentCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	return agent, nil
+}
+
+// RotateAgentCredentials issues a new token to an agent. The token the agent
+// presented, or its current one when presented is empty, stays valid for
+// the grace window so an agent that misses the new token can retry. It
+// returns the new token and when the previous one expires, or
+// sql.ErrNoRows for unknown and revoked agents.
+func (r *Registry) RotateAgentCredentials(id, presented string) (string, time.Time, error) {
+	token, err := GenerateAgentToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var presentedHash string
+	if presented != "" {
+		presentedHash = hashToken(presented)
+	}
+
+	expiresAt := time.Now().Add(r.credentialGraceWindow())
+	if err := r.db.RotateAgentToken(id, presentedHash, hashToken(token), expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	r.logger.Info("Agent credentials rotated", "agent_id", id, "previous_token_expires_at", expiresAt)
+	return token, expiresAt, nil
+}
+
+// RevokeAgent immediately invalidates every token and client certificate of
+// an agent, cancels its pending commands and moves it to the revoked status.
+// The agent has to enroll again to come back. It returns the revoked agent
+// and sql.ErrNoRows for unknown or already revoked agents.
+func (r *Registry) RevokeAgent(id string) (*database.Agent, error) {
+	now := time.Now()
+	cancelled, err := r.db.RevokeAgent(id, now)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.db.RevokeAgentCertificates(id, now); err != nil {
+		return nil, err
+	}
+
+	agent, err := r.db.GetAgent(id)
+	if err != nil {
+		return nil, err
+	}
+	r.agents.Store(id, agent)
+	r.logger.Info("Agent revoked", "agent_id", id, "cancelled_commands", cancelled)
+	return agent, nil
+}
+
+// reinstateAgent lets a revoked agent back in with a new token after it
+// presented an enrollment token of its organization
+func (r *Registry) reinstateAgent(agent *database.Agent, enrollmentToken, token string) error {
+	if enrollmentToken == "" {
+		return ErrAgentRevoked
+	}
+	orgID, err := r.db.ConsumeEnrollmentToken(hashToken(enrollmentToken), time.Now())
+	if err != nil {
+		return err
+	}
+	if orgID != agent.OrgID {
+		return ErrAgentRevoked
+	}
+	if err := r.db.ReinstateAgent(agent.ID, hashToken(token), time.Now()); err != nil {
+		return err
+	}
+	r.agents.Delete(agent.ID)
+	r.logger.Info("Revoked agent enrolled again", "agent_id", agent.ID, "org_id", orgID)
+	return nil
+}
@@ -0,0 +1,376 @@
+package registry
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+)
+
+// ErrAgentDecommissioned is returned when a decommissioned agent registers
+// again; an operator has to restore it first
+var ErrAgentDecommissioned = errors.New("agent is decommissioned; an operator has to restore it")
+
+// ErrExportFormat is returned for export formats other than json and csv
+var ErrExportFormat = errors.New("export format must be json or csv")
+
+// Agent export formats. A json export is a single document; a csv export is
+// a zip archive with one CSV file per kind of history.
+const (
+	ExportJSON = "json"
+	ExportCSV  = "csv"
+)
+
+// decommissionPurgeInterval is how often decommissioned agents past their
+// retention period are purged
+const decommissionPurgeInterval = time.Hour
+
+// SetDecommission replaces the retention settings for decommissioned
+// agents, e.g. after a configuration reload
+func (r *Registry) SetDecommission(decommission config.DecommissionConfig) {
+	r.decommission.Store(&decommission)
+}
+
+// DecommissionAgent revokes an agent's credentials, cancels its pending
+// commands and hides it from listings. Its history is kept for the
+// retention period. It returns sql.ErrNoRows for unknown or already
+// decommissioned agents.
+func (r *Registry) DecommissionAgent(id string) (*database.Agent, error) {
+	cancelled, err := r.db.DecommissionAgent(id, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	agent, err := r.db.GetAgent(id)
+	if err != nil {
+		return nil, err
+	}
+	r.agents.Store(id, agent)
+	r.forgetAgentAddresses(id)
+	r.logger.Info("Agent decommissioned", "agent_id", id, "cancelled_commands", cancelled)
+	return agent, nil
+}
+
+// RestoreAgent brings a decommissioned agent back as revoked; it has to
+// enroll again to connect. It returns sql.ErrNoRows unless the agent is
+// decommissioned.
+func (r *Registry) RestoreAgent(id string) (*database.Agent, error) {
+	if err := r.db.RestoreAgent(id, time.Now()); err != nil {
+		return nil, err
+	}
+	agent, err := r.db.GetAgent(id)
+	if err != nil {
+		return nil, err
+	}
+	r.agents.Store(id, agent)
+	r.logger.Info("Agent restored", "agent_id", id)
+	return agent, nil
+}
+
+// PurgeAgent writes a final export of an agent to the configured export
+// directory and then deletes the agent with its whole history. Nothing is
+// deleted when the export fails. It returns the path of the export.
+func (r *Registry) PurgeAgent(agent *database.Agent) (string, error) {
+	cfg := r.decommission.Load()
+	if cfg == nil {
+		return "", errors.New("decommissioning is not configured")
+	}
+	path, err := r.writeExport(agent, cfg.ExportDir, cfg.ExportFormat)
+	if err != nil {
+		return "", fmt.Errorf("export agent %s: %w", agent.ID, err)
+	}
+	if err := r.db.DeleteAgent(agent.ID); err != nil {
+		return "", err
+	}
+	r.agents.Delete(agent.ID)
+	r.forgetAgentAddresses(agent.ID)
+	r.logger.Info("Agent purged", "agent_id", agent.ID, "export", path)
+	return path, nil
+}
+
+// PurgeDecommissioned purges the agents decommissioned longer ago than the
+// retention period and returns how many were purged
+func (r *Registry) PurgeDecommissioned() (int, error) {
+	cfg := r.decommission.Load()
+	if cfg == nil || cfg.Retention <= 0 {
+		return 0, nil
+	}
+	agents, err := r.db.ListDecommissionedAgents(time.Now().Add(-cfg.Retention))
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, agent := range agents {
+		if _, err := r.PurgeAgent(agent); err != nil {
+			r.logger.Error("Failed to purge decommissioned agent", "agent_id", agent.ID, "error", err)
+			continue
+		}
+		r.Audit(AuditRecord{
+			OrgID: agent.OrgID, Actor: ActorSystem, Action: AuditAgentPurge, TargetType: "agent", TargetID: agent.ID,
+			Before: AgentSummary(agent),
+		})
+		purged++
+	}
+	return purged, nil
+}
+
+// RunDecommissionPurge purges expired decommissioned agents every hour
+// until ctx is cancelled
+func (r *Registry) RunDecommissionPurge(ctx context.Context) error {
+	ticker := time.NewTicker(decommissionPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := r.PurgeDecommissioned(); err != nil {
+				r.logger.Error("Failed to purge decommissioned agents", "error", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// PurgeAfter returns when a decommissioned agent will be purged
+func (r *Registry) PurgeAfter(agent *database.Agent) *time.Time {
+	cfg := r.decommission.Load()
+	if agent.DecommissionedAt == nil || cfg == nil {
+		return nil
+	}
+	t := agent.DecommissionedAt.Add(cfg.Retention)
+	return &t
+}
+
+// ExportFileName returns the file name of an agent export in a format
+func ExportFileName(agentID, format string, at time.Time) string {
+	ext := "json"
+	if format == ExportCSV {
+		ext = "zip"
+	}
+	return fmt.Sprintf("silentrig-agent-%s-%s.%s", agentID, at.UTC().Format("20060102-150405"), ext)
+}
+
+// writeExport exports an agent into a new file in dir
+func (r *Registry) writeExport(agent *database.Agent, dir, format string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, ExportFileName(agent.ID, format, time.Now()))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return "", err
+	}
+	if err := r.ExportAgent(f, agent, format); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return path, nil
+}
+
+// ExportAgent writes an agent with its inventory versions, status
+// transitions, metrics and commands to w
+func (r *Registry) ExportAgent(w io.Writer, agent *database.Agent, format string) error {
+	switch format {
+	case ExportJSON:
+		return r.exportJSON(w, agent)
+	case ExportCSV:
+		return r.exportCSV(w, agent)
+	}
+	return ErrExportFormat
+}
+
+// agentExportHeader is the part of an export that fits in memory
+type agentExportHeader struct {
+	ExportedAt   time.Time               `json:"exported_at"`
+	Agent        *database.Agent         `json:"agent"`
+	Inventory    []*database.Inventory   `json:"inventory"`
+	StatusEvents []*database.StatusEvent `json:"status_events"`
+}
+
+func (r *Registry) exportHeader(agent *database.Agent) (*agentExportHeader, error) {
+	inventory, err := r.db.GetInventoryHistory(agent.ID)
+	if err != nil {
+		return nil, err
+	}
+	events, err := r.db.GetStatusEvents(agent.ID, time.Unix(0, 0), time.Now().Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	return &agentExportHeader{ExportedAt: time.Now().UTC(), Agent: agent, Inventory: inventory, StatusEvents: events}, nil
+}
+
+// exportJSON streams a single JSON document; metrics and commands are
+// written one at a time since they can be large
+func (r *Registry) exportJSON(w io.Writer, agent *database.Agent) error {
+	header, err := r.exportHeader(agent)
+	if err != nil {
+		return err
+	}
+	head, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	// Reopen the header object to append the streamed arrays
+	if _, err := w.Write(head[:len(head)-1]); err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, `,"metrics":[`); err != nil {
+		return err
+	}
+	if err := r.db.EachMetric(agent.ID, jsonArrayWriter[*database.Metrics](w)); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(w, `],"commands":[`); err != nil {
+		return err
+	}
+	if err := r.db.EachCommand(agent.ID, jsonArrayWriter[*database.Command](w)); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "]}\n")
+	return err
+}
+
+// jsonArrayWriter returns a callback writing each value as an element of a
+// JSON array
+func jsonArrayWriter[T any](w io.Writer) func(T) error {
+	first := true
+	return func(v T) error {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		_, err = w.Write(b)
+		return err
+	}
+}
+
+// exportCSV writes a zip archive with the agent as agent.json and its
+// history as metrics.csv, commands.csv, status_events.csv and inventory.csv
+func (r *Registry) exportCSV(w io.Writer, agent *database.Agent) error {
+	header, err := r.exportHeader(agent)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(w)
+
+	f, err := createArchiveFile(archive, "agent.json", header.ExportedAt)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(struct {
+		ExportedAt time.Time       `json:"exported_at"`
+		Agent      *database.Agent `json:"agent"`
+	}{header.ExportedAt, agent}); err != nil {
+		return err
+	}
+
+	if err := writeCSV(archive, header.ExportedAt, "metrics.csv",
+		[]string{"id", "created_at", "hashrate", "accepted_shares", "rejected_shares", "temperature", "power_consumption", "pool_url", "algorithm", "cpu_usage", "memory_usage", "uptime"},
+		func(write func([]string) error) error {
+			return r.db.EachMetric(agent.ID, func(m *database.Metrics) error {
+				return write([]string{
+					strconv.FormatInt(m.ID, 10), m.CreatedAt.Format(time.RFC3339Nano), formatFloat(m.Hashrate),
+					strconv.FormatInt(m.AcceptedShares, 10), strconv.FormatInt(m.RejectedShares, 10), formatFloat(m.Temperature),
+					formatFloat(m.PowerConsumption), m.PoolURL, m.Algorithm, formatFloat(m.CPUUsage), formatFloat(m.MemoryUsage), formatFloat(m.Uptime),
+				})
+			})
+		}); err != nil {
+		return err
+	}
+
+	if err := writeCSV(archive, header.ExportedAt, "commands.csv",
+		[]string{"id", "created_at", "updated_at", "command", "parameters", "status"},
+		func(write func([]string) error) error {
+			return r.db.EachCommand(agent.ID, func(c *database.Command) error {
+				return write([]string{
+					strconv.FormatInt(c.ID, 10), c.CreatedAt.Format(time.RFC3339Nano), c.UpdatedAt.Format(time.RFC3339Nano),
+					c.Command, c.Parameters, c.Status,
+				})
+			})
+		}); err != nil {
+		return err
+	}
+
+	if err := writeCSV(archive, header.ExportedAt, "status_events.csv",
+		[]string{"id", "changed_at", "from_status", "to_status"},
+		func(write func([]string) error) error {
+			for _, e := range header.StatusEvents {
+				if err := write([]string{strconv.FormatInt(e.ID, 10), e.ChangedAt.Format(time.RFC3339Nano), e.FromStatus, e.ToStatus}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	if err := writeCSV(archive, header.ExportedAt, "inventory.csv",
+		[]string{"version", "created_at", "os", "architecture", "kernel", "cpu_model", "cpu_cores", "cpu_threads", "memory_bytes", "cpu_features", "miner_version", "agent_version"},
+		func(write func([]string) error) error {
+			for _, inv := range header.Inventory {
+				if err := write([]string{
+					strconv.Itoa(inv.Version), inv.CreatedAt.Format(time.RFC3339Nano), inv.OS, inv.Architecture, inv.Kernel, inv.CPUModel,
+					strconv.Itoa(inv.CPUCores), strconv.Itoa(inv.CPUThreads), strconv.FormatInt(inv.MemoryBytes, 10),
+					strings.Join(inv.CPUFeatures, " "), inv.MinerVersion, inv.AgentVersion,
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// writeCSV adds a CSV file to an archive, with rows produced by fill
+func writeCSV(archive *zip.Writer, modified time.Time, name string, header []string, fill func(write func([]string) error) error) error {
+	f, err := createArchiveFile(archive, name, modified)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	if err := fill(w.Write); err != nil {
+		return err
+	}
+	w.Flush()
+	return w.Error()
+}
+
+// createArchiveFile adds a compressed file to an archive
+func createArchiveFile(archive *zip.Writer, name string, modified time.Time) (io.Writer, error) {
+	return archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+// ErrEnrollmentRequired is returned when an unknown agent registers without
+// an enrollment token while enrollment is required
+var ErrEnrollmentRequired = errors.New("enrollment token required")
+
+// enrollmentTokenPrefix makes enrollment tokens recognizable in logs and
+// secret scanners
+const enrollmentTokenPrefix = "sre_"
+
+// SetEnrollmentRequired controls whether new agents need an enrollment token
+// to register
+func (r *Registry) SetEnrollmentRequired(required bool) {
+	r.enrollmentRequired.Store(required)
+}
+
+// CreateEnrollmentToken issues a token allowing up to maxUses agents (zero
+// for unlimited) to register in an organization within ttl (zero for no
+// expiry). The token is only returned here; the database keeps its hash.
+func (r *Registry) CreateEnrollmentToken(orgID, description string, maxUses int, ttl time.Duration) (string, *database.EnrollmentToken, error) {
+	if maxUses < 0 {
+		return "", nil, errors.New("max uses must not be negative")
+	}
+	if err := r.checkOrganization(orgID); err != nil {
+		return "", nil, err
+	}
+
+	token, err := generateToken(enrollmentTokenPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var expiresAt *time.Time
+	if ttl > 0 {
+		t := time.Now().Add(ttl)
+		expiresAt = &t
+	}
+
+	record, err := r.db.CreateEnrollmentToken(hashToken(token), orgID, description, maxUses, expiresAt)
+	if err != nil {
+		return "", nil, err
+	}
+	r.logger.Info("Enrollment token created", "id", record.ID, "org_id", orgID, "description", description)
+	return token, record, nil
+}
+
+// EnrollAgent registers an agent on behalf of the agent itself. An agent is
+// identified by its machine ID together with its token: when both match it
+// registers again and keeps its ID and history. A token presented for
+// another machine, or a known machine presenting a token that is not its
+// agent's, is recorded as a conflict for an operator to resolve and
+// rejected with ErrAgentConflict. New agents must present a valid
+// enrollment token when enrollment is required; they join the token's
+// organization, or the default organization without a token. Revoked
+// agents need an enrollment token of their organization to come back with
+// the token they present. It reports whether the agent is new or enrolled
+// again, and so needs new credentials such as a client certificate.
+func (r *Registry) EnrollAgent(enrollmentToken, machineID, token, name, sourceIP string, inventory *database.Inventory) (*database.Agent, bool, error) {
+	tokenHash := hashToken(token)
+	existing, err := r.db.GetAgentByTokenHash(tokenHash, time.Now())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+	if err == nil {
+		if existing.MachineID != machineID {
+			return nil, false, r.recordConflict(&database.AgentConflict{
+				AgentID: existing.ID, OrgID: existing.OrgID, Kind: database.ConflictMachineID,
+				MachineID: machineID, TokenHash: tokenHash, SourceIP: sourceIP,
+			})
+		}
+		agent, err := r.reregisterAgent(existing.ID, inventory)
+		if err != nil {
+			return nil, false, err
+		}
+		r.ObserveAgentAddress(agent, sourceIP)
+		return agent, false, nil
+	}
+
+	existing, err = r.db.GetAgentByMachineID(machineID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+	if err == nil {
+		if existing.DecommissionedAt != nil {
+			return nil, false, ErrAgentDecommissioned
+		}
+		if existing.RevokedAt == nil {
+			return nil, false, r.recordConflict(&database.AgentConflict{
+				AgentID: existing.ID, OrgID: existing.OrgID, Kind: database.ConflictCredentials,
+				MachineID: machineID, TokenHash: tokenHash, SourceIP: sourceIP,
+			})
+		}
+		if err := r.reinstateAgent(existing, enrollmentToken, token); err != nil {
+			return nil, false, err
+		}
+		agent, err := r.reregisterAgent(existing.ID, inventory)
+		return agent, true, err
+	}
+
+	orgID := database.DefaultOrg
+	switch {
+	case enrollmentToken != "":
+		if orgID, err = r.db.ConsumeEnrollmentToken(hashToken(enrollmentToken), time.Now()); err != nil {
+			return nil, false, err
+		}
+	case r.enrollmentRequired.Load():
+		return nil, false, ErrEnrollmentRequired
+	}
+
+	agent, err := r.RegisterAgent(machineID, token, name, orgID, inventory)
+	if errors.Is(err, database.ErrAgentExists) {
+		// Another host registered the same machine at the same time
+		return nil, false, ErrAgentConflict
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	r.ObserveAgentAddress(agent, sourceIP)
+	return agent, true, nil
+}
+
+// generateToken returns a random secret token with the given prefix
+func generateToken(prefix string) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash under which a secret token is stored
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ListAgentCertificates returns the client certificates issued to an agent
+func (r *Registry) ListAgentCertificates(agentID string) ([]*database.AgentCertificate, error) {
+	return r.db.ListAgentCertificates(agentID)
+}
+
+// RevokeAgentCertificates revokes every client certificate of an agent so it
+// can no longer connect to the agent listener
+func (r *Registry) RevokeAgentCertificates(agentID string) (int, error) {
+	n, err := r.db.RevokeAgentCertificates(agentID, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	r.logger.Info("Agent certificates revoked", "agent_id", agentID, "count", n)
+	return n, nil
+}
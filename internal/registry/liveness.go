@@ -0,0 +1,145 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+// Thresholds returns how long an agent may stay silent before it is marked
+// stale and offline. Agents that reported a heartbeat interval derive their
+// thresholds from it; the first matching override wins over both.
+func (r *Registry) Thresholds(agent *database.Agent) (stale, offline time.Duration) {
+	cfg := r.liveness.Load()
+	stale, offline = cfg.StaleAfter, cfg.OfflineAfter
+
+	if agent.HeartbeatInterval > 0 {
+		interval := time.Duration(agent.HeartbeatInterval) * time.Second
+		if cfg.StaleMissedHeartbeats > 0 {
+			stale = interval * time.Duration(cfg.StaleMissedHeartbeats)
+		}
+		if cfg.OfflineMissedHeartbeats > 0 {
+			offline = interval * time.Duration(cfg.OfflineMissedHeartbeats)
+		}
+	}
+
+	for _, override := range cfg.Overrides {
+		if !matchesSelector(agent, override.Labels, override.Groups) {
+			continue
+		}
+		if override.StaleAfter > 0 {
+			stale = override.StaleAfter
+		}
+		if override.OfflineAfter > 0 {
+			offline = override.OfflineAfter
+		}
+		break
+	}
+
+	if offline < stale {
+		offline = stale
+	}
+	return stale, offline
+}
+
+// livenessStatus returns the status an agent should have after being silent
+// for the given duration
+func (r *Registry) livenessStatus(agent *database.Agent, silence time.Duration) string {
+	stale, offline := r.Thresholds(agent)
+	switch {
+	case silence >= offline:
+		return database.StatusOffline
+	case silence >= stale:
+		return database.StatusStale
+	default:
+		return database.StatusActive
+	}
+}
+
+// CheckLiveness moves active agents that stopped sending heartbeats to stale
+// and stale agents to offline
+func (r *Registry) CheckLiveness() {
+	agents, err := r.ListAgents(&database.AgentFilter{
+		Statuses: []string{database.StatusActive, database.StatusStale},
+	})
+	if err != nil {
+		r.logger.Error("Failed to list agents for liveness check", "error", err)
+		return
+	}
+
+	now := time.Now()
+	for _, agent := range agents {
+		status := r.livenessStatus(agent, now.Sub(agent.LastSeen))
+		if status == agent.Status || status == database.StatusActive {
+			continue
+		}
+
+		changed, err := r.db.TransitionAgentStatus(agent.ID, agent.Status, status, now)
+		if err != nil {
+			r.logger.Error("Failed to update agent status", "agent_id", agent.ID, "status", status, "error", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+
+		r.logger.Info("Agent status changed", "agent_id", agent.ID, "from", agent.Status, "to", status, "last_seen", agent.LastSeen)
+		if updated, err := r.db.GetAgent(agent.ID); err == nil {
+			r.agents.Store(agent.ID, updated)
+		}
+	}
+}
+
+// RunLivenessChecks checks agent liveness on every tick of the configured
+// interval until ctx is cancelled
+func (r *Registry) RunLivenessChecks(ctx context.Context) error {
+	interval := r.checkInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.CheckLiveness()
+
+			// Pick up interval changes from configuration reloads
+			if next := r.checkInterval(); next != interval {
+				interval = next
+				ticker.Reset(interval)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (r *Registry) checkInterval() time.Duration {
+	if interval := r.liveness.Load().CheckInterval; interval > 0 {
+		return interval
+	}
+	return 30 * time.Second
+}
+
+// matchesSelector reports whether an agent carries all of the given labels
+// and groups
+func matchesSelector(agent *database.Agent, labels map[string]string, groups []string) bool {
+	for key, value := range labels {
+		if agent.Labels[key] != value {
+			return false
+		}
+	}
+	for _, group := range groups {
+		found := false
+		for _, g := range agent.Groups {
+			if g == group {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+)
+
+// oidcLoginTTL is how long a user has to log in at the OIDC provider
+const oidcLoginTTL = 10 * time.Minute
+
+var (
+	// ErrOIDCNoRole is returned for provider users whose groups map to no
+	// role
+	ErrOIDCNoRole = errors.New("no role is mapped to the user's groups")
+	// ErrOIDCNotProvisioned is returned for provider users without an
+	// account when automatic provisioning is off
+	ErrOIDCNotProvisioned = errors.New("user has no account")
+	// ErrOIDCUsernameTaken is returned when the provider's username
+	// belongs to an account that is not linked to the provider
+	ErrOIDCUsernameTaken = errors.New("username belongs to a local account")
+)
+
+// OIDCSubject identifies a provider's user across issuers
+func OIDCSubject(issuer, subject string) string {
+	return strings.TrimSuffix(issuer, "/") + " " + subject
+}
+
+// SaveOIDCLogin keeps a login in progress until the provider redirects back
+func (r *Registry) SaveOIDCLogin(req *auth.OIDCAuthRequest, redirect string) error {
+	now := time.Now().UTC()
+	return r.db.CreateOIDCLogin(&database.OIDCLogin{
+		State:        req.State,
+		Nonce:        req.Nonce,
+		CodeVerifier: req.CodeVerifier,
+		Redirect:     redirect,
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(oidcLoginTTL),
+	})
+}
+
+// TakeOIDCLogin returns the login with the given state. Each login can be
+// completed once; unknown and expired states return
+// database.ErrOIDCLoginInvalid.
+func (r *Registry) TakeOIDCLogin(state string) (*database.OIDCLogin, error) {
+	return r.db.TakeOIDCLogin(state, time.Now().UTC())
+}
+
+// OIDCProvisioning describes what ProvisionOIDCUser changed
+type OIDCProvisioning struct {
+	Created bool
+	// PreviousRole is set when the user's role changed
+	PreviousRole string
+}
+
+// ProvisionOIDCUser returns the account of a user authenticated by the
+// provider. Its role follows the role mapping on every login; with
+// AutoProvision, users without an account get one.
+func (r *Registry) ProvisionOIDCUser(identity *auth.OIDCIdentity, cfg config.OIDCConfig) (*database.User, OIDCProvisioning, error) {
+	var result OIDCProvisioning
+	role := auth.RoleForGroups(identity.Groups, cfg.RoleMapping, cfg.DefaultRole)
+	subject := OIDCSubject(identity.Issuer, identity.Subject)
+
+	user, err := r.db.GetUserByOIDCSubject(subject)
+	switch {
+	case err == nil:
+		if role == "" {
+			return user, result, ErrOIDCNoRole
+		}
+		if user.Role != role {
+			if err := r.db.UpdateUserRole(user.Username, role); err != nil {
+				return nil, result, err
+			}
+			r.logger.Info("User role changed by OIDC groups", "username", user.Username, "from", user.Role, "to", role)
+			result.PreviousRole, user.Role = user.Role, role
+		}
+		return user, result, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, result, err
+	}
+
+	if role == "" {
+		return nil, result, ErrOIDCNoRole
+	}
+	if !cfg.AutoProvision {
+		return nil, result, ErrOIDCNotProvisioned
+	}
+	if err := r.checkOrganization(cfg.Organization); err != nil {
+		return nil, result, err
+	}
+	user, err = r.db.CreateOIDCUser(identity.Username, role, cfg.Organization, subject)
+	if errors.Is(err, database.ErrUserExists) {
+		return nil, result, ErrOIDCUsernameTaken
+	}
+	if err != nil {
+		return nil, result, err
+	}
+	r.logger.Info("User provisioned from OIDC", "username", user.Username, "role", role, "org_id", user.OrgID, "subject", subject)
+	result.Created = true
+	return user, result, nil
+}
+
+// CreateOIDCUser adds an account in an organization for a user of the
+// provider before their first login, e.g. when automatic provisioning is off
+func (r *Registry) CreateOIDCUser(username, role, orgID, issuer, subject string) (*database.User, error) {
+	if username == "" || subject == "" {
+		return nil, errors.New("username and subject must not be empty")
+	}
+	if err := auth.ValidateRole(role); err != nil {
+		return nil, err
+	}
+	if err := r.checkOrganization(orgID); err != nil {
+		return nil, err
+	}
+	user, err := r.db.CreateOIDCUser(username, role, orgID, OIDCSubject(issuer, subject))
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("OIDC user created", "username", username, "role", role)
+	return user, nil
+}
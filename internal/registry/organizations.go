@@ -0,0 +1,73 @@
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"silentrig/internal/database"
+)
+
+// ErrUnknownOrganization is returned when assigning an account, agent or
+// token to an organization that does not exist
+var ErrUnknownOrganization = errors.New("unknown organization")
+
+// ErrInvalidOrganization is returned for malformed organization IDs
+var ErrInvalidOrganization = errors.New("invalid organization")
+
+// orgIDPattern keeps organization IDs short slugs that are safe in URLs,
+// tokens and log lines
+var orgIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// CreateOrganization adds an organization. The ID is a lowercase slug; the
+// name defaults to the ID.
+func (r *Registry) CreateOrganization(id, name string) (*database.Organization, error) {
+	if !orgIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("%w: ID %q must be lowercase letters, digits and dashes", ErrInvalidOrganization, id)
+	}
+	if name = strings.TrimSpace(name); name == "" {
+		name = id
+	}
+
+	org, err := r.db.CreateOrganization(id, name)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("Organization created", "org_id", id, "name", name)
+	return org, nil
+}
+
+// GetOrganization returns the organization with the given ID
+func (r *Registry) GetOrganization(id string) (*database.Organization, error) {
+	return r.db.GetOrganization(id)
+}
+
+// ListOrganizations returns every organization
+func (r *Registry) ListOrganizations() ([]*database.Organization, error) {
+	return r.db.ListOrganizations()
+}
+
+// DeleteOrganization removes an organization that owns nothing. The
+// default organization cannot be deleted.
+func (r *Registry) DeleteOrganization(id string) error {
+	if id == database.DefaultOrg {
+		return fmt.Errorf("%w: the default organization cannot be deleted", ErrInvalidOrganization)
+	}
+	if err := r.db.DeleteOrganization(id); err != nil {
+		return err
+	}
+	r.logger.Info("Organization deleted", "org_id", id)
+	return nil
+}
+
+// checkOrganization returns ErrUnknownOrganization unless the organization
+// exists
+func (r *Registry) checkOrganization(id string) error {
+	_, err := r.db.GetOrganization(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("%w %q", ErrUnknownOrganization, id)
+	}
+	return err
+}
@@ -1,47 +1,67 @@
 package registry
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"silentrig/internal/config"
 	"silentrig/internal/database"
 	"silentrig/internal/logger"
 )
 
+// ErrInvalidSelector is returned when a label or group selector is malformed
+var ErrInvalidSelector = errors.New("invalid selector")
+
 type Registry struct {
-	db     *database.Database
-	logger logger.Logger
-	agents sync.Map
+	db       *database.Database
+	logger   logger.Logger
+	agents   sync.Map
+	liveness atomic.Pointer[config.LivenessConfig]
+
+	enrollmentRequired atomic.Bool
+	credentialGrace    atomic.Int64
+
+	cloneWindow atomic.Int64
+	addressMu   sync.Mutex
+	addresses   map[string]*agentAddresses
+
+	decommission atomic.Pointer[config.DecommissionConfig]
 }
 
-func New(db *database.Database, logger logger.Logger) *Registry {
-	return &Registry{
+func New(db *database.Database, logger logger.Logger, liveness config.LivenessConfig) *Registry {
+	r := &Registry{
 		db:     db,
 		logger: logger,
 	}
+	r.SetLiveness(liveness)
+	return r
 }
 
-// RegisterAgent registers a new mining agent
-func (r *Registry) RegisterAgent(machineID, token, name string) (*database.Agent, error) {
-	// Check if agent already exists
-	existingAgent, err := r.db.GetAgentByToken(token)
-	if err == nil {
-		// Update existing agent
-		if err := r.db.UpdateAgentStatus(existingAgent.ID, "active"); err != nil {
-			return nil, err
-		}
-		agent, err := r.db.GetAgent(existingAgent.ID)
-		if err != nil {
-			return nil, err
-		}
-		r.agents.Store(agent.ID, agent)
-		return agent, nil
-	}
+// SetLiveness replaces the liveness thresholds, e.g. after a configuration
+// reload. The next liveness check uses the new values.
+func (r *Registry) SetLiveness(liveness config.LivenessConfig) {
+	r.liveness.Store(&liveness)
+}
 
-	// Create new agent
+// RegisterAgent creates a mining agent for a machine in an organization.
+// Machines that already have an agent are never replaced; the database
+// returns ErrAgentExists for them. The inventory, if given, is recorded as
+// the first version.
+func (r *Registry) RegisterAgent(machineID, token, name, orgID string, inventory *database.Inventory) (*database.Agent, error) {
+	if err := r.checkOrganization(orgID); err != nil {
+		return nil, err
+	}
 	agentID := generateAgentID()
-	if err := r.db.CreateAgent(agentID, machineID, token, name); err != nil {
+	if err := r.db.CreateAgent(agentID, machineID, hashToken(token), name, orgID); err != nil {
+		return nil, err
+	}
+	if _, err := r.RecordInventory(agentID, inventory); err != nil {
 		return nil, err
 	}
 
@@ -51,11 +71,63 @@ func (r *Registry) RegisterAgent(machineID, token, name string) (*database.Agent
 	}
 
 	r.agents.Store(agent.ID, agent)
-	r.logger.Info("New agent registered", "agent_id", agent.ID, "machine_id", machineID, "name", name)
+	r.logger.Info("New agent registered", "agent_id", agent.ID, "machine_id", machineID, "name", name, "org_id", orgID)
+
+	return agent, nil
+}
 
+// reregisterAgent refreshes an existing agent that registered again. Its
+// ID, and with it its metrics and command history, stays the same.
+func (r *Registry) reregisterAgent(id string, inventory *database.Inventory) (*database.Agent, error) {
+	if err := r.Heartbeat(id, 0); errors.Is(err, database.ErrAgentRevoked) {
+		return nil, ErrAgentRevoked
+	} else if err != nil {
+		return nil, err
+	}
+	if _, err := r.RecordInventory(id, inventory); err != nil {
+		return nil, err
+	}
+	agent, err := r.db.GetAgent(id)
+	if err != nil {
+		return nil, err
+	}
+	r.agents.Store(agent.ID, agent)
 	return agent, nil
 }
 
+// RecordInventory stores the reported inventory of an agent as a new version
+// if any fact changed since the previous report. It returns the current
+// inventory, which is nil when the agent never reported one.
+func (r *Registry) RecordInventory(agentID string, inventory *database.Inventory) (*database.Inventory, error) {
+	latest, err := r.db.GetLatestInventory(agentID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if inventory == nil || inventory.SameFacts(latest) {
+		return latest, nil
+	}
+
+	current, err := r.db.StoreInventory(agentID, inventory)
+	if err != nil {
+		return nil, err
+	}
+
+	if latest != nil {
+		r.logger.Info("Agent inventory changed", "agent_id", agentID, "version", current.Version)
+	}
+	return current, nil
+}
+
+// GetInventory returns the current inventory of an agent
+func (r *Registry) GetInventory(agentID string) (*database.Inventory, error) {
+	return r.db.GetLatestInventory(agentID)
+}
+
+// GetInventoryHistory returns every inventory version of an agent, newest first
+func (r *Registry) GetInventoryHistory(agentID string) ([]*database.Inventory, error) {
+	return r.db.GetInventoryHistory(agentID)
+}
+
 // GetAgent retrieves an agent by ID
 func (r *Registry) GetAgent(id string) (*database.Agent, error) {
 	// Check cache first
@@ -73,9 +145,24 @@ func (r *Registry) GetAgent(id string) (*database.Agent, error) {
 	return agent, nil
 }
 
-// ListAgents returns all registered agents
-func (r *Registry) ListAgents() ([]*database.Agent, error) {
-	agents, err := r.db.ListAgents()
+// GetAgentInOrg retrieves an agent of an organization, or of any
+// organization when orgID is empty. Agents of other organizations are
+// reported as sql.ErrNoRows so their existence is not revealed.
+func (r *Registry) GetAgentInOrg(orgID, id string) (*database.Agent, error) {
+	agent, err := r.GetAgent(id)
+	if err != nil {
+		return nil, err
+	}
+	if orgID != "" && agent.OrgID != orgID {
+		return nil, sql.ErrNoRows
+	}
+	return agent, nil
+}
+
+// ListAgents returns the registered agents matching the filter. A nil filter
+// returns every agent.
+func (r *Registry) ListAgents(filter *database.AgentFilter) ([]*database.Agent, error) {
+	agents, err := r.db.ListAgents(filter)
 	if err != nil {
 		return nil, err
 	}
@@ -88,12 +175,20 @@ func (r *Registry) ListAgents() ([]*database.Agent, error) {
 	return agents, nil
 }
 
-// UpdateAgentStatus updates the status of an agent
-func (r *Registry) UpdateAgentStatus(id, status string) error {
-	if err := r.db.UpdateAgentStatus(id, status); err != nil {
+// Heartbeat records that an agent is alive. A positive interval (in
+// seconds) updates the heartbeat interval the agent reported. It returns
+// database.ErrAgentRevoked for revoked and decommissioned agents.
+func (r *Registry) Heartbeat(id string, interval int) error {
+	now := time.Now()
+	previous, err := r.db.RecordHeartbeat(id, now, interval)
+	if err != nil {
 		return err
 	}
 
+	if previous != database.StatusActive {
+		r.logger.Info("Agent became active", "agent_id", id, "previous_status", previous)
+	}
+
 	// Update cache
 	if agent, err := r.db.GetAgent(id); err == nil {
 		r.agents.Store(id, agent)
@@ -102,6 +197,59 @@ func (r *Registry) UpdateAgentStatus(id, status string) error {
 	return nil
 }
 
+// ListAgentsPage returns one sorted page of agents matching the filter along
+// with the total number of matches
+func (r *Registry) ListAgentsPage(filter *database.AgentFilter, opts database.ListOptions) (*database.AgentPage, error) {
+	page, err := r.db.ListAgentsPage(filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, agent := range page.Agents {
+		r.agents.Store(agent.ID, agent)
+	}
+
+	return page, nil
+}
+
+// CountAgentsByStatus returns the number of agents of an organization, or
+// of all when orgID is empty, in each status
+func (r *Registry) CountAgentsByStatus(orgID string) (map[string]int, error) {
+	return r.db.CountAgentsByStatus(orgID)
+}
+
+// AgentBreakdowns counts the agents of an organization, or of all when
+// orgID is empty, per label value and per group
+func (r *Registry) AgentBreakdowns(orgID string) (map[string]map[string]*database.Breakdown, map[string]*database.Breakdown, error) {
+	return r.db.AgentBreakdowns(orgID)
+}
+
+// UpdateAgent changes the name, labels and groups of an agent. Nil arguments
+// leave the corresponding attribute untouched; labels and groups replace the
+// existing set when given.
+func (r *Registry) UpdateAgent(id string, name *string, labels map[string]string, groups []string) (*database.Agent, error) {
+	if err := validateLabels(labels); err != nil {
+		return nil, err
+	}
+	if err := validateGroups(groups); err != nil {
+		return nil, err
+	}
+
+	if err := r.db.UpdateAgentTags(id, name, labels, groups); err != nil {
+		return nil, err
+	}
+
+	agent, err := r.db.GetAgent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	r.agents.Store(id, agent)
+	r.logger.Info("Agent updated", "agent_id", id, "labels", agent.Labels, "groups", agent.Groups)
+
+	return agent, nil
+}
+
 // StoreMetrics stores metrics for an agent
 func (r *Registry) StoreMetrics(agentID string, metrics *database.Metrics) error {
 	return r.db.StoreMetrics(agentID, metrics)
@@ -112,7 +260,8 @@ func (r *Registry) GetMetrics(agentID string, limit int) ([]*database.Metrics, e
 	return r.db.GetMetrics(agentID, limit)
 }
 
-// CreateCommand creates a new command for an agent
+// CreateCommand creates a new command for an agent. It returns
+// sql.ErrNoRows if the agent does not exist.
 func (r *Registry) CreateCommand(agentID, command string, parameters interface{}) (int64, error) {
 	paramsJSON, err := json.Marshal(parameters)
 	if err != nil {
@@ -122,59 +271,87 @@ func (r *Registry) CreateCommand(agentID, command string, parameters interface{}
 	return r.db.CreateCommand(agentID, command, string(paramsJSON))
 }
 
+// CreateCommandForSelector queues a command for every agent matching the
+// selector, within the selector's organization if set, and returns the
+// created command IDs keyed by agent ID. Revoked and decommissioned agents
+// are skipped. Either every command is queued or none is.
+func (r *Registry) CreateCommandForSelector(selector *database.AgentFilter, command string, parameters interface{}) (map[string]int64, error) {
+	if selector.IsEmpty() {
+		return nil, fmt.Errorf("%w: at least one label or group is required", ErrInvalidSelector)
+	}
+
+	paramsJSON, err := json.Marshal(parameters)
+	if err != nil {
+		return nil, err
+	}
+	return r.db.CreateCommandForAgents(selector, command, string(paramsJSON))
+}
+
 // GetPendingCommands retrieves pending commands for an agent
 func (r *Registry) GetPendingCommands(agentID string) ([]*database.Command, error) {
 	return r.db.GetPendingCommands(agentID)
 }
 
-// UpdateCommandStatus updates the status of a command
-func (r *Registry) UpdateCommandStatus(id int64, status string) error {
-	return r.db.UpdateCommandStatus(id, status)
+// UpdateCommandStatus updates the status of a command of an agent
+func (r *Registry) UpdateCommandStatus(agentID string, id int64, status string) error {
+	return r.db.UpdateCommandStatus(agentID, id, status)
 }
 
-// DeleteAgent removes an agent from the registry
-func (r *Registry) DeleteAgent(id string) error {
-	if err := r.db.DeleteAgent(id); err != nil {
-		return err
-	}
-
-	r.agents.Delete(id)
-	r.logger.Info("Agent deleted", "agent_id", id)
+// GetCommand returns a command by ID
+func (r *Registry) GetCommand(id int64) (*database.Command, error) {
+	return r.db.GetCommand(id)
+}
 
-	return nil
+// CancelCommand cancels a command of an organization, or of any when orgID
+// is empty, that was not delivered yet
+func (r *Registry) CancelCommand(id int64, orgID string) (*database.Command, error) {
+	return r.db.CancelCommand(id, orgID)
 }
 
-// CleanupInactiveAgents marks agents as inactive if they haven't been seen recently
-func (r *Registry) CleanupInactiveAgents() {
-	agents, err := r.ListAgents()
-	if err != nil {
-		r.logger.Error("Failed to list agents for cleanup", err)
-		return
-	}
+// ParseSelector builds an agent filter from "key=value" label expressions and
+// group names as they appear in query strings
+func ParseSelector(labels, groups []string) (*database.AgentFilter, error) {
+	filter := &database.AgentFilter{}
 
-	threshold := time.Now().Add(-5 * time.Minute) // 5 minutes threshold
+	for _, expr := range labels {
+		key, value, ok := strings.Cut(expr, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: label %q must be key=value", ErrInvalidSelector, expr)
+		}
+		if filter.Labels == nil {
+			filter.Labels = make(map[string]string)
+		}
+		filter.Labels[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	if err := validateLabels(filter.Labels); err != nil {
+		return nil, err
+	}
 
-	for _, agent := range agents {
-		if agent.LastSeen.Before(threshold) && agent.Status == "active" {
-			if err := r.UpdateAgentStatus(agent.ID, "inactive"); err != nil {
-				r.logger.Error("Failed to mark agent as inactive", "agent_id", agent.ID, "error", err)
-			} else {
-				r.logger.Info("Marked agent as inactive", "agent_id", agent.ID, "last_seen", agent.LastSeen)
-			}
+	for _, group := range groups {
+		if group = strings.TrimSpace(group); group != "" {
+			filter.Groups = append(filter.Groups, group)
 		}
 	}
+
+	return filter, nil
 }
 
-// StartCleanupRoutine starts a background routine to clean up inactive agents
-func (r *Registry) StartCleanupRoutine() {
-	go func() {
-		ticker := time.NewTicker(2 * time.Minute) // Run every 2 minutes
-		defer ticker.Stop()
+func validateLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" || strings.ContainsAny(key, "=,") {
+			return fmt.Errorf("%w: invalid label key %q", ErrInvalidSelector, key)
+		}
+	}
+	return nil
+}
 
-		for range ticker.C {
-			r.CleanupInactiveAgents()
+func validateGroups(groups []string) error {
+	for _, group := range groups {
+		if strings.TrimSpace(group) == "" {
+			return fmt.Errorf("%w: group names must not be empty", ErrInvalidSelector)
 		}
-	}()
+	}
+	return nil
 }
 
 func generateAgentID() string {
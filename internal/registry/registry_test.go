@@ -0,0 +1,26 @@
+package registry
+
+import (
+	"path/filepath"
+	"testing"
+
+	"silentrig/internal/config"
+	"silentrig/internal/database"
+	"silentrig/internal/logger"
+)
+
+// newTestRegistry returns a registry on a new database in a temp directory
+func newTestRegistry(t *testing.T) *Registry {
+	t.Helper()
+	log, outputs, err := logger.Open(config.LoggingConfig{Level: "error", Format: "json"})
+	if err != nil {
+		t.Fatalf("open logger: %v", err)
+	}
+	t.Cleanup(func() { outputs.Close() })
+	db, err := database.New(filepath.Join(t.TempDir(), "silentrig.db"), log)
+	if err != nil {
+		t.Fatalf("open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return New(db, log, config.LivenessConfig{})
+}
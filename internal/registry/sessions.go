@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"silentrig/internal/database"
+)
+
+// refreshTokenPrefix makes refresh tokens recognizable in logs and secret
+// scanners
+const refreshTokenPrefix = "srr_"
+
+// sessionCleanupInterval is how often expired sessions are deleted
+const sessionCleanupInterval = time.Hour
+
+// CreateSession starts a session for a user who just logged in. It returns
+// the session's first refresh token, which is only stored as a hash, and
+// the session lasts ttl unless it is refreshed, and at most maxAge if
+// positive.
+func (r *Registry) CreateSession(username, sourceIP, userAgent string, ttl, maxAge time.Duration) (string, *database.Session, error) {
+	token, err := generateToken(refreshTokenPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	if maxAge > 0 && ttl > maxAge {
+		ttl = maxAge
+	}
+	now := time.Now().UTC()
+	session := &database.Session{
+		ID:         uuid.NewString(),
+		Username:   username,
+		SourceIP:   sourceIP,
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+	if err := r.db.CreateSession(session, hashToken(token)); err != nil {
+		return "", nil, err
+	}
+	r.logger.Debug("Session created", "username", username, "session_id", session.ID)
+	return token, session, nil
+}
+
+// RefreshSession exchanges a refresh token for a new one and extends the
+// session by ttl, up to maxAge after login if positive. A token that was
+// already exchanged revokes the session and returns
+// database.ErrRefreshTokenReused together with it.
+func (r *Registry) RefreshSession(refreshToken string, ttl, maxAge time.Duration) (string, *database.Session, error) {
+	next, err := generateToken(refreshTokenPrefix)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	session, err := r.db.RotateRefreshToken(hashToken(refreshToken), hashToken(next), now, now.Add(ttl), maxAge)
+	if errors.Is(err, database.ErrRefreshTokenReused) {
+		r.logger.Warn("Refresh token reused, session revoked", "username", session.Username, "session_id", session.ID)
+		return "", session, err
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return next, session, nil
+}
+
+// EndSession logs out: the access token with the given ID is revoked until
+// it expires, and its session can no longer be refreshed
+func (r *Registry) EndSession(sessionID, tokenID string, tokenExpiresAt time.Time) error {
+	now := time.Now().UTC()
+	if err := r.db.RevokeToken(tokenID, tokenExpiresAt.UTC(), now); err != nil {
+		return err
+	}
+	_, err := r.db.RevokeSession(sessionID, database.RevokedLogout, now)
+	return err
+}
+
+// ListSessions returns the active sessions of a user
+func (r *Registry) ListSessions(username string) ([]*database.Session, error) {
+	return r.db.ListSessions(username, time.Now().UTC())
+}
+
+// RevokeUserSessions ends every session of a user. Their access tokens are
+// rejected from then on.
+func (r *Registry) RevokeUserSessions(username string) (int, error) {
+	n, err := r.db.RevokeUserSessions(username, database.RevokedByAdmin, time.Now().UTC())
+	if err != nil {
+		return 0, err
+	}
+	r.logger.Info("User sessions revoked", "username", username, "count", n)
+	return n, nil
+}
+
+// TokenRevoked reports whether an access token has been revoked or belongs
+// to a session that has ended
+func (r *Registry) TokenRevoked(tokenID, sessionID string) (bool, error) {
+	return r.db.TokenRevoked(tokenID, sessionID, time.Now().UTC())
+}
+
+// RunSessionCleanup deletes expired sessions and revoked tokens every hour
+// until ctx is cancelled
+func (r *Registry) RunSessionCleanup(ctx context.Context) error {
+	ticker := time.NewTicker(sessionCleanupInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := r.db.PruneSessions(time.Now().UTC())
+			if err != nil {
+				r.logger.Error("Failed to delete expired sessions", "error", err)
+				continue
+			}
+			if n > 0 {
+				r.logger.Debug("Expired sessions deleted", "count", n)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
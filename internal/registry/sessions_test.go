@@ -0,0 +1,75 @@
+package registry
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"silentrig/internal/database"
+)
+
+func TestRefreshSession(t *testing.T) {
+	r := newTestRegistry(t)
+	first, session, err := r.CreateSession("admin", "192.0.2.1", "test", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if !strings.HasPrefix(first, refreshTokenPrefix) {
+		t.Errorf("refresh token %q lacks the %s prefix", first, refreshTokenPrefix)
+	}
+
+	second, refreshed, err := r.RefreshSession(first, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if second == first || refreshed.ID != session.ID {
+		t.Errorf("refresh returned token %q of session %s, want a new token of %s", second, refreshed.ID, session.ID)
+	}
+	if _, _, err := r.RefreshSession(second, time.Hour, 0); err != nil {
+		t.Errorf("refresh with the new token: %v", err)
+	}
+}
+
+func TestRefreshTokenReuseEndsSession(t *testing.T) {
+	r := newTestRegistry(t)
+	first, session, err := r.CreateSession("admin", "192.0.2.1", "test", time.Hour, 0)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	second, _, err := r.RefreshSession(first, time.Hour, 0)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+
+	// The first token was copied before the owner used it
+	_, revoked, err := r.RefreshSession(first, time.Hour, 0)
+	if !errors.Is(err, database.ErrRefreshTokenReused) {
+		t.Fatalf("reuse: got %v, want ErrRefreshTokenReused", err)
+	}
+	if revoked == nil || revoked.ID != session.ID {
+		t.Errorf("reuse returned session %+v, want %s", revoked, session.ID)
+	}
+
+	// Neither the owner's token nor the session's access tokens work
+	if _, _, err := r.RefreshSession(second, time.Hour, 0); !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Errorf("owner's token after reuse: got %v, want ErrRefreshTokenInvalid", err)
+	}
+	if ok, err := r.TokenRevoked("jti", session.ID); err != nil || !ok {
+		t.Errorf("access token revoked = %v, %v; want true", ok, err)
+	}
+	if sessions, err := r.ListSessions("admin"); err != nil || len(sessions) != 0 {
+		t.Errorf("active sessions after reuse: %v, %v", sessions, err)
+	}
+}
+
+func TestSessionMaxAge(t *testing.T) {
+	r := newTestRegistry(t)
+	_, session, err := r.CreateSession("admin", "192.0.2.1", "test", time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if got := session.ExpiresAt.Sub(session.CreatedAt); got != time.Minute {
+		t.Errorf("session lasts %s, want the maximum age of 1m", got)
+	}
+}
@@ -0,0 +1,27 @@
+package registry
+
+import (
+	"time"
+
+	"silentrig/internal/database"
+)
+
+// ListSigningKeys returns every token signing key, newest first
+func (r *Registry) ListSigningKeys() ([]*database.SigningKey, error) {
+	return r.db.ListSigningKeys()
+}
+
+// CreateSigningKey stores a new token signing key
+func (r *Registry) CreateSigningKey(key *database.SigningKey) error {
+	return r.db.CreateSigningKey(key)
+}
+
+// RetireSigningKeys retires every active signing key except one
+func (r *Registry) RetireSigningKeys(exceptID string, at time.Time) error {
+	return r.db.RetireSigningKeys(exceptID, at)
+}
+
+// DeleteSigningKeys deletes signing keys retired before the given time
+func (r *Registry) DeleteSigningKeys(retiredBefore time.Time) (int, error) {
+	return r.db.DeleteSigningKeys(retiredBefore)
+}
@@ -0,0 +1,238 @@
+package registry
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+const (
+	// mfaTokenPrefix makes two-factor login tokens recognizable in logs
+	// and secret scanners
+	mfaTokenPrefix = "srm_"
+	// mfaChallengeTTL is how long a user has to enter the second factor
+	// after the password
+	mfaChallengeTTL = 5 * time.Minute
+	// mfaMaxAttempts limits the codes tried per password login
+	mfaMaxAttempts = 5
+	// recoveryCodeCount is the number of recovery codes issued at once
+	recoveryCodeCount = 10
+)
+
+var (
+	// ErrMFACodeInvalid is returned for wrong, reused or expired codes
+	ErrMFACodeInvalid = errors.New("invalid two-factor code")
+	// ErrMFAEnabled is returned when setting up two-factor authentication
+	// again without disabling it first
+	ErrMFAEnabled = errors.New("two-factor authentication is already enabled")
+	// ErrMFANotEnabled is returned when two-factor authentication has not
+	// been set up
+	ErrMFANotEnabled = errors.New("two-factor authentication is not set up")
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorStatus describes the second factor of a user
+type TwoFactorStatus struct {
+	Enabled bool `json:"enabled"`
+	// Pending is set while an enrollment waits for its first code
+	Pending                bool       `json:"pending"`
+	EnabledAt              *time.Time `json:"enabled_at,omitempty"`
+	RecoveryCodesRemaining int        `json:"recovery_codes_remaining"`
+}
+
+// TwoFactorStatus returns whether a user has set up a second factor
+func (r *Registry) TwoFactorStatus(username string) (*TwoFactorStatus, error) {
+	status := &TwoFactorStatus{}
+	cred, err := r.db.GetTOTP(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	status.Enabled, status.Pending, status.EnabledAt = cred.Enabled(), !cred.Enabled(), cred.EnabledAt
+	if status.Enabled {
+		if status.RecoveryCodesRemaining, err = r.db.CountRecoveryCodes(username); err != nil {
+			return nil, err
+		}
+	}
+	return status, nil
+}
+
+// BeginTOTPEnrollment generates a TOTP secret for a user. It takes effect
+// once ConfirmTOTP receives a code generated from it.
+func (r *Registry) BeginTOTPEnrollment(username, issuer string) (secret, uri string, err error) {
+	secret, err = auth.GenerateTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	stored, err := r.db.SetPendingTOTP(username, secret, time.Now().UTC())
+	if err != nil {
+		return "", "", err
+	}
+	if !stored {
+		return "", "", ErrMFAEnabled
+	}
+	return secret, auth.TOTPProvisioningURI(issuer, username, secret), nil
+}
+
+// ConfirmTOTP enables a pending TOTP secret with a code generated from it
+// and returns the user's recovery codes
+func (r *Registry) ConfirmTOTP(username, code string) ([]string, error) {
+	cred, err := r.db.GetTOTP(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrMFANotEnabled
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cred.Enabled() {
+		return nil, ErrMFAEnabled
+	}
+	if err := r.useTOTPCode(cred, code); err != nil {
+		return nil, err
+	}
+	codes, err := r.RegenerateRecoveryCodes(username)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("Two-factor authentication enabled", "username", username)
+	return codes, nil
+}
+
+// VerifySecondFactor checks a TOTP code or, failing that, a recovery code
+// of a user with two-factor authentication enabled. Each code works once.
+// It returns "totp" or "recovery_code" for the kind of code used.
+func (r *Registry) VerifySecondFactor(username, code string) (string, error) {
+	cred, err := r.db.GetTOTP(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrMFANotEnabled
+	}
+	if err != nil {
+		return "", err
+	}
+	if !cred.Enabled() {
+		return "", ErrMFANotEnabled
+	}
+	err = r.useTOTPCode(cred, code)
+	if !errors.Is(err, ErrMFACodeInvalid) {
+		return "totp", err
+	}
+
+	used, err := r.db.UseRecoveryCode(username, hashToken(normalizeRecoveryCode(code)), time.Now().UTC())
+	if err != nil {
+		return "", err
+	}
+	if !used {
+		return "", ErrMFACodeInvalid
+	}
+	r.logger.Info("Recovery code used", "username", username)
+	return "recovery_code", nil
+}
+
+// useTOTPCode accepts a code of the credential once
+func (r *Registry) useTOTPCode(cred *database.TOTPCredential, code string) error {
+	now := time.Now().UTC()
+	step, ok := auth.ValidateTOTP(cred.Secret, code, now, cred.LastStep)
+	if !ok {
+		return ErrMFACodeInvalid
+	}
+	accepted, err := r.db.UseTOTPStep(cred.Username, step, now)
+	if err != nil {
+		return err
+	}
+	if !accepted {
+		return ErrMFACodeInvalid
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of a user. The codes
+// are only returned here; the database keeps their hashes.
+func (r *Registry) RegenerateRecoveryCodes(username string) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(recoveryCodeEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashToken(code)
+	}
+	if err := r.db.ReplaceRecoveryCodes(username, hashes, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips the separator and case a user may type
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// DisableTwoFactor removes the second factor of a user and reports whether
+// there was one
+func (r *Registry) DisableTwoFactor(username string) (bool, error) {
+	removed, err := r.db.DeleteTOTP(username)
+	if err != nil {
+		return false, err
+	}
+	if removed {
+		r.logger.Info("Two-factor authentication disabled", "username", username)
+	}
+	return removed, nil
+}
+
+// ResetTwoFactor removes the second factor of a user who lost it and ends
+// their sessions. Users whose role requires a second factor set up a new
+// one at their next login.
+func (r *Registry) ResetTwoFactor(username string) error {
+	if _, err := r.db.GetUserByUsername(username); err != nil {
+		return err
+	}
+	if _, err := r.db.DeleteTOTP(username); err != nil {
+		return err
+	}
+	n, err := r.db.RevokeUserSessions(username, database.RevokedTwoFactorReset, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	r.logger.Info("Two-factor authentication reset", "username", username, "sessions_revoked", n)
+	return nil
+}
+
+// CreateMFAChallenge is called after a user passed the password check. The
+// returned token lets them complete the login with a second factor.
+func (r *Registry) CreateMFAChallenge(username string) (string, time.Time, error) {
+	token, err := generateToken(mfaTokenPrefix)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(mfaChallengeTTL)
+	if err := r.db.CreateMFAChallenge(hashToken(token), username, now, expiresAt); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// AttemptMFAChallenge counts an attempt to complete a login and returns the
+// user. Unknown, expired and exhausted challenges return
+// database.ErrMFAChallengeInvalid.
+func (r *Registry) AttemptMFAChallenge(token string) (string, error) {
+	return r.db.AttemptMFAChallenge(hashToken(token), time.Now().UTC(), mfaMaxAttempts)
+}
+
+// CompleteMFAChallenge removes a challenge once its login succeeded
+func (r *Registry) CompleteMFAChallenge(token string) error {
+	return r.db.DeleteMFAChallenge(hashToken(token))
+}
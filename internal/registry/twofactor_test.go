@@ -0,0 +1,113 @@
+package registry
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+// currentTOTP computes the code an authenticator app shows for the secret
+func currentTOTP(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatalf("decode secret: %v", err)
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(time.Now().Unix()/30))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	return fmt.Sprintf("%06d", (binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff)%1000000)
+}
+
+// enrollTOTP sets up TOTP for a new user and returns its secret, the code
+// used to confirm it and the recovery codes
+func enrollTOTP(t *testing.T, r *Registry, username string) (string, string, []string) {
+	t.Helper()
+	if _, err := r.CreateUser(username, "password123", auth.RoleAdmin, database.DefaultOrg); err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	secret, _, err := r.BeginTOTPEnrollment(username, "SilentRig")
+	if err != nil {
+		t.Fatalf("begin enrollment: %v", err)
+	}
+	code := currentTOTP(t, secret)
+	recovery, err := r.ConfirmTOTP(username, code)
+	if err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	return secret, code, recovery
+}
+
+func TestTOTPCodeCannotBeReplayed(t *testing.T) {
+	r := newTestRegistry(t)
+	_, code, _ := enrollTOTP(t, r, "admin")
+
+	// The code confirming the enrollment is used up
+	if _, err := r.VerifySecondFactor("admin", code); !errors.Is(err, ErrMFACodeInvalid) {
+		t.Errorf("replayed code: got %v, want ErrMFACodeInvalid", err)
+	}
+	wrong := code[:5] + string('0'+(code[5]-'0'+1)%10)
+	if _, err := r.VerifySecondFactor("admin", wrong); !errors.Is(err, ErrMFACodeInvalid) {
+		t.Errorf("wrong code: got %v, want ErrMFACodeInvalid", err)
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	r := newTestRegistry(t)
+	_, _, recovery := enrollTOTP(t, r, "admin")
+	if len(recovery) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(recovery), recoveryCodeCount)
+	}
+
+	// Typed in upper case without the separator
+	typed := strings.ToUpper(strings.ReplaceAll(recovery[0], "-", ""))
+	if kind, err := r.VerifySecondFactor("admin", typed); err != nil || kind != "recovery_code" {
+		t.Fatalf("first use of a recovery code: got %q, %v", kind, err)
+	}
+	if _, err := r.VerifySecondFactor("admin", recovery[0]); !errors.Is(err, ErrMFACodeInvalid) {
+		t.Errorf("second use of a recovery code: got %v, want ErrMFACodeInvalid", err)
+	}
+
+	status, err := r.TwoFactorStatus("admin")
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if status.RecoveryCodesRemaining != recoveryCodeCount-1 {
+		t.Errorf("%d recovery codes remaining, want %d", status.RecoveryCodesRemaining, recoveryCodeCount-1)
+	}
+
+	// Regenerating invalidates the old codes
+	if _, err := r.RegenerateRecoveryCodes("admin"); err != nil {
+		t.Fatalf("regenerate: %v", err)
+	}
+	if _, err := r.VerifySecondFactor("admin", recovery[1]); !errors.Is(err, ErrMFACodeInvalid) {
+		t.Errorf("old recovery code after regenerating: got %v, want ErrMFACodeInvalid", err)
+	}
+}
+
+func TestConfirmTOTPRequiresPendingSecret(t *testing.T) {
+	r := newTestRegistry(t)
+	secret, _, _ := enrollTOTP(t, r, "admin")
+
+	if _, _, err := r.BeginTOTPEnrollment("admin", "SilentRig"); !errors.Is(err, ErrMFAEnabled) {
+		t.Errorf("enrolling again: got %v, want ErrMFAEnabled", err)
+	}
+	if _, err := r.ConfirmTOTP("admin", currentTOTP(t, secret)); !errors.Is(err, ErrMFAEnabled) {
+		t.Errorf("confirming again: got %v, want ErrMFAEnabled", err)
+	}
+	if _, err := r.VerifySecondFactor("nobody", "123456"); !errors.Is(err, ErrMFANotEnabled) {
+		t.Errorf("user without a second factor: got %v, want ErrMFANotEnabled", err)
+	}
+}
@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"silentrig/internal/auth"
+	"silentrig/internal/database"
+)
+
+// ErrInvalidCredentials is returned when a username or password is wrong
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// ErrServiceAccount is returned when setting the password of a service
+// account
+var ErrServiceAccount = errors.New("service accounts have no password")
+
+// ErrOIDCAccount is returned when setting the password of an account that
+// logs in through the OIDC provider
+var ErrOIDCAccount = errors.New("accounts of the OIDC provider have no password")
+
+// dummyHash is compared against when a user does not exist so failed logins
+// take the same time either way
+var dummyHash, _ = auth.HashPassword("silentrig-dummy-password")
+
+// CreateUser adds an operator account with the given role to an
+// organization
+func (r *Registry) CreateUser(username, password, role, orgID string) (*database.User, error) {
+	if username == "" {
+		return nil, errors.New("username must not be empty")
+	}
+	if err := auth.ValidateRole(role); err != nil {
+		return nil, err
+	}
+	if err := r.checkOrganization(orgID); err != nil {
+		return nil, err
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := r.db.CreateUser(username, hash, role, orgID, false)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("User created", "username", username, "role", role, "org_id", orgID)
+	return user, nil
+}
+
+// CreateServiceAccount adds an account for automation to an organization.
+// It has no password and authenticates with API keys only.
+func (r *Registry) CreateServiceAccount(username, role, orgID string) (*database.User, error) {
+	if username == "" {
+		return nil, errors.New("username must not be empty")
+	}
+	if err := auth.ValidateRole(role); err != nil {
+		return nil, err
+	}
+	if err := r.checkOrganization(orgID); err != nil {
+		return nil, err
+	}
+
+	user, err := r.db.CreateUser(username, "", role, orgID, true)
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Info("Service account created", "username", username, "role", role, "org_id", orgID)
+	return user, nil
+}
+
+// SetPassword replaces the password of an account and ends its sessions
+func (r *Registry) SetPassword(username, password string) error {
+	user, err := r.db.GetUserByUsername(username)
+	if err != nil {
+		return err
+	}
+	if user.Service {
+		return ErrServiceAccount
+	}
+	if user.OIDCSubject != "" {
+		return ErrOIDCAccount
+	}
+	hash, err := auth.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	if err := r.db.UpdateUserPassword(username, hash); err != nil {
+		return err
+	}
+	n, err := r.db.RevokeUserSessions(username, database.RevokedPasswordChanged, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	r.logger.Info("User password changed", "username", username, "sessions_revoked", n)
+	return nil
+}
+
+// GetUser returns the account with the given username
+func (r *Registry) GetUser(username string) (*database.User, error) {
+	return r.db.GetUserByUsername(username)
+}
+
+// GetUserInOrg returns an account of an organization, or of any
+// organization when orgID is empty. Accounts of other organizations are
+// reported as sql.ErrNoRows.
+func (r *Registry) GetUserInOrg(orgID, username string) (*database.User, error) {
+	user, err := r.db.GetUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if orgID != "" && user.OrgID != orgID {
+		return nil, sql.ErrNoRows
+	}
+	return user, nil
+}
+
+// ListUsers returns the operator accounts of an organization, or every
+// account when orgID is empty
+func (r *Registry) ListUsers(orgID string) ([]*database.User, error) {
+	return r.db.ListUsers(orgID)
+}
+
+// CountUsers returns the number of operator accounts
+func (r *Registry) CountUsers() (int, error) {
+	return r.db.CountUsers()
+}
+
+// Authenticate checks a username and password and returns the account
+func (r *Registry) Authenticate(username, password string) (*database.User, error) {
+	user, err := r.db.GetUserByUsername(username)
+	if errors.Is(err, sql.ErrNoRows) {
+		auth.CheckPassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, err
+	}
+	if user.Service || user.OIDCSubject != "" {
+		auth.CheckPassword(dummyHash, password)
+		return nil, ErrInvalidCredentials
+	}
+	if !auth.CheckPassword(user.PasswordHash, password) {
+		return nil, ErrInvalidCredentials
+	}
+	return user, nil
+}
@@ -0,0 +1,130 @@
+// Package tlsutil builds server TLS configurations from the settings and
+// keeps certificates current when their files change.
+package tlsutil
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"silentrig/internal/config"
+	"silentrig/internal/logger"
+)
+
+// intermediateCiphers are the TLS 1.2 suites allowed by the "intermediate"
+// policy: forward secret and authenticated encryption only. TLS 1.3 suites
+// are not configurable and always secure.
+var intermediateCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// Reloader serves a certificate loaded from files and reloads it when they
+// change, so renewed certificates are used without a restart
+type Reloader struct {
+	certFile string
+	keyFile  string
+	logger   logger.Logger
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// NewReloader loads the certificate and key
+func NewReloader(certFile, keyFile string, log logger.Logger) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, logger: log}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate %s: %w", r.certFile, err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Watch reloads the certificate when the certificate or key file changes
+// until ctx is cancelled. A pair that fails to load, e.g. because only one
+// of the files was replaced so far, keeps the previous certificate.
+func (r *Reloader) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	files := make(map[string]bool)
+	for _, file := range []string{r.certFile, r.keyFile} {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		files[abs] = true
+		if err := watcher.Add(filepath.Dir(abs)); err != nil {
+			return err
+		}
+	}
+
+	const debounce = 500 * time.Millisecond
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return fmt.Errorf("certificate watcher closed")
+			}
+			if files[filepath.Clean(event.Name)] || filepath.Base(event.Name) == "..data" {
+				timer.Reset(debounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return fmt.Errorf("certificate watcher closed")
+			}
+			return err
+		case <-timer.C:
+			if err := r.load(); err != nil {
+				r.logger.Error("Certificate reload failed, keeping the previous certificate", "error", err)
+				continue
+			}
+			r.logger.Info("Certificate reloaded", "cert_file", r.certFile)
+		}
+	}
+}
+
+// ServerConfig returns a TLS configuration serving the reloader's
+// certificate with the configured protocol version and cipher policy
+func ServerConfig(cfg config.TLSConfig, reloader *Reloader) *tls.Config {
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if cfg.MinVersion == "1.3" {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
+	if cfg.CipherPolicy == "intermediate" {
+		tlsConfig.CipherSuites = intermediateCiphers
+	}
+	return tlsConfig
+}